@@ -0,0 +1,21 @@
+#!/bin/bash
+#
+# Builds a Complement image for Palpo from a Palpo checkout.
+#
+# Usage: build-palpo-image.sh PALPO_DIR [IMAGE_TAG]
+
+set -euo pipefail
+
+if [ $# -lt 1 ]; then
+    echo "Usage: $0 PALPO_DIR [IMAGE_TAG]" >&2
+    exit 2
+fi
+
+palpo_dir=$1
+tag=${2:-complement-palpo}
+complement_dir=$(cd "$(dirname "$0")/../.." && pwd)
+
+DOCKER_BUILDKIT=1 docker build -t "$tag" \
+    -f "$complement_dir/dockerfiles/palpo/Dockerfile" \
+    --build-context complement="$complement_dir/dockerfiles/palpo" \
+    "$palpo_dir"
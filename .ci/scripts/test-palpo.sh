@@ -0,0 +1,17 @@
+#!/bin/bash
+#
+# Builds a Complement image for Palpo and runs the test suite against it. Arguments are passed to
+# `go test`.
+#
+# Usage: PALPO_DIR=../palpo test-palpo.sh [go test args...]
+
+set -euo pipefail
+
+: "${PALPO_DIR:?PALPO_DIR must be set to a Palpo checkout}"
+complement_dir=$(cd "$(dirname "$0")/../.." && pwd)
+
+"$complement_dir/.ci/scripts/build-palpo-image.sh" "$PALPO_DIR" complement-palpo
+
+cd "$complement_dir"
+export COMPLEMENT_EXPECTATIONS_FILE="${COMPLEMENT_EXPECTATIONS_FILE:-$complement_dir/dockerfiles/palpo/expectations.yaml}"
+COMPLEMENT_BASE_IMAGE=complement-palpo go test -v -tags palpo_blacklist -timeout 30m "$@" ./tests/...
@@ -0,0 +1,398 @@
+// package appservice is an EXPERIMENTAL in-process application service, for testing what homeservers send to
+// application services. It is marked as EXPERIMENTAL as the API may break without warning.
+package appservice
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/internal/coverage"
+	"github.com/matrix-org/complement/internal/har"
+)
+
+// Subset of Deployment used by the application service.
+type AppServiceDeployment interface {
+	GetConfig() *config.Complement
+}
+
+// ApplicationServiceServer is implemented by deployments which can serve requests from the homeserver to an
+// application service in-process, such as the Docker deployment. Custom deployers which want to run tests
+// using this package must implement it.
+type ApplicationServiceServer interface {
+	// ServeApplicationService serves requests from the HS to the application service `asID` with `h`, until the
+	// returned function is called. The application service must not have a URL in the blueprint, which makes
+	// the deployment listen on its behalf. Returns the application service registration.
+	ServeApplicationService(t ct.TestLike, hsName, asID string, h http.Handler) (registration string, stop func())
+}
+
+// EXPERIMENTAL
+// Server is an in-process application service. It receives the transactions and queries which a homeserver
+// sends to an application service in a blueprint, which must not have a URL:
+//
+//	ApplicationServices: []b.ApplicationService{{
+//		ID:              "my_as_id",
+//		SenderLocalpart: "the-bridge-user",
+//	}},
+//
+// Complement listens on behalf of the application service when the blueprint is deployed, and acknowledges
+// transactions until Listen is called. Transactions received before then are not recorded.
+type Server struct {
+	t          ct.TestLike
+	deployment AppServiceDeployment
+	asServer   ApplicationServiceServer
+	hsName     string
+	id         string
+	mux        *mux.Router
+	handler    http.Handler
+	listening  bool
+
+	// The tokens from the application service registration. Only valid after calling Listen().
+	HSToken string
+	ASToken string
+	// The localpart of the application service's sender user. Only valid after calling Listen().
+	SenderLocalpart string
+
+	transactionHandler    func(txn Transaction) util.JSONResponse
+	userQueryHandler      func(userID string) util.JSONResponse
+	roomAliasQueryHandler func(alias string) util.JSONResponse
+
+	mu               sync.Mutex
+	transactions     []Transaction
+	attempts         map[string]int // txn ID -> number of times received
+	userQueries      []string
+	roomAliasQueries []string
+	waiters          []*transactionWaiter
+}
+
+// Transaction is a transaction sent by the homeserver to `PUT /_matrix/app/v1/transactions/{txnId}`.
+type Transaction struct {
+	ID string
+	// The number of times this transaction has been received, including this one. Greater than 1 if the
+	// homeserver retried the transaction.
+	Attempt int
+	// The PDUs in the transaction.
+	Events []gjson.Result
+	// The ephemeral events in the transaction (MSC2409). Requires SendEphemeral in the blueprint.
+	Ephemeral []gjson.Result
+	// The to-device messages in the transaction (MSC2409). Requires SendEphemeral in the blueprint.
+	ToDevice []gjson.Result
+	// The device list changes in the transaction (MSC3202). Requires EnableEncryption in the blueprint.
+	DeviceLists DeviceLists
+	// The one-time key counts and unused fallback key types in the transaction (MSC3202), keyed on user ID
+	// then device ID. Requires EnableEncryption in the blueprint.
+	OneTimeKeysCount       gjson.Result
+	UnusedFallbackKeyTypes gjson.Result
+	// The entire request body.
+	Body gjson.Result
+}
+
+// DeviceLists are the users whose devices have changed, or who no longer share a room with an application
+// service user.
+type DeviceLists struct {
+	Changed []string
+	Left    []string
+}
+
+type transactionWaiter struct {
+	check  func(txn Transaction) bool
+	waiter *helpers.Waiter
+}
+
+// EXPERIMENTAL
+// NewServer creates a new application service for the application service `asID` on the homeserver `hsName`.
+// Call Listen() to start serving requests. Skips the test if the deployment does not implement
+// ApplicationServiceServer.
+func NewServer(t ct.TestLike, deployment AppServiceDeployment, hsName, asID string, opts ...func(*Server)) *Server {
+	t.Helper()
+	asServer, ok := deployment.(ApplicationServiceServer)
+	if !ok {
+		t.Skipf("appservice: deployment %T cannot serve application services in-process", deployment)
+	}
+	srv := &Server{
+		t:          t,
+		deployment: deployment,
+		asServer:   asServer,
+		hsName:     hsName,
+		id:         asID,
+		mux:        mux.NewRouter(),
+		attempts:   make(map[string]int),
+	}
+	srv.mux.HandleFunc("/_matrix/app/v1/transactions/{txnId}", srv.authenticated(srv.handleTransaction)).Methods("PUT")
+	srv.mux.HandleFunc("/_matrix/app/v1/users/{userId}", srv.authenticated(srv.handleUserQuery)).Methods("GET")
+	srv.mux.HandleFunc("/_matrix/app/v1/rooms/{roomAlias}", srv.authenticated(srv.handleRoomAliasQuery)).Methods("GET")
+	srv.mux.HandleFunc("/_matrix/app/v1/ping", srv.authenticated(func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{Code: 200, JSON: struct{}{}}
+	})).Methods("POST")
+	srv.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Logf("appservice: %s received unknown request %s %s", asID, req.Method, req.URL.Path)
+		writeJSONResponse(w, util.JSONResponse{
+			Code: 404,
+			JSON: map[string]string{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request"},
+		})
+	})
+	handler := har.ForTest(t, deployment.GetConfig()).Handler("Complement application service "+asID, srv.mux)
+	srv.handler = coverage.Handler(deployment.GetConfig(), handler)
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// HandleTransactions calls `handler` for every transaction the homeserver sends, including retries, and
+// responds with its response. Transactions are only recorded if the response is 200 OK, so returning an
+// error causes the homeserver to retry the transaction. By default, all transactions are accepted.
+func HandleTransactions(handler func(txn Transaction) util.JSONResponse) func(*Server) {
+	return func(srv *Server) {
+		srv.transactionHandler = handler
+	}
+}
+
+// HandleUserQueries calls `handler` when the homeserver asks whether a user in the application service's
+// namespace exists. The handler should register the user before returning 200 OK. By default, users
+// do not exist.
+func HandleUserQueries(handler func(userID string) util.JSONResponse) func(*Server) {
+	return func(srv *Server) {
+		srv.userQueryHandler = handler
+	}
+}
+
+// HandleRoomAliasQueries calls `handler` when the homeserver asks whether a room alias in the application
+// service's namespace exists. The handler should create the room with the alias before returning 200 OK.
+// By default, room aliases do not exist.
+func HandleRoomAliasQueries(handler func(alias string) util.JSONResponse) func(*Server) {
+	return func(srv *Server) {
+		srv.roomAliasQueryHandler = handler
+	}
+}
+
+// Listen starts serving requests from the homeserver. Returns a function which stops serving them.
+func (s *Server) Listen() (cancel func()) {
+	s.t.Helper()
+	if s.listening {
+		return func() {}
+	}
+	s.listening = true
+	// hold the lock until the tokens are set, as the homeserver may send requests immediately
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	registration, stop := s.asServer.ServeApplicationService(s.t, s.hsName, s.id, s.handler)
+	var reg struct {
+		HSToken         string `yaml:"hs_token"`
+		ASToken         string `yaml:"as_token"`
+		SenderLocalpart string `yaml:"sender_localpart"`
+	}
+	if err := yaml.Unmarshal([]byte(registration), &reg); err != nil {
+		stop()
+		ct.Fatalf(s.t, "appservice: failed to parse registration for %s: %s", s.id, err)
+	}
+	s.HSToken = reg.HSToken
+	s.ASToken = reg.ASToken
+	s.SenderLocalpart = reg.SenderLocalpart
+	return stop
+}
+
+// Transactions returns the transactions received so far, in the order they were received. Retried
+// transactions are only included once.
+func (s *Server) Transactions() []Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Transaction(nil), s.transactions...)
+}
+
+// UserQueries returns the user IDs the homeserver has queried so far.
+func (s *Server) UserQueries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.userQueries...)
+}
+
+// RoomAliasQueries returns the room aliases the homeserver has queried so far.
+func (s *Server) RoomAliasQueries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.roomAliasQueries...)
+}
+
+// WaiterForTransaction creates a Waiter which waits until a transaction for which `check` returns true
+// has been received. Transactions received before calling this function are checked too. Note that calling
+// this function doesn't actually block. Call .Wait(time.Duration) on the waiter to block.
+func (s *Server) WaiterForTransaction(check func(txn Transaction) bool) *helpers.Waiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := helpers.NewWaiter()
+	for _, txn := range s.transactions {
+		if check(txn) {
+			w.Finish()
+			return w
+		}
+	}
+	s.waiters = append(s.waiters, &transactionWaiter{check: check, waiter: w})
+	return w
+}
+
+// WaiterForEvent creates a Waiter which waits until the given event ID has been received in a transaction.
+func (s *Server) WaiterForEvent(eventID string) *helpers.Waiter {
+	return s.WaiterForTransaction(func(txn Transaction) bool {
+		for _, ev := range txn.Events {
+			if ev.Get("event_id").Str == eventID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// authenticated checks that requests have the hs_token from the registration, failing the test if not.
+func (s *Server) authenticated(handler func(req *http.Request) util.JSONResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			// homeservers used to send the token as a query parameter
+			token = req.URL.Query().Get("access_token")
+		}
+		s.mu.Lock()
+		hsToken := s.HSToken
+		s.mu.Unlock()
+		if token != hsToken {
+			ct.Errorf(s.t, "appservice: %s received %s %s with the wrong hs_token: %q", s.id, req.Method, req.URL.Path, token)
+			writeJSONResponse(w, util.JSONResponse{
+				Code: 403,
+				JSON: map[string]string{"errcode": "M_FORBIDDEN", "error": "Wrong hs_token"},
+			})
+			return
+		}
+		writeJSONResponse(w, handler(req))
+	}
+}
+
+func (s *Server) handleTransaction(req *http.Request) util.JSONResponse {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 500,
+			JSON: map[string]string{"errcode": "M_UNKNOWN", "error": err.Error()},
+		}
+	}
+	txnID := mux.Vars(req)["txnId"]
+	s.mu.Lock()
+	s.attempts[txnID]++
+	attempt := s.attempts[txnID]
+	s.mu.Unlock()
+
+	txn := parseTransaction(txnID, attempt, gjson.ParseBytes(body))
+	s.t.Logf("appservice: %s received transaction %s (attempt %d) with %d events", s.id, txnID, attempt, len(txn.Events))
+	res := util.JSONResponse{Code: 200, JSON: struct{}{}}
+	if s.transactionHandler != nil {
+		res = s.transactionHandler(txn)
+	}
+	if res.Code != 200 {
+		return res
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.transactions {
+		if existing.ID == txnID {
+			// the homeserver is retrying a transaction we already accepted
+			return res
+		}
+	}
+	s.transactions = append(s.transactions, txn)
+	waiters := s.waiters[:0]
+	for _, w := range s.waiters {
+		if w.check(txn) {
+			w.waiter.Finish()
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	s.waiters = waiters
+	return res
+}
+
+func (s *Server) handleUserQuery(req *http.Request) util.JSONResponse {
+	userID := mux.Vars(req)["userId"]
+	s.mu.Lock()
+	s.userQueries = append(s.userQueries, userID)
+	s.mu.Unlock()
+	if s.userQueryHandler != nil {
+		return s.userQueryHandler(userID)
+	}
+	return util.JSONResponse{
+		Code: 404,
+		JSON: map[string]string{"errcode": "M_NOT_FOUND", "error": "User does not exist"},
+	}
+}
+
+func (s *Server) handleRoomAliasQuery(req *http.Request) util.JSONResponse {
+	alias := mux.Vars(req)["roomAlias"]
+	s.mu.Lock()
+	s.roomAliasQueries = append(s.roomAliasQueries, alias)
+	s.mu.Unlock()
+	if s.roomAliasQueryHandler != nil {
+		return s.roomAliasQueryHandler(alias)
+	}
+	return util.JSONResponse{
+		Code: 404,
+		JSON: map[string]string{"errcode": "M_NOT_FOUND", "error": "Room alias does not exist"},
+	}
+}
+
+func parseTransaction(txnID string, attempt int, body gjson.Result) Transaction {
+	txn := Transaction{
+		ID:      txnID,
+		Attempt: attempt,
+		Events:  body.Get("events").Array(),
+		// MSC2409 and MSC3202 fields are sent with their unstable prefixes by some homeservers
+		Ephemeral: firstOf(body, "ephemeral", "de.sorunome.msc2409.ephemeral").Array(),
+		ToDevice:  firstOf(body, "to_device", "de.sorunome.msc2409.to_device").Array(),
+		OneTimeKeysCount: firstOf(
+			body, "device_one_time_keys_count", "org.matrix.msc3202.device_one_time_keys_count",
+		),
+		UnusedFallbackKeyTypes: firstOf(
+			body, "device_unused_fallback_key_types", "org.matrix.msc3202.device_unused_fallback_key_types",
+		),
+		Body: body,
+	}
+	deviceLists := firstOf(body, "device_lists", "org.matrix.msc3202.device_lists")
+	for _, userID := range deviceLists.Get("changed").Array() {
+		txn.DeviceLists.Changed = append(txn.DeviceLists.Changed, userID.Str)
+	}
+	for _, userID := range deviceLists.Get("left").Array() {
+		txn.DeviceLists.Left = append(txn.DeviceLists.Left, userID.Str)
+	}
+	return txn
+}
+
+// firstOf returns the first of the keys which exists in `body`.
+func firstOf(body gjson.Result, keys ...string) gjson.Result {
+	for _, key := range keys {
+		res := body.Get(client.GjsonEscape(key))
+		if res.Exists() {
+			return res
+		}
+	}
+	return gjson.Result{}
+}
+
+func writeJSONResponse(w http.ResponseWriter, res util.JSONResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	for k, v := range res.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(res.Code)
+	b, _ := json.Marshal(res.JSON)
+	w.Write(b)
+}
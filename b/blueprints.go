@@ -24,14 +24,15 @@ import (
 
 // KnownBlueprints lists static blueprints
 var KnownBlueprints = map[string]*Blueprint{
-	BlueprintCleanHS.Name:                     &BlueprintCleanHS,
-	BlueprintAlice.Name:                       &BlueprintAlice,
-	BlueprintFederationOneToOneRoom.Name:      &BlueprintFederationOneToOneRoom,
-	BlueprintFederationTwoLocalOneRemote.Name: &BlueprintFederationTwoLocalOneRemote,
-	BlueprintHSWithApplicationService.Name:    &BlueprintHSWithApplicationService,
-	BlueprintOneToOneRoom.Name:                &BlueprintOneToOneRoom,
-	BlueprintPerfManyMessages.Name:            &BlueprintPerfManyMessages,
-	BlueprintPerfManyRooms.Name:               &BlueprintPerfManyRooms,
+	BlueprintCleanHS.Name:                           &BlueprintCleanHS,
+	BlueprintAlice.Name:                             &BlueprintAlice,
+	BlueprintFederationOneToOneRoom.Name:            &BlueprintFederationOneToOneRoom,
+	BlueprintFederationTwoLocalOneRemote.Name:       &BlueprintFederationTwoLocalOneRemote,
+	BlueprintHSWithApplicationService.Name:          &BlueprintHSWithApplicationService,
+	BlueprintHSWithExclusiveApplicationService.Name: &BlueprintHSWithExclusiveApplicationService,
+	BlueprintOneToOneRoom.Name:                      &BlueprintOneToOneRoom,
+	BlueprintPerfManyMessages.Name:                  &BlueprintPerfManyMessages,
+	BlueprintPerfManyRooms.Name:                     &BlueprintPerfManyRooms,
 }
 
 // Blueprint represents an entire deployment to make.
@@ -79,14 +80,33 @@ type Room struct {
 }
 
 type ApplicationService struct {
-	ID               string
-	HSToken          string
-	ASToken          string
+	ID      string
+	HSToken string
+	ASToken string
+	// The URL the homeserver sends transactions and queries to. If empty, Complement listens on behalf of
+	// the application service and rewrites the URL to point to it, so tests can handle its requests
+	// in-process using package appservice.
 	URL              string
 	SenderLocalpart  string
 	RateLimited      bool
 	SendEphemeral    bool
 	EnableEncryption bool
+	// The namespaces the application service is interested in. If nil, the application service is
+	// interested in all users non-exclusively, and no rooms or aliases.
+	Namespaces *ApplicationServiceNamespaces
+}
+
+type ApplicationServiceNamespaces struct {
+	Users   []ApplicationServiceNamespace
+	Aliases []ApplicationServiceNamespace
+	Rooms   []ApplicationServiceNamespace
+}
+
+type ApplicationServiceNamespace struct {
+	// The regular expression to match against. As registrations are stored as image labels, this must not
+	// contain double quotes or backslashes e.g use `[.]` rather than `\.`.
+	Regex     string
+	Exclusive bool
 }
 
 type Event struct {
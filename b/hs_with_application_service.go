@@ -19,7 +19,6 @@ var BlueprintHSWithApplicationService = MustValidate(Blueprint{
 			ApplicationServices: []ApplicationService{
 				{
 					ID:              "my_as_id",
-					URL:             "http://localhost:9000",
 					SenderLocalpart: "the-bridge-user",
 					RateLimited:     false,
 				},
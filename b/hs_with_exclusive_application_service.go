@@ -0,0 +1,33 @@
+package b
+
+// BlueprintHSWithExclusiveApplicationService has an application service which exclusively owns the users
+// `@bridged_*` and room aliases `#bridged_*`
+var BlueprintHSWithExclusiveApplicationService = MustValidate(Blueprint{
+	Name: "hs_with_exclusive_application_service",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+			},
+			ApplicationServices: []ApplicationService{
+				{
+					ID:              "bridge",
+					SenderLocalpart: "bridge-bot",
+					RateLimited:     false,
+					Namespaces: &ApplicationServiceNamespaces{
+						Users: []ApplicationServiceNamespace{
+							{Regex: "@bridged_.*:hs1", Exclusive: true},
+						},
+						Aliases: []ApplicationServiceNamespace{
+							{Regex: "#bridged_.*:hs1", Exclusive: true},
+						},
+					},
+				},
+			},
+		},
+	},
+})
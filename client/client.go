@@ -29,7 +29,8 @@ import (
 type ctxKey string
 
 const (
-	CtxKeyWithRetryUntil ctxKey = "complement_retry_until" // contains *retryUntilParams
+	CtxKeyWithRetryUntil  ctxKey = "complement_retry_until"       // contains *retryUntilParams
+	CtxKeyRateLimitPolicy ctxKey = "complement_rate_limit_policy" // contains *rateLimitParams
 )
 
 var (
@@ -58,6 +59,9 @@ type CSAPI struct {
 	SyncUntilTimeout time.Duration
 	// True to enable verbose logging
 	Debug bool
+	// If set, requests which are rate limited are retried according to this policy. Can be overridden
+	// per-request with WithRateLimitPolicy or WithoutRateLimitRetries.
+	RateLimitPolicy *RateLimitPolicy
 
 	txnID int64
 }
@@ -445,10 +449,29 @@ func (c *CSAPI) MustUploadKeys(t ct.TestLike, deviceKeys map[string]interface{},
 	return s.OTKCounts
 }
 
-// Generate realistic looking device keys and OTKs. They are not guaranteed to be 100% valid, but should
-// pass most server-side checks. Critically, these keys are generated using a Pseudo-Random Number Generator (PRNG)
-// for determinism and hence ARE NOT SECURE. DO NOT USE THIS OUTSIDE OF TESTS.
-func (c *CSAPI) MustGenerateOneTimeKeys(t ct.TestLike, otkCount uint) (deviceKeys map[string]interface{}, oneTimeKeys map[string]interface{}) {
+// DeviceSigningKey is the ed25519 signing key of a device, as made by MustGenerateDeviceKeys.
+type DeviceSigningKey struct {
+	UserID     string
+	DeviceID   string
+	PrivateKey ed25519.PrivateKey
+}
+
+// KeyID returns the key ID for this key, which is `ed25519:` followed by the device ID.
+func (k *DeviceSigningKey) KeyID() string {
+	return "ed25519:" + k.DeviceID
+}
+
+// Sign returns a copy of `obj` with a signature from this device added to any existing signatures.
+func (k *DeviceSigningKey) Sign(t ct.TestLike, obj map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	return signObject(t, k.UserID, k.KeyID(), k.PrivateKey, obj)
+}
+
+// Generate realistic looking, self-signed device keys and return them along with the device's signing key,
+// which can be used to sign other objects such as key backup auth data. Critically, these keys are generated
+// using a Pseudo-Random Number Generator (PRNG) for determinism and hence ARE NOT SECURE. DO NOT USE THIS
+// OUTSIDE OF TESTS.
+func (c *CSAPI) MustGenerateDeviceKeys(t ct.TestLike) (deviceKeys map[string]interface{}, signingKey *DeviceSigningKey) {
 	t.Helper()
 	ed25519PubKey, ed25519PrivKey, err := ed25519.GenerateKey(prng)
 	if err != nil {
@@ -461,7 +484,11 @@ func (c *CSAPI) MustGenerateOneTimeKeys(t ct.TestLike, otkCount uint) (deviceKey
 		ct.Fatalf(t, "failed to read from prng: %s", err)
 	}
 
-	ed25519KeyID := fmt.Sprintf("ed25519:%s", c.DeviceID)
+	signingKey = &DeviceSigningKey{
+		UserID:     c.UserID,
+		DeviceID:   c.DeviceID,
+		PrivateKey: ed25519PrivKey,
+	}
 	curveKeyID := fmt.Sprintf("curve25519:%s", c.DeviceID)
 
 	deviceKeys = map[string]interface{}{
@@ -469,39 +496,26 @@ func (c *CSAPI) MustGenerateOneTimeKeys(t ct.TestLike, otkCount uint) (deviceKey
 		"device_id":  c.DeviceID,
 		"algorithms": []interface{}{"m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"},
 		"keys": map[string]interface{}{
-			ed25519KeyID: base64.RawStdEncoding.EncodeToString(ed25519PubKey),
-			curveKeyID:   base64.RawStdEncoding.EncodeToString(curveKey),
+			signingKey.KeyID(): base64.RawStdEncoding.EncodeToString(ed25519PubKey),
+			curveKeyID:         base64.RawStdEncoding.EncodeToString(curveKey),
 		},
 	}
+	return signingKey.Sign(t, deviceKeys), signingKey
+}
 
-	signJSON := func(input any) []byte {
-		inputJSON, err := json.Marshal(input)
-		if err != nil {
-			ct.Fatalf(t, "failed to marshal struct: %s", err)
-		}
-		inputJSON, err = gomatrixserverlib.CanonicalJSON(inputJSON)
-		if err != nil {
-			ct.Fatalf(t, "failed to canonical json: %s", err)
-		}
-		signature := ed25519.Sign(ed25519PrivKey, inputJSON)
-		if err != nil {
-			ct.Fatalf(t, "failed to sign json: %s", err)
-		}
-		return signature
-	}
-
-	deviceKeys["signatures"] = map[string]interface{}{
-		c.UserID: map[string]interface{}{
-			ed25519KeyID: base64.RawStdEncoding.EncodeToString(signJSON(deviceKeys)),
-		},
-	}
+// Generate realistic looking device keys and OTKs. They are not guaranteed to be 100% valid, but should
+// pass most server-side checks. Critically, these keys are generated using a Pseudo-Random Number Generator (PRNG)
+// for determinism and hence ARE NOT SECURE. DO NOT USE THIS OUTSIDE OF TESTS.
+func (c *CSAPI) MustGenerateOneTimeKeys(t ct.TestLike, otkCount uint) (deviceKeys map[string]interface{}, oneTimeKeys map[string]interface{}) {
+	t.Helper()
+	deviceKeys, signingKey := c.MustGenerateDeviceKeys(t)
 	oneTimeKeys = map[string]interface{}{}
 
 	for i := uint(0); i < otkCount; i++ {
 		privateKeyBytes := make([]byte, 32)
-		_, err = prng.Read(privateKeyBytes)
+		_, err := prng.Read(privateKeyBytes)
 		if err != nil {
-			ct.Fatalf(t, "failed to read from prng", err)
+			ct.Fatalf(t, "failed to read from prng: %s", err)
 		}
 		key, err := curve25519.X25519(privateKeyBytes, curve25519.Basepoint)
 		if err != nil {
@@ -513,13 +527,7 @@ func (c *CSAPI) MustGenerateOneTimeKeys(t ct.TestLike, otkCount uint) (deviceKey
 			"key": base64.RawStdEncoding.EncodeToString(key),
 		}
 
-		keyMap["signatures"] = map[string]interface{}{
-			c.UserID: map[string]interface{}{
-				ed25519KeyID: base64.RawStdEncoding.EncodeToString(signJSON(keyMap)),
-			},
-		}
-
-		oneTimeKeys[keyID] = keyMap
+		oneTimeKeys[keyID] = signingKey.Sign(t, keyMap)
 	}
 
 	return deviceKeys, oneTimeKeys
@@ -592,10 +600,29 @@ func WithRetryUntil(timeout time.Duration, untilFn func(res *http.Response) bool
 	}
 }
 
+// WithContext sets the context for the request, which can be used to cancel the request or to set a
+// deadline. This includes any retries made via WithRetryUntil. If the context is cancelled, the test
+// fails. This is the same as calling DoCtx.
+func WithContext(ctx context.Context) RequestOpt {
+	return func(req *http.Request) {
+		// preserve the other values stored on the request context. Don't reassign `ctx`, as the
+		// RequestOpt may be used for more than one request.
+		reqCtx := context.WithValue(ctx, CtxKeyWithRetryUntil, req.Context().Value(CtxKeyWithRetryUntil))
+		reqCtx = context.WithValue(reqCtx, CtxKeyRateLimitPolicy, req.Context().Value(CtxKeyRateLimitPolicy))
+		*req = *req.WithContext(reqCtx)
+	}
+}
+
 // MustDo is the same as Do but fails the test if the returned HTTP response code is not 2xx.
 func (c *CSAPI) MustDo(t ct.TestLike, method string, paths []string, opts ...RequestOpt) *http.Response {
 	t.Helper()
-	res := c.Do(t, method, paths, opts...)
+	return c.MustDoCtx(context.Background(), t, method, paths, opts...)
+}
+
+// MustDoCtx is the same as DoCtx but fails the test if the returned HTTP response code is not 2xx.
+func (c *CSAPI) MustDoCtx(ctx context.Context, t ct.TestLike, method string, paths []string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	res := c.DoCtx(ctx, t, method, paths, opts...)
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		defer res.Body.Close()
 		body, _ := io.ReadAll(res.Body)
@@ -618,13 +645,26 @@ func (c *CSAPI) MustDo(t ct.TestLike, method string, paths []string, opts ...Req
 //		},
 //	})
 func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	return c.DoCtx(context.Background(), t, method, paths, opts...)
+}
+
+// DoCtx is the same as Do but the request is made with the given context, which can be used to cancel
+// the request or to set a deadline. The context also bounds any retries made via WithRetryUntil.
+//
+// Fails the test if the context is cancelled before a response is returned.
+func (c *CSAPI) DoCtx(ctx context.Context, t ct.TestLike, method string, paths []string, opts ...RequestOpt) *http.Response {
 	t.Helper()
 	escapedPaths := make([]string, len(paths))
 	for i := range paths {
 		escapedPaths[i] = url.PathEscape(paths[i])
 	}
 	reqURL := c.BaseURL + "/" + strings.Join(escapedPaths, "/")
-	req, err := http.NewRequest(method, reqURL, nil)
+	retryUntil := &retryUntilParams{}
+	rateLimit := &rateLimitParams{}
+	ctx = context.WithValue(ctx, CtxKeyWithRetryUntil, retryUntil)
+	ctx = context.WithValue(ctx, CtxKeyRateLimitPolicy, rateLimit)
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, nil)
 	if err != nil {
 		ct.Fatalf(t, "CSAPI.Do failed to create http.NewRequest: %s", err)
 	}
@@ -632,9 +672,6 @@ func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...Request
 	if c.AccessToken != "" {
 		req.Header.Set("Authorization", "Bearer "+c.AccessToken)
 	}
-	retryUntil := &retryUntilParams{}
-	ctx := context.WithValue(req.Context(), CtxKeyWithRetryUntil, retryUntil)
-	req = req.WithContext(ctx)
 
 	// set functional options
 	for _, o := range opts {
@@ -644,6 +681,9 @@ func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...Request
 	if req.Header.Get("Content-Type") == "" {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	if !rateLimit.set {
+		rateLimit.policy = c.RateLimitPolicy
+	}
 	// debug log the request
 	if c.Debug {
 		t.Logf("Making %s request to %s (%s)", method, req.URL, c.AccessToken)
@@ -659,10 +699,14 @@ func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...Request
 		}
 	}
 	now := time.Now()
+	rateLimitRetries := 0
 	for {
 		// Perform the HTTP request
 		res, err := c.Client.Do(req)
 		if err != nil {
+			if req.Context().Err() != nil {
+				ct.Fatalf(t, "CSAPI.Do %v %v was cancelled after %v: %s", method, req.URL, time.Since(now), context.Cause(req.Context()))
+			}
 			ct.Fatalf(t, "CSAPI.Do response returned error: %s", err)
 		}
 		// debug log the response
@@ -674,6 +718,25 @@ func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...Request
 			}
 			t.Logf("%s", string(dump))
 		}
+		if rateLimit.policy != nil && rateLimitRetries < rateLimit.policy.MaxRetries {
+			resBody, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				ct.Fatalf(t, "CSAPI.Do failed to read response body for rate limit check: %s", err)
+			}
+			res.Body = io.NopCloser(bytes.NewBuffer(resBody))
+			if backoff, limited := rateLimit.policy.Backoff(res, resBody); limited {
+				rateLimitRetries++
+				t.Logf("CSAPI.Do %v %v was rate limited, backing off for %v (retry %d/%d)", method, req.URL, backoff, rateLimitRetries, rateLimit.policy.MaxRetries)
+				select {
+				case <-req.Context().Done():
+					ct.Fatalf(t, "CSAPI.Do %v %v was cancelled after %v: %s", method, req.URL, time.Since(now), context.Cause(req.Context()))
+				case <-time.After(backoff):
+				}
+				resetRequestBody(t, req)
+				continue
+			}
+		}
 		if retryUntil == nil || retryUntil.timeout == 0 {
 			return res // don't retry
 		}
@@ -698,8 +761,26 @@ func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...Request
 		}
 		t.Logf("CSAPI.Do RetryUntil: %v %v response condition not yet met, retrying", method, req.URL)
 		// small sleep to avoid tight-looping
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-req.Context().Done():
+			ct.Fatalf(t, "CSAPI.Do RetryUntil: %v %v was cancelled after %v: %s", method, req.URL, time.Since(now), context.Cause(req.Context()))
+		case <-time.After(100 * time.Millisecond):
+		}
+		resetRequestBody(t, req)
+	}
+}
+
+// resetRequestBody rewinds the request body so the request can be sent again.
+func resetRequestBody(t ct.TestLike, req *http.Request) {
+	t.Helper()
+	if req.GetBody == nil {
+		return
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		ct.Fatalf(t, "CSAPI.Do failed to reset request body for retry: %s", err)
 	}
+	req.Body = body
 }
 
 // NewLoggedClient returns an http.Client which logs requests/responses
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/cttest"
+)
+
+// blockingServer returns a client for a server which never responds to `path` until the request is cancelled.
+// Other paths return `{}` with a new `next_batch`.
+func blockingServer(t *testing.T, path string) *CSAPI {
+	t.Helper()
+	var mu sync.Mutex
+	count := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		count++
+		n := count
+		mu.Unlock()
+		if req.URL.Path == path {
+			<-req.Context().Done()
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(`{"next_batch":"s%d"}`, n)))
+	}))
+	t.Cleanup(srv.Close)
+	return &CSAPI{
+		UserID:           "@alice:hs1",
+		BaseURL:          srv.URL,
+		Client:           srv.Client(),
+		SyncUntilTimeout: time.Minute,
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	t.Run("DoCtx fails the test when cancelled", func(t *testing.T) {
+		c := blockingServer(t, "/block")
+		ctx, cancel := context.WithCancelCause(context.Background())
+		time.AfterFunc(50*time.Millisecond, func() { cancel(fmt.Errorf("test cancelled")) })
+		ft := &cttest.FatalT{}
+		fatal := ft.Run(t, func() {
+			c.DoCtx(ctx, ft, "GET", []string{"block"})
+		})
+		if !strings.Contains(fatal, "was cancelled") || !strings.Contains(fatal, "test cancelled") {
+			t.Errorf("got failure %q, want it to say the request was cancelled and why", fatal)
+		}
+	})
+
+	t.Run("WithContext fails the test when cancelled", func(t *testing.T) {
+		c := blockingServer(t, "/block")
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		ft := &cttest.FatalT{}
+		fatal := ft.Run(t, func() {
+			c.Do(ft, "GET", []string{"block"}, WithContext(ctx))
+		})
+		if !strings.Contains(fatal, "was cancelled") {
+			t.Errorf("got failure %q, want it to say the request was cancelled", fatal)
+		}
+	})
+
+	t.Run("WithContext can be reused across requests", func(t *testing.T) {
+		c := blockingServer(t, "/block")
+		opt := WithContext(context.Background())
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res := c.MustDo(t, "GET", []string{"ok"}, opt, WithRetryUntil(time.Second, func(res *http.Response) bool {
+					return true
+				}))
+				res.Body.Close()
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("MustSyncUntilCtx fails the test when cancelled during a long-poll", func(t *testing.T) {
+		c := blockingServer(t, "/_matrix/client/v3/sync")
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		ft := &cttest.FatalT{}
+		fatal := ft.Run(t, func() {
+			c.MustSyncUntilCtx(ctx, ft, SyncReq{}, func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+				return fmt.Errorf("never passes")
+			})
+		})
+		if !strings.Contains(fatal, "cancelled") {
+			t.Errorf("got failure %q, want it to say the sync was cancelled", fatal)
+		}
+	})
+
+	t.Run("MustSyncUntilCtx fails the test with checker errors when cancelled between syncs", func(t *testing.T) {
+		c := blockingServer(t, "/block")
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		ft := &cttest.FatalT{}
+		fatal := ft.Run(t, func() {
+			c.MustSyncUntilCtx(ctx, ft, SyncReq{}, func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+				time.Sleep(10 * time.Millisecond)
+				return fmt.Errorf("never passes")
+			})
+		})
+		if !strings.Contains(fatal, "cancelled") || !strings.Contains(fatal, "never passes") {
+			t.Errorf("got failure %q, want it to say the sync was cancelled and include the checker errors", fatal)
+		}
+	})
+}
@@ -0,0 +1,264 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// CrossSigningKey is an ed25519 cross-signing key pair: a master, self-signing or user-signing key.
+type CrossSigningKey struct {
+	// The usage of this key e.g "master"
+	Usage      string
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// NewCrossSigningKey generates a new cross-signing key pair with the given usage. Fails the test on error.
+func NewCrossSigningKey(t ct.TestLike, usage string) *CrossSigningKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		ct.Fatalf(t, "NewCrossSigningKey: failed to generate ed25519 key: %s", err)
+	}
+	return &CrossSigningKey{
+		Usage:      usage,
+		PublicKey:  pub,
+		PrivateKey: priv,
+	}
+}
+
+// PublicKeyBase64 returns the unpadded base64 public key.
+func (k *CrossSigningKey) PublicKeyBase64() string {
+	return base64.RawStdEncoding.EncodeToString(k.PublicKey)
+}
+
+// KeyID returns the key ID for this key, which is `ed25519:` followed by the public key.
+func (k *CrossSigningKey) KeyID() string {
+	return "ed25519:" + k.PublicKeyBase64()
+}
+
+// KeyJSON returns the key in the format uploaded to /keys/device_signing/upload, without signatures.
+func (k *CrossSigningKey) KeyJSON(userID string) map[string]interface{} {
+	return map[string]interface{}{
+		"user_id": userID,
+		"usage":   []string{k.Usage},
+		"keys": map[string]interface{}{
+			k.KeyID(): k.PublicKeyBase64(),
+		},
+	}
+}
+
+// Sign returns a copy of `obj` with a signature from this key, made by `signerUserID`, added to any
+// existing signatures. The `signatures` and `unsigned` keys are not signed, as per the spec.
+// Fails the test if the object cannot be encoded as canonical JSON.
+func (k *CrossSigningKey) Sign(t ct.TestLike, signerUserID string, obj map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	return signObject(t, signerUserID, k.KeyID(), k.PrivateKey, obj)
+}
+
+// CrossSigningKeys are the cross-signing keys for a user, as made by CSAPI.MustBootstrapCrossSigning.
+type CrossSigningKeys struct {
+	UserID      string
+	Master      *CrossSigningKey
+	SelfSigning *CrossSigningKey
+	UserSigning *CrossSigningKey
+	// The signed key objects which were uploaded to the server.
+	MasterKey      map[string]interface{}
+	SelfSigningKey map[string]interface{}
+	UserSigningKey map[string]interface{}
+}
+
+// SignDevice returns a copy of the given device keys signed by the self-signing key. The device must
+// belong to the same user as the cross-signing keys.
+func (k *CrossSigningKeys) SignDevice(t ct.TestLike, deviceKeys map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	return k.SelfSigning.Sign(t, k.UserID, deviceKeys)
+}
+
+// SignUser returns a copy of another user's master key signed by the user-signing key, which marks
+// that user as verified.
+func (k *CrossSigningKeys) SignUser(t ct.TestLike, otherMasterKey map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	return k.UserSigning.Sign(t, k.UserID, otherMasterKey)
+}
+
+// MustBootstrapCrossSigning generates new master, self-signing and user-signing keys, uploads them via
+// /keys/device_signing/upload and signs this client's device with the self-signing key. User-interactive
+// auth is completed as with DoWithUIA. If this device has not uploaded device keys yet, they are
+// generated and uploaded first. Fails the test on error.
+func (c *CSAPI) MustBootstrapCrossSigning(t ct.TestLike, stages ...UIAStage) *CrossSigningKeys {
+	t.Helper()
+	keys := &CrossSigningKeys{
+		UserID:      c.UserID,
+		Master:      NewCrossSigningKey(t, "master"),
+		SelfSigning: NewCrossSigningKey(t, "self_signing"),
+		UserSigning: NewCrossSigningKey(t, "user_signing"),
+	}
+	keys.MasterKey = keys.Master.KeyJSON(c.UserID)
+	keys.SelfSigningKey = keys.Master.Sign(t, c.UserID, keys.SelfSigning.KeyJSON(c.UserID))
+	keys.UserSigningKey = keys.Master.Sign(t, c.UserID, keys.UserSigning.KeyJSON(c.UserID))
+	c.MustDoWithUIA(t, "POST", []string{"_matrix", "client", "v3", "keys", "device_signing", "upload"}, []RequestOpt{
+		WithJSONBody(t, map[string]interface{}{
+			"master_key":       keys.MasterKey,
+			"self_signing_key": keys.SelfSigningKey,
+			"user_signing_key": keys.UserSigningKey,
+		}),
+	}, stages...)
+
+	deviceKeys := c.MustQueryKeys(t, map[string][]string{c.UserID: {c.DeviceID}}).Get(
+		"device_keys." + GjsonEscape(c.UserID) + "." + GjsonEscape(c.DeviceID),
+	)
+	var device map[string]interface{}
+	if deviceKeys.Exists() {
+		if err := json.Unmarshal([]byte(deviceKeys.Raw), &device); err != nil {
+			ct.Fatalf(t, "MustBootstrapCrossSigning: failed to unmarshal device keys: %s", err)
+		}
+	} else {
+		device, _ = c.MustGenerateOneTimeKeys(t, 0)
+		c.MustUploadKeys(t, device, nil)
+	}
+	c.MustUploadSignatures(t, map[string]map[string]interface{}{
+		c.UserID: {
+			c.DeviceID: keys.SignDevice(t, device),
+		},
+	})
+	return keys
+}
+
+// MustQueryKeys calls /keys/query for the given users and devices and returns the response. An empty
+// list of devices queries all devices for that user. `opts` are applied to the request, e.g WithRetryUntil
+// to wait for keys to arrive over federation. Fails the test if the request fails.
+func (c *CSAPI) MustQueryKeys(t ct.TestLike, deviceKeys map[string][]string, opts ...RequestOpt) gjson.Result {
+	t.Helper()
+	query := make(map[string][]string, len(deviceKeys))
+	for userID, devices := range deviceKeys {
+		if devices == nil {
+			devices = []string{}
+		}
+		query[userID] = devices
+	}
+	opts = append([]RequestOpt{WithJSONBody(t, map[string]interface{}{
+		"device_keys": query,
+	})}, opts...)
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, opts...)
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// MustGetMasterKey returns the master cross-signing key of the given user from /keys/query, including any
+// signatures visible to this user. `opts` are applied to the /keys/query request. Fails the test if the
+// user has no master key.
+func (c *CSAPI) MustGetMasterKey(t ct.TestLike, userID string, opts ...RequestOpt) map[string]interface{} {
+	t.Helper()
+	masterKey := c.MustQueryKeys(t, map[string][]string{userID: {}}, opts...).Get("master_keys." + GjsonEscape(userID))
+	if !masterKey.Exists() {
+		ct.Fatalf(t, "CSAPI.MustGetMasterKey: %s has no master key", userID)
+	}
+	var key map[string]interface{}
+	if err := json.Unmarshal([]byte(masterKey.Raw), &key); err != nil {
+		ct.Fatalf(t, "CSAPI.MustGetMasterKey: failed to unmarshal master key: %s", err)
+	}
+	return key
+}
+
+// UploadSignatures uploads signed keys to /keys/signatures/upload. The map is keyed on user ID then
+// key ID, which is the device ID for device keys or the public key for cross-signing keys.
+func (c *CSAPI) UploadSignatures(t ct.TestLike, signedKeys map[string]map[string]interface{}) *http.Response {
+	t.Helper()
+	return c.Do(t, "POST", []string{"_matrix", "client", "v3", "keys", "signatures", "upload"}, WithJSONBody(t, signedKeys))
+}
+
+// MustUploadSignatures is the same as UploadSignatures but fails the test if the request fails or if
+// the server reports any failures.
+func (c *CSAPI) MustUploadSignatures(t ct.TestLike, signedKeys map[string]map[string]interface{}) {
+	t.Helper()
+	res := c.UploadSignatures(t, signedKeys)
+	mustRespond2xx(t, res)
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	if failures := body.Get("failures"); failures.Exists() && len(failures.Map()) > 0 {
+		ct.Fatalf(t, "CSAPI.MustUploadSignatures: server reported failures: %s", failures.Raw)
+	}
+}
+
+// VerifySignature checks that `obj` has a valid signature from the given ed25519 public key, made by
+// `signerUserID` with the given key ID. The `signatures` and `unsigned` keys are not signed.
+func VerifySignature(obj gjson.Result, signerUserID, keyID string, pub ed25519.PublicKey) error {
+	sig := obj.Get("signatures." + GjsonEscape(signerUserID) + "." + GjsonEscape(keyID))
+	if !sig.Exists() {
+		return fmt.Errorf("no signature from %s with key %s", signerUserID, keyID)
+	}
+	sigBytes, err := base64.RawStdEncoding.DecodeString(sig.Str)
+	if err != nil {
+		return fmt.Errorf("signature is not unpadded base64: %w", err)
+	}
+	var toVerify map[string]interface{}
+	if err := json.Unmarshal([]byte(obj.Raw), &toVerify); err != nil {
+		return fmt.Errorf("failed to unmarshal object: %w", err)
+	}
+	delete(toVerify, "signatures")
+	delete(toVerify, "unsigned")
+	objJSON, err := json.Marshal(toVerify)
+	if err != nil {
+		return err
+	}
+	canonical, err := gomatrixserverlib.CanonicalJSON(objJSON)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, canonical, sigBytes) {
+		return fmt.Errorf("signature from %s with key %s does not verify", signerUserID, keyID)
+	}
+	return nil
+}
+
+// signObject signs `obj` as per https://spec.matrix.org/v1.9/appendices/#signing-json and returns a copy
+// of it with the new signature merged into any existing signatures.
+func signObject(t ct.TestLike, signerUserID, keyID string, priv ed25519.PrivateKey, obj map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	toSign := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		if k == "signatures" || k == "unsigned" {
+			continue
+		}
+		toSign[k] = v
+	}
+	objJSON, err := json.Marshal(toSign)
+	if err != nil {
+		ct.Fatalf(t, "signObject: failed to marshal object: %s", err)
+	}
+	canonical, err := gomatrixserverlib.CanonicalJSON(objJSON)
+	if err != nil {
+		ct.Fatalf(t, "signObject: failed to make canonical JSON: %s", err)
+	}
+	signature := base64.RawStdEncoding.EncodeToString(ed25519.Sign(priv, canonical))
+
+	// deep copy the existing signatures so we don't modify the caller's object
+	signatures := map[string]map[string]interface{}{}
+	if existing, ok := obj["signatures"]; ok {
+		existingJSON, err := json.Marshal(existing)
+		if err != nil {
+			ct.Fatalf(t, "signObject: failed to marshal signatures: %s", err)
+		}
+		if err := json.Unmarshal(existingJSON, &signatures); err != nil {
+			ct.Fatalf(t, "signObject: malformed signatures: %s", err)
+		}
+	}
+	if signatures[signerUserID] == nil {
+		signatures[signerUserID] = map[string]interface{}{}
+	}
+	signatures[signerUserID][keyID] = signature
+
+	signed := make(map[string]interface{}, len(obj)+1)
+	for k, v := range obj {
+		signed[k] = v
+	}
+	signed["signatures"] = signatures
+	return signed
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/web"
+)
+
+// EmailValidation is an email validation session, for use with UIAEmailIdentity or as `threepid_creds`.
+type EmailValidation struct {
+	Address      string
+	SID          string
+	ClientSecret string
+}
+
+// ThreePIDCreds returns the `threepid_creds` object for this session.
+func (v EmailValidation) ThreePIDCreds() map[string]interface{} {
+	return map[string]interface{}{
+		"sid":           v.SID,
+		"client_secret": v.ClientSecret,
+	}
+}
+
+// UIAStage returns the m.login.email.identity stage for this session.
+func (v EmailValidation) UIAStage() UIAStage {
+	return UIAEmailIdentity(v.SID, v.ClientSecret)
+}
+
+// MustRequestEmailToken asks the homeserver to send a validation email to `address` via the requestToken
+// endpoint at `paths` e.g `[]string{"_matrix", "client", "v3", "account", "3pid", "email", "requestToken"}`.
+// Returns the session, which is not validated until the link in the email is followed. Fails the test if the
+// request fails.
+func (c *CSAPI) MustRequestEmailToken(t ct.TestLike, paths []string, address string) EmailValidation {
+	t.Helper()
+	clientSecret := web.RandomString(16)
+	res := c.MustDo(t, "POST", paths, WithJSONBody(t, map[string]interface{}{
+		"client_secret": clientSecret,
+		"email":         address,
+		"send_attempt":  1,
+	}))
+	sid := gjson.GetBytes(ParseJSON(t, res), "sid").Str
+	if sid == "" {
+		ct.Fatalf(t, "CSAPI.MustRequestEmailToken: response has no sid")
+	}
+	return EmailValidation{
+		Address:      address,
+		SID:          sid,
+		ClientSecret: clientSecret,
+	}
+}
+
+// MustSubmitEmailToken follows the validation link from an email sent by this homeserver. Only the path and
+// query of the link are used, as the host in the link is only resolvable inside the deployment network. If the
+// homeserver asks to confirm the validation with a form, the form is submitted. Fails the test if the
+// homeserver does not accept the token.
+func (c *CSAPI) MustSubmitEmailToken(t ct.TestLike, link string) {
+	t.Helper()
+	u, err := url.Parse(link)
+	if err != nil {
+		ct.Fatalf(t, "CSAPI.MustSubmitEmailToken: invalid link %s: %s", link, err)
+	}
+	paths := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	res := c.MustDo(t, "GET", paths, WithQueries(u.Query()))
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		ct.Fatalf(t, "CSAPI.MustSubmitEmailToken: failed to read response: %s", err)
+	}
+	if strings.Contains(strings.ToLower(string(body)), `method="post"`) {
+		// e.g Synapse asks users to confirm password resets, so link previews don't reset passwords
+		res = c.MustDo(t, "POST", paths, WithQueries(u.Query()),
+			WithContentType("application/x-www-form-urlencoded"), WithRawBody([]byte(u.Query().Encode())),
+		)
+		res.Body.Close()
+	}
+}
+
+// MustValidateEmail runs the whole email validation flow: it requests a validation email via the requestToken
+// endpoint at `paths`, then uses `getLink` to wait for the email and return the validation link in it, which
+// is then followed. `getLink` is typically email.Server.MustGetValidationLink. Returns the validated session.
+//
+//	sink := email.NewServer(t, deployment)
+//	v := alice.MustValidateEmail(t, []string{"_matrix", "client", "v3", "account", "3pid", "email", "requestToken"},
+//		"alice@example.com", sink.MustGetValidationLink)
+//	alice.MustAddThreePID(t, v)
+func (c *CSAPI) MustValidateEmail(t ct.TestLike, paths []string, address string, getLink func(t ct.TestLike, address string) string) EmailValidation {
+	t.Helper()
+	v := c.MustRequestEmailToken(t, paths, address)
+	c.MustSubmitEmailToken(t, getLink(t, address))
+	return v
+}
+
+// MustAddThreePID adds the validated email address to this user's account via `/account/3pid/add`,
+// authenticating with CSAPI.Password if required.
+func (c *CSAPI) MustAddThreePID(t ct.TestLike, v EmailValidation) {
+	t.Helper()
+	res, _ := c.MustDoWithUIA(t, "POST", []string{"_matrix", "client", "v3", "account", "3pid", "add"}, []RequestOpt{
+		WithJSONBody(t, map[string]interface{}{
+			"sid":           v.SID,
+			"client_secret": v.ClientSecret,
+		}),
+	})
+	res.Body.Close()
+}
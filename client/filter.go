@@ -0,0 +1,313 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// Filter is a filter for /sync, as created via /user/{userId}/filter. Use the `With...` functions to build
+// one up, then either pass `Filter.JSON(t)` as SyncReq.Filter or upload it with CSAPI.MustCreateFilter:
+//
+//	filter := client.NewFilter().WithTimeline(
+//		client.NewRoomEventFilter().WithLimit(10).WithNotSenders(bob.UserID),
+//	).WithState(
+//		client.NewRoomEventFilter().WithLazyLoadMembers(true),
+//	)
+//	alice.MustSyncUntil(t, client.SyncReq{Filter: filter.JSON(t)}, ...)
+//
+// See https://spec.matrix.org/v1.10/client-server-api/#filtering
+type Filter struct {
+	EventFields []string     `json:"event_fields,omitempty"`
+	EventFormat string       `json:"event_format,omitempty"`
+	Presence    *EventFilter `json:"presence,omitempty"`
+	AccountData *EventFilter `json:"account_data,omitempty"`
+	Room        *RoomFilter  `json:"room,omitempty"`
+}
+
+// EventFilter filters non-room events, such as presence and global account data.
+type EventFilter struct {
+	Limit      *int     `json:"limit,omitempty"`
+	Types      []string `json:"types,omitempty"`
+	NotTypes   []string `json:"not_types,omitempty"`
+	Senders    []string `json:"senders,omitempty"`
+	NotSenders []string `json:"not_senders,omitempty"`
+}
+
+// RoomFilter filters the rooms returned by /sync, and the events within them.
+type RoomFilter struct {
+	Rooms        []string         `json:"rooms,omitempty"`
+	NotRooms     []string         `json:"not_rooms,omitempty"`
+	IncludeLeave bool             `json:"include_leave,omitempty"`
+	Timeline     *RoomEventFilter `json:"timeline,omitempty"`
+	State        *RoomEventFilter `json:"state,omitempty"`
+	Ephemeral    *RoomEventFilter `json:"ephemeral,omitempty"`
+	AccountData  *RoomEventFilter `json:"account_data,omitempty"`
+}
+
+// RoomEventFilter filters room events. This is also the filter used by /messages and /context.
+type RoomEventFilter struct {
+	Limit                     *int     `json:"limit,omitempty"`
+	Types                     []string `json:"types,omitempty"`
+	NotTypes                  []string `json:"not_types,omitempty"`
+	Senders                   []string `json:"senders,omitempty"`
+	NotSenders                []string `json:"not_senders,omitempty"`
+	Rooms                     []string `json:"rooms,omitempty"`
+	NotRooms                  []string `json:"not_rooms,omitempty"`
+	ContainsURL               *bool    `json:"contains_url,omitempty"`
+	LazyLoadMembers           bool     `json:"lazy_load_members,omitempty"`
+	IncludeRedundantMembers   bool     `json:"include_redundant_members,omitempty"`
+	UnreadThreadNotifications bool     `json:"unread_thread_notifications,omitempty"`
+}
+
+// NewFilter returns an empty filter, which matches everything.
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+// WithEventFields only includes the given fields in each event e.g "content.body".
+func (f *Filter) WithEventFields(fields ...string) *Filter {
+	f.EventFields = fields
+	return f
+}
+
+// WithEventFormat sets the event format, either "client" or "federation".
+func (f *Filter) WithEventFormat(format string) *Filter {
+	f.EventFormat = format
+	return f
+}
+
+// WithPresence sets the filter for presence events.
+func (f *Filter) WithPresence(presence *EventFilter) *Filter {
+	f.Presence = presence
+	return f
+}
+
+// WithAccountData sets the filter for global account data.
+func (f *Filter) WithAccountData(accountData *EventFilter) *Filter {
+	f.AccountData = accountData
+	return f
+}
+
+// WithRoom sets the room filter, replacing any room event filters set via WithTimeline etc.
+func (f *Filter) WithRoom(room *RoomFilter) *Filter {
+	f.Room = room
+	return f
+}
+
+// WithRooms only includes the given rooms.
+func (f *Filter) WithRooms(roomIDs ...string) *Filter {
+	f.room().Rooms = roomIDs
+	return f
+}
+
+// WithNotRooms excludes the given rooms.
+func (f *Filter) WithNotRooms(roomIDs ...string) *Filter {
+	f.room().NotRooms = roomIDs
+	return f
+}
+
+// WithIncludeLeave includes rooms the user has left.
+func (f *Filter) WithIncludeLeave(includeLeave bool) *Filter {
+	f.room().IncludeLeave = includeLeave
+	return f
+}
+
+// WithTimeline sets the filter for room timelines.
+func (f *Filter) WithTimeline(timeline *RoomEventFilter) *Filter {
+	f.room().Timeline = timeline
+	return f
+}
+
+// WithState sets the filter for room state.
+func (f *Filter) WithState(state *RoomEventFilter) *Filter {
+	f.room().State = state
+	return f
+}
+
+// WithEphemeral sets the filter for room ephemeral events e.g typing notifications and receipts.
+func (f *Filter) WithEphemeral(ephemeral *RoomEventFilter) *Filter {
+	f.room().Ephemeral = ephemeral
+	return f
+}
+
+// WithRoomAccountData sets the filter for room account data.
+func (f *Filter) WithRoomAccountData(accountData *RoomEventFilter) *Filter {
+	f.room().AccountData = accountData
+	return f
+}
+
+// JSON returns the filter as a JSON string, suitable for SyncReq.Filter. Fails the test if the filter
+// cannot be marshalled.
+func (f *Filter) JSON(t ct.TestLike) string {
+	t.Helper()
+	return mustMarshalFilter(t, f)
+}
+
+func (f *Filter) room() *RoomFilter {
+	if f.Room == nil {
+		f.Room = &RoomFilter{}
+	}
+	return f.Room
+}
+
+// NewEventFilter returns an empty event filter, which matches everything.
+func NewEventFilter() *EventFilter {
+	return &EventFilter{}
+}
+
+// WithLimit sets the maximum number of events to return.
+func (f *EventFilter) WithLimit(limit int) *EventFilter {
+	f.Limit = &limit
+	return f
+}
+
+// WithTypes only includes events with the given types. A '*' can be used as a wildcard.
+func (f *EventFilter) WithTypes(types ...string) *EventFilter {
+	f.Types = types
+	return f
+}
+
+// WithNotTypes excludes events with the given types. A '*' can be used as a wildcard.
+func (f *EventFilter) WithNotTypes(types ...string) *EventFilter {
+	f.NotTypes = types
+	return f
+}
+
+// WithSenders only includes events from the given senders.
+func (f *EventFilter) WithSenders(userIDs ...string) *EventFilter {
+	f.Senders = userIDs
+	return f
+}
+
+// WithNotSenders excludes events from the given senders.
+func (f *EventFilter) WithNotSenders(userIDs ...string) *EventFilter {
+	f.NotSenders = userIDs
+	return f
+}
+
+// NewRoomEventFilter returns an empty room event filter, which matches everything.
+func NewRoomEventFilter() *RoomEventFilter {
+	return &RoomEventFilter{}
+}
+
+// WithLimit sets the maximum number of events to return.
+func (f *RoomEventFilter) WithLimit(limit int) *RoomEventFilter {
+	f.Limit = &limit
+	return f
+}
+
+// WithTypes only includes events with the given types. A '*' can be used as a wildcard.
+func (f *RoomEventFilter) WithTypes(types ...string) *RoomEventFilter {
+	f.Types = types
+	return f
+}
+
+// WithNotTypes excludes events with the given types. A '*' can be used as a wildcard.
+func (f *RoomEventFilter) WithNotTypes(types ...string) *RoomEventFilter {
+	f.NotTypes = types
+	return f
+}
+
+// WithSenders only includes events from the given senders.
+func (f *RoomEventFilter) WithSenders(userIDs ...string) *RoomEventFilter {
+	f.Senders = userIDs
+	return f
+}
+
+// WithNotSenders excludes events from the given senders.
+func (f *RoomEventFilter) WithNotSenders(userIDs ...string) *RoomEventFilter {
+	f.NotSenders = userIDs
+	return f
+}
+
+// WithRooms only includes events from the given rooms.
+func (f *RoomEventFilter) WithRooms(roomIDs ...string) *RoomEventFilter {
+	f.Rooms = roomIDs
+	return f
+}
+
+// WithNotRooms excludes events from the given rooms.
+func (f *RoomEventFilter) WithNotRooms(roomIDs ...string) *RoomEventFilter {
+	f.NotRooms = roomIDs
+	return f
+}
+
+// WithContainsURL only includes events with a `url` key in their content if true, or only events
+// without one if false.
+func (f *RoomEventFilter) WithContainsURL(containsURL bool) *RoomEventFilter {
+	f.ContainsURL = &containsURL
+	return f
+}
+
+// WithLazyLoadMembers enables lazy-loading of room members.
+func (f *RoomEventFilter) WithLazyLoadMembers(lazyLoad bool) *RoomEventFilter {
+	f.LazyLoadMembers = lazyLoad
+	return f
+}
+
+// WithIncludeRedundantMembers sends membership events the client has already seen when lazy-loading.
+func (f *RoomEventFilter) WithIncludeRedundantMembers(includeRedundant bool) *RoomEventFilter {
+	f.IncludeRedundantMembers = includeRedundant
+	return f
+}
+
+// WithUnreadThreadNotifications enables separate notification counts for each thread.
+func (f *RoomEventFilter) WithUnreadThreadNotifications(enabled bool) *RoomEventFilter {
+	f.UnreadThreadNotifications = enabled
+	return f
+}
+
+// JSON returns the filter as a JSON string, suitable for MessagesOpts.Filter or the `filter` query
+// parameter of /messages and /context. Fails the test if the filter cannot be marshalled.
+func (f *RoomEventFilter) JSON(t ct.TestLike) string {
+	t.Helper()
+	return mustMarshalFilter(t, f)
+}
+
+// CreateFilter uploads `filter` via /user/{userId}/filter. `filter` is usually a *Filter, but can be
+// anything which marshals to JSON, to test how the server handles invalid filters.
+func (c *CSAPI) CreateFilter(t ct.TestLike, filter interface{}) *http.Response {
+	t.Helper()
+	return c.Do(t, "POST", []string{"_matrix", "client", "v3", "user", c.UserID, "filter"}, WithJSONBody(t, filter))
+}
+
+// MustCreateFilter uploads `filter` and returns the filter ID, which can be used as SyncReq.Filter.
+// Fails the test if the request fails.
+func (c *CSAPI) MustCreateFilter(t ct.TestLike, filter *Filter) string {
+	t.Helper()
+	res := c.CreateFilter(t, filter)
+	mustRespond2xx(t, res)
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "filter_id")
+}
+
+// GetFilter downloads the filter with the given ID via /user/{userId}/filter/{filterId}.
+func (c *CSAPI) GetFilter(t ct.TestLike, filterID string) *http.Response {
+	t.Helper()
+	return c.Do(t, "GET", []string{"_matrix", "client", "v3", "user", c.UserID, "filter", filterID})
+}
+
+// MustGetFilter downloads the filter with the given ID. Fails the test if the request fails or the
+// filter cannot be parsed.
+func (c *CSAPI) MustGetFilter(t ct.TestLike, filterID string) *Filter {
+	t.Helper()
+	res := c.GetFilter(t, filterID)
+	mustRespond2xx(t, res)
+	body := ParseJSON(t, res)
+	var filter Filter
+	if err := json.Unmarshal(body, &filter); err != nil {
+		ct.Fatalf(t, "CSAPI.MustGetFilter: failed to parse filter %s: %s", string(body), err)
+	}
+	return &filter
+}
+
+func mustMarshalFilter(t ct.TestLike, filter interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(filter)
+	if err != nil {
+		ct.Fatalf(t, "failed to marshal filter: %s", err)
+	}
+	return string(b)
+}
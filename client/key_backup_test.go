@@ -0,0 +1,90 @@
+package client
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestKeyBackupSessionIsBetter(t *testing.T) {
+	testCases := []struct {
+		name      string
+		candidate KeyBackupSession
+		existing  KeyBackupSession
+		want      bool
+	}{
+		{"verified beats unverified", KeyBackupSession{IsVerified: true, FirstMessageIndex: 5, ForwardedCount: 5}, KeyBackupSession{}, true},
+		{"unverified loses to verified", KeyBackupSession{}, KeyBackupSession{IsVerified: true, FirstMessageIndex: 5, ForwardedCount: 5}, false},
+		{"lower first message index wins", KeyBackupSession{FirstMessageIndex: 1, ForwardedCount: 5}, KeyBackupSession{FirstMessageIndex: 2}, true},
+		{"higher first message index loses", KeyBackupSession{FirstMessageIndex: 2}, KeyBackupSession{FirstMessageIndex: 1, ForwardedCount: 5}, false},
+		{"lower forwarded count wins", KeyBackupSession{ForwardedCount: 1}, KeyBackupSession{ForwardedCount: 2}, true},
+		{"higher forwarded count loses", KeyBackupSession{ForwardedCount: 2}, KeyBackupSession{ForwardedCount: 1}, false},
+		{"identical sessions are not better", KeyBackupSession{IsVerified: true, FirstMessageIndex: 1, ForwardedCount: 1}, KeyBackupSession{IsVerified: true, FirstMessageIndex: 1, ForwardedCount: 1}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := KeyBackupSessionIsBetter(tc.candidate, tc.existing); got != tc.want {
+				t.Errorf("KeyBackupSessionIsBetter(%+v, %+v): got %v, want %v", tc.candidate, tc.existing, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKeyBackupEncryption(t *testing.T) {
+	// The backup private key is Bob's key from RFC 7748 section 6.1 and the ephemeral public key is Alice's,
+	// so the shared secret is the one in the RFC. The ciphertext and MAC were made independently with openssl.
+	priv, _ := hex.DecodeString("5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb")
+	pub, _ := hex.DecodeString("de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f")
+	backup := &KeyBackup{PrivateKey: priv, PublicKey: pub}
+	const wantSession = `{"algorithm":"m.megolm.v1.aes-sha2","session_key":"abc"}`
+
+	t.Run("decrypts a known vector", func(t *testing.T) {
+		session, err := backup.DecryptSession(gjson.Parse(`{
+			"ephemeral": "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo",
+			"ciphertext": "9lq9DgATQh0Ey5ZaVGHfoeMtfpavaYtV17dAmUZKJ5IHOCF7fvSQ8UcWQV28eOU9hbvVlmZr5fx1tqkhzmgP5Q",
+			"mac": "zpzU6BkZcNI"
+		}`))
+		if err != nil {
+			t.Fatalf("DecryptSession: %s", err)
+		}
+		if session.Raw != wantSession {
+			t.Errorf("DecryptSession: got %s, want %s", session.Raw, wantSession)
+		}
+	})
+
+	t.Run("rejects a bad MAC", func(t *testing.T) {
+		_, err := backup.DecryptSession(gjson.Parse(`{
+			"ephemeral": "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo",
+			"ciphertext": "9lq9DgATQh0Ey5ZaVGHfoeMtfpavaYtV17dAmUZKJ5IHOCF7fvSQ8UcWQV28eOU9hbvVlmZr5fx1tqkhzmgP5Q",
+			"mac": "AAAAAAAAAAA"
+		}`))
+		if err == nil {
+			t.Errorf("DecryptSession: decrypted session data with a bad MAC")
+		}
+	})
+
+	t.Run("round trips through a new backup", func(t *testing.T) {
+		backup := NewKeyBackup(t)
+		if backup.AuthData["public_key"] == "" {
+			t.Fatalf("NewKeyBackup: missing public_key in auth_data")
+		}
+		sessionData := backup.EncryptSession(t, map[string]interface{}{
+			"algorithm":   "m.megolm.v1.aes-sha2",
+			"session_key": "abc",
+		})
+		b, _ := json.Marshal(sessionData)
+		session, err := backup.DecryptSession(gjson.ParseBytes(b))
+		if err != nil {
+			t.Fatalf("DecryptSession: %s", err)
+		}
+		if session.Raw != wantSession {
+			t.Errorf("DecryptSession: got %s, want %s", session.Raw, wantSession)
+		}
+		// a different backup cannot decrypt it
+		if _, err := NewKeyBackup(t).DecryptSession(gjson.ParseBytes(b)); err == nil {
+			t.Errorf("DecryptSession: decrypted session data for a different backup")
+		}
+	})
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// MessagesOpts configures a MessagesIterator.
+type MessagesOpts struct {
+	// The direction to paginate in: "b" (backwards) or "f" (forwards). Default: "b".
+	Dir string
+	// The token to start paginating from, e.g a `prev_batch` from /sync or an `end` token from an
+	// earlier /messages response. If empty, pagination starts from the latest event (dir=b) or the
+	// first event (dir=f).
+	From string
+	// The token to stop paginating at, e.g the `next_batch` of an earlier /sync to fill a gap.
+	To string
+	// The maximum number of events to request per page. If 0, the server default is used.
+	Limit int
+	// A RoomEventFilter encoded as JSON.
+	Filter string
+	// The maximum number of pages to fetch before failing the test, to stop tests spinning forever
+	// on servers which never return the end of the timeline. Default: 100.
+	MaxPages int
+}
+
+// MessagesPage is a single /messages response.
+type MessagesPage struct {
+	// The `from` token used to request this page.
+	From  string
+	Start string
+	// The token for the next page. Empty if the end of the timeline was reached.
+	End   string
+	Chunk []gjson.Result
+	State []gjson.Result
+	// The raw response body.
+	Body gjson.Result
+}
+
+// MessagesIterator lazily paginates /rooms/{roomID}/messages, following `end` tokens until the timeline
+// is exhausted. No requests are made until events are asked for. Every page is recorded so tests can
+// check for duplicate or missing events across page boundaries.
+//
+//	it := alice.MessagesIterator(t, roomID, client.MessagesOpts{From: prevBatch, Limit: 5})
+//	event, ok := it.Until(t, func(ev gjson.Result) bool {
+//		return ev.Get("type").Str == "m.room.create"
+//	})
+//	must.Equal(t, len(it.DuplicateEventIDs()), 0, "duplicate events")
+type MessagesIterator struct {
+	c      *CSAPI
+	roomID string
+	opts   MessagesOpts
+
+	pages     []MessagesPage
+	nextToken string
+	exhausted bool
+	// the position of the next event to return from Next
+	pageIndex  int
+	eventIndex int
+}
+
+// MessagesIterator returns an iterator over the events in the room, starting at opts.From.
+func (c *CSAPI) MessagesIterator(t ct.TestLike, roomID string, opts MessagesOpts) *MessagesIterator {
+	t.Helper()
+	if opts.Dir == "" {
+		opts.Dir = "b"
+	}
+	if opts.Dir != "b" && opts.Dir != "f" {
+		ct.Fatalf(t, "MessagesIterator: dir must be 'b' or 'f', got '%s'", opts.Dir)
+	}
+	if opts.MaxPages == 0 {
+		opts.MaxPages = 100
+	}
+	return &MessagesIterator{
+		c:         c,
+		roomID:    roomID,
+		opts:      opts,
+		nextToken: opts.From,
+	}
+}
+
+// NextPage fetches and returns the next page. Returns false if the timeline has been exhausted.
+// Fails the test if the request fails, or if more than MaxPages pages are fetched.
+func (it *MessagesIterator) NextPage(t ct.TestLike) (*MessagesPage, bool) {
+	t.Helper()
+	if it.exhausted {
+		return nil, false
+	}
+	if len(it.pages) >= it.opts.MaxPages {
+		ct.Fatalf(t, "MessagesIterator: fetched %d pages without reaching the end of the timeline", len(it.pages))
+	}
+	query := url.Values{
+		"dir": {it.opts.Dir},
+	}
+	if it.nextToken != "" {
+		query.Set("from", it.nextToken)
+	}
+	if it.opts.To != "" {
+		query.Set("to", it.opts.To)
+	}
+	if it.opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(it.opts.Limit))
+	}
+	if it.opts.Filter != "" {
+		query.Set("filter", it.opts.Filter)
+	}
+	res := it.c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", it.roomID, "messages"}, WithQueries(query))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	page := MessagesPage{
+		From:  it.nextToken,
+		Start: body.Get("start").Str,
+		End:   body.Get("end").Str,
+		Chunk: body.Get("chunk").Array(),
+		State: body.Get("state").Array(),
+		Body:  body,
+	}
+	it.pages = append(it.pages, page)
+	// The end of the timeline is signalled by omitting `end`. Some servers instead return the same
+	// token again, so treat that as the end too. Empty chunks are not the end: with a filter, servers
+	// may return pages with no matching events which still have an `end` token. MaxPages stops servers
+	// which never reach the end.
+	if page.End == "" || page.End == it.nextToken {
+		it.exhausted = true
+	}
+	it.nextToken = page.End
+	return &it.pages[len(it.pages)-1], true
+}
+
+// Next returns the next event, fetching more pages as needed. Returns false once the timeline has
+// been exhausted.
+func (it *MessagesIterator) Next(t ct.TestLike) (gjson.Result, bool) {
+	t.Helper()
+	for {
+		if it.pageIndex < len(it.pages) {
+			chunk := it.pages[it.pageIndex].Chunk
+			if it.eventIndex < len(chunk) {
+				ev := chunk[it.eventIndex]
+				it.eventIndex++
+				return ev, true
+			}
+			it.pageIndex++
+			it.eventIndex = 0
+			continue
+		}
+		if _, ok := it.NextPage(t); !ok {
+			return gjson.Result{}, false
+		}
+	}
+}
+
+// Until returns the first event for which `predicate` returns true, fetching only as many pages as
+// needed. Returns false if the timeline was exhausted without a match.
+func (it *MessagesIterator) Until(t ct.TestLike, predicate func(ev gjson.Result) bool) (gjson.Result, bool) {
+	t.Helper()
+	for {
+		ev, ok := it.Next(t)
+		if !ok {
+			return gjson.Result{}, false
+		}
+		if predicate(ev) {
+			return ev, true
+		}
+	}
+}
+
+// MustUntil is the same as Until but fails the test if no event matches.
+func (it *MessagesIterator) MustUntil(t ct.TestLike, predicate func(ev gjson.Result) bool) gjson.Result {
+	t.Helper()
+	ev, ok := it.Until(t, predicate)
+	if !ok {
+		ct.Fatalf(t, "MessagesIterator.MustUntil: no matching event in %s after %d pages: %v", it.roomID, len(it.pages), it.EventIDs())
+	}
+	return ev
+}
+
+// All paginates until the timeline is exhausted and returns every remaining event.
+func (it *MessagesIterator) All(t ct.TestLike) []gjson.Result {
+	t.Helper()
+	var events []gjson.Result
+	for {
+		ev, ok := it.Next(t)
+		if !ok {
+			return events
+		}
+		events = append(events, ev)
+	}
+}
+
+// Exhausted returns true if the end of the timeline has been reached.
+func (it *MessagesIterator) Exhausted() bool {
+	return it.exhausted
+}
+
+// Pages returns every page fetched so far.
+func (it *MessagesIterator) Pages() []MessagesPage {
+	return it.pages
+}
+
+// Events returns every event in every page fetched so far, in the order the server returned them.
+func (it *MessagesIterator) Events() []gjson.Result {
+	var events []gjson.Result
+	for _, page := range it.pages {
+		events = append(events, page.Chunk...)
+	}
+	return events
+}
+
+// EventIDs returns the event IDs of Events().
+func (it *MessagesIterator) EventIDs() []string {
+	var eventIDs []string
+	for _, ev := range it.Events() {
+		eventIDs = append(eventIDs, ev.Get("event_id").Str)
+	}
+	return eventIDs
+}
+
+// DuplicateEventIDs returns the event IDs which appeared more than once in the pages fetched so far,
+// e.g because the server returned the same event either side of a page boundary.
+func (it *MessagesIterator) DuplicateEventIDs() []string {
+	seen := make(map[string]int)
+	var duplicates []string
+	for _, eventID := range it.EventIDs() {
+		seen[eventID]++
+		if seen[eventID] == 2 {
+			duplicates = append(duplicates, eventID)
+		}
+	}
+	return duplicates
+}
+
+// MissingEventIDs returns the event IDs in `want` which have not appeared in the pages fetched so far.
+func (it *MessagesIterator) MissingEventIDs(want []string) []string {
+	seen := make(map[string]bool)
+	for _, eventID := range it.EventIDs() {
+		seen[eventID] = true
+	}
+	var missing []string
+	for _, eventID := range want {
+		if !seen[eventID] {
+			missing = append(missing, eventID)
+		}
+	}
+	return missing
+}
+
+// String returns a summary of the pages fetched so far, for use in test failure messages.
+func (it *MessagesIterator) String() string {
+	s := fmt.Sprintf("MessagesIterator(%s dir=%s) %d pages:", it.roomID, it.opts.Dir, len(it.pages))
+	for i, page := range it.pages {
+		s += fmt.Sprintf("\n  #%d from=%q end=%q events=%d", i+1, page.From, page.End, len(page.Chunk))
+	}
+	return s
+}
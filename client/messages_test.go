@@ -0,0 +1,132 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/cttest"
+)
+
+// messagesServer is a stub server which serves /messages pages keyed by the `from` token.
+type messagesServer struct {
+	pages map[string]map[string]interface{}
+
+	mu      sync.Mutex
+	queries []map[string]string
+}
+
+func newMessagesServer(t *testing.T, pages map[string]map[string]interface{}) (*messagesServer, *CSAPI) {
+	s := &messagesServer{pages: pages}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, &CSAPI{
+		UserID:  "@alice:hs1",
+		BaseURL: srv.URL,
+		Client:  srv.Client(),
+	}
+}
+
+func (s *messagesServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasSuffix(req.URL.Path, "/messages") {
+		w.WriteHeader(404)
+		return
+	}
+	q := req.URL.Query()
+	s.mu.Lock()
+	s.queries = append(s.queries, map[string]string{
+		"from": q.Get("from"), "dir": q.Get("dir"), "limit": q.Get("limit"), "filter": q.Get("filter"),
+	})
+	s.mu.Unlock()
+	page, ok := s.pages[q.Get("from")]
+	if !ok {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"errcode":"M_INVALID_PARAM"}`))
+		return
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func messagesPage(end string, eventIDs ...string) map[string]interface{} {
+	chunk := []interface{}{}
+	for _, eventID := range eventIDs {
+		chunk = append(chunk, map[string]interface{}{"event_id": eventID, "type": "m.room.message"})
+	}
+	page := map[string]interface{}{"chunk": chunk}
+	if end != "" {
+		page["end"] = end
+	}
+	return page
+}
+
+func TestMessagesIterator(t *testing.T) {
+	t.Run("empty pages with an end token do not end the timeline", func(t *testing.T) {
+		s, c := newMessagesServer(t, map[string]map[string]interface{}{
+			"":   messagesPage("t1", "$1"),
+			"t1": messagesPage("t2"),
+			"t2": messagesPage("t3", "$2"),
+			"t3": messagesPage(""),
+		})
+		it := c.MessagesIterator(t, "!room:hs1", MessagesOpts{Limit: 5, Filter: `{"types":["m.room.message"]}`})
+		ev := it.MustUntil(t, func(ev gjson.Result) bool {
+			return ev.Get("event_id").Str == "$2"
+		})
+		if ev.Get("event_id").Str != "$2" {
+			t.Errorf("MustUntil: got %s, want $2", ev.Raw)
+		}
+		if got := it.All(t); len(got) != 0 || !it.Exhausted() {
+			t.Errorf("All: got %d more events and exhausted=%v, want none and the end of the timeline", len(got), it.Exhausted())
+		}
+		if missing := it.MissingEventIDs([]string{"$1", "$2"}); len(missing) != 0 {
+			t.Errorf("MissingEventIDs: got %v, want none", missing)
+		}
+		if len(it.Pages()) != 4 {
+			t.Errorf("got %d pages, want 4\n%s", len(it.Pages()), it)
+		}
+		if _, ok := it.NextPage(t); ok {
+			t.Errorf("NextPage returned a page after the end of the timeline")
+		}
+		wantFroms := []string{"", "t1", "t2", "t3"}
+		for i, q := range s.queries {
+			if q["from"] != wantFroms[i] || q["dir"] != "b" || q["limit"] != "5" || q["filter"] != `{"types":["m.room.message"]}` {
+				t.Errorf("request %d: got query %v, want from=%q dir=b limit=5 and the filter", i, q, wantFroms[i])
+			}
+		}
+	})
+
+	t.Run("a repeated end token ends the timeline", func(t *testing.T) {
+		_, c := newMessagesServer(t, map[string]map[string]interface{}{
+			"":   messagesPage("t1", "$1"),
+			"t1": messagesPage("t1"),
+		})
+		it := c.MessagesIterator(t, "!room:hs1", MessagesOpts{})
+		if got := it.EventIDs(); len(got) != 0 {
+			t.Errorf("EventIDs: got %v before any requests, want none", got)
+		}
+		it.All(t)
+		if !reflect.DeepEqual(it.EventIDs(), []string{"$1"}) || len(it.Pages()) != 2 {
+			t.Errorf("got events %v in %d pages, want [$1] in 2 pages", it.EventIDs(), len(it.Pages()))
+		}
+	})
+
+	t.Run("fails the test after MaxPages", func(t *testing.T) {
+		_, c := newMessagesServer(t, map[string]map[string]interface{}{
+			"":   messagesPage("t1"),
+			"t1": messagesPage("t2"),
+			"t2": messagesPage("t1"),
+		})
+		ft := &cttest.FatalT{}
+		fatal := ft.Run(t, func() {
+			c.MessagesIterator(ft, "!room:hs1", MessagesOpts{MaxPages: 5}).All(ft)
+		})
+		if !strings.Contains(fatal, "fetched 5 pages without reaching the end of the timeline") {
+			t.Errorf("got failure %q, want it to say MaxPages was reached", fatal)
+		}
+	})
+}
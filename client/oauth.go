@@ -0,0 +1,310 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/web"
+)
+
+// OAuthLoginOpts configures how to obtain an access token from an OAuth 2.0 provider (MSC3861).
+type OAuthLoginOpts struct {
+	// The HTTP client used to talk to the provider. Required, as the provider is usually only
+	// reachable from the machine running Complement via a custom dialer e.g oauth.Server.HTTPClient().
+	// It must not follow redirects.
+	HTTPClient *http.Client
+	// The issuer URL. If empty, it is discovered from the homeserver.
+	Issuer string
+	// The Matrix user ID to log in as. Sent to the provider as `login_hint=mxid:<UserID>`.
+	UserID string
+	// The device ID to request. If empty, a random one is used.
+	DeviceID string
+	// The redirect URI to register and use. Default: http://localhost/complement/callback
+	RedirectURI string
+	// Extra scopes to request, in addition to the Matrix API and device scopes.
+	ExtraScopes []string
+}
+
+// OAuthTokens is the result of a successful OAuth 2.0 login.
+type OAuthTokens struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    time.Duration
+	Scope        string
+	// The dynamically registered client ID used to log in.
+	ClientID string
+	// The provider's token endpoint, which can be used with MustRefreshOAuthToken.
+	TokenEndpoint string
+}
+
+// MustGetOAuthIssuer returns the issuer of the OAuth 2.0 provider the homeserver delegates auth to,
+// using the stable auth_metadata endpoint and falling back to the unstable MSC2965 endpoints.
+// Returns the empty string if the homeserver does not advertise a provider.
+func (c *CSAPI) MustGetOAuthIssuer(t ct.TestLike) string {
+	t.Helper()
+	for _, paths := range [][]string{
+		{"_matrix", "client", "v1", "auth_metadata"},
+		{"_matrix", "client", "unstable", "org.matrix.msc2965", "auth_metadata"},
+	} {
+		res := c.Do(t, "GET", paths)
+		if res.StatusCode == 200 {
+			return GetJSONFieldStr(t, ParseJSON(t, res), "issuer")
+		}
+		res.Body.Close()
+	}
+	res := c.Do(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc2965", "auth_issuer"})
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return ""
+	}
+	return GetJSONFieldStr(t, ParseJSON(t, res), "issuer")
+}
+
+// MustLoginWithOAuth logs in via the OAuth 2.0 authorization code grant with PKCE. The provider must
+// approve the authorization request without user interaction, as the stub provider in the `oauth`
+// package does. On success, the CSAPI's AccessToken, UserID and DeviceID are set and the tokens are
+// returned.
+func (c *CSAPI) MustLoginWithOAuth(t ct.TestLike, opts OAuthLoginOpts) *OAuthTokens {
+	t.Helper()
+	opts = c.withOAuthDefaults(t, opts)
+	metadata := mustGetOAuthMetadata(t, opts)
+	clientID := mustRegisterOAuthClient(t, opts, metadata, []string{"authorization_code", "refresh_token"})
+
+	verifier := web.RandomString(32)
+	challenge := sha256.Sum256([]byte(verifier))
+	state := web.RandomString(8)
+	authURL, err := url.Parse(metadata.Get("authorization_endpoint").Str)
+	if err != nil {
+		ct.Fatalf(t, "MustLoginWithOAuth: invalid authorization_endpoint: %s", err)
+	}
+	authURL.RawQuery = url.Values{
+		"response_type":         {"code"},
+		"response_mode":         {"query"},
+		"client_id":             {clientID},
+		"redirect_uri":          {opts.RedirectURI},
+		"scope":                 {oauthScope(opts)},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+		"login_hint":            {"mxid:" + opts.UserID},
+	}.Encode()
+	res, err := opts.HTTPClient.Get(authURL.String())
+	if err != nil {
+		ct.Fatalf(t, "MustLoginWithOAuth: authorization request failed: %s", err)
+	}
+	res.Body.Close()
+	location, err := res.Location()
+	if err != nil {
+		ct.Fatalf(t, "MustLoginWithOAuth: authorization request returned %s without a redirect: %s", res.Status, err)
+	}
+	callback := location.Query()
+	if callback.Get("error") != "" {
+		ct.Fatalf(t, "MustLoginWithOAuth: authorization failed: %s %s", callback.Get("error"), callback.Get("error_description"))
+	}
+	if callback.Get("state") != state {
+		ct.Fatalf(t, "MustLoginWithOAuth: state mismatch: got %q want %q", callback.Get("state"), state)
+	}
+
+	tokenEndpoint := metadata.Get("token_endpoint").Str
+	body := mustOAuthTokenRequest(t, opts.HTTPClient, tokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {callback.Get("code")},
+		"redirect_uri":  {opts.RedirectURI},
+		"client_id":     {clientID},
+		"code_verifier": {verifier},
+	})
+	return c.useOAuthTokens(t, body, clientID, tokenEndpoint)
+}
+
+// MustLoginWithOAuthDeviceGrant logs in via the OAuth 2.0 device authorization grant (RFC 8628).
+// `approve` is called with the user code and verification URI, and should approve the request
+// (e.g via oauth.Server.ApproveDeviceAuthorization). The token endpoint is then polled until the
+// request is approved, or fails the test after `timeout`. On success, the CSAPI's AccessToken, UserID
+// and DeviceID are set and the tokens are returned.
+func (c *CSAPI) MustLoginWithOAuthDeviceGrant(t ct.TestLike, opts OAuthLoginOpts, timeout time.Duration, approve func(userCode, verificationURI string)) *OAuthTokens {
+	t.Helper()
+	opts = c.withOAuthDefaults(t, opts)
+	metadata := mustGetOAuthMetadata(t, opts)
+	deviceGrant := "urn:ietf:params:oauth:grant-type:device_code"
+	clientID := mustRegisterOAuthClient(t, opts, metadata, []string{deviceGrant, "refresh_token"})
+
+	res, err := opts.HTTPClient.PostForm(metadata.Get("device_authorization_endpoint").Str, url.Values{
+		"client_id": {clientID},
+		"scope":     {oauthScope(opts)},
+	})
+	if err != nil {
+		ct.Fatalf(t, "MustLoginWithOAuthDeviceGrant: device authorization request failed: %s", err)
+	}
+	authz := gjson.ParseBytes(mustReadOAuthResponse(t, res, "device authorization"))
+	approve(authz.Get("user_code").Str, authz.Get("verification_uri").Str)
+
+	interval := time.Duration(authz.Get("interval").Int()) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	tokenEndpoint := metadata.Get("token_endpoint").Str
+	start := time.Now()
+	for {
+		res, err := opts.HTTPClient.PostForm(tokenEndpoint, url.Values{
+			"grant_type":  {deviceGrant},
+			"device_code": {authz.Get("device_code").Str},
+			"client_id":   {clientID},
+		})
+		if err != nil {
+			ct.Fatalf(t, "MustLoginWithOAuthDeviceGrant: token request failed: %s", err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			ct.Fatalf(t, "MustLoginWithOAuthDeviceGrant: failed to read token response: %s", err)
+		}
+		if res.StatusCode == 200 {
+			return c.useOAuthTokens(t, body, clientID, tokenEndpoint)
+		}
+		switch errcode := gjson.GetBytes(body, "error").Str; errcode {
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			ct.Fatalf(t, "MustLoginWithOAuthDeviceGrant: token request returned %s: %s", res.Status, string(body))
+		}
+		if time.Since(start) > timeout {
+			ct.Fatalf(t, "MustLoginWithOAuthDeviceGrant: device authorization was not approved after %v", timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// MustRefreshOAuthToken uses the refresh token to get a new access token from the provider. The
+// CSAPI's AccessToken is updated and the new tokens are returned.
+func (c *CSAPI) MustRefreshOAuthToken(t ct.TestLike, httpClient *http.Client, tokens *OAuthTokens) *OAuthTokens {
+	t.Helper()
+	body := mustOAuthTokenRequest(t, httpClient, tokens.TokenEndpoint, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tokens.RefreshToken},
+		"client_id":     {tokens.ClientID},
+	})
+	newTokens := oauthTokensFromBody(body, tokens.ClientID, tokens.TokenEndpoint)
+	c.AccessToken = newTokens.AccessToken
+	return newTokens
+}
+
+func (c *CSAPI) withOAuthDefaults(t ct.TestLike, opts OAuthLoginOpts) OAuthLoginOpts {
+	t.Helper()
+	if opts.HTTPClient == nil {
+		ct.Fatalf(t, "OAuthLoginOpts.HTTPClient must be set")
+	}
+	if opts.UserID == "" {
+		ct.Fatalf(t, "OAuthLoginOpts.UserID must be set")
+	}
+	if opts.Issuer == "" {
+		opts.Issuer = c.MustGetOAuthIssuer(t)
+		if opts.Issuer == "" {
+			ct.Fatalf(t, "homeserver does not advertise an OAuth 2.0 issuer")
+		}
+	}
+	if opts.DeviceID == "" {
+		opts.DeviceID = strings.ToUpper(web.RandomString(5))
+	}
+	if opts.RedirectURI == "" {
+		opts.RedirectURI = "http://localhost/complement/callback"
+	}
+	return opts
+}
+
+// useOAuthTokens sets the access token on the client and fills in the user and device IDs via /whoami.
+func (c *CSAPI) useOAuthTokens(t ct.TestLike, body []byte, clientID, tokenEndpoint string) *OAuthTokens {
+	t.Helper()
+	tokens := oauthTokensFromBody(body, clientID, tokenEndpoint)
+	c.AccessToken = tokens.AccessToken
+	whoami := ParseJSON(t, c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"}))
+	c.UserID = GetJSONFieldStr(t, whoami, "user_id")
+	c.DeviceID = gjson.GetBytes(whoami, "device_id").Str
+	return tokens
+}
+
+func oauthTokensFromBody(body []byte, clientID, tokenEndpoint string) *OAuthTokens {
+	res := gjson.ParseBytes(body)
+	return &OAuthTokens{
+		AccessToken:   res.Get("access_token").Str,
+		RefreshToken:  res.Get("refresh_token").Str,
+		ExpiresIn:     time.Duration(res.Get("expires_in").Int()) * time.Second,
+		Scope:         res.Get("scope").Str,
+		ClientID:      clientID,
+		TokenEndpoint: tokenEndpoint,
+	}
+}
+
+func mustGetOAuthMetadata(t ct.TestLike, opts OAuthLoginOpts) gjson.Result {
+	t.Helper()
+	res, err := opts.HTTPClient.Get(strings.TrimSuffix(opts.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		ct.Fatalf(t, "failed to fetch OAuth 2.0 provider metadata: %s", err)
+	}
+	return gjson.ParseBytes(mustReadOAuthResponse(t, res, "provider metadata"))
+}
+
+func mustRegisterOAuthClient(t ct.TestLike, opts OAuthLoginOpts, metadata gjson.Result, grantTypes []string) string {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"client_name":                "Complement",
+		"client_uri":                 "https://github.com/matrix-org/complement",
+		"application_type":           "native",
+		"redirect_uris":              []string{opts.RedirectURI},
+		"grant_types":                grantTypes,
+		"response_types":             []string{"code"},
+		"token_endpoint_auth_method": "none",
+	}
+	req, err := http.NewRequest("POST", metadata.Get("registration_endpoint").Str, nil)
+	if err != nil {
+		ct.Fatalf(t, "failed to create client registration request: %s", err)
+	}
+	WithJSONBody(t, reqBody)(req)
+	res, err := opts.HTTPClient.Do(req)
+	if err != nil {
+		ct.Fatalf(t, "client registration request failed: %s", err)
+	}
+	return gjson.GetBytes(mustReadOAuthResponse(t, res, "client registration"), "client_id").Str
+}
+
+func mustOAuthTokenRequest(t ct.TestLike, httpClient *http.Client, tokenEndpoint string, form url.Values) []byte {
+	t.Helper()
+	res, err := httpClient.PostForm(tokenEndpoint, form)
+	if err != nil {
+		ct.Fatalf(t, "token request failed: %s", err)
+	}
+	return mustReadOAuthResponse(t, res, "token")
+}
+
+func mustReadOAuthResponse(t ct.TestLike, res *http.Response, what string) []byte {
+	t.Helper()
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		ct.Fatalf(t, "failed to read %s response: %s", what, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		ct.Fatalf(t, "%s request to %s returned %s: %s", what, res.Request.URL.String(), res.Status, string(body))
+	}
+	if !gjson.ValidBytes(body) {
+		ct.Fatalf(t, "%s response is not valid JSON: %s", what, string(body))
+	}
+	return body
+}
+
+func oauthScope(opts OAuthLoginOpts) string {
+	scopes := []string{
+		"openid",
+		"urn:matrix:org.matrix.msc2967.client:api:*",
+		"urn:matrix:org.matrix.msc2967.client:device:" + opts.DeviceID,
+	}
+	return strings.Join(append(scopes, opts.ExtraScopes...), " ")
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"github.com/matrix-org/complement/ct"
+)
+
+// Pusher is the request body of `POST /_matrix/client/v3/pushers/set`.
+type Pusher struct {
+	// "http" or "email"
+	Kind              string `json:"kind"`
+	AppID             string `json:"app_id"`
+	PushKey           string `json:"pushkey"`
+	AppDisplayName    string `json:"app_display_name"`
+	DeviceDisplayName string `json:"device_display_name"`
+	ProfileTag        string `json:"profile_tag,omitempty"`
+	Lang              string `json:"lang"`
+	// For HTTP pushers, the `url` of the push gateway and optionally the `format` e.g "event_id_only".
+	Data map[string]interface{} `json:"data"`
+	// If true, other pushers with the same pushkey for other users are not removed.
+	Append bool `json:"append,omitempty"`
+}
+
+// MustSetPusher creates or updates a pusher for this user, failing the test if the request fails. Use
+// pushgateway.Server.Pusher to make a pusher which sends notifications to a stub push gateway.
+func (c *CSAPI) MustSetPusher(t ct.TestLike, pusher Pusher) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "v3", "pushers", "set"}, WithJSONBody(t, pusher))
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// RateLimitPolicy controls how requests which are rate limited by the server are retried. Requests are
+// rate limited if they return HTTP 429 or the error code M_LIMIT_EXCEEDED.
+//
+// Retrying is opt-in: set CSAPI.RateLimitPolicy, or use WithRateLimitPolicy for a single request.
+// Tests which check rate limiting itself should use WithoutRateLimitRetries.
+type RateLimitPolicy struct {
+	// The maximum number of times to retry a single request. Once reached, the rate limited response is
+	// returned as-is.
+	MaxRetries int
+	// The maximum time to wait before each retry. If the server asks for a longer back-off, this is used
+	// instead.
+	MaxBackoff time.Duration
+	// The time to wait if the server does not say how long to back off for.
+	DefaultBackoff time.Duration
+}
+
+// DefaultRateLimitPolicy is a sensible RateLimitPolicy for most tests.
+var DefaultRateLimitPolicy = RateLimitPolicy{
+	MaxRetries:     5,
+	MaxBackoff:     5 * time.Second,
+	DefaultBackoff: 500 * time.Millisecond,
+}
+
+// Backoff returns how long to wait before retrying the request which returned `res` with the response
+// body `body`. Returns false if the response is not rate limited.
+//
+// The `Retry-After` header is preferred over the deprecated `retry_after_ms` field, as per
+// https://spec.matrix.org/v1.10/client-server-api/#rate-limiting
+func (p RateLimitPolicy) Backoff(res *http.Response, body []byte) (time.Duration, bool) {
+	errcode := gjson.GetBytes(body, "errcode").Str
+	if res.StatusCode != http.StatusTooManyRequests && errcode != "M_LIMIT_EXCEEDED" {
+		return 0, false
+	}
+	backoff := p.DefaultBackoff
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter != "" {
+		if secs, err := strconv.Atoi(retryAfter); err == nil {
+			backoff = time.Duration(secs) * time.Second
+		} else if at, err := http.ParseTime(retryAfter); err == nil {
+			backoff = time.Until(at)
+		}
+	} else if retryAfterMs := gjson.GetBytes(body, "retry_after_ms"); retryAfterMs.Exists() {
+		backoff = time.Duration(retryAfterMs.Int()) * time.Millisecond
+	}
+	if backoff < 0 {
+		backoff = 0
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff, true
+}
+
+// WithRateLimitPolicy retries the request according to `policy` if it is rate limited, overriding
+// CSAPI.RateLimitPolicy.
+func WithRateLimitPolicy(policy RateLimitPolicy) RequestOpt {
+	return func(req *http.Request) {
+		params := req.Context().Value(CtxKeyRateLimitPolicy).(*rateLimitParams)
+		params.policy = &policy
+		params.set = true
+	}
+}
+
+// WithoutRateLimitRetries disables retrying the request if it is rate limited, overriding
+// CSAPI.RateLimitPolicy. Use this in tests which check rate limiting behaviour.
+func WithoutRateLimitRetries() RequestOpt {
+	return func(req *http.Request) {
+		params := req.Context().Value(CtxKeyRateLimitPolicy).(*rateLimitParams)
+		params.policy = nil
+		params.set = true
+	}
+}
+
+type rateLimitParams struct {
+	// nil if rate limited requests should not be retried
+	policy *RateLimitPolicy
+	// true if a RequestOpt set the policy for this request
+	set bool
+}
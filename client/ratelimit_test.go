@@ -0,0 +1,214 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rateLimitedServer returns a server which rate limits the first `limitedRequests` requests with `status`
+// and `retryAfter` as the Retry-After header, if set. A negative `limitedRequests` rate limits every request.
+// Returns a client for the server and the number of requests it has received.
+func rateLimitedServer(t *testing.T, limitedRequests int, status int, retryAfter string, retryAfterMs int64) (*CSAPI, *atomic.Int32) {
+	t.Helper()
+	var count atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if int(count.Add(1)) > limitedRequests && limitedRequests >= 0 {
+			w.WriteHeader(200)
+			w.Write([]byte(`{}`))
+			return
+		}
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errcode":        "M_LIMIT_EXCEEDED",
+			"error":          "Too many requests",
+			"retry_after_ms": retryAfterMs,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return &CSAPI{
+		BaseURL: srv.URL,
+		Client:  srv.Client(),
+	}, &count
+}
+
+func TestRateLimitPolicyBackoff(t *testing.T) {
+	policy := RateLimitPolicy{
+		MaxRetries:     3,
+		MaxBackoff:     2 * time.Second,
+		DefaultBackoff: 100 * time.Millisecond,
+	}
+	testCases := []struct {
+		name        string
+		status      int
+		header      string
+		body        string
+		wantBackoff time.Duration
+		wantLimited bool
+	}{
+		{
+			name:        "not rate limited",
+			status:      400,
+			body:        `{"errcode":"M_BAD_JSON"}`,
+			wantLimited: false,
+		},
+		{
+			name:        "429 without a back-off uses the default",
+			status:      429,
+			body:        `{}`,
+			wantBackoff: 100 * time.Millisecond,
+			wantLimited: true,
+		},
+		{
+			name:        "M_LIMIT_EXCEEDED without 429 is rate limited",
+			status:      400,
+			body:        `{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":250}`,
+			wantBackoff: 250 * time.Millisecond,
+			wantLimited: true,
+		},
+		{
+			name:        "Retry-After is preferred over retry_after_ms",
+			status:      429,
+			header:      "1",
+			body:        `{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":250}`,
+			wantBackoff: time.Second,
+			wantLimited: true,
+		},
+		{
+			name:        "back-off is capped",
+			status:      429,
+			header:      "60",
+			body:        `{"errcode":"M_LIMIT_EXCEEDED"}`,
+			wantBackoff: 2 * time.Second,
+			wantLimited: true,
+		},
+		{
+			name:        "Retry-After in the past does not back off",
+			status:      429,
+			header:      time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat),
+			body:        `{"errcode":"M_LIMIT_EXCEEDED"}`,
+			wantBackoff: 0,
+			wantLimited: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := &http.Response{
+				StatusCode: tc.status,
+				Header:     make(http.Header),
+			}
+			if tc.header != "" {
+				res.Header.Set("Retry-After", tc.header)
+			}
+			backoff, limited := policy.Backoff(res, []byte(tc.body))
+			if limited != tc.wantLimited || backoff != tc.wantBackoff {
+				t.Errorf("Backoff: got (%v, %v), want (%v, %v)", backoff, limited, tc.wantBackoff, tc.wantLimited)
+			}
+		})
+	}
+}
+
+func TestRateLimitRetries(t *testing.T) {
+	policy := RateLimitPolicy{
+		MaxRetries:     3,
+		MaxBackoff:     50 * time.Millisecond,
+		DefaultBackoff: 10 * time.Millisecond,
+	}
+
+	t.Run("retries until the request succeeds", func(t *testing.T) {
+		c, count := rateLimitedServer(t, 2, 429, "", 30)
+		c.RateLimitPolicy = &policy
+		start := time.Now()
+		res := c.Do(t, "GET", []string{"test"})
+		elapsed := time.Since(start)
+		if res.StatusCode != 200 {
+			t.Errorf("got HTTP %d, want 200", res.StatusCode)
+		}
+		if got := count.Load(); got != 3 {
+			t.Errorf("got %d requests, want 3", got)
+		}
+		// backs off for retry_after_ms before each retry
+		if elapsed < 60*time.Millisecond {
+			t.Errorf("request took %v, want at least 60ms of back-off", elapsed)
+		}
+	})
+
+	t.Run("back-off from Retry-After is capped by MaxBackoff", func(t *testing.T) {
+		c, count := rateLimitedServer(t, 1, 429, "10", 0)
+		start := time.Now()
+		res := c.Do(t, "GET", []string{"test"}, WithRateLimitPolicy(policy))
+		elapsed := time.Since(start)
+		if res.StatusCode != 200 {
+			t.Errorf("got HTTP %d, want 200", res.StatusCode)
+		}
+		if got := count.Load(); got != 2 {
+			t.Errorf("got %d requests, want 2", got)
+		}
+		if elapsed < policy.MaxBackoff || elapsed > 5*time.Second {
+			t.Errorf("request took %v, want the back-off to be capped at %v", elapsed, policy.MaxBackoff)
+		}
+	})
+
+	t.Run("gives up after MaxRetries", func(t *testing.T) {
+		c, count := rateLimitedServer(t, -1, 429, "", 1)
+		c.RateLimitPolicy = &policy
+		res := c.Do(t, "GET", []string{"test"})
+		if res.StatusCode != 429 {
+			t.Errorf("got HTTP %d, want the rate limited response to be returned", res.StatusCode)
+		}
+		if got := count.Load(); got != int32(policy.MaxRetries+1) {
+			t.Errorf("got %d requests, want %d", got, policy.MaxRetries+1)
+		}
+	})
+
+	t.Run("retries requests with a body", func(t *testing.T) {
+		var bodies []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var body map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&body)
+			s, _ := body["msg"].(string)
+			bodies = append(bodies, s)
+			if len(bodies) == 1 {
+				w.WriteHeader(429)
+				w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":1}`))
+				return
+			}
+			w.Write([]byte(`{}`))
+		}))
+		defer srv.Close()
+		c := &CSAPI{BaseURL: srv.URL, Client: srv.Client(), RateLimitPolicy: &policy}
+		c.MustDo(t, "POST", []string{"test"}, WithJSONBody(t, map[string]interface{}{"msg": "hello"}))
+		if len(bodies) != 2 || bodies[0] != "hello" || bodies[1] != "hello" {
+			t.Errorf("got request bodies %v, want the body to be sent on each attempt", bodies)
+		}
+	})
+
+	t.Run("does not retry without a policy", func(t *testing.T) {
+		c, count := rateLimitedServer(t, 1, 429, "", 1)
+		res := c.Do(t, "GET", []string{"test"})
+		if res.StatusCode != 429 {
+			t.Errorf("got HTTP %d, want 429", res.StatusCode)
+		}
+		if got := count.Load(); got != 1 {
+			t.Errorf("got %d requests, want 1", got)
+		}
+	})
+
+	t.Run("WithoutRateLimitRetries overrides CSAPI.RateLimitPolicy", func(t *testing.T) {
+		c, count := rateLimitedServer(t, 1, 429, "", 1)
+		c.RateLimitPolicy = &policy
+		res := c.Do(t, "GET", []string{"test"}, WithoutRateLimitRetries())
+		if res.StatusCode != 429 {
+			t.Errorf("got HTTP %d, want 429", res.StatusCode)
+		}
+		if got := count.Load(); got != 1 {
+			t.Errorf("got %d requests, want 1", got)
+		}
+	})
+}
@@ -0,0 +1,388 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustSendReaction sends an m.reaction annotating `targetEventID` with `key` e.g "👍", and waits for it
+// to come down /sync. Returns the event ID of the reaction.
+func (c *CSAPI) MustSendReaction(t ct.TestLike, roomID, targetEventID, key string) string {
+	t.Helper()
+	return c.SendEventSynced(t, roomID, b.Event{
+		Type: "m.reaction",
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.annotation",
+				"event_id": targetEventID,
+				"key":      key,
+			},
+		},
+	})
+}
+
+// MustSendEdit sends an m.room.message which replaces the content of `targetEventID` with `newContent`,
+// and waits for it to come down /sync. The edit has a fallback `body` of "* " followed by the new body.
+// Returns the event ID of the edit.
+func (c *CSAPI) MustSendEdit(t ct.TestLike, roomID, targetEventID string, newContent map[string]interface{}) string {
+	t.Helper()
+	content := copyContent(newContent)
+	if body, ok := newContent["body"].(string); ok {
+		content["body"] = "* " + body
+	}
+	content["m.new_content"] = newContent
+	content["m.relates_to"] = map[string]interface{}{
+		"rel_type": "m.replace",
+		"event_id": targetEventID,
+	}
+	return c.SendEventSynced(t, roomID, b.Event{
+		Type:    "m.room.message",
+		Content: content,
+	})
+}
+
+// MustSendThreadReply sends an m.room.message with the given content into the thread rooted at
+// `threadRootID`, and waits for it to come down /sync. The reply has a fallback reply to the thread root
+// for clients which do not understand threads. Returns the event ID of the reply.
+func (c *CSAPI) MustSendThreadReply(t ct.TestLike, roomID, threadRootID string, content map[string]interface{}) string {
+	t.Helper()
+	content = copyContent(content)
+	content["m.relates_to"] = map[string]interface{}{
+		"rel_type":        "m.thread",
+		"event_id":        threadRootID,
+		"is_falling_back": true,
+		"m.in_reply_to": map[string]interface{}{
+			"event_id": threadRootID,
+		},
+	}
+	return c.SendEventSynced(t, roomID, b.Event{
+		Type:    "m.room.message",
+		Content: content,
+	})
+}
+
+// MustSendReply sends an m.room.message with the given content as a rich reply to `replyToEventID`, and
+// waits for it to come down /sync. Returns the event ID of the reply.
+func (c *CSAPI) MustSendReply(t ct.TestLike, roomID, replyToEventID string, content map[string]interface{}) string {
+	t.Helper()
+	content = copyContent(content)
+	content["m.relates_to"] = map[string]interface{}{
+		"m.in_reply_to": map[string]interface{}{
+			"event_id": replyToEventID,
+		},
+	}
+	return c.SendEventSynced(t, roomID, b.Event{
+		Type:    "m.room.message",
+		Content: content,
+	})
+}
+
+// RelationsOpts configures a RelationsIterator.
+type RelationsOpts struct {
+	// Only return relations of this type e.g "m.thread".
+	RelType string
+	// Only return events of this type e.g "m.room.message". Requires RelType.
+	EventType string
+	// The direction to paginate in: "b" (backwards) or "f" (forwards). Default: "b".
+	Dir string
+	// The token to start paginating from, e.g a `next_batch` from an earlier /relations response.
+	From string
+	// The token to stop paginating at.
+	To string
+	// The maximum number of events to request per page. If 0, the server default is used.
+	Limit int
+	// If true, also return events which relate to the related events, e.g edits of thread replies.
+	Recurse bool
+	// The maximum number of pages to fetch before failing the test. Default: 100.
+	MaxPages int
+}
+
+// RelationsPage is a single /relations response.
+type RelationsPage struct {
+	// The `from` token used to request this page.
+	From string
+	// The token for the next page. Empty if there are no more relations.
+	NextBatch string
+	PrevBatch string
+	// The recursion depth used by the server, if Recurse was set.
+	RecursionDepth int64
+	Chunk          []gjson.Result
+	// The raw response body.
+	Body gjson.Result
+}
+
+// RelationsIterator paginates /rooms/{roomID}/relations/{eventID}, following `next_batch` tokens until
+// there are no more relations.
+type RelationsIterator struct {
+	c       *CSAPI
+	roomID  string
+	eventID string
+	opts    RelationsOpts
+
+	pages     []RelationsPage
+	nextToken string
+	exhausted bool
+}
+
+// RelationsIterator returns an iterator over the events which relate to `eventID`.
+func (c *CSAPI) RelationsIterator(t ct.TestLike, roomID, eventID string, opts RelationsOpts) *RelationsIterator {
+	t.Helper()
+	if opts.Dir == "" {
+		opts.Dir = "b"
+	}
+	if opts.EventType != "" && opts.RelType == "" {
+		ct.Fatalf(t, "RelationsIterator: EventType requires RelType to be set")
+	}
+	if opts.MaxPages == 0 {
+		opts.MaxPages = 100
+	}
+	return &RelationsIterator{
+		c:         c,
+		roomID:    roomID,
+		eventID:   eventID,
+		opts:      opts,
+		nextToken: opts.From,
+	}
+}
+
+// NextPage fetches and returns the next page. Returns false if there are no more relations.
+// Fails the test if the request fails, or if more than MaxPages pages are fetched.
+func (it *RelationsIterator) NextPage(t ct.TestLike) (*RelationsPage, bool) {
+	t.Helper()
+	if it.exhausted {
+		return nil, false
+	}
+	if len(it.pages) >= it.opts.MaxPages {
+		ct.Fatalf(t, "RelationsIterator: fetched %d pages without reaching the end of the relations", len(it.pages))
+	}
+	paths := []string{"_matrix", "client", "v1", "rooms", it.roomID, "relations", it.eventID}
+	if it.opts.RelType != "" {
+		paths = append(paths, it.opts.RelType)
+		if it.opts.EventType != "" {
+			paths = append(paths, it.opts.EventType)
+		}
+	}
+	query := url.Values{
+		"dir": {it.opts.Dir},
+	}
+	if it.nextToken != "" {
+		query.Set("from", it.nextToken)
+	}
+	if it.opts.To != "" {
+		query.Set("to", it.opts.To)
+	}
+	if it.opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(it.opts.Limit))
+	}
+	if it.opts.Recurse {
+		query.Set("recurse", "true")
+	}
+	res := it.c.MustDo(t, "GET", paths, WithQueries(query))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	page := RelationsPage{
+		From:           it.nextToken,
+		NextBatch:      body.Get("next_batch").Str,
+		PrevBatch:      body.Get("prev_batch").Str,
+		RecursionDepth: body.Get("recursion_depth").Int(),
+		Chunk:          body.Get("chunk").Array(),
+		Body:           body,
+	}
+	it.pages = append(it.pages, page)
+	// empty pages may still have a next_batch, so only stop when there isn't one or it doesn't change
+	if page.NextBatch == "" || page.NextBatch == it.nextToken {
+		it.exhausted = true
+	}
+	it.nextToken = page.NextBatch
+	return &it.pages[len(it.pages)-1], true
+}
+
+// All paginates until there are no more relations and returns every event fetched, including those
+// in pages fetched before All was called.
+func (it *RelationsIterator) All(t ct.TestLike) []gjson.Result {
+	t.Helper()
+	for {
+		if _, ok := it.NextPage(t); !ok {
+			return it.Events()
+		}
+	}
+}
+
+// Exhausted returns true if there are no more relations to fetch.
+func (it *RelationsIterator) Exhausted() bool {
+	return it.exhausted
+}
+
+// Pages returns every page fetched so far.
+func (it *RelationsIterator) Pages() []RelationsPage {
+	return it.pages
+}
+
+// Events returns every event in every page fetched so far, in the order the server returned them.
+func (it *RelationsIterator) Events() []gjson.Result {
+	var events []gjson.Result
+	for _, page := range it.pages {
+		events = append(events, page.Chunk...)
+	}
+	return events
+}
+
+// EventIDs returns the event IDs of Events().
+func (it *RelationsIterator) EventIDs() []string {
+	var eventIDs []string
+	for _, ev := range it.Events() {
+		eventIDs = append(eventIDs, ev.Get("event_id").Str)
+	}
+	return eventIDs
+}
+
+// BundledAggregationCheck checks the bundled aggregations in `unsigned.m.relations` of an event, and
+// returns an error describing what is wrong, if anything.
+type BundledAggregationCheck func(event gjson.Result) error
+
+// BundledThread checks that the event is a thread root with `count` replies, the latest of which
+// is `latestEventID`.
+func BundledThread(latestEventID string, count int) BundledAggregationCheck {
+	return func(event gjson.Result) error {
+		thread := event.Get(`unsigned.m\.relations.m\.thread`)
+		if !thread.Exists() {
+			return fmt.Errorf("no m.thread aggregation in %s", event.Get("unsigned").Raw)
+		}
+		if got := thread.Get("latest_event.event_id").Str; got != latestEventID {
+			return fmt.Errorf("m.thread latest_event is %s, want %s", got, latestEventID)
+		}
+		if got := thread.Get("count").Int(); got != int64(count) {
+			return fmt.Errorf("m.thread count is %d, want %d", got, count)
+		}
+		return nil
+	}
+}
+
+// BundledThreadParticipated checks that the m.thread aggregation has `current_user_participated` set
+// to `participated`.
+func BundledThreadParticipated(participated bool) BundledAggregationCheck {
+	return func(event gjson.Result) error {
+		got := event.Get(`unsigned.m\.relations.m\.thread.current_user_participated`)
+		if !got.Exists() {
+			return fmt.Errorf("no m.thread current_user_participated in %s", event.Get("unsigned").Raw)
+		}
+		if got.Bool() != participated {
+			return fmt.Errorf("m.thread current_user_participated is %v, want %v", got.Bool(), participated)
+		}
+		return nil
+	}
+}
+
+// BundledEdit checks that the most recent edit of the event is `editEventID`.
+func BundledEdit(editEventID string) BundledAggregationCheck {
+	return func(event gjson.Result) error {
+		replace := event.Get(`unsigned.m\.relations.m\.replace`)
+		if !replace.Exists() {
+			return fmt.Errorf("no m.replace aggregation in %s", event.Get("unsigned").Raw)
+		}
+		if got := replace.Get("event_id").Str; got != editEventID {
+			return fmt.Errorf("m.replace event_id is %s, want %s", got, editEventID)
+		}
+		return nil
+	}
+}
+
+// BundledReferences checks that the event is referenced by exactly the given events, in any order.
+func BundledReferences(eventIDs ...string) BundledAggregationCheck {
+	return func(event gjson.Result) error {
+		chunk := event.Get(`unsigned.m\.relations.m\.reference.chunk`)
+		if !chunk.Exists() {
+			return fmt.Errorf("no m.reference aggregation in %s", event.Get("unsigned").Raw)
+		}
+		want := make(map[string]bool, len(eventIDs))
+		for _, eventID := range eventIDs {
+			want[eventID] = true
+		}
+		var got []string
+		for _, ref := range chunk.Array() {
+			got = append(got, ref.Get("event_id").Str)
+			delete(want, ref.Get("event_id").Str)
+		}
+		if len(want) > 0 || len(got) != len(eventIDs) {
+			return fmt.Errorf("m.reference chunk is %v, want %v", got, eventIDs)
+		}
+		return nil
+	}
+}
+
+// NoBundledAggregation checks that the event has no bundled aggregation for `relType`.
+func NoBundledAggregation(relType string) BundledAggregationCheck {
+	return func(event gjson.Result) error {
+		if agg := event.Get(`unsigned.m\.relations.` + GjsonEscape(relType)); agg.Exists() {
+			return fmt.Errorf("unexpected %s aggregation: %s", relType, agg.Raw)
+		}
+		return nil
+	}
+}
+
+// SyncTimelineHasBundledAggregations checks that the timeline for `roomID` has `eventID`, and that every
+// check passes for it.
+func SyncTimelineHasBundledAggregations(roomID, eventID string, checks ...BundledAggregationCheck) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		for _, ev := range topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".timeline.events").Array() {
+			if ev.Get("event_id").Str != eventID {
+				continue
+			}
+			if err := checkBundledAggregations(ev, checks); err != nil {
+				return fmt.Errorf("SyncTimelineHasBundledAggregations(%s): %s", eventID, err)
+			}
+			return nil
+		}
+		return fmt.Errorf("SyncTimelineHasBundledAggregations(%s): event not in timeline", eventID)
+	}
+}
+
+// MustHaveBundledAggregations checks that every check passes for `eventID` when it is returned by
+// /rooms/{roomID}/event, /rooms/{roomID}/context and /rooms/{roomID}/messages. Fails the test if any
+// check fails for any of these endpoints. For /sync, see SyncTimelineHasBundledAggregations.
+func (c *CSAPI) MustHaveBundledAggregations(t ct.TestLike, roomID, eventID string, checks ...BundledAggregationCheck) {
+	t.Helper()
+	res := c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", eventID})
+	event := gjson.ParseBytes(ParseJSON(t, res))
+	if err := checkBundledAggregations(event, checks); err != nil {
+		ct.Fatalf(t, "MustHaveBundledAggregations: /event for %s: %s", eventID, err)
+	}
+
+	res = c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "context", eventID}, WithQueries(url.Values{
+		"limit": {"0"},
+	}))
+	event = gjson.ParseBytes(ParseJSON(t, res)).Get("event")
+	if err := checkBundledAggregations(event, checks); err != nil {
+		ct.Fatalf(t, "MustHaveBundledAggregations: /context for %s: %s", eventID, err)
+	}
+
+	event = c.MessagesIterator(t, roomID, MessagesOpts{}).MustUntil(t, func(ev gjson.Result) bool {
+		return ev.Get("event_id").Str == eventID
+	})
+	if err := checkBundledAggregations(event, checks); err != nil {
+		ct.Fatalf(t, "MustHaveBundledAggregations: /messages for %s: %s", eventID, err)
+	}
+}
+
+func checkBundledAggregations(event gjson.Result, checks []BundledAggregationCheck) error {
+	for _, check := range checks {
+		if err := check(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyContent returns a shallow copy of the event content, so callers' maps are not modified.
+func copyContent(content map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(content)+2)
+	for k, v := range content {
+		copied[k] = v
+	}
+	return copied
+}
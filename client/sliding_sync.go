@@ -0,0 +1,520 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// SlidingSyncCheckOpt is a functional option for use with MustSlidingSyncUntil which should return <nil> if
+// the response satisfies the check, else return a human friendly error.
+// The result object is the entire sliding sync response from this request.
+type SlidingSyncCheckOpt func(clientUserID string, topLevelSlidingSyncJSON gjson.Result) error
+
+// SlidingSyncReq contains all the sliding sync request configuration options, as defined by
+// MSC4186 (simplified sliding sync). The empty struct `SlidingSyncReq{}` is valid and will start
+// a new sliding sync connection without any lists or room subscriptions.
+type SlidingSyncReq struct {
+	// A point in time to continue a sync from. This should be the `pos` token returned by an
+	// earlier call to this endpoint.
+	Pos string
+	// The maximum time to wait, in milliseconds, before returning this request. If no data becomes
+	// available before this time elapses, the server will return a response with empty fields.
+	// By default, this is 1000 for Complement testing.
+	TimeoutMillis string // string for easier conversion to query params
+	// Controls whether the client is automatically marked as online by polling this API.
+	// One of: [offline online unavailable].
+	SetPresence string
+	// An optional connection ID, used to distinguish multiple sliding sync connections made with
+	// the same access token.
+	ConnID string
+	// Sliding window lists, keyed by a client-chosen list name.
+	Lists map[string]SlidingSyncList
+	// Explicit room subscriptions, keyed by room ID.
+	RoomSubscriptions map[string]SlidingSyncRoomSubscription
+	// Extensions to enable for this connection. Nil means no extensions.
+	Extensions *SlidingSyncExtensions
+}
+
+// SlidingSyncRoomSubscription configures which data is returned for a room, either as part of
+// a list or as an explicit room subscription.
+type SlidingSyncRoomSubscription struct {
+	// Tuples of [event type, state key] which should be returned for each room.
+	// `*` may be used as a wildcard, and `$LAZY` / `$ME` are recognised as state keys.
+	RequiredState [][2]string `json:"required_state,omitempty"`
+	// The maximum number of timeline events to return per room.
+	TimelineLimit int `json:"timeline_limit"`
+}
+
+// SlidingSyncList is a sliding window list of rooms.
+type SlidingSyncList struct {
+	SlidingSyncRoomSubscription
+	// The ranges of rooms to return, inclusive on both ends e.g [[0, 9]] for the first 10 rooms.
+	Ranges [][2]int64 `json:"ranges,omitempty"`
+	// Filters to apply to the list, or nil to not filter.
+	Filters *SlidingSyncListFilters `json:"filters,omitempty"`
+}
+
+// SlidingSyncListFilters restricts the rooms which are included in a list.
+type SlidingSyncListFilters struct {
+	IsDM         *bool     `json:"is_dm,omitempty"`
+	IsInvite     *bool     `json:"is_invite,omitempty"`
+	IsEncrypted  *bool     `json:"is_encrypted,omitempty"`
+	RoomTypes    []*string `json:"room_types,omitempty"`
+	NotRoomTypes []*string `json:"not_room_types,omitempty"`
+	Spaces       []string  `json:"spaces,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	NotTags      []string  `json:"not_tags,omitempty"`
+}
+
+// SlidingSyncExtensions configures the sliding sync extensions. Each extension is only
+// requested if it is non-nil.
+type SlidingSyncExtensions struct {
+	ToDevice    *SlidingSyncToDeviceExtension `json:"to_device,omitempty"`
+	E2EE        *SlidingSyncExtension         `json:"e2ee,omitempty"`
+	AccountData *SlidingSyncExtension         `json:"account_data,omitempty"`
+	Receipts    *SlidingSyncExtension         `json:"receipts,omitempty"`
+	Typing      *SlidingSyncExtension         `json:"typing,omitempty"`
+}
+
+// SlidingSyncExtension is the common configuration for sliding sync extensions.
+type SlidingSyncExtension struct {
+	Enabled bool `json:"enabled"`
+	// The list names to apply this extension to. Nil means all lists.
+	Lists []string `json:"lists,omitempty"`
+	// The room IDs to apply this extension to. Nil means all room subscriptions.
+	Rooms []string `json:"rooms,omitempty"`
+}
+
+// SlidingSyncToDeviceExtension configures the to-device extension. The `Since` token is
+// advanced automatically by MustSlidingSyncUntil.
+type SlidingSyncToDeviceExtension struct {
+	Enabled bool   `json:"enabled"`
+	Since   string `json:"since,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+func (r *SlidingSyncReq) requestBody() map[string]interface{} {
+	body := map[string]interface{}{}
+	if r.ConnID != "" {
+		body["conn_id"] = r.ConnID
+	}
+	if len(r.Lists) > 0 {
+		body["lists"] = r.Lists
+	}
+	if len(r.RoomSubscriptions) > 0 {
+		body["room_subscriptions"] = r.RoomSubscriptions
+	}
+	if r.Extensions != nil {
+		body["extensions"] = r.Extensions
+	}
+	return body
+}
+
+// MustSlidingSyncUntil blocks and continually calls the sliding sync endpoint (advancing the `pos`
+// token) until all the check functions return no error. Returns the final/latest `pos` token.
+// This behaves exactly like MustSyncUntil does for /sync, so checks are unordered and independent,
+// and are removed once they have passed.
+//
+// If the to-device extension is enabled, its `since` token is advanced between requests as well.
+//
+// Example:
+//
+//	pos := alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+//	    Lists: map[string]client.SlidingSyncList{
+//	        "all": {
+//	            Ranges: [][2]int64{{0, 20}},
+//	            SlidingSyncRoomSubscription: client.SlidingSyncRoomSubscription{
+//	                RequiredState: [][2]string{{"m.room.name", ""}},
+//	                TimelineLimit: 5,
+//	            },
+//	        },
+//	    },
+//	}, client.SlidingSyncRoomName(roomID, "My Room"))
+//
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) MustSlidingSyncUntil(t ct.TestLike, req SlidingSyncReq, checks ...SlidingSyncCheckOpt) string {
+	t.Helper()
+	start := time.Now()
+	numResponsesReturned := 0
+	checkers := make([]struct {
+		check SlidingSyncCheckOpt
+		errs  []string
+	}, len(checks))
+	for i := range checks {
+		c := checkers[i]
+		c.check = checks[i]
+		checkers[i] = c
+	}
+	printErrors := func() string {
+		err := "Checkers:\n"
+		for _, c := range checkers {
+			err += strings.Join(c.errs, "\n")
+			err += ", \n"
+		}
+		return err
+	}
+	for {
+		if time.Since(start) > c.SyncUntilTimeout {
+			ct.Fatalf(t, "%s MustSlidingSyncUntil: timed out after %v. Seen %d sliding sync responses. %s", c.UserID, time.Since(start), numResponsesReturned, printErrors())
+		}
+		response, pos := c.MustSlidingSync(t, req)
+		req.Pos = pos
+		if req.Extensions != nil && req.Extensions.ToDevice != nil {
+			if nextBatch := response.Get("extensions.to_device.next_batch"); nextBatch.Exists() {
+				toDevice := *req.Extensions.ToDevice
+				toDevice.Since = nextBatch.Str
+				extensions := *req.Extensions
+				extensions.ToDevice = &toDevice
+				req.Extensions = &extensions
+			}
+		}
+		numResponsesReturned += 1
+
+		for i := 0; i < len(checkers); i++ {
+			err := checkers[i].check(c.UserID, response)
+			if err == nil {
+				// check passed, removed from checkers
+				checkers = append(checkers[:i], checkers[i+1:]...)
+				i--
+			} else {
+				c := checkers[i]
+				c.errs = append(c.errs, fmt.Sprintf("[t=%v] Response #%d: %s", time.Since(start), numResponsesReturned, err))
+				checkers[i] = c
+			}
+		}
+		if len(checkers) == 0 {
+			// every checker has passed!
+			return req.Pos
+		}
+	}
+}
+
+// MustSlidingSync performs a single sliding sync request with the given request options. To sync
+// until something happens, see `MustSlidingSyncUntil`.
+//
+// Fails the test if the request does not return 200 OK.
+// Returns the top-level parsed response JSON as well as the `pos` token from the response.
+func (c *CSAPI) MustSlidingSync(t ct.TestLike, req SlidingSyncReq) (gjson.Result, string) {
+	t.Helper()
+	jsonBody, res := c.SlidingSync(t, req)
+	mustRespond2xx(t, res)
+	return jsonBody, jsonBody.Get("pos").Str
+}
+
+// SlidingSync performs a single sliding sync request with the given request options. To sync
+// until something happens, see `MustSlidingSyncUntil`.
+//
+// Always returns the HTTP response, even on non-2xx.
+// Returns the top-level parsed response JSON on 2xx.
+func (c *CSAPI) SlidingSync(t ct.TestLike, req SlidingSyncReq) (gjson.Result, *http.Response) {
+	t.Helper()
+	query := url.Values{
+		"timeout": []string{"1000"},
+	}
+	if req.TimeoutMillis != "" {
+		query["timeout"] = []string{req.TimeoutMillis}
+	}
+	if req.Pos != "" {
+		query["pos"] = []string{req.Pos}
+	}
+	if req.SetPresence != "" {
+		query["set_presence"] = []string{req.SetPresence}
+	}
+	res := c.Do(
+		t, "POST", []string{"_matrix", "client", "unstable", "org.matrix.simplified_msc3575", "sync"},
+		WithQueries(query), WithJSONBody(t, req.requestBody()),
+	)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return gjson.Result{}, res
+	}
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body), res
+}
+
+func slidingSyncRoomPath(roomID string) string {
+	return "rooms." + GjsonEscape(roomID)
+}
+
+// SlidingSyncListCount checks that the list `listKey` has the given total number of rooms.
+func SlidingSyncListCount(listKey string, count int64) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		got := res.Get("lists." + GjsonEscape(listKey) + ".count")
+		if !got.Exists() {
+			return fmt.Errorf("SlidingSyncListCount(%s): list has no count: %s", listKey, res.Get("lists").Raw)
+		}
+		if got.Int() != count {
+			return fmt.Errorf("SlidingSyncListCount(%s): got count %d, want %d", listKey, got.Int(), count)
+		}
+		return nil
+	}
+}
+
+// SlidingSyncHasRoom checks that the response includes `roomID` in `rooms`. Lists only return their `count`,
+// so this is how to check a room is in a list's ranges.
+func SlidingSyncHasRoom(roomID string) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		if !res.Get(slidingSyncRoomPath(roomID)).Exists() {
+			return fmt.Errorf("SlidingSyncHasRoom: room %s not found in rooms: %v", roomID, slidingSyncRoomIDs(res))
+		}
+		return nil
+	}
+}
+
+// SlidingSyncRooms checks that the response includes exactly the given rooms in `rooms`, in any order. This is
+// useful for checking which rooms a list's ranges select.
+func SlidingSyncRooms(roomIDs []string) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		got := slidingSyncRoomIDs(res)
+		want := append([]string(nil), roomIDs...)
+		sort.Strings(want)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			return fmt.Errorf("SlidingSyncRooms: got rooms %v, want %v", got, want)
+		}
+		return nil
+	}
+}
+
+// SlidingSyncRoomsOrderedByRecency checks that the rooms are all in the response, and that their `bump_stamp`s
+// are in descending order i.e the first room is the most recently active.
+func SlidingSyncRoomsOrderedByRecency(roomIDs []string) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		var prevStamp int64
+		for i, roomID := range roomIDs {
+			stamp := res.Get(slidingSyncRoomPath(roomID) + ".bump_stamp")
+			if !stamp.Exists() {
+				return fmt.Errorf("SlidingSyncRoomsOrderedByRecency: room %s has no bump_stamp", roomID)
+			}
+			if i > 0 && stamp.Int() >= prevStamp {
+				return fmt.Errorf("SlidingSyncRoomsOrderedByRecency: room %s has bump_stamp %d, want less than %d of room %s",
+					roomID, stamp.Int(), prevStamp, roomIDs[i-1])
+			}
+			prevStamp = stamp.Int()
+		}
+		return nil
+	}
+}
+
+// slidingSyncRoomIDs returns the sorted room IDs in `rooms`.
+func slidingSyncRoomIDs(res gjson.Result) []string {
+	roomIDs := []string{}
+	res.Get("rooms").ForEach(func(key, _ gjson.Result) bool {
+		roomIDs = append(roomIDs, key.Str)
+		return true
+	})
+	sort.Strings(roomIDs)
+	return roomIDs
+}
+
+// SlidingSyncRoomName checks that the calculated room name for `roomID` is `name`.
+func SlidingSyncRoomName(roomID, name string) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		got := res.Get(slidingSyncRoomPath(roomID) + ".name")
+		if !got.Exists() {
+			return fmt.Errorf("SlidingSyncRoomName(%s): room has no name field", roomID)
+		}
+		if got.Str != name {
+			return fmt.Errorf("SlidingSyncRoomName(%s): got %q, want %q", roomID, got.Str, name)
+		}
+		return nil
+	}
+}
+
+// SlidingSyncRoomAvatar checks that the room avatar for `roomID` is `avatarURL`.
+func SlidingSyncRoomAvatar(roomID, avatarURL string) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		got := res.Get(slidingSyncRoomPath(roomID) + ".avatar")
+		if !got.Exists() {
+			return fmt.Errorf("SlidingSyncRoomAvatar(%s): room has no avatar field", roomID)
+		}
+		if got.Str != avatarURL {
+			return fmt.Errorf("SlidingSyncRoomAvatar(%s): got %q, want %q", roomID, got.Str, avatarURL)
+		}
+		return nil
+	}
+}
+
+// SlidingSyncRoomHeroes checks that the heroes for `roomID` are exactly `userIDs`, in any order.
+func SlidingSyncRoomHeroes(roomID string, userIDs []string) SlidingSyncCheckOpt {
+	// don't sort the input slice the test gave us.
+	want := make([]string, len(userIDs))
+	copy(want, userIDs)
+	sort.Strings(want)
+	return func(clientUserID string, res gjson.Result) error {
+		heroes := res.Get(slidingSyncRoomPath(roomID) + ".heroes")
+		if !heroes.Exists() {
+			return fmt.Errorf("SlidingSyncRoomHeroes(%s): room has no heroes field", roomID)
+		}
+		var got []string
+		for _, h := range heroes.Array() {
+			got = append(got, h.Get("user_id").Str)
+		}
+		sort.Strings(got)
+		if len(got) == 0 && len(want) == 0 {
+			return nil
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("SlidingSyncRoomHeroes(%s): got %v, want %v", roomID, got, want)
+		}
+		return nil
+	}
+}
+
+// SlidingSyncRoomNotificationCount checks the notification and highlight counts for `roomID`.
+func SlidingSyncRoomNotificationCount(roomID string, notificationCount, highlightCount int64) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		room := res.Get(slidingSyncRoomPath(roomID))
+		if !room.Exists() {
+			return fmt.Errorf("SlidingSyncRoomNotificationCount(%s): room not in response", roomID)
+		}
+		gotNotif := room.Get("notification_count").Int()
+		gotHighlight := room.Get("highlight_count").Int()
+		if gotNotif != notificationCount || gotHighlight != highlightCount {
+			return fmt.Errorf(
+				"SlidingSyncRoomNotificationCount(%s): got notification_count=%d highlight_count=%d, want %d and %d",
+				roomID, gotNotif, gotHighlight, notificationCount, highlightCount,
+			)
+		}
+		return nil
+	}
+}
+
+// SlidingSyncRoomTimelineHas checks that the timeline for `roomID` has an event which passes the check function.
+func SlidingSyncRoomTimelineHas(roomID string, check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		err := checkArrayElements(res, slidingSyncRoomPath(roomID)+".timeline", check)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncRoomTimelineHas(%s): %s", roomID, err)
+	}
+}
+
+// SlidingSyncRoomRequiredStateHas checks that the required state for `roomID` has an event which
+// passes the check function.
+func SlidingSyncRoomRequiredStateHas(roomID string, check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		err := checkArrayElements(res, slidingSyncRoomPath(roomID)+".required_state", check)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncRoomRequiredStateHas(%s): %s", roomID, err)
+	}
+}
+
+// SlidingSyncToDeviceHas checks that the to-device extension has a message which passes the check
+// function. If fromUser is non-empty, only messages from that user are passed to the check function.
+func SlidingSyncToDeviceHas(fromUser string, check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		err := checkArrayElements(res, "extensions.to_device.events", func(ev gjson.Result) bool {
+			if fromUser != "" && ev.Get("sender").Str != fromUser {
+				return false
+			}
+			return check(ev)
+		})
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncToDeviceHas(%v): %s", fromUser, err)
+	}
+}
+
+// SlidingSyncDeviceListChanged checks that the e2ee extension lists `userID` as having changed devices.
+func SlidingSyncDeviceListChanged(userID string) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		err := checkArrayElements(res, "extensions.e2ee.device_lists.changed", func(r gjson.Result) bool {
+			return r.Str == userID
+		})
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncDeviceListChanged(%s): %s", userID, err)
+	}
+}
+
+// SlidingSyncOneTimeKeyCount checks that the e2ee extension reports `count` one-time keys for `algorithm`.
+func SlidingSyncOneTimeKeyCount(algorithm string, count int64) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		got := res.Get("extensions.e2ee.device_one_time_keys_count." + GjsonEscape(algorithm))
+		if !got.Exists() {
+			return fmt.Errorf("SlidingSyncOneTimeKeyCount(%s): missing from %s", algorithm, res.Get("extensions.e2ee").Raw)
+		}
+		if got.Int() != count {
+			return fmt.Errorf("SlidingSyncOneTimeKeyCount(%s): got %d, want %d", algorithm, got.Int(), count)
+		}
+		return nil
+	}
+}
+
+// SlidingSyncGlobalAccountDataHas checks that the account_data extension has a global account
+// data event which passes the check function.
+func SlidingSyncGlobalAccountDataHas(check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		err := checkArrayElements(res, "extensions.account_data.global", check)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncGlobalAccountDataHas: %s", err)
+	}
+}
+
+// SlidingSyncRoomAccountDataHas checks that the account_data extension has a room account data
+// event for `roomID` which passes the check function.
+func SlidingSyncRoomAccountDataHas(roomID string, check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		err := checkArrayElements(res, "extensions.account_data.rooms."+GjsonEscape(roomID), check)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncRoomAccountDataHas(%s): %s", roomID, err)
+	}
+}
+
+// SlidingSyncReceiptsHas checks that the receipts extension has an `m.receipt` EDU for `roomID`
+// which passes the check function.
+func SlidingSyncReceiptsHas(roomID string, check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res gjson.Result) error {
+		edu := res.Get("extensions.receipts.rooms." + GjsonEscape(roomID))
+		if !edu.Exists() {
+			return fmt.Errorf("SlidingSyncReceiptsHas(%s): no receipts for room in %s", roomID, res.Get("extensions.receipts").Raw)
+		}
+		if !check(edu) {
+			return fmt.Errorf("SlidingSyncReceiptsHas(%s): check function did not pass for %s", roomID, edu.Raw)
+		}
+		return nil
+	}
+}
+
+// SlidingSyncUsersTyping checks that the typing extension reports exactly `userIDs` as typing in `roomID`.
+func SlidingSyncUsersTyping(roomID string, userIDs []string) SlidingSyncCheckOpt {
+	// don't sort the input slice the test gave us.
+	want := make([]string, len(userIDs))
+	copy(want, userIDs)
+	sort.Strings(want)
+	return func(clientUserID string, res gjson.Result) error {
+		edu := res.Get("extensions.typing.rooms." + GjsonEscape(roomID))
+		if !edu.Exists() {
+			return fmt.Errorf("SlidingSyncUsersTyping(%s): no typing for room in %s", roomID, res.Get("extensions.typing").Raw)
+		}
+		var got []string
+		for _, u := range edu.Get("content.user_ids").Array() {
+			got = append(got, u.Str)
+		}
+		sort.Strings(got)
+		if len(got) == 0 && len(want) == 0 {
+			return nil
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("SlidingSyncUsersTyping(%s): got %v, want %v", roomID, got, want)
+		}
+		return nil
+	}
+}
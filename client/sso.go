@@ -0,0 +1,171 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// SSOAuthenticator completes the identity provider part of an SSO login. It is given the login page
+// served by the identity provider and must return the response which sends the browser back to the
+// homeserver, e.g by submitting the login form.
+type SSOAuthenticator func(t ct.TestLike, httpClient *http.Client, loginPage *http.Response) *http.Response
+
+// SSOLoginOpts configures how to follow an `m.login.sso` redirect flow.
+type SSOLoginOpts struct {
+	// The HTTP client used to act as the browser. It must have a cookie jar and must not follow
+	// redirects. Required.
+	HTTPClient *http.Client
+	// URLs starting with this prefix are requested as-is. All other URLs, apart from RedirectURL, are
+	// assumed to be on the homeserver and are sent to CSAPI.BaseURL, as the homeserver's public base
+	// URL is usually only resolvable inside the deployment network. Required.
+	IdPBaseURL string
+	// Completes the login at the identity provider. Required.
+	Authenticate SSOAuthenticator
+	// The identity provider ID to use with /login/sso/redirect/{idpId}. If empty, the homeserver's
+	// default identity provider is used.
+	IdPID string
+	// The client URL the homeserver redirects to with a `loginToken`. This must be allowed by the
+	// homeserver without a confirmation page. Default: http://localhost/complement/sso
+	RedirectURL string
+}
+
+// MustGetLoginTokenViaSSO starts an SSO login at /login/sso/redirect, completes it at the identity
+// provider and returns the `loginToken` the homeserver redirects back to the client with. Fails the
+// test if the flow does not end at RedirectURL with a `loginToken`.
+func (c *CSAPI) MustGetLoginTokenViaSSO(t ct.TestLike, opts SSOLoginOpts) string {
+	t.Helper()
+	if opts.HTTPClient == nil || opts.IdPBaseURL == "" || opts.Authenticate == nil {
+		ct.Fatalf(t, "MustGetLoginTokenViaSSO: SSOLoginOpts.HTTPClient, IdPBaseURL and Authenticate must be set")
+	}
+	if opts.RedirectURL == "" {
+		opts.RedirectURL = "http://localhost/complement/sso"
+	}
+	startURL := c.BaseURL + "/_matrix/client/v3/login/sso/redirect"
+	if opts.IdPID != "" {
+		startURL += "/" + url.PathEscape(opts.IdPID)
+	}
+	start, err := url.Parse(startURL)
+	if err != nil {
+		ct.Fatalf(t, "MustGetLoginTokenViaSSO: failed to parse URL: %s", err)
+	}
+	start.RawQuery = url.Values{"redirectUrl": {opts.RedirectURL}}.Encode()
+
+	hsURL, err := url.Parse(c.BaseURL)
+	if err != nil {
+		ct.Fatalf(t, "MustGetLoginTokenViaSSO: failed to parse BaseURL: %s", err)
+	}
+	get := func(u *url.URL) *http.Response {
+		t.Helper()
+		if !strings.HasPrefix(u.String(), opts.IdPBaseURL) {
+			rewritten := *u
+			rewritten.Scheme = hsURL.Scheme
+			rewritten.Host = hsURL.Host
+			u = &rewritten
+		}
+		res, err := opts.HTTPClient.Get(u.String())
+		if err != nil {
+			ct.Fatalf(t, "MustGetLoginTokenViaSSO: GET %s failed: %s", u.String(), err)
+		}
+		return res
+	}
+
+	res := get(start)
+	authenticated := false
+	for hops := 0; ; hops++ {
+		if hops > 20 {
+			ct.Fatalf(t, "MustGetLoginTokenViaSSO: too many redirects, last URL %s", res.Request.URL.String())
+		}
+		if res.StatusCode >= 300 && res.StatusCode < 400 {
+			res.Body.Close()
+			location, err := res.Location()
+			if err != nil {
+				ct.Fatalf(t, "MustGetLoginTokenViaSSO: %s returned %s without a Location: %s", res.Request.URL.String(), res.Status, err)
+			}
+			if strings.HasPrefix(location.String(), opts.RedirectURL) {
+				loginToken := location.Query().Get("loginToken")
+				if loginToken == "" {
+					ct.Fatalf(t, "MustGetLoginTokenViaSSO: redirected to %s without a loginToken", location.String())
+				}
+				return loginToken
+			}
+			res = get(location)
+			continue
+		}
+		if !authenticated && strings.HasPrefix(res.Request.URL.String(), opts.IdPBaseURL) {
+			authenticated = true
+			res = opts.Authenticate(t, opts.HTTPClient, res)
+			continue
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		ct.Fatalf(t, "MustGetLoginTokenViaSSO: SSO flow stopped at %s with %s: %s", res.Request.URL.String(), res.Status, string(body))
+	}
+}
+
+// MustLoginViaSSO logs in via SSO and returns the new session. It is the same as calling
+// MustGetLoginTokenViaSSO then MustLoginWithToken.
+func (c *CSAPI) MustLoginViaSSO(t ct.TestLike, opts SSOLoginOpts, loginOpts ...LoginOpt) (userID, accessToken, deviceID string) {
+	t.Helper()
+	loginToken := c.MustGetLoginTokenViaSSO(t, opts)
+	return c.MustLoginWithToken(t, loginToken, loginOpts...)
+}
+
+// LoginWithToken makes a /login request of type `m.login.token` with the given login token and
+// returns the response.
+func (c *CSAPI) LoginWithToken(t ct.TestLike, loginToken string, opts ...LoginOpt) *http.Response {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"type":  "m.login.token",
+		"token": loginToken,
+	}
+	for _, opt := range opts {
+		opt(reqBody)
+	}
+	return c.Do(t, "POST", []string{"_matrix", "client", "v3", "login"}, WithJSONBody(t, reqBody))
+}
+
+// MustLoginWithToken logs in with an `m.login.token` login token and creates a new device. Fails the
+// test if the login is unsuccessful.
+func (c *CSAPI) MustLoginWithToken(t ct.TestLike, loginToken string, opts ...LoginOpt) (userID, accessToken, deviceID string) {
+	t.Helper()
+	res := c.LoginWithToken(t, loginToken, opts...)
+	mustRespond2xx(t, res)
+	body := ParseJSON(t, res)
+	userID = GetJSONFieldStr(t, body, "user_id")
+	accessToken = GetJSONFieldStr(t, body, "access_token")
+	deviceID = GetJSONFieldStr(t, body, "device_id")
+	return userID, accessToken, deviceID
+}
+
+// GenerateLoginToken requests a login token for this user from /login/get_token (MSC3882), which
+// can be used by another device to log in with `m.login.token`. User-interactive auth is completed
+// as with DoWithUIA. Falls back to the unstable MSC3882 endpoint if the stable one is not supported.
+func (c *CSAPI) GenerateLoginToken(t ct.TestLike, stages ...UIAStage) *http.Response {
+	t.Helper()
+	res, _ := c.DoWithUIA(t, "POST", []string{"_matrix", "client", "v1", "login", "get_token"}, nil, stages...)
+	if res.StatusCode != 404 && res.StatusCode != 405 {
+		return res
+	}
+	res.Body.Close()
+	res, _ = c.DoWithUIA(t, "POST", []string{"_matrix", "client", "unstable", "org.matrix.msc3882", "login", "token"}, nil, stages...)
+	return res
+}
+
+// MustGenerateLoginToken is the same as GenerateLoginToken but fails the test if a login token is not
+// returned. Returns the login token and how long it is valid for.
+func (c *CSAPI) MustGenerateLoginToken(t ct.TestLike, stages ...UIAStage) (loginToken string, expiresIn time.Duration) {
+	t.Helper()
+	res := c.GenerateLoginToken(t, stages...)
+	mustRespond2xx(t, res)
+	body := ParseJSON(t, res)
+	loginToken = GetJSONFieldStr(t, body, "login_token")
+	expiresIn = time.Duration(gjson.GetBytes(body, "expires_in_ms").Int()) * time.Millisecond
+	return loginToken, expiresIn
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -51,6 +52,30 @@ type SyncReq struct {
 	TimeoutMillis string // string for easier conversion to query params
 }
 
+// queryParams converts the SyncReq into /sync query parameters.
+func (syncReq SyncReq) queryParams() url.Values {
+	query := url.Values{
+		"timeout": []string{"1000"},
+	}
+	// configure the HTTP request based on SyncReq
+	if syncReq.TimeoutMillis != "" {
+		query["timeout"] = []string{syncReq.TimeoutMillis}
+	}
+	if syncReq.Since != "" {
+		query["since"] = []string{syncReq.Since}
+	}
+	if syncReq.Filter != "" {
+		query["filter"] = []string{syncReq.Filter}
+	}
+	if syncReq.FullState {
+		query["full_state"] = []string{"true"}
+	}
+	if syncReq.SetPresence != "" {
+		query["set_presence"] = []string{syncReq.SetPresence}
+	}
+	return query
+}
+
 // MustSyncUntil blocks and continually calls /sync (advancing the since token) until all the
 // check functions return no error. Returns the final/latest since token.
 //
@@ -90,6 +115,14 @@ type SyncReq struct {
 // Will time out after CSAPI.SyncUntilTimeout. Returns the `next_batch` token from the final
 // response.
 func (c *CSAPI) MustSyncUntil(t ct.TestLike, syncReq SyncReq, checks ...SyncCheckOpt) string {
+	t.Helper()
+	return c.MustSyncUntilCtx(context.Background(), t, syncReq, checks...)
+}
+
+// MustSyncUntilCtx is the same as MustSyncUntil but each /sync request is made with the given context.
+// If the context is cancelled, including part way through a long-poll, the test fails with the errors
+// returned by the checkers so far.
+func (c *CSAPI) MustSyncUntilCtx(ctx context.Context, t ct.TestLike, syncReq SyncReq, checks ...SyncCheckOpt) string {
 	t.Helper()
 	start := time.Now()
 	numResponsesReturned := 0
@@ -114,7 +147,10 @@ func (c *CSAPI) MustSyncUntil(t ct.TestLike, syncReq SyncReq, checks ...SyncChec
 		if time.Since(start) > c.SyncUntilTimeout {
 			ct.Fatalf(t, "%s MustSyncUntil: timed out after %v. Seen %d /sync responses. %s", c.UserID, time.Since(start), numResponsesReturned, printErrors())
 		}
-		response, nextBatch := c.MustSync(t, syncReq)
+		if ctx.Err() != nil {
+			ct.Fatalf(t, "%s MustSyncUntil: cancelled after %v: %s. Seen %d /sync responses. %s", c.UserID, time.Since(start), context.Cause(ctx), numResponsesReturned, printErrors())
+		}
+		response, nextBatch := c.MustSyncCtx(ctx, t, syncReq)
 		syncReq.Since = nextBatch
 		numResponsesReturned += 1
 
@@ -144,7 +180,14 @@ func (c *CSAPI) MustSyncUntil(t ct.TestLike, syncReq SyncReq, checks ...SyncChec
 // Returns the top-level parsed /sync response JSON as well as the next_batch token from the response.
 func (c *CSAPI) MustSync(t ct.TestLike, syncReq SyncReq) (gjson.Result, string) {
 	t.Helper()
-	jsonBody, res := c.Sync(t, syncReq)
+	return c.MustSyncCtx(context.Background(), t, syncReq)
+}
+
+// MustSyncCtx is the same as MustSync but the /sync request is made with the given context.
+// Fails the test if the context is cancelled before a response is returned.
+func (c *CSAPI) MustSyncCtx(ctx context.Context, t ct.TestLike, syncReq SyncReq) (gjson.Result, string) {
+	t.Helper()
+	jsonBody, res := c.SyncCtx(ctx, t, syncReq)
 	mustRespond2xx(t, res)
 	return jsonBody, jsonBody.Get("next_batch").Str
 }
@@ -156,26 +199,14 @@ func (c *CSAPI) MustSync(t ct.TestLike, syncReq SyncReq) (gjson.Result, string)
 // Returns the top-level parsed /sync response JSON on 2xx.
 func (c *CSAPI) Sync(t ct.TestLike, syncReq SyncReq) (gjson.Result, *http.Response) {
 	t.Helper()
-	query := url.Values{
-		"timeout": []string{"1000"},
-	}
-	// configure the HTTP request based on SyncReq
-	if syncReq.TimeoutMillis != "" {
-		query["timeout"] = []string{syncReq.TimeoutMillis}
-	}
-	if syncReq.Since != "" {
-		query["since"] = []string{syncReq.Since}
-	}
-	if syncReq.Filter != "" {
-		query["filter"] = []string{syncReq.Filter}
-	}
-	if syncReq.FullState {
-		query["full_state"] = []string{"true"}
-	}
-	if syncReq.SetPresence != "" {
-		query["set_presence"] = []string{syncReq.SetPresence}
-	}
-	res := c.Do(t, "GET", []string{"_matrix", "client", "v3", "sync"}, WithQueries(query))
+	return c.SyncCtx(context.Background(), t, syncReq)
+}
+
+// SyncCtx is the same as Sync but the /sync request is made with the given context.
+// Fails the test if the context is cancelled before a response is returned.
+func (c *CSAPI) SyncCtx(ctx context.Context, t ct.TestLike, syncReq SyncReq) (gjson.Result, *http.Response) {
+	t.Helper()
+	res := c.DoCtx(ctx, t, "GET", []string{"_matrix", "client", "v3", "sync"}, WithQueries(syncReq.queryParams()))
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		return gjson.Result{}, res
 	}
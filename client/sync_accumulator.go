@@ -0,0 +1,341 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// SyncAccumulator consumes successive /sync responses into a model of the client's view of the world,
+// in the same way a real client would. This makes it possible to assert on derived state such as the
+// current room name or member list after several incremental syncs, rather than on a single response.
+//
+// Example:
+//
+//	acc := client.NewSyncAccumulator(alice.UserID)
+//	alice.MustSyncAccumulate(t, acc, client.SyncReq{})
+//	// ... do things ...
+//	alice.MustSyncAccumulateUntil(t, acc, client.SyncReq{}, func(acc *client.SyncAccumulator) error {
+//	    if acc.Room(roomID).Name() != "new name" {
+//	        return fmt.Errorf("room name not updated")
+//	    }
+//	    return nil
+//	})
+//	alice.MustMatchAccumulatedState(t, acc, roomID)
+type SyncAccumulator struct {
+	// The user ID of the client making the /sync requests.
+	UserID string
+	// The next_batch token from the most recent response.
+	NextBatch string
+	// All rooms the user is or has been in, keyed by room ID.
+	Rooms map[string]*AccumulatedRoom
+	// Global account data, keyed by event type. The value is the entire event.
+	AccountData map[string]gjson.Result
+	// The number of responses accumulated so far.
+	NumResponses int
+}
+
+// AccumulatedRoom is the accumulated client view of a single room.
+type AccumulatedRoom struct {
+	RoomID string
+	// One of join, invite, leave or knock.
+	Membership string
+	// Current room state as seen by the client: event type -> state key -> event.
+	State map[string]map[string]gjson.Result
+	// Stripped state for invited or knocked rooms: event type -> state key -> event.
+	StrippedState map[string]map[string]gjson.Result
+	// The timeline events received since the last gap. A limited timeline clears this.
+	Timeline []gjson.Result
+	// The number of times a limited timeline was received for this room.
+	NumGaps int
+	// The prev_batch token from the most recent timeline.
+	PrevBatch string
+	// The latest ephemeral event for each event type, other than receipts which are merged into Receipts.
+	Ephemeral map[string]gjson.Result
+	// Merged read receipts: receipt type -> user ID -> event ID.
+	Receipts map[string]map[string]string
+	// Room account data, keyed by event type. The value is the entire event.
+	AccountData map[string]gjson.Result
+	// The most recent unread counts for this room.
+	NotificationCount int64
+	HighlightCount    int64
+	// The most recent room summary fields.
+	Heroes             []string
+	JoinedMemberCount  int64
+	InvitedMemberCount int64
+}
+
+// NewSyncAccumulator creates a new empty accumulator for the given user.
+func NewSyncAccumulator(userID string) *SyncAccumulator {
+	return &SyncAccumulator{
+		UserID:      userID,
+		Rooms:       make(map[string]*AccumulatedRoom),
+		AccountData: make(map[string]gjson.Result),
+	}
+}
+
+// Room returns the accumulated room with the given ID, creating an empty one if it has not been seen.
+func (a *SyncAccumulator) Room(roomID string) *AccumulatedRoom {
+	room, ok := a.Rooms[roomID]
+	if !ok {
+		room = &AccumulatedRoom{
+			RoomID:        roomID,
+			State:         make(map[string]map[string]gjson.Result),
+			StrippedState: make(map[string]map[string]gjson.Result),
+			Ephemeral:     make(map[string]gjson.Result),
+			Receipts:      make(map[string]map[string]string),
+			AccountData:   make(map[string]gjson.Result),
+		}
+		a.Rooms[roomID] = room
+	}
+	return room
+}
+
+// Accumulate consumes a single /sync response. `fullState` should be true if the request was made
+// with `full_state=true` or without a since token, in which case room state is replaced rather than merged.
+func (a *SyncAccumulator) Accumulate(topLevelSyncJSON gjson.Result, fullState bool) {
+	a.NumResponses++
+	a.NextBatch = topLevelSyncJSON.Get("next_batch").Str
+	for _, ev := range topLevelSyncJSON.Get("account_data.events").Array() {
+		a.AccountData[ev.Get("type").Str] = ev
+	}
+	topLevelSyncJSON.Get("rooms.join").ForEach(func(roomID, roomJSON gjson.Result) bool {
+		a.Room(roomID.Str).accumulateRoom("join", roomJSON, fullState)
+		return true
+	})
+	topLevelSyncJSON.Get("rooms.leave").ForEach(func(roomID, roomJSON gjson.Result) bool {
+		a.Room(roomID.Str).accumulateRoom("leave", roomJSON, fullState)
+		return true
+	})
+	topLevelSyncJSON.Get("rooms.invite").ForEach(func(roomID, roomJSON gjson.Result) bool {
+		a.Room(roomID.Str).accumulateStripped("invite", roomJSON.Get("invite_state.events"))
+		return true
+	})
+	topLevelSyncJSON.Get("rooms.knock").ForEach(func(roomID, roomJSON gjson.Result) bool {
+		a.Room(roomID.Str).accumulateStripped("knock", roomJSON.Get("knock_state.events"))
+		return true
+	})
+}
+
+func (r *AccumulatedRoom) accumulateStripped(membership string, events gjson.Result) {
+	r.Membership = membership
+	r.StrippedState = make(map[string]map[string]gjson.Result)
+	for _, ev := range events.Array() {
+		setStateEvent(r.StrippedState, ev)
+	}
+}
+
+func (r *AccumulatedRoom) accumulateRoom(membership string, roomJSON gjson.Result, fullState bool) {
+	// When (re)joining a room the server sends the complete state, so anything we had is stale.
+	joined := r.Membership != "join" && membership == "join"
+	r.Membership = membership
+	// any stripped state is superseded by real state once we are in the room
+	r.StrippedState = make(map[string]map[string]gjson.Result)
+	if fullState || joined {
+		r.State = make(map[string]map[string]gjson.Result)
+	}
+	// The state block is the state up to the start of the timeline, so apply it first.
+	for _, ev := range roomJSON.Get("state.events").Array() {
+		setStateEvent(r.State, ev)
+	}
+	timeline := roomJSON.Get("timeline")
+	if timeline.Exists() {
+		if timeline.Get("limited").Bool() {
+			r.Timeline = nil
+			r.NumGaps++
+		}
+		if prevBatch := timeline.Get("prev_batch"); prevBatch.Exists() {
+			r.PrevBatch = prevBatch.Str
+		}
+		for _, ev := range timeline.Get("events").Array() {
+			r.Timeline = append(r.Timeline, ev)
+			if ev.Get("state_key").Exists() {
+				setStateEvent(r.State, ev)
+			}
+		}
+	}
+	for _, ev := range roomJSON.Get("ephemeral.events").Array() {
+		evType := ev.Get("type").Str
+		if evType == "m.receipt" {
+			r.accumulateReceipts(ev)
+			continue
+		}
+		r.Ephemeral[evType] = ev
+	}
+	for _, ev := range roomJSON.Get("account_data.events").Array() {
+		r.AccountData[ev.Get("type").Str] = ev
+	}
+	if n := roomJSON.Get("unread_notifications.notification_count"); n.Exists() {
+		r.NotificationCount = n.Int()
+	}
+	if n := roomJSON.Get("unread_notifications.highlight_count"); n.Exists() {
+		r.HighlightCount = n.Int()
+	}
+	summary := roomJSON.Get("summary")
+	if heroes := summary.Get(GjsonEscape("m.heroes")); heroes.Exists() {
+		r.Heroes = nil
+		for _, h := range heroes.Array() {
+			r.Heroes = append(r.Heroes, h.Str)
+		}
+	}
+	if n := summary.Get(GjsonEscape("m.joined_member_count")); n.Exists() {
+		r.JoinedMemberCount = n.Int()
+	}
+	if n := summary.Get(GjsonEscape("m.invited_member_count")); n.Exists() {
+		r.InvitedMemberCount = n.Int()
+	}
+}
+
+func (r *AccumulatedRoom) accumulateReceipts(ev gjson.Result) {
+	// content is { event_id: { receipt_type: { user_id: { ts: ... } } } }
+	ev.Get("content").ForEach(func(eventID, receiptTypes gjson.Result) bool {
+		receiptTypes.ForEach(func(receiptType, users gjson.Result) bool {
+			byUser, ok := r.Receipts[receiptType.Str]
+			if !ok {
+				byUser = make(map[string]string)
+				r.Receipts[receiptType.Str] = byUser
+			}
+			users.ForEach(func(userID, _ gjson.Result) bool {
+				byUser[userID.Str] = eventID.Str
+				return true
+			})
+			return true
+		})
+		return true
+	})
+}
+
+func setStateEvent(state map[string]map[string]gjson.Result, ev gjson.Result) {
+	evType := ev.Get("type").Str
+	byStateKey, ok := state[evType]
+	if !ok {
+		byStateKey = make(map[string]gjson.Result)
+		state[evType] = byStateKey
+	}
+	byStateKey[ev.Get("state_key").Str] = ev
+}
+
+// CurrentState returns the current state event for the given type and state key. The result
+// will not exist if the client has not seen this state event.
+func (r *AccumulatedRoom) CurrentState(evType, stateKey string) gjson.Result {
+	return r.State[evType][stateKey]
+}
+
+// Name returns the `name` of the current m.room.name event, or the empty string.
+func (r *AccumulatedRoom) Name() string {
+	return r.CurrentState("m.room.name", "").Get("content.name").Str
+}
+
+// MembersWithMembership returns the sorted user IDs whose current membership is `membership`.
+func (r *AccumulatedRoom) MembersWithMembership(membership string) []string {
+	var userIDs []string
+	for stateKey, ev := range r.State["m.room.member"] {
+		if ev.Get("content.membership").Str == membership {
+			userIDs = append(userIDs, stateKey)
+		}
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// JoinedMembers returns the sorted user IDs who are currently joined to the room.
+func (r *AccumulatedRoom) JoinedMembers() []string {
+	return r.MembersWithMembership("join")
+}
+
+// TypingUsers returns the sorted user IDs from the latest m.typing event.
+func (r *AccumulatedRoom) TypingUsers() []string {
+	var userIDs []string
+	for _, u := range r.Ephemeral["m.typing"].Get("content.user_ids").Array() {
+		userIDs = append(userIDs, u.Str)
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// StateDiff compares the accumulated state with `stateEvents`, which should be the complete current
+// state of the room e.g from /rooms/{roomID}/state. Returns a human readable description of each
+// (type, state key) whose event ID differs, or nil if they are identical.
+func (r *AccumulatedRoom) StateDiff(stateEvents []gjson.Result) []string {
+	want := make(map[string]map[string]gjson.Result)
+	for _, ev := range stateEvents {
+		setStateEvent(want, ev)
+	}
+	var diffs []string
+	for evType, byStateKey := range want {
+		for stateKey, wantEv := range byStateKey {
+			gotEv, ok := r.State[evType][stateKey]
+			if !ok {
+				diffs = append(diffs, fmt.Sprintf("missing (%s, %q): want %s", evType, stateKey, wantEv.Get("event_id").Str))
+			} else if gotEv.Get("event_id").Str != wantEv.Get("event_id").Str {
+				diffs = append(diffs, fmt.Sprintf("wrong (%s, %q): got %s want %s", evType, stateKey, gotEv.Get("event_id").Str, wantEv.Get("event_id").Str))
+			}
+		}
+	}
+	for evType, byStateKey := range r.State {
+		for stateKey, gotEv := range byStateKey {
+			if _, ok := want[evType][stateKey]; !ok {
+				diffs = append(diffs, fmt.Sprintf("unexpected (%s, %q): got %s", evType, stateKey, gotEv.Get("event_id").Str))
+			}
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// MustSyncAccumulate performs a single /sync request, continuing from the accumulator's next_batch
+// token unless `syncReq.Since` is set, and accumulates the response. Fails the test if /sync fails.
+func (c *CSAPI) MustSyncAccumulate(t ct.TestLike, acc *SyncAccumulator, syncReq SyncReq) {
+	t.Helper()
+	if syncReq.Since == "" {
+		syncReq.Since = acc.NextBatch
+	}
+	res, _ := c.MustSync(t, syncReq)
+	acc.Accumulate(res, syncReq.FullState || syncReq.Since == "")
+}
+
+// MustSyncAccumulateUntil calls MustSyncAccumulate until all the check functions return no error
+// when called with the accumulator. Unlike MustSyncUntil, checks are re-evaluated against the
+// accumulated state after every response, not against individual responses.
+//
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) MustSyncAccumulateUntil(t ct.TestLike, acc *SyncAccumulator, syncReq SyncReq, checks ...func(acc *SyncAccumulator) error) {
+	t.Helper()
+	start := time.Now()
+	for {
+		c.MustSyncAccumulate(t, acc, syncReq)
+		// only the first request can use a custom since token, the rest continue from the accumulator
+		syncReq.Since = ""
+		syncReq.FullState = false
+		var errs []string
+		for i, check := range checks {
+			if err := check(acc); err != nil {
+				errs = append(errs, fmt.Sprintf("check %d: %s", i, err))
+			}
+		}
+		if len(errs) == 0 {
+			return
+		}
+		if time.Since(start) > c.SyncUntilTimeout {
+			ct.Fatalf(t, "%s MustSyncAccumulateUntil: timed out after %v. Seen %d /sync responses. %s", c.UserID, time.Since(start), acc.NumResponses, strings.Join(errs, "\n"))
+		}
+	}
+}
+
+// MustMatchAccumulatedState fetches /rooms/{roomID}/state and fails the test if it differs from the
+// state accumulated by `acc` for that room. This is useful to detect state which was lost or
+// incorrectly calculated over gappy (limited) syncs.
+func (c *CSAPI) MustMatchAccumulatedState(t ct.TestLike, acc *SyncAccumulator, roomID string) {
+	t.Helper()
+	res := c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state"})
+	body := ParseJSON(t, res)
+	diffs := acc.Room(roomID).StateDiff(gjson.ParseBytes(body).Array())
+	if len(diffs) > 0 {
+		ct.Fatalf(t, "MustMatchAccumulatedState(%s): accumulated state differs from /state after %d /sync responses:\n%s", roomID, acc.NumResponses, strings.Join(diffs, "\n"))
+	}
+}
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// syncResponse is a canned /sync response body and whether it was requested with full state.
+type syncResponse struct {
+	body      string
+	fullState bool
+}
+
+func memberEvent(eventID, userID, membership string) string {
+	return `{"type":"m.room.member","state_key":"` + userID + `","event_id":"` + eventID + `","content":{"membership":"` + membership + `"}}`
+}
+
+func TestSyncAccumulator(t *testing.T) {
+	const roomID = "!room:hs1"
+	testCases := []struct {
+		name      string
+		responses []syncResponse
+		check     func(t *testing.T, acc *SyncAccumulator)
+	}{
+		{
+			name: "initial sync applies state then timeline",
+			responses: []syncResponse{
+				{fullState: true, body: `{"next_batch":"s1","rooms":{"join":{"!room:hs1":{
+					"state":{"events":[` + memberEvent("$alice1", "@alice:hs1", "join") + `,{"type":"m.room.name","state_key":"","event_id":"$name1","content":{"name":"first"}}]},
+					"timeline":{"prev_batch":"p1","events":[{"type":"m.room.name","state_key":"","event_id":"$name2","content":{"name":"second"}},{"type":"m.room.message","event_id":"$msg1"}]},
+					"unread_notifications":{"notification_count":2,"highlight_count":1},
+					"summary":{"m.heroes":["@bob:hs1"],"m.joined_member_count":2,"m.invited_member_count":1}
+				}}}}`},
+			},
+			check: func(t *testing.T, acc *SyncAccumulator) {
+				room := acc.Room(roomID)
+				if acc.NextBatch != "s1" || room.Membership != "join" || room.PrevBatch != "p1" {
+					t.Errorf("got next_batch %q membership %q prev_batch %q, want s1 join p1", acc.NextBatch, room.Membership, room.PrevBatch)
+				}
+				if room.Name() != "second" {
+					t.Errorf("Name: got %q, want the name from the timeline", room.Name())
+				}
+				if len(room.Timeline) != 2 || !reflect.DeepEqual(room.JoinedMembers(), []string{"@alice:hs1"}) {
+					t.Errorf("got %d timeline events and joined members %v, want 2 and [@alice:hs1]", len(room.Timeline), room.JoinedMembers())
+				}
+				if room.NotificationCount != 2 || room.HighlightCount != 1 {
+					t.Errorf("got unread counts %d/%d, want 2/1", room.NotificationCount, room.HighlightCount)
+				}
+				if !reflect.DeepEqual(room.Heroes, []string{"@bob:hs1"}) || room.JoinedMemberCount != 2 || room.InvitedMemberCount != 1 {
+					t.Errorf("got summary %v %d %d, want [@bob:hs1] 2 1", room.Heroes, room.JoinedMemberCount, room.InvitedMemberCount)
+				}
+			},
+		},
+		{
+			name: "limited timeline clears the timeline but keeps state",
+			responses: []syncResponse{
+				{fullState: true, body: `{"next_batch":"s1","rooms":{"join":{"!room:hs1":{
+					"state":{"events":[` + memberEvent("$alice1", "@alice:hs1", "join") + `]},
+					"timeline":{"prev_batch":"p1","events":[{"type":"m.room.message","event_id":"$msg1"}]}
+				}}}}`},
+				{body: `{"next_batch":"s2","rooms":{"join":{"!room:hs1":{
+					"state":{"events":[` + memberEvent("$bob1", "@bob:hs1", "join") + `]},
+					"timeline":{"limited":true,"prev_batch":"p2","events":[{"type":"m.room.message","event_id":"$msg2"}]}
+				}}}}`},
+				{body: `{"next_batch":"s3","rooms":{"join":{"!room:hs1":{
+					"timeline":{"events":[{"type":"m.room.message","event_id":"$msg3"}]}
+				}}}}`},
+			},
+			check: func(t *testing.T, acc *SyncAccumulator) {
+				room := acc.Room(roomID)
+				var timeline []string
+				for _, ev := range room.Timeline {
+					timeline = append(timeline, ev.Get("event_id").Str)
+				}
+				if !reflect.DeepEqual(timeline, []string{"$msg2", "$msg3"}) || room.NumGaps != 1 {
+					t.Errorf("got timeline %v with %d gaps, want [$msg2 $msg3] with 1 gap", timeline, room.NumGaps)
+				}
+				// a timeline without prev_batch keeps the previous token
+				if room.PrevBatch != "p2" {
+					t.Errorf("PrevBatch: got %q, want p2", room.PrevBatch)
+				}
+				if !reflect.DeepEqual(room.JoinedMembers(), []string{"@alice:hs1", "@bob:hs1"}) {
+					t.Errorf("JoinedMembers: got %v, want state merged across the gap", room.JoinedMembers())
+				}
+			},
+		},
+		{
+			name: "full_state replaces state instead of merging",
+			responses: []syncResponse{
+				{fullState: true, body: `{"next_batch":"s1","rooms":{"join":{"!room:hs1":{
+					"state":{"events":[` + memberEvent("$alice1", "@alice:hs1", "join") + `,` + memberEvent("$bob1", "@bob:hs1", "join") + `]}
+				}}}}`},
+				{fullState: true, body: `{"next_batch":"s2","rooms":{"join":{"!room:hs1":{
+					"state":{"events":[` + memberEvent("$alice1", "@alice:hs1", "join") + `]}
+				}}}}`},
+			},
+			check: func(t *testing.T, acc *SyncAccumulator) {
+				room := acc.Room(roomID)
+				if !reflect.DeepEqual(room.JoinedMembers(), []string{"@alice:hs1"}) {
+					t.Errorf("JoinedMembers: got %v, want only the members in the full state", room.JoinedMembers())
+				}
+				diffs := room.StateDiff([]gjson.Result{gjson.Parse(memberEvent("$alice1", "@alice:hs1", "join"))})
+				if len(diffs) != 0 {
+					t.Errorf("StateDiff: got %v, want none", diffs)
+				}
+			},
+		},
+		{
+			name: "leave then rejoin replaces state",
+			responses: []syncResponse{
+				{fullState: true, body: `{"next_batch":"s1","rooms":{"join":{"!room:hs1":{
+					"state":{"events":[{"type":"m.room.topic","state_key":"","event_id":"$topic1","content":{"topic":"old"}}]},
+					"timeline":{"events":[` + memberEvent("$alice1", "@alice:hs1", "join") + `]}
+				}}}}`},
+				{body: `{"next_batch":"s2","rooms":{"leave":{"!room:hs1":{
+					"timeline":{"events":[` + memberEvent("$alice2", "@alice:hs1", "leave") + `]}
+				}}}}`},
+				{body: `{"next_batch":"s3","rooms":{"invite":{"!room:hs1":{
+					"invite_state":{"events":[{"type":"m.room.name","state_key":"","content":{"name":"stripped"}}]}
+				}}}}`},
+				{body: `{"next_batch":"s4","rooms":{"join":{"!room:hs1":{
+					"state":{"events":[{"type":"m.room.name","state_key":"","event_id":"$name1","content":{"name":"real"}}]},
+					"timeline":{"events":[` + memberEvent("$alice3", "@alice:hs1", "join") + `]}
+				}}}}`},
+			},
+			check: func(t *testing.T, acc *SyncAccumulator) {
+				room := acc.Room(roomID)
+				if room.Membership != "join" || len(room.StrippedState) != 0 {
+					t.Errorf("got membership %q with %d stripped state types, want join with none", room.Membership, len(room.StrippedState))
+				}
+				want := []gjson.Result{
+					gjson.Parse(`{"type":"m.room.name","state_key":"","event_id":"$name1"}`),
+					gjson.Parse(memberEvent("$alice3", "@alice:hs1", "join")),
+				}
+				if diffs := room.StateDiff(want); len(diffs) != 0 {
+					t.Errorf("StateDiff: got %v, want the old topic to be dropped on rejoin", diffs)
+				}
+			},
+		},
+		{
+			name: "invites keep stripped state only",
+			responses: []syncResponse{
+				{body: `{"next_batch":"s1","rooms":{"invite":{"!room:hs1":{
+					"invite_state":{"events":[{"type":"m.room.name","state_key":"","content":{"name":"stripped"}},` + memberEvent("", "@alice:hs1", "invite") + `]}
+				}}}}`},
+			},
+			check: func(t *testing.T, acc *SyncAccumulator) {
+				room := acc.Room(roomID)
+				if room.Membership != "invite" || room.StrippedState["m.room.name"][""].Get("content.name").Str != "stripped" {
+					t.Errorf("got membership %q and stripped state %v, want invite with the room name", room.Membership, room.StrippedState)
+				}
+				if room.Name() != "" || len(room.State) != 0 {
+					t.Errorf("got name %q and %d state types, want no real state", room.Name(), len(room.State))
+				}
+			},
+		},
+		{
+			name: "receipts are merged and other ephemeral events replaced",
+			responses: []syncResponse{
+				{body: `{"next_batch":"s1","rooms":{"join":{"!room:hs1":{"ephemeral":{"events":[
+					{"type":"m.receipt","content":{"$1":{"m.read":{"@alice:hs1":{"ts":1},"@bob:hs1":{"ts":1}}}}},
+					{"type":"m.typing","content":{"user_ids":["@bob:hs1","@alice:hs1"]}}
+				]}}}}}`},
+				{body: `{"next_batch":"s2","rooms":{"join":{"!room:hs1":{"ephemeral":{"events":[
+					{"type":"m.receipt","content":{"$2":{"m.read":{"@bob:hs1":{"ts":2}},"m.read.private":{"@bob:hs1":{"ts":2}}}}},
+					{"type":"m.typing","content":{"user_ids":["@bob:hs1"]}}
+				]}}}}}`},
+			},
+			check: func(t *testing.T, acc *SyncAccumulator) {
+				room := acc.Room(roomID)
+				want := map[string]map[string]string{
+					"m.read":         {"@alice:hs1": "$1", "@bob:hs1": "$2"},
+					"m.read.private": {"@bob:hs1": "$2"},
+				}
+				if !reflect.DeepEqual(room.Receipts, want) {
+					t.Errorf("Receipts: got %v, want %v", room.Receipts, want)
+				}
+				if _, ok := room.Ephemeral["m.receipt"]; ok {
+					t.Errorf("Ephemeral: receipts should only be in Receipts")
+				}
+				if !reflect.DeepEqual(room.TypingUsers(), []string{"@bob:hs1"}) {
+					t.Errorf("TypingUsers: got %v, want the latest m.typing event", room.TypingUsers())
+				}
+			},
+		},
+		{
+			name: "account data is replaced per event type",
+			responses: []syncResponse{
+				{body: `{"next_batch":"s1","account_data":{"events":[{"type":"a","content":{"v":1}},{"type":"b","content":{"v":1}}]},
+					"rooms":{"join":{"!room:hs1":{"account_data":{"events":[{"type":"m.tag","content":{"tags":{}}}]}}}}}`},
+				{body: `{"next_batch":"s2","account_data":{"events":[{"type":"a","content":{"v":2}}]}}`},
+			},
+			check: func(t *testing.T, acc *SyncAccumulator) {
+				if acc.AccountData["a"].Get("content.v").Int() != 2 || acc.AccountData["b"].Get("content.v").Int() != 1 {
+					t.Errorf("AccountData: got %v, want a=2 b=1", acc.AccountData)
+				}
+				if !acc.Room(roomID).AccountData["m.tag"].Exists() {
+					t.Errorf("room AccountData: missing m.tag")
+				}
+				if acc.NumResponses != 2 || acc.NextBatch != "s2" {
+					t.Errorf("got %d responses and next_batch %q, want 2 and s2", acc.NumResponses, acc.NextBatch)
+				}
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			acc := NewSyncAccumulator("@alice:hs1")
+			for i, res := range tc.responses {
+				if !gjson.Valid(res.body) {
+					t.Fatalf("response %d is not valid JSON", i)
+				}
+				acc.Accumulate(gjson.Parse(res.body), res.fullState)
+			}
+			tc.check(t, acc)
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// SyncLoopResponse is a single /sync response seen by a SyncLoop.
+type SyncLoopResponse struct {
+	// When the response was received.
+	ReceivedAt time.Time
+	// The since token used to make the request.
+	Since string
+	// The top-level parsed /sync response JSON.
+	Body gjson.Result
+}
+
+// SyncLoop continually calls /sync in a background goroutine, advancing the since token each time,
+// and fans responses out to all subscriptions. Create one with CSAPI.StartSyncLoop.
+//
+// Unlike MustSyncUntil, every response is retained so a subscription made after an event arrived
+// will still see it. This makes it possible to wait for several things in parallel, e.g:
+//
+//	loop := alice.StartSyncLoop(t, client.SyncReq{})
+//	defer loop.Stop()
+//	joined := loop.Subscribe(client.SyncJoinedTo(bob.UserID, roomID))
+//	typing := loop.Subscribe(client.SyncUsersTyping(roomID, []string{bob.UserID}))
+//	bob.MustJoinRoom(t, roomID, nil)
+//	bob.MustSendTyping(t, roomID, true, 10000)
+//	joined.Wait(t, 5*time.Second)
+//	typing.Wait(t, 5*time.Second)
+type SyncLoop struct {
+	c       *CSAPI
+	t       ct.TestLike
+	syncReq SyncReq
+
+	mu        sync.Mutex
+	responses []SyncLoopResponse
+	subs      []*SyncSubscription
+	err       error
+
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// SyncSubscription is a set of checks evaluated against every response seen by a SyncLoop.
+// It completes once every check has passed at least once.
+type SyncSubscription struct {
+	loop    *SyncLoop
+	checks  []SyncCheckOpt
+	passed  []bool
+	errs    []string
+	ch      chan struct{}
+	matched bool
+}
+
+// StartSyncLoop starts calling /sync in the background using `syncReq` as the initial request. The
+// since token is advanced automatically. The loop stops when Stop is called, or when the test ends if
+// `t` supports `Cleanup` (as *testing.T does). Any non-2xx /sync response is reported as a test error
+// and stops the loop.
+func (c *CSAPI) StartSyncLoop(t ct.TestLike, syncReq SyncReq) *SyncLoop {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	loop := &SyncLoop{
+		c:       c,
+		t:       t,
+		syncReq: syncReq,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if tc, ok := t.(interface{ Cleanup(func()) }); ok {
+		tc.Cleanup(loop.Stop)
+	}
+	go loop.run(ctx)
+	return loop
+}
+
+// Stop the sync loop and wait for the background goroutine to exit. Any in-flight /sync request is
+// cancelled. It is safe to call Stop multiple times.
+func (l *SyncLoop) Stop() {
+	l.stopOnce.Do(func() {
+		l.cancel()
+	})
+	<-l.done
+}
+
+// Since returns the most recent next_batch token seen by the loop.
+func (l *SyncLoop) Since() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncReq.Since
+}
+
+// Responses returns a copy of every /sync response seen by the loop so far, in the order received.
+func (l *SyncLoop) Responses() []SyncLoopResponse {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	responses := make([]SyncLoopResponse, len(l.responses))
+	copy(responses, l.responses)
+	return responses
+}
+
+// Subscribe returns a subscription which completes once every check has passed, in any response.
+// Checks are evaluated against all responses already seen by the loop before any new responses,
+// so events which arrived before the subscription was made are not lost.
+func (l *SyncLoop) Subscribe(checks ...SyncCheckOpt) *SyncSubscription {
+	sub := &SyncSubscription{
+		loop:   l,
+		checks: checks,
+		passed: make([]bool, len(checks)),
+		ch:     make(chan struct{}),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, res := range l.responses {
+		sub.evaluate(l.c.UserID, i+1, res)
+	}
+	if !sub.matched {
+		l.subs = append(l.subs, sub)
+	}
+	return sub
+}
+
+// evaluate runs all outstanding checks against a response. Must be called with the loop mutex held.
+func (s *SyncSubscription) evaluate(userID string, responseNum int, res SyncLoopResponse) {
+	if s.matched {
+		return
+	}
+	allPassed := true
+	for i, check := range s.checks {
+		if s.passed[i] {
+			continue
+		}
+		if err := check(userID, res.Body); err != nil {
+			allPassed = false
+			s.errs = append(s.errs, fmt.Sprintf("[%s] Response #%d check %d: %s", res.ReceivedAt.Format(time.StampMilli), responseNum, i, err))
+		} else {
+			s.passed[i] = true
+		}
+	}
+	if allPassed {
+		s.matched = true
+		close(s.ch)
+	}
+}
+
+// Wait blocks until every check in this subscription has passed or until the timeout is reached.
+// If the timeout is reached, or the sync loop failed, the test is failed with the errors from
+// each check and a log of every /sync response seen by the loop.
+func (s *SyncSubscription) Wait(t ct.TestLike, timeout time.Duration) {
+	t.Helper()
+	s.Waitf(t, timeout, "SyncSubscription.Wait")
+}
+
+// Waitf is the same as Wait but prefixes the failure message with the given error message.
+func (s *SyncSubscription) Waitf(t ct.TestLike, timeout time.Duration, errFormat string, args ...interface{}) {
+	t.Helper()
+	errmsg := fmt.Sprintf(errFormat, args...)
+	select {
+	case <-s.ch:
+		return
+	case <-s.loop.done:
+		// the loop may have seen a matching response just before stopping
+		select {
+		case <-s.ch:
+			return
+		default:
+		}
+		ct.Fatalf(t, "%s: sync loop stopped before checks passed: %v\n%s", errmsg, s.loop.stopError(), s.loop.failureOutput(s))
+	case <-time.After(timeout):
+		ct.Fatalf(t, "%s: timed out after %f seconds.\n%s", errmsg, timeout.Seconds(), s.loop.failureOutput(s))
+	}
+}
+
+func (l *SyncLoop) stopError() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		return fmt.Errorf("stopped")
+	}
+	return l.err
+}
+
+func (l *SyncLoop) failureOutput(sub *SyncSubscription) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var sb strings.Builder
+	sb.WriteString("Checkers:\n")
+	sb.WriteString(strings.Join(sub.errs, "\n"))
+	sb.WriteString(fmt.Sprintf("\nSync loop for %s saw %d responses:\n", l.c.UserID, len(l.responses)))
+	for i, res := range l.responses {
+		sb.WriteString(fmt.Sprintf("#%d [%s] since=%q: %s\n", i+1, res.ReceivedAt.Format(time.StampMilli), res.Since, res.Body.Raw))
+	}
+	return sb.String()
+}
+
+func (l *SyncLoop) run(ctx context.Context) {
+	defer close(l.done)
+	lt := &loopT{TestLike: l.t}
+	defer func() {
+		// requests fail via loopT.Fatalf, which exits this goroutine
+		if err := lt.failure(); err != nil && ctx.Err() == nil {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			ct.Errorf(l.t, "%s SyncLoop: %s", l.c.UserID, err)
+		}
+	}()
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		l.mu.Lock()
+		syncReq := l.syncReq
+		l.mu.Unlock()
+
+		body := l.doSync(ctx, lt, syncReq)
+		res := SyncLoopResponse{
+			ReceivedAt: time.Now(),
+			Since:      syncReq.Since,
+			Body:       body,
+		}
+
+		l.mu.Lock()
+		l.responses = append(l.responses, res)
+		l.syncReq.Since = body.Get("next_batch").Str
+		remaining := l.subs[:0]
+		for _, sub := range l.subs {
+			sub.evaluate(l.c.UserID, len(l.responses), res)
+			if !sub.matched {
+				remaining = append(remaining, sub)
+			}
+		}
+		l.subs = remaining
+		l.mu.Unlock()
+	}
+}
+
+// doSync performs a single /sync request via CSAPI.SyncCtx, so CSAPI.Debug and CSAPI.RateLimitPolicy apply.
+// Fails `t` if the request fails or returns a non-2xx response.
+func (l *SyncLoop) doSync(ctx context.Context, t ct.TestLike, syncReq SyncReq) gjson.Result {
+	body, res := l.c.SyncCtx(ctx, t, syncReq)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		resBody, _ := io.ReadAll(res.Body)
+		ct.Fatalf(t, "/sync returned non-2xx code: %s - body: %s", res.Status, string(resBody))
+	}
+	return body
+}
+
+// loopT is the ct.TestLike used for requests made by a SyncLoop. Failing a test via Fatalf must be done
+// from the goroutine running the test, so instead this records the failure and exits the loop goroutine.
+type loopT struct {
+	ct.TestLike
+
+	mu  sync.Mutex
+	err error
+}
+
+func (t *loopT) Helper()                                {}
+func (t *loopT) Error(args ...interface{})              { t.Fatalf("%s", fmt.Sprint(args...)) }
+func (t *loopT) Errorf(msg string, args ...interface{}) { t.Fatalf(msg, args...) }
+func (t *loopT) Skipf(msg string, args ...interface{})  { t.Fatalf(msg, args...) }
+func (t *loopT) Fatalf(msg string, args ...interface{}) {
+	t.mu.Lock()
+	if t.err == nil {
+		t.err = fmt.Errorf(msg, args...)
+	}
+	t.mu.Unlock()
+	runtime.Goexit()
+}
+func (t *loopT) Failed() bool { return t.failure() != nil }
+
+func (t *loopT) failure() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/cttest"
+)
+
+// syncServer is a stub server whose /sync long-polls until a response is queued via send.
+type syncServer struct {
+	responses chan string
+	// status codes to return before any queued responses
+	statuses chan int
+
+	mu     sync.Mutex
+	sinces []string
+}
+
+func newSyncServer(t *testing.T) (*syncServer, *CSAPI) {
+	s := &syncServer{
+		responses: make(chan string, 10),
+		statuses:  make(chan int, 10),
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, &CSAPI{
+		UserID:  "@alice:hs1",
+		BaseURL: srv.URL,
+		Client:  srv.Client(),
+	}
+}
+
+func (s *syncServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/_matrix/client/v3/sync" {
+		w.WriteHeader(404)
+		return
+	}
+	s.mu.Lock()
+	s.sinces = append(s.sinces, req.URL.Query().Get("since"))
+	n := len(s.sinces)
+	s.mu.Unlock()
+	select {
+	case status := <-s.statuses:
+		w.WriteHeader(status)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN","retry_after_ms":1}`))
+		return
+	default:
+	}
+	select {
+	case body := <-s.responses:
+		w.Write([]byte(fmt.Sprintf(`{"next_batch":"s%d",%s}`, n, body)))
+	case <-req.Context().Done():
+	}
+}
+
+// send queues a /sync response with the given top-level key and value.
+func (s *syncServer) send(key, value string) {
+	s.responses <- fmt.Sprintf("%q:%s", key, value)
+}
+
+func (s *syncServer) requestSinces() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.sinces...)
+}
+
+// syncHas checks the top-level key has the given value.
+func syncHas(key, value string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if got := topLevelSyncJSON.Get(key).Str; got != value {
+			return fmt.Errorf("%s: got %q, want %q", key, got, value)
+		}
+		return nil
+	}
+}
+
+func TestSyncLoop(t *testing.T) {
+	t.Run("subscriptions see responses received before and after subscribing", func(t *testing.T) {
+		s, c := newSyncServer(t)
+		loop := c.StartSyncLoop(t, SyncReq{})
+		defer loop.Stop()
+		s.send("a", `"1"`)
+		loop.Subscribe(syncHas("a", "1")).Wait(t, 5*time.Second)
+
+		// checks can pass in different responses
+		sub := loop.Subscribe(syncHas("a", "1"), syncHas("b", "2"))
+		s.send("b", `"2"`)
+		sub.Wait(t, 5*time.Second)
+
+		responses := loop.Responses()
+		if len(responses) != 2 || responses[0].Since != "" || responses[1].Since != "s1" {
+			t.Errorf("got responses %+v, want 2 with the since token advancing", responses)
+		}
+		if since := loop.Since(); since != "s2" {
+			t.Errorf("got since %q, want s2", since)
+		}
+	})
+
+	t.Run("Stop cancels the in-flight request", func(t *testing.T) {
+		s, c := newSyncServer(t)
+		loop := c.StartSyncLoop(t, SyncReq{Since: "s0"})
+		sub := loop.Subscribe(syncHas("a", "1"))
+		// wait for the long-poll to begin
+		for len(s.requestSinces()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		ft := &cttest.FatalT{}
+		fatal := ft.Run(t, func() {
+			loop.Stop()
+			loop.Stop()
+			sub.Wait(ft, 5*time.Second)
+		})
+		if !strings.Contains(fatal, "sync loop stopped before checks passed: stopped") {
+			t.Errorf("got failure %q, want it to say the loop stopped", fatal)
+		}
+		if sinces := s.requestSinces(); len(sinces) != 1 || sinces[0] != "s0" {
+			t.Errorf("got requests with since %v, want a single request with the initial since", sinces)
+		}
+	})
+
+	t.Run("non-2xx responses fail the test and stop the loop", func(t *testing.T) {
+		s, c := newSyncServer(t)
+		s.statuses <- 500
+		loopT := &cttest.FatalT{}
+		loop := c.StartSyncLoop(loopT, SyncReq{})
+		sub := loop.Subscribe(syncHas("a", "1"))
+		ft := &cttest.FatalT{}
+		fatal := ft.Run(t, func() {
+			sub.Wait(ft, 5*time.Second)
+		})
+		if !strings.Contains(fatal, "sync loop stopped before checks passed") || !strings.Contains(fatal, "500") {
+			t.Errorf("got failure %q, want it to say the loop stopped with a 500", fatal)
+		}
+		if !loopT.Failed() {
+			t.Errorf("the loop did not fail the test")
+		}
+	})
+
+	t.Run("requests use CSAPI.RateLimitPolicy", func(t *testing.T) {
+		s, c := newSyncServer(t)
+		c.RateLimitPolicy = &RateLimitPolicy{MaxRetries: 1}
+		s.statuses <- 429
+		loop := c.StartSyncLoop(t, SyncReq{})
+		defer loop.Stop()
+		s.send("a", `"1"`)
+		loop.Subscribe(syncHas("a", "1")).Wait(t, 5*time.Second)
+		if sinces := s.requestSinces(); len(sinces) < 2 || sinces[0] != "" || sinces[1] != "" {
+			t.Errorf("got requests with since %v, want the rate limited request to be retried", sinces)
+		}
+	})
+}
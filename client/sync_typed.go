@@ -0,0 +1,389 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// SyncResponse is a typed /sync response, as an alternative to walking the raw JSON with gjson paths.
+// Every struct which may contain unknown or unstable fields keeps the raw JSON in a `Raw` field.
+// See https://spec.matrix.org/v1.10/client-server-api/#get_matrixclientv3sync
+type SyncResponse struct {
+	NextBatch                    string          `json:"next_batch"`
+	Rooms                        SyncRooms       `json:"rooms"`
+	Presence                     SyncEventList   `json:"presence"`
+	AccountData                  SyncEventList   `json:"account_data"`
+	ToDevice                     SyncEventList   `json:"to_device"`
+	DeviceLists                  SyncDeviceLists `json:"device_lists"`
+	DeviceOneTimeKeysCount       map[string]int  `json:"device_one_time_keys_count"`
+	DeviceUnusedFallbackKeyTypes []string        `json:"device_unused_fallback_key_types"`
+	// The entire /sync response
+	Raw gjson.Result `json:"-"`
+}
+
+// SyncRooms are the rooms in a /sync response, keyed on room ID.
+type SyncRooms struct {
+	Join   map[string]*SyncJoinedRoom  `json:"join"`
+	Invite map[string]*SyncInvitedRoom `json:"invite"`
+	Leave  map[string]*SyncLeftRoom    `json:"leave"`
+	Knock  map[string]*SyncKnockedRoom `json:"knock"`
+}
+
+// SyncJoinedRoom is a room in `rooms.join`.
+type SyncJoinedRoom struct {
+	Summary                   SyncRoomSummary                    `json:"summary"`
+	State                     SyncEventList                      `json:"state"`
+	Timeline                  SyncTimeline                       `json:"timeline"`
+	Ephemeral                 SyncEventList                      `json:"ephemeral"`
+	AccountData               SyncEventList                      `json:"account_data"`
+	UnreadNotifications       SyncUnreadNotifications            `json:"unread_notifications"`
+	UnreadThreadNotifications map[string]SyncUnreadNotifications `json:"unread_thread_notifications"`
+	// The raw JSON for this room
+	Raw gjson.Result `json:"-"`
+}
+
+// SyncInvitedRoom is a room in `rooms.invite`.
+type SyncInvitedRoom struct {
+	InviteState SyncEventList `json:"invite_state"`
+	// The raw JSON for this room
+	Raw gjson.Result `json:"-"`
+}
+
+// SyncLeftRoom is a room in `rooms.leave`.
+type SyncLeftRoom struct {
+	State       SyncEventList `json:"state"`
+	Timeline    SyncTimeline  `json:"timeline"`
+	AccountData SyncEventList `json:"account_data"`
+	// The raw JSON for this room
+	Raw gjson.Result `json:"-"`
+}
+
+// SyncKnockedRoom is a room in `rooms.knock`.
+type SyncKnockedRoom struct {
+	KnockState SyncEventList `json:"knock_state"`
+	// The raw JSON for this room
+	Raw gjson.Result `json:"-"`
+}
+
+// SyncRoomSummary is the `summary` of a joined room. The counts are nil if they were omitted, which
+// servers do when they have not changed.
+type SyncRoomSummary struct {
+	Heroes             []string `json:"m.heroes"`
+	JoinedMemberCount  *int     `json:"m.joined_member_count"`
+	InvitedMemberCount *int     `json:"m.invited_member_count"`
+}
+
+// SyncUnreadNotifications are the notification counts for a room or thread.
+type SyncUnreadNotifications struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
+}
+
+// SyncTimeline is the timeline of a room.
+type SyncTimeline struct {
+	Events    []SyncEvent `json:"events"`
+	Limited   bool        `json:"limited"`
+	PrevBatch string      `json:"prev_batch"`
+}
+
+// SyncEventList is a list of events, used for sections of the response which only contain `events`.
+type SyncEventList struct {
+	Events []SyncEvent `json:"events"`
+}
+
+// SyncDeviceLists are the users whose device lists have changed, or who no longer share a room.
+type SyncDeviceLists struct {
+	Changed []string `json:"changed"`
+	Left    []string `json:"left"`
+}
+
+// SyncEvent is an event in a /sync response. Not all fields are present for all kinds of event, for
+// example EDUs have no event ID and stripped state has no timestamp.
+type SyncEvent struct {
+	Type     string
+	EventID  string
+	Sender   string
+	StateKey *string
+	// Milliseconds since the epoch, or 0 if not present.
+	OriginServerTS int64
+	Content        gjson.Result
+	Unsigned       gjson.Result
+	// The raw event JSON
+	Raw gjson.Result
+}
+
+// IsState returns true if this is a state event.
+func (e SyncEvent) IsState() bool {
+	return e.StateKey != nil
+}
+
+// IsMembership returns true if this is an m.room.member event for `userID` with the given membership.
+func (e SyncEvent) IsMembership(userID, membership string) bool {
+	return e.Type == "m.room.member" && e.StateKey != nil && *e.StateKey == userID && e.Content.Get("membership").Str == membership
+}
+
+func (e *SyncEvent) UnmarshalJSON(b []byte) error {
+	if !gjson.ValidBytes(b) {
+		return fmt.Errorf("invalid event JSON: %s", string(b))
+	}
+	raw := gjson.ParseBytes(b)
+	if !raw.IsObject() {
+		return fmt.Errorf("event is not a JSON object: %s", raw.Raw)
+	}
+	*e = SyncEvent{
+		Type:           raw.Get("type").Str,
+		EventID:        raw.Get("event_id").Str,
+		Sender:         raw.Get("sender").Str,
+		OriginServerTS: raw.Get("origin_server_ts").Int(),
+		Content:        raw.Get("content"),
+		Unsigned:       raw.Get("unsigned"),
+		Raw:            raw,
+	}
+	if stateKey := raw.Get("state_key"); stateKey.Exists() {
+		e.StateKey = &stateKey.Str
+	}
+	return nil
+}
+
+func (r *SyncJoinedRoom) UnmarshalJSON(b []byte) error {
+	type alias SyncJoinedRoom
+	if err := json.Unmarshal(b, (*alias)(r)); err != nil {
+		return err
+	}
+	r.Raw = gjson.ParseBytes(b)
+	return nil
+}
+
+func (r *SyncInvitedRoom) UnmarshalJSON(b []byte) error {
+	type alias SyncInvitedRoom
+	if err := json.Unmarshal(b, (*alias)(r)); err != nil {
+		return err
+	}
+	r.Raw = gjson.ParseBytes(b)
+	return nil
+}
+
+func (r *SyncLeftRoom) UnmarshalJSON(b []byte) error {
+	type alias SyncLeftRoom
+	if err := json.Unmarshal(b, (*alias)(r)); err != nil {
+		return err
+	}
+	r.Raw = gjson.ParseBytes(b)
+	return nil
+}
+
+func (r *SyncKnockedRoom) UnmarshalJSON(b []byte) error {
+	type alias SyncKnockedRoom
+	if err := json.Unmarshal(b, (*alias)(r)); err != nil {
+		return err
+	}
+	r.Raw = gjson.ParseBytes(b)
+	return nil
+}
+
+// NewSyncResponse parses a /sync response. Returns an error if the response does not match the types
+// in the spec, e.g `limited` is not a boolean.
+func NewSyncResponse(topLevelSyncJSON gjson.Result) (*SyncResponse, error) {
+	var res SyncResponse
+	if err := json.Unmarshal([]byte(topLevelSyncJSON.Raw), &res); err != nil {
+		return nil, fmt.Errorf("failed to parse /sync response: %w", err)
+	}
+	res.Raw = topLevelSyncJSON
+	return &res, nil
+}
+
+// MustSyncTyped is the same as MustSync but returns a typed response. Fails the test if the response
+// cannot be parsed.
+func (c *CSAPI) MustSyncTyped(t ct.TestLike, syncReq SyncReq) *SyncResponse {
+	t.Helper()
+	topLevelSyncJSON, _ := c.MustSync(t, syncReq)
+	res, err := NewSyncResponse(topLevelSyncJSON)
+	if err != nil {
+		ct.Fatalf(t, "CSAPI.MustSyncTyped: %s", err)
+	}
+	return res
+}
+
+// SyncTypedCheckOpt is the same as SyncCheckOpt but is given a typed /sync response. Use SyncTyped to
+// pass it to MustSyncUntil.
+type SyncTypedCheckOpt func(clientUserID string, res *SyncResponse) error
+
+// SyncTyped converts a SyncTypedCheckOpt into a SyncCheckOpt for use with MustSyncUntil. The check
+// fails if the response cannot be parsed.
+func SyncTyped(check SyncTypedCheckOpt) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		res, err := NewSyncResponse(topLevelSyncJSON)
+		if err != nil {
+			return err
+		}
+		return check(clientUserID, res)
+	}
+}
+
+// SyncTimelineHasTyped is the same as SyncTimelineHas but the check function is given typed events.
+func SyncTimelineHasTyped(roomID string, check func(SyncEvent) bool) SyncCheckOpt {
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		room, ok := res.Rooms.Join[roomID]
+		if !ok {
+			return fmt.Errorf("SyncTimelineHasTyped(%s): room not in rooms.join", roomID)
+		}
+		return checkEvents("SyncTimelineHasTyped("+roomID+") timeline", room.Timeline.Events, check)
+	})
+}
+
+// SyncTimelineHasEventIDTyped is the same as SyncTimelineHasEventID.
+func SyncTimelineHasEventIDTyped(roomID, eventID string) SyncCheckOpt {
+	return SyncTimelineHasTyped(roomID, func(ev SyncEvent) bool {
+		return ev.EventID == eventID
+	})
+}
+
+// SyncStateHasTyped is the same as SyncStateHas but the check function is given typed events.
+func SyncStateHasTyped(roomID string, check func(SyncEvent) bool) SyncCheckOpt {
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		room, ok := res.Rooms.Join[roomID]
+		if !ok {
+			return fmt.Errorf("SyncStateHasTyped(%s): room not in rooms.join", roomID)
+		}
+		return checkEvents("SyncStateHasTyped("+roomID+") state", room.State.Events, check)
+	})
+}
+
+// SyncEphemeralHasTyped is the same as SyncEphemeralHas but the check function is given typed events.
+func SyncEphemeralHasTyped(roomID string, check func(SyncEvent) bool) SyncCheckOpt {
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		room, ok := res.Rooms.Join[roomID]
+		if !ok {
+			return fmt.Errorf("SyncEphemeralHasTyped(%s): room not in rooms.join", roomID)
+		}
+		return checkEvents("SyncEphemeralHasTyped("+roomID+") ephemeral", room.Ephemeral.Events, check)
+	})
+}
+
+// SyncJoinedToTyped is the same as SyncJoinedTo but the extra check functions are given typed events.
+func SyncJoinedToTyped(userID, roomID string, checks ...func(SyncEvent) bool) SyncCheckOpt {
+	checkJoined := func(ev SyncEvent) bool {
+		if !ev.IsMembership(userID, "join") {
+			return false
+		}
+		for _, check := range checks {
+			if !check(ev) {
+				return false
+			}
+		}
+		return true
+	}
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		room, ok := res.Rooms.Join[roomID]
+		if !ok {
+			return fmt.Errorf("SyncJoinedToTyped(%s): room not in rooms.join", roomID)
+		}
+		// on initial sync the join event may only be in the state section
+		if checkEvents("", room.Timeline.Events, checkJoined) == nil || checkEvents("", room.State.Events, checkJoined) == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncJoinedToTyped(%s): no join event for %s in %d timeline and %d state events", roomID, userID, len(room.Timeline.Events), len(room.State.Events))
+	})
+}
+
+// SyncInvitedToTyped is the same as SyncInvitedTo.
+func SyncInvitedToTyped(userID, roomID string) SyncCheckOpt {
+	isInvite := func(ev SyncEvent) bool {
+		return ev.IsMembership(userID, "invite")
+	}
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		if clientUserID != userID {
+			return SyncTimelineHasTyped(roomID, isInvite)(clientUserID, res.Raw)
+		}
+		room, ok := res.Rooms.Invite[roomID]
+		if !ok {
+			return fmt.Errorf("SyncInvitedToTyped(%s): room not in rooms.invite", roomID)
+		}
+		return checkEvents("SyncInvitedToTyped("+roomID+") invite_state", room.InviteState.Events, isInvite)
+	})
+}
+
+// SyncLeftFromTyped is the same as SyncLeftFrom.
+func SyncLeftFromTyped(userID, roomID string) SyncCheckOpt {
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		if clientUserID != userID {
+			return SyncTimelineHasTyped(roomID, func(ev SyncEvent) bool {
+				return ev.IsMembership(userID, "leave")
+			})(clientUserID, res.Raw)
+		}
+		if _, ok := res.Rooms.Leave[roomID]; !ok {
+			return fmt.Errorf("SyncLeftFromTyped(%s): room not in rooms.leave", roomID)
+		}
+		return nil
+	})
+}
+
+// SyncGlobalAccountDataHasTyped is the same as SyncGlobalAccountDataHas but the check function is given
+// typed events.
+func SyncGlobalAccountDataHasTyped(check func(SyncEvent) bool) SyncCheckOpt {
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		return checkEvents("SyncGlobalAccountDataHasTyped account_data", res.AccountData.Events, check)
+	})
+}
+
+// SyncRoomAccountDataHasTyped is the same as SyncRoomAccountDataHas but the check function is given
+// typed events.
+func SyncRoomAccountDataHasTyped(roomID string, check func(SyncEvent) bool) SyncCheckOpt {
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		room, ok := res.Rooms.Join[roomID]
+		if !ok {
+			return fmt.Errorf("SyncRoomAccountDataHasTyped(%s): room not in rooms.join", roomID)
+		}
+		return checkEvents("SyncRoomAccountDataHasTyped("+roomID+") account_data", room.AccountData.Events, check)
+	})
+}
+
+// SyncToDeviceHasTyped is the same as SyncToDeviceHas but the check function is given typed events.
+func SyncToDeviceHasTyped(fromUser string, check func(SyncEvent) bool) SyncCheckOpt {
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		return checkEvents(fmt.Sprintf("SyncToDeviceHasTyped(%v) to_device", fromUser), res.ToDevice.Events, func(ev SyncEvent) bool {
+			if fromUser != "" && ev.Sender != fromUser {
+				return false
+			}
+			return check(ev)
+		})
+	})
+}
+
+// SyncDeviceListsChanged checks that `userID` is in `device_lists.changed`.
+func SyncDeviceListsChanged(userID string) SyncCheckOpt {
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		for _, changed := range res.DeviceLists.Changed {
+			if changed == userID {
+				return nil
+			}
+		}
+		return fmt.Errorf("SyncDeviceListsChanged: %s not in device_lists.changed: %v", userID, res.DeviceLists.Changed)
+	})
+}
+
+// SyncDeviceListsLeft checks that `userID` is in `device_lists.left`.
+func SyncDeviceListsLeft(userID string) SyncCheckOpt {
+	return SyncTyped(func(clientUserID string, res *SyncResponse) error {
+		for _, left := range res.DeviceLists.Left {
+			if left == userID {
+				return nil
+			}
+		}
+		return fmt.Errorf("SyncDeviceListsLeft: %s not in device_lists.left: %v", userID, res.DeviceLists.Left)
+	})
+}
+
+// checkEvents returns nil if `check` returns true for any of the events.
+func checkEvents(name string, events []SyncEvent, check func(SyncEvent) bool) error {
+	for _, ev := range events {
+		if check(ev) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: none of the %d events passed the check", name, len(events))
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// fullSyncResponse has every section of a /sync response which SyncResponse models.
+const fullSyncResponse = `{
+	"next_batch": "s72595_4483_1934",
+	"presence": {"events": [{"type": "m.presence", "sender": "@bob:hs1", "content": {"presence": "online"}}]},
+	"account_data": {"events": [{"type": "org.example.custom.config", "content": {"custom_config_key": "value"}}]},
+	"to_device": {"events": [{"type": "m.new_device", "sender": "@bob:hs1", "content": {"device_id": "XYZ"}}]},
+	"device_lists": {"changed": ["@bob:hs1"], "left": ["@charlie:hs1"]},
+	"device_one_time_keys_count": {"signed_curve25519": 20},
+	"device_unused_fallback_key_types": ["signed_curve25519"],
+	"rooms": {
+		"join": {
+			"!joined:hs1": {
+				"summary": {"m.heroes": ["@bob:hs1"], "m.joined_member_count": 2},
+				"state": {"events": [{"type": "m.room.member", "state_key": "@bob:hs1", "sender": "@bob:hs1", "event_id": "$bob", "origin_server_ts": 1432735824653, "content": {"membership": "join"}}]},
+				"timeline": {
+					"limited": true,
+					"prev_batch": "t34-23535_0_0",
+					"events": [
+						{"type": "m.room.member", "state_key": "@alice:hs1", "sender": "@alice:hs1", "event_id": "$alice", "origin_server_ts": 1432735824654, "content": {"membership": "join"}, "unsigned": {"age": 1234}},
+						{"type": "m.room.message", "sender": "@alice:hs1", "event_id": "$msg", "origin_server_ts": 1432735824655, "content": {"body": "hello", "msgtype": "m.text"}}
+					]
+				},
+				"ephemeral": {"events": [{"type": "m.typing", "content": {"user_ids": ["@bob:hs1"]}}]},
+				"account_data": {"events": [{"type": "m.tag", "content": {"tags": {"u.work": {"order": 0.9}}}}]},
+				"unread_notifications": {"highlight_count": 1, "notification_count": 5},
+				"unread_thread_notifications": {"$thread": {"highlight_count": 0, "notification_count": 2}},
+				"org.example.unstable_field": true
+			}
+		},
+		"invite": {
+			"!invited:hs1": {"invite_state": {"events": [{"type": "m.room.member", "state_key": "@alice:hs1", "sender": "@bob:hs1", "content": {"membership": "invite"}}]}}
+		},
+		"leave": {
+			"!left:hs1": {"timeline": {"events": [{"type": "m.room.member", "state_key": "@alice:hs1", "sender": "@alice:hs1", "event_id": "$leave", "content": {"membership": "leave"}}]}}
+		},
+		"knock": {
+			"!knocked:hs1": {"knock_state": {"events": [{"type": "m.room.join_rules", "state_key": "", "sender": "@bob:hs1", "content": {"join_rule": "knock"}}]}}
+		}
+	}
+}`
+
+func TestNewSyncResponse(t *testing.T) {
+	res, err := NewSyncResponse(gjson.Parse(fullSyncResponse))
+	if err != nil {
+		t.Fatalf("NewSyncResponse: %s", err)
+	}
+	if res.NextBatch != "s72595_4483_1934" || res.Raw.Get("next_batch").Str != res.NextBatch {
+		t.Errorf("got next_batch %q, want s72595_4483_1934 and the raw response", res.NextBatch)
+	}
+	if len(res.Presence.Events) != 1 || res.Presence.Events[0].Sender != "@bob:hs1" {
+		t.Errorf("got presence %+v, want one event from @bob:hs1", res.Presence.Events)
+	}
+	if len(res.AccountData.Events) != 1 || res.AccountData.Events[0].Content.Get("custom_config_key").Str != "value" {
+		t.Errorf("got account data %+v, want the custom config", res.AccountData.Events)
+	}
+	if len(res.ToDevice.Events) != 1 || res.ToDevice.Events[0].Type != "m.new_device" {
+		t.Errorf("got to-device events %+v, want m.new_device", res.ToDevice.Events)
+	}
+	if !reflect.DeepEqual(res.DeviceLists, SyncDeviceLists{Changed: []string{"@bob:hs1"}, Left: []string{"@charlie:hs1"}}) {
+		t.Errorf("got device lists %+v", res.DeviceLists)
+	}
+	if res.DeviceOneTimeKeysCount["signed_curve25519"] != 20 || !reflect.DeepEqual(res.DeviceUnusedFallbackKeyTypes, []string{"signed_curve25519"}) {
+		t.Errorf("got key counts %v and fallback key types %v", res.DeviceOneTimeKeysCount, res.DeviceUnusedFallbackKeyTypes)
+	}
+
+	joined := res.Rooms.Join["!joined:hs1"]
+	if joined == nil {
+		t.Fatalf("missing joined room")
+	}
+	if !reflect.DeepEqual(joined.Summary.Heroes, []string{"@bob:hs1"}) || joined.Summary.JoinedMemberCount == nil || *joined.Summary.JoinedMemberCount != 2 {
+		t.Errorf("got summary %+v, want heroes and a joined member count of 2", joined.Summary)
+	}
+	if joined.Summary.InvitedMemberCount != nil {
+		t.Errorf("got invited member count %d, want nil when omitted", *joined.Summary.InvitedMemberCount)
+	}
+	if !joined.Timeline.Limited || joined.Timeline.PrevBatch != "t34-23535_0_0" || len(joined.Timeline.Events) != 2 {
+		t.Errorf("got timeline %+v, want a limited timeline with 2 events", joined.Timeline)
+	}
+	member := joined.Timeline.Events[0]
+	if !member.IsState() || !member.IsMembership("@alice:hs1", "join") || member.IsMembership("@bob:hs1", "join") {
+		t.Errorf("got member event %s, want a join for @alice:hs1", member.Raw.Raw)
+	}
+	if member.EventID != "$alice" || member.OriginServerTS != 1432735824654 || member.Unsigned.Get("age").Int() != 1234 {
+		t.Errorf("got member event fields %+v", member)
+	}
+	if msg := joined.Timeline.Events[1]; msg.IsState() || msg.Content.Get("body").Str != "hello" {
+		t.Errorf("got message %s, want a non-state event with a body", msg.Raw.Raw)
+	}
+	if len(joined.State.Events) != 1 || len(joined.Ephemeral.Events) != 1 || len(joined.AccountData.Events) != 1 {
+		t.Errorf("got %d state, %d ephemeral and %d account data events, want 1 of each", len(joined.State.Events), len(joined.Ephemeral.Events), len(joined.AccountData.Events))
+	}
+	if joined.UnreadNotifications != (SyncUnreadNotifications{HighlightCount: 1, NotificationCount: 5}) || joined.UnreadThreadNotifications["$thread"].NotificationCount != 2 {
+		t.Errorf("got unread notifications %+v and %+v", joined.UnreadNotifications, joined.UnreadThreadNotifications)
+	}
+	// unknown fields are only available in the raw JSON
+	if !joined.Raw.Get("org\\.example\\.unstable_field").Bool() {
+		t.Errorf("joined room Raw: got %s, want the unstable field", joined.Raw.Raw)
+	}
+
+	if invited := res.Rooms.Invite["!invited:hs1"]; invited == nil || len(invited.InviteState.Events) != 1 || !invited.InviteState.Events[0].IsMembership("@alice:hs1", "invite") || !invited.Raw.Exists() {
+		t.Errorf("got invited room %+v, want the invite in invite_state", invited)
+	}
+	if left := res.Rooms.Leave["!left:hs1"]; left == nil || len(left.Timeline.Events) != 1 || left.Timeline.Events[0].EventID != "$leave" || !left.Raw.Exists() {
+		t.Errorf("got left room %+v, want the leave event in the timeline", left)
+	}
+	if knocked := res.Rooms.Knock["!knocked:hs1"]; knocked == nil || len(knocked.KnockState.Events) != 1 || knocked.KnockState.Events[0].Content.Get("join_rule").Str != "knock" || !knocked.Raw.Exists() {
+		t.Errorf("got knocked room %+v, want the join rules in knock_state", knocked)
+	}
+
+	t.Run("checkers", func(t *testing.T) {
+		raw := gjson.Parse(fullSyncResponse)
+		passing := map[string]SyncCheckOpt{
+			"SyncTimelineHasEventIDTyped":   SyncTimelineHasEventIDTyped("!joined:hs1", "$msg"),
+			"SyncStateHasTyped":             SyncStateHasTyped("!joined:hs1", func(ev SyncEvent) bool { return ev.EventID == "$bob" }),
+			"SyncJoinedToTyped":             SyncJoinedToTyped("@alice:hs1", "!joined:hs1"),
+			"SyncInvitedToTyped":            SyncInvitedToTyped("@alice:hs1", "!invited:hs1"),
+			"SyncLeftFromTyped":             SyncLeftFromTyped("@alice:hs1", "!left:hs1"),
+			"SyncToDeviceHasTyped":          SyncToDeviceHasTyped("@bob:hs1", func(ev SyncEvent) bool { return true }),
+			"SyncDeviceListsChanged":        SyncDeviceListsChanged("@bob:hs1"),
+			"SyncDeviceListsLeft":           SyncDeviceListsLeft("@charlie:hs1"),
+			"SyncRoomAccountDataHasTyped":   SyncRoomAccountDataHasTyped("!joined:hs1", func(ev SyncEvent) bool { return ev.Type == "m.tag" }),
+			"SyncGlobalAccountDataHasTyped": SyncGlobalAccountDataHasTyped(func(ev SyncEvent) bool { return ev.Type == "org.example.custom.config" }),
+			"SyncEphemeralHasTyped":         SyncEphemeralHasTyped("!joined:hs1", func(ev SyncEvent) bool { return ev.Type == "m.typing" }),
+			"SyncTimelineHasTyped":          SyncTimelineHasTyped("!joined:hs1", func(ev SyncEvent) bool { return ev.Sender == "@alice:hs1" }),
+		}
+		for name, check := range passing {
+			if err := check("@alice:hs1", raw); err != nil {
+				t.Errorf("%s: %s", name, err)
+			}
+		}
+		failing := map[string]SyncCheckOpt{
+			"SyncTimelineHasEventIDTyped": SyncTimelineHasEventIDTyped("!joined:hs1", "$missing"),
+			"SyncJoinedToTyped":           SyncJoinedToTyped("@charlie:hs1", "!joined:hs1"),
+			"SyncLeftFromTyped":           SyncLeftFromTyped("@alice:hs1", "!joined:hs1"),
+			"SyncToDeviceHasTyped":        SyncToDeviceHasTyped("@charlie:hs1", func(ev SyncEvent) bool { return true }),
+			"SyncDeviceListsChanged":      SyncDeviceListsChanged("@charlie:hs1"),
+		}
+		for name, check := range failing {
+			if err := check("@alice:hs1", raw); err == nil {
+				t.Errorf("%s: passed, want an error", name)
+			}
+		}
+	})
+
+	t.Run("rejects responses which do not match the spec", func(t *testing.T) {
+		for _, body := range []string{
+			`{"rooms":{"join":{"!r:hs1":{"timeline":{"limited":"yes"}}}}}`,
+			`{"rooms":{"join":{"!r:hs1":{"timeline":{"events":["not an event"]}}}}}`,
+			`{"device_lists":{"changed":"@bob:hs1"}}`,
+		} {
+			if _, err := NewSyncResponse(gjson.Parse(body)); err == nil {
+				t.Errorf("NewSyncResponse(%s): got no error", body)
+			}
+		}
+	})
+}
@@ -0,0 +1,306 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// UIAStage completes a single stage of user-interactive authentication. The returned map is sent as
+// the `auth` dict for this stage; the `type` and `session` keys are added automatically.
+type UIAStage struct {
+	// The stage type e.g "m.login.password"
+	Type string
+	// Auth returns the auth dict for this stage. `params` is the `params` object for this stage
+	// type from the 401 response, which may not exist.
+	Auth func(t ct.TestLike, c *CSAPI, params gjson.Result) map[string]interface{}
+}
+
+// UIAChallenge is the parsed form of a 401 user-interactive authentication response.
+type UIAChallenge struct {
+	// The available flows, each of which is a list of stage types.
+	Flows [][]string
+	// Per-stage parameters, keyed by stage type.
+	Params gjson.Result
+	// The session ID to use when completing stages.
+	Session string
+	// The stages which have been completed so far.
+	Completed []string
+	// The raw response body.
+	Body gjson.Result
+}
+
+// UIAResult describes how a request made via DoWithUIA was authenticated.
+type UIAResult struct {
+	// The flow which was chosen. Nil if the server did not require user-interactive auth.
+	Flow []string
+	// The session ID used.
+	Session string
+	// The stages the server reported as completed in the last 401 response.
+	Completed []string
+	// The last 401 challenge seen, if any.
+	LastChallenge *UIAChallenge
+}
+
+// UIAPassword completes the m.login.password stage. If `password` is empty, CSAPI.Password is used.
+func UIAPassword(password string) UIAStage {
+	return UIAStage{
+		Type: "m.login.password",
+		Auth: func(t ct.TestLike, c *CSAPI, params gjson.Result) map[string]interface{} {
+			pass := password
+			if pass == "" {
+				pass = c.Password
+			}
+			return map[string]interface{}{
+				"identifier": map[string]interface{}{
+					"type": "m.id.user",
+					"user": c.UserID,
+				},
+				"password": pass,
+			}
+		},
+	}
+}
+
+// UIADummy completes the m.login.dummy stage.
+func UIADummy() UIAStage {
+	return UIAStage{
+		Type: "m.login.dummy",
+		Auth: func(t ct.TestLike, c *CSAPI, params gjson.Result) map[string]interface{} {
+			return map[string]interface{}{}
+		},
+	}
+}
+
+// UIARegistrationToken completes the m.login.registration_token stage with the given token.
+func UIARegistrationToken(token string) UIAStage {
+	return UIAStage{
+		Type: "m.login.registration_token",
+		Auth: func(t ct.TestLike, c *CSAPI, params gjson.Result) map[string]interface{} {
+			return map[string]interface{}{
+				"token": token,
+			}
+		},
+	}
+}
+
+// UIAEmailIdentity completes the m.login.email.identity stage using the given validation session.
+// Complement does not validate the email itself, so the `sid` and `clientSecret` must refer to a
+// session which has already been validated (or which the test expects to be rejected).
+func UIAEmailIdentity(sid, clientSecret string) UIAStage {
+	return UIAStage{
+		Type: "m.login.email.identity",
+		Auth: func(t ct.TestLike, c *CSAPI, params gjson.Result) map[string]interface{} {
+			return map[string]interface{}{
+				"threepid_creds": map[string]interface{}{
+					"sid":           sid,
+					"client_secret": clientSecret,
+				},
+			}
+		},
+	}
+}
+
+// UIAChallengeFromResponse parses a 401 user-interactive auth response. Fails the test if the
+// response is not a valid UIA challenge. The response body is consumed.
+func UIAChallengeFromResponse(t ct.TestLike, res *http.Response) *UIAChallenge {
+	t.Helper()
+	if res.StatusCode != 401 {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		ct.Fatalf(t, "UIAChallengeFromResponse: expected 401 but got %s - body: %s", res.Status, string(body))
+	}
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	if !body.Get("flows").IsArray() {
+		ct.Fatalf(t, "UIAChallengeFromResponse: 401 response has no flows: %s", body.Raw)
+	}
+	challenge := &UIAChallenge{
+		Params:  body.Get("params"),
+		Session: body.Get("session").Str,
+		Body:    body,
+	}
+	for _, flow := range body.Get("flows").Array() {
+		var stages []string
+		for _, stage := range flow.Get("stages").Array() {
+			stages = append(stages, stage.Str)
+		}
+		challenge.Flows = append(challenge.Flows, stages)
+	}
+	for _, stage := range body.Get("completed").Array() {
+		challenge.Completed = append(challenge.Completed, stage.Str)
+	}
+	return challenge
+}
+
+// MustGetUIAChallenge makes the request without an `auth` dict and returns the 401 challenge.
+// Fails the test if the server does not respond with a 401.
+func (c *CSAPI) MustGetUIAChallenge(t ct.TestLike, method string, paths []string, opts []RequestOpt) *UIAChallenge {
+	t.Helper()
+	res := c.Do(t, method, paths, append(opts[:len(opts):len(opts)], withUIAAuth(t, nil))...)
+	return UIAChallengeFromResponse(t, res)
+}
+
+// DoUIAStage makes the request with the `auth` dict for a single stage in the given session. The `auth` dict
+// is added to the JSON body set by `opts`, if any. Returns the raw response, which is 401 if further stages
+// are required.
+func (c *CSAPI) DoUIAStage(t ct.TestLike, method string, paths []string, opts []RequestOpt, session string, stage UIAStage, params gjson.Result) *http.Response {
+	t.Helper()
+	auth := stage.Auth(t, c, params)
+	auth["type"] = stage.Type
+	if session != "" {
+		auth["session"] = session
+	}
+	return c.Do(t, method, paths, append(opts[:len(opts):len(opts)], withUIAAuth(t, auth))...)
+}
+
+// DoWithUIA makes a request which may require user-interactive authentication, completing stages
+// using the given stage handlers. `opts` are applied to every request made, and the `auth` dict is added
+// to the JSON body they set, if any. If no stages are given, m.login.password (using CSAPI.Password)
+// and m.login.dummy are used.
+//
+// The first flow which can be completed entirely with the given stages is chosen. Returns the final
+// HTTP response and a description of the flow used. The final response is not necessarily 2xx: if a
+// stage fails (e.g a wrong password, or the session expired), the response for that stage is returned so
+// it can be asserted on. Fails the test if no flow can be completed with the given stages.
+//
+// Example of deleting a device:
+//
+//	res, uia := alice.DoWithUIA(t, "DELETE", []string{"_matrix", "client", "v3", "devices", deviceID}, nil)
+//	must.MatchResponse(t, res, match.HTTPResponse{StatusCode: 200})
+//	t.Logf("used flow %v", uia.Flow)
+func (c *CSAPI) DoWithUIA(t ct.TestLike, method string, paths []string, opts []RequestOpt, stages ...UIAStage) (*http.Response, *UIAResult) {
+	t.Helper()
+	if len(stages) == 0 {
+		stages = []UIAStage{UIAPassword(""), UIADummy()}
+	}
+	result := &UIAResult{}
+	res := c.Do(t, method, paths, append(opts[:len(opts):len(opts)], withUIAAuth(t, nil))...)
+	if res.StatusCode != 401 {
+		return res, result // no UIA required
+	}
+	challenge := UIAChallengeFromResponse(t, res)
+	result.LastChallenge = challenge
+	result.Session = challenge.Session
+	result.Flow = chooseUIAFlow(challenge.Flows, stages)
+	if result.Flow == nil {
+		ct.Fatalf(t, "DoWithUIA: %s %v: no flow in %v can be completed with the given stages %v", method, paths, challenge.Flows, stageTypes(stages))
+	}
+	for _, stageType := range result.Flow {
+		if slices.Contains(challenge.Completed, stageType) {
+			continue
+		}
+		stage := stageByType(stages, stageType)
+		res = c.DoUIAStage(t, method, paths, opts, result.Session, stage, challenge.Params.Get(GjsonEscape(stageType)))
+		if res.StatusCode != 401 {
+			// success, or an error which isn't part of UIA e.g an expired session
+			return res, result
+		}
+		// the server wants more stages: check this one was accepted before continuing
+		resBody, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			ct.Fatalf(t, "DoWithUIA: failed to read 401 response body: %s", err)
+		}
+		res.Body = io.NopCloser(bytes.NewReader(resBody))
+		if !gjson.GetBytes(resBody, "flows").IsArray() {
+			// a 401 which isn't a UIA challenge e.g M_UNKNOWN_TOKEN
+			return res, result
+		}
+		next := UIAChallengeFromResponse(t, res)
+		res.Body = io.NopCloser(bytes.NewReader(resBody))
+		result.LastChallenge = next
+		result.Completed = next.Completed
+		if !slices.Contains(next.Completed, stageType) {
+			// this stage failed e.g wrong password, return the error response
+			return res, result
+		}
+		challenge = next
+	}
+	return res, result
+}
+
+// MustDoWithUIA is the same as DoWithUIA but fails the test if the final response is not 2xx.
+//
+//	alice.MustDoWithUIA(t, "POST", []string{"_matrix", "client", "v3", "account", "deactivate"}, []client.RequestOpt{
+//		client.WithJSONBody(t, map[string]interface{}{"erase": true}),
+//	}, client.UIAPassword(""))
+func (c *CSAPI) MustDoWithUIA(t ct.TestLike, method string, paths []string, opts []RequestOpt, stages ...UIAStage) (*http.Response, *UIAResult) {
+	t.Helper()
+	res, result := c.DoWithUIA(t, method, paths, opts, stages...)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		resBody, _ := io.ReadAll(res.Body)
+		ct.Fatalf(t, "CSAPI.MustDoWithUIA %s %s returned non-2xx code using flow %v: %s - body: %s", method, res.Request.URL.String(), result.Flow, res.Status, string(resBody))
+	}
+	return res, result
+}
+
+// chooseUIAFlow returns the first flow where every stage has a handler, or nil.
+func chooseUIAFlow(flows [][]string, stages []UIAStage) []string {
+	for _, flow := range flows {
+		ok := true
+		for _, stageType := range flow {
+			if stageByType(stages, stageType).Type == "" {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return flow
+		}
+	}
+	return nil
+}
+
+func stageByType(stages []UIAStage, stageType string) UIAStage {
+	for _, s := range stages {
+		if s.Type == stageType {
+			return s
+		}
+	}
+	return UIAStage{}
+}
+
+func stageTypes(stages []UIAStage) []string {
+	types := make([]string, len(stages))
+	for i := range stages {
+		types[i] = stages[i].Type
+	}
+	return types
+}
+
+// withUIAAuth replaces the `auth` dict in the JSON body set by earlier RequestOpts, or removes it if `auth`
+// is nil. If no body was set, the body is just the `auth` dict. Must be applied after the other RequestOpts.
+func withUIAAuth(t ct.TestLike, auth map[string]interface{}) RequestOpt {
+	return func(req *http.Request) {
+		t.Helper()
+		// json.RawMessage so the other fields are sent exactly as the RequestOpts set them
+		body := map[string]json.RawMessage{}
+		if req.Body != nil {
+			b, err := io.ReadAll(req.Body)
+			if err != nil {
+				ct.Fatalf(t, "DoWithUIA: failed to read request body: %s", err)
+			}
+			if len(b) > 0 {
+				if err := json.Unmarshal(b, &body); err != nil {
+					ct.Fatalf(t, "DoWithUIA: request body must be a JSON object: %s", err)
+				}
+			}
+		}
+		delete(body, "auth")
+		if auth != nil {
+			authJSON, err := json.Marshal(auth)
+			if err != nil {
+				ct.Fatalf(t, "DoWithUIA: failed to marshal auth dict: %s", err)
+			}
+			body["auth"] = authJSON
+		}
+		WithJSONBody(t, body)(req)
+	}
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// uiaServer is a stub server which requires user-interactive auth for every request, with the flows
+// [m.login.password] and [m.login.registration_token, m.login.dummy].
+type uiaServer struct {
+	mu       sync.Mutex
+	sessions map[string][]string
+	// if true, sessions expire after their first completed stage
+	expireAfterFirstStage bool
+	// the requests received, and their bodies
+	requests []*http.Request
+	bodies   []gjson.Result
+}
+
+func newUIAServer(t *testing.T) (*uiaServer, *CSAPI) {
+	s := &uiaServer{sessions: make(map[string][]string)}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, &CSAPI{
+		UserID:   "@alice:hs1",
+		Password: "secret",
+		BaseURL:  srv.URL,
+		Client:   srv.Client(),
+	}
+}
+
+func (s *uiaServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var body map[string]interface{}
+	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"errcode":"M_NOT_JSON"}`))
+		return
+	}
+	s.requests = append(s.requests, req)
+	b, _ := json.Marshal(body)
+	s.bodies = append(s.bodies, gjson.ParseBytes(b))
+
+	auth, ok := body["auth"].(map[string]interface{})
+	if !ok {
+		session := fmt.Sprintf("session%d", len(s.sessions))
+		s.sessions[session] = nil
+		s.challenge(w, session, nil)
+		return
+	}
+	session, _ := auth["session"].(string)
+	completed, ok := s.sessions[session]
+	if !ok {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"Unknown session ID"}`))
+		return
+	}
+	stage, _ := auth["type"].(string)
+	switch stage {
+	case "m.login.password":
+		if auth["password"] != "secret" {
+			s.challenge(w, session, completed, "M_FORBIDDEN")
+			return
+		}
+	case "m.login.registration_token":
+		if auth["token"] != "token" {
+			s.challenge(w, session, completed, "M_FORBIDDEN")
+			return
+		}
+	}
+	completed = append(completed, stage)
+	s.sessions[session] = completed
+	if s.expireAfterFirstStage {
+		delete(s.sessions, session)
+	}
+	if stage == "m.login.password" || len(completed) == 2 {
+		delete(s.sessions, session)
+		w.Write([]byte(`{}`))
+		return
+	}
+	s.challenge(w, session, completed)
+}
+
+func (s *uiaServer) challenge(w http.ResponseWriter, session string, completed []string, errcode ...string) {
+	res := map[string]interface{}{
+		"flows": []interface{}{
+			map[string]interface{}{"stages": []string{"m.login.password"}},
+			map[string]interface{}{"stages": []string{"m.login.registration_token", "m.login.dummy"}},
+		},
+		"params": map[string]interface{}{
+			"m.login.registration_token": map[string]interface{}{"hint": "token"},
+		},
+		"session": session,
+	}
+	if completed != nil {
+		res["completed"] = completed
+	}
+	if len(errcode) > 0 {
+		res["errcode"] = errcode[0]
+	}
+	w.WriteHeader(401)
+	json.NewEncoder(w).Encode(res)
+}
+
+func TestDoWithUIA(t *testing.T) {
+	t.Run("completes the first flow using CSAPI.Password by default", func(t *testing.T) {
+		_, c := newUIAServer(t)
+		res, uia := c.MustDoWithUIA(t, "POST", []string{"test"}, nil)
+		res.Body.Close()
+		if !reflect.DeepEqual(uia.Flow, []string{"m.login.password"}) {
+			t.Errorf("got flow %v, want [m.login.password]", uia.Flow)
+		}
+		if uia.Session != "session0" || uia.LastChallenge == nil {
+			t.Errorf("got session %q and challenge %v, want session0 and a challenge", uia.Session, uia.LastChallenge)
+		}
+	})
+
+	t.Run("completes a multi-stage flow and applies opts to every request", func(t *testing.T) {
+		s, c := newUIAServer(t)
+		var params gjson.Result
+		tokenStage := UIARegistrationToken("token")
+		auth := tokenStage.Auth
+		tokenStage.Auth = func(t ct.TestLike, c *CSAPI, p gjson.Result) map[string]interface{} {
+			params = p
+			return auth(t, c, p)
+		}
+		res, uia := c.MustDoWithUIA(t, "PUT", []string{"test"}, []RequestOpt{
+			WithQueries(map[string][]string{"dir": {"b"}}),
+			WithJSONBody(t, map[string]interface{}{
+				// 2^53 + 1, which is not representable as a float64
+				"big":  json.RawMessage(`9007199254740993`),
+				"auth": map[string]interface{}{"type": "stale"},
+			}),
+		}, tokenStage, UIADummy())
+		res.Body.Close()
+		if !reflect.DeepEqual(uia.Flow, []string{"m.login.registration_token", "m.login.dummy"}) {
+			t.Errorf("got flow %v, want [m.login.registration_token m.login.dummy]", uia.Flow)
+		}
+		if !reflect.DeepEqual(uia.Completed, []string{"m.login.registration_token"}) {
+			t.Errorf("got completed stages %v, want [m.login.registration_token]", uia.Completed)
+		}
+		if params.Get("hint").Str != "token" {
+			t.Errorf("stage was not given its params, got %s", params.Raw)
+		}
+		if len(s.requests) != 3 {
+			t.Fatalf("got %d requests, want 3", len(s.requests))
+		}
+		wantAuthTypes := []string{"", "m.login.registration_token", "m.login.dummy"}
+		for i, req := range s.requests {
+			if req.Method != "PUT" || req.URL.Query().Get("dir") != "b" {
+				t.Errorf("request %d: got %s %s, want the method and query params from opts", i, req.Method, req.URL)
+			}
+			if got := s.bodies[i].Get("big").Raw; got != "9007199254740993" {
+				t.Errorf("request %d: got body field %s, want it unchanged", i, got)
+			}
+			if got := s.bodies[i].Get("auth.type").Str; got != wantAuthTypes[i] {
+				t.Errorf("request %d: got auth type %q, want %q", i, got, wantAuthTypes[i])
+			}
+		}
+	})
+
+	t.Run("wrong passwords can be asserted on", func(t *testing.T) {
+		_, c := newUIAServer(t)
+		res, uia := c.DoWithUIA(t, "POST", []string{"test"}, nil, UIAPassword("wrong"))
+		body := gjson.ParseBytes(ParseJSON(t, res))
+		if res.StatusCode != 401 || body.Get("errcode").Str != "M_FORBIDDEN" {
+			t.Errorf("got HTTP %d %s, want 401 M_FORBIDDEN", res.StatusCode, body.Raw)
+		}
+		if uia.LastChallenge == nil || uia.LastChallenge.Session != uia.Session || len(uia.Completed) != 0 {
+			t.Errorf("got %+v, want the challenge for the failed stage", uia)
+		}
+	})
+
+	t.Run("expired sessions can be asserted on", func(t *testing.T) {
+		s, c := newUIAServer(t)
+		s.expireAfterFirstStage = true
+		res, uia := c.DoWithUIA(t, "POST", []string{"test"}, nil, UIARegistrationToken("token"), UIADummy())
+		body := gjson.ParseBytes(ParseJSON(t, res))
+		if res.StatusCode != 400 || body.Get("errcode").Str != "M_UNKNOWN" {
+			t.Errorf("got HTTP %d %s, want 400 M_UNKNOWN", res.StatusCode, body.Raw)
+		}
+		if !reflect.DeepEqual(uia.Completed, []string{"m.login.registration_token"}) {
+			t.Errorf("got completed stages %v, want [m.login.registration_token]", uia.Completed)
+		}
+
+		// the session can't be used for individual stages either
+		res = c.DoUIAStage(t, "POST", []string{"test"}, nil, uia.Session, UIADummy(), gjson.Result{})
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("got HTTP %d, want 400", res.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,214 @@
+// endpoint-coverage compares the endpoints hit during a test run with the endpoints in the spec.
+//
+// Run the tests with COMPLEMENT_COVERAGE_DIR set, check out https://github.com/matrix-org/matrix-spec, then:
+//
+//	go run ./cmd/endpoint-coverage -spec ../matrix-spec $COMPLEMENT_COVERAGE_DIR
+//
+// Add -v to list every endpoint, or -json for machine-readable output.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/matrix-org/complement/internal/coverage"
+	"github.com/matrix-org/complement/internal/openapi"
+)
+
+var (
+	specDir    = flag.String("spec", "", "The path to a checkout of https://github.com/matrix-org/matrix-spec")
+	verbose    = flag.Bool("v", false, "List every endpoint, not just totals")
+	jsonOutput = flag.Bool("json", false, "Output JSON instead of text")
+)
+
+// The APIs to report coverage for, and their directory in matrix-spec.
+var apis = []struct {
+	name string
+	dir  string
+}{
+	{"client-server", "client-server"},
+	{"federation", "server-server"},
+	{"appservice", "application-service"},
+	{"push", "push-gateway"},
+}
+
+type Report struct {
+	APIs []APIReport `json:"apis"`
+	// Endpoints which were hit but are not in the spec e.g unstable endpoints
+	NotInSpec []coverage.Endpoint `json:"not_in_spec"`
+}
+
+type APIReport struct {
+	Name      string           `json:"name"`
+	Covered   int              `json:"covered"`
+	Total     int              `json:"total"`
+	Endpoints []EndpointReport `json:"endpoints"`
+}
+
+type EndpointReport struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	OperationID string `json:"operation_id"`
+	// The number of requests made to this endpoint across all packages
+	Count int `json:"count"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -spec /path/to/matrix-spec [-v] [-json] COVERAGE_DIR_OR_FILE...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *specDir == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	hits, err := readCoverage(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read coverage: %s\n", err)
+		os.Exit(1)
+	}
+	report, err := buildReport(*specDir, hits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build report: %s\n", err)
+		os.Exit(1)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write JSON: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	printReport(report)
+}
+
+// readCoverage merges the coverage files in `paths`, which are files or directories of files.
+func readCoverage(paths []string) ([]coverage.Endpoint, error) {
+	merged := make(map[[2]string]int)
+	for _, path := range paths {
+		files := []string{path}
+		if info, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if info.IsDir() {
+			files, err = filepath.Glob(filepath.Join(path, "*.json"))
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, file := range files {
+			f, err := coverage.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			for _, e := range f.Endpoints {
+				merged[[2]string{e.Method, e.Path}] += e.Count
+			}
+		}
+	}
+	hits := make([]coverage.Endpoint, 0, len(merged))
+	for key, count := range merged {
+		hits = append(hits, coverage.Endpoint{Method: key[0], Path: key[1], Count: count})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Path != hits[j].Path {
+			return hits[i].Path < hits[j].Path
+		}
+		return hits[i].Method < hits[j].Method
+	})
+	return hits, nil
+}
+
+func buildReport(specDir string, hits []coverage.Endpoint) (*Report, error) {
+	report := &Report{
+		NotInSpec: []coverage.Endpoint{},
+	}
+	matched := make([]bool, len(hits))
+	for _, api := range apis {
+		spec, err := openapi.Load(filepath.Join(specDir, "data", "api", api.dir))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", api.name, err)
+		}
+		counts := make(map[openapi.Endpoint]int)
+		for i, hit := range hits {
+			endpoint, ok := spec.Match(hit.Method, hit.Path)
+			if !ok {
+				continue
+			}
+			matched[i] = true
+			counts[endpoint] += hit.Count
+		}
+		apiReport := APIReport{
+			Name:      api.name,
+			Endpoints: []EndpointReport{},
+		}
+		for _, endpoint := range spec.Endpoints() {
+			count := counts[endpoint]
+			if count > 0 {
+				apiReport.Covered++
+			}
+			apiReport.Total++
+			apiReport.Endpoints = append(apiReport.Endpoints, EndpointReport{
+				Method:      endpoint.Method,
+				Path:        endpoint.Path,
+				OperationID: endpoint.OperationID,
+				Count:       count,
+			})
+		}
+		sort.Slice(apiReport.Endpoints, func(i, j int) bool {
+			a, b := apiReport.Endpoints[i], apiReport.Endpoints[j]
+			if a.Path != b.Path {
+				return a.Path < b.Path
+			}
+			return a.Method < b.Method
+		})
+		report.APIs = append(report.APIs, apiReport)
+	}
+	for i, hit := range hits {
+		if !matched[i] {
+			report.NotInSpec = append(report.NotInSpec, hit)
+		}
+	}
+	return report, nil
+}
+
+func printReport(report *Report) {
+	var covered, total int
+	for _, api := range report.APIs {
+		covered += api.Covered
+		total += api.Total
+		fmt.Printf("%s %d/%d endpoints (%s)\n", api.Name, api.Covered, api.Total, percent(api.Covered, api.Total))
+		if !*verbose {
+			continue
+		}
+		for _, e := range api.Endpoints {
+			mark := "×"
+			if e.Count > 0 {
+				mark = "✓"
+			}
+			fmt.Printf("    %s %s %s (%s) %d requests\n", mark, e.Method, e.Path, e.OperationID, e.Count)
+		}
+		fmt.Println()
+	}
+	if *verbose && len(report.NotInSpec) > 0 {
+		fmt.Printf("Endpoints not in the spec:\n")
+		for _, e := range report.NotInSpec {
+			fmt.Printf("    %s %s %d requests\n", e.Method, e.Path, e.Count)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("\nTOTAL: %d/%d endpoints covered (%s), %d endpoints not in the spec\n", covered, total, percent(covered, total), len(report.NotInSpec))
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
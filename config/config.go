@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -124,6 +125,116 @@ type Complement struct {
 	// called exactly once at the end of the test suite, and is called with the TestName of "COMPLEMENT_ENABLE_DIRTY_RUNS"
 	// and TestFailed=false.
 	PostTestScript string
+
+	// Name: COMPLEMENT_OAUTH_STUB_PORT
+	// Default: 0
+	// Description: **EXPERIMENTAL** If set, homeservers are told to delegate authentication to the stub OAuth 2.0
+	// provider in the `oauth` package (MSC3861), which tests must listen on this port. When set, every homeserver
+	// is given the environment variables `COMPLEMENT_OAUTH_ISSUER`, `COMPLEMENT_OAUTH_CLIENT_ID` and
+	// `COMPLEMENT_OAUTH_CLIENT_SECRET`. The issuer is `http://$COMPLEMENT_HOSTNAME_RUNNING_COMPLEMENT:$PORT/`.
+	// If 0, homeservers use their normal authentication and OAuth tests are skipped.
+	OAuthStubPort int
+
+	// Name: COMPLEMENT_SSO_IDP_PORT
+	// Default: 0
+	// Description: **EXPERIMENTAL** If set, homeservers are told to offer SSO login via the fake OpenID Connect
+	// identity provider in the `idp` package, which tests must listen on this port. When set, every homeserver
+	// is given the environment variables `COMPLEMENT_SSO_IDP_ISSUER`, `COMPLEMENT_SSO_IDP_CLIENT_ID` and
+	// `COMPLEMENT_SSO_IDP_CLIENT_SECRET`. The issuer is `http://$COMPLEMENT_HOSTNAME_RUNNING_COMPLEMENT:$PORT/`.
+	// If 0, SSO tests are skipped.
+	SSOIdPPort int
+
+	// Name: COMPLEMENT_SMTP_SINK_PORT
+	// Default: 0
+	// Description: **EXPERIMENTAL** If set, homeservers are told to send email to the SMTP server in the `email`
+	// package, which tests must listen on this port. When set, every homeserver is given the environment variables
+	// `COMPLEMENT_SMTP_HOST` and `COMPLEMENT_SMTP_PORT`. The host is `$COMPLEMENT_HOSTNAME_RUNNING_COMPLEMENT`.
+	// If 0, tests which need the homeserver to send email are skipped.
+	SMTPSinkPort int
+
+	// Name: COMPLEMENT_HAR_DIR
+	// Default: $TMPDIR/complement-har
+	// Description: The directory to write HAR 1.2 files to. Every client-server request, every request to and from
+	// Complement's federation servers and every `DoFederationRequest` made during a test is recorded with timings
+	// and bodies, and written to `$COMPLEMENT_HAR_DIR/<package>/<test name>.har` if the test fails. These files can
+	// be opened in the network tab of browser devtools.
+	HARDir string
+
+	// Name: COMPLEMENT_HAR_ALWAYS
+	// Default: 0
+	// Description: If 1, HAR files are written for every test, not just failing tests. See COMPLEMENT_HAR_DIR.
+	HARAlways bool
+
+	// Name: COMPLEMENT_SPEC_VALIDATION_DIR
+	// Description: If set, every client-server response is validated against the OpenAPI definitions in this
+	// directory, which is either a checkout of https://github.com/matrix-org/matrix-spec or its
+	// `data/api/client-server` directory. Responses with undocumented status codes, missing required headers, or
+	// bodies which do not match the schema fail the test with the JSON pointer of the offending field. Requests to
+	// endpoints which are not in the spec e.g unstable endpoints are not validated.
+	SpecValidationDir string
+
+	// Name: COMPLEMENT_SPEC_VALIDATION_LENIENT
+	// Default: 0
+	// Description: If 1, spec violations found via COMPLEMENT_SPEC_VALIDATION_DIR are logged as warnings instead
+	// of failing the test.
+	SpecValidationLenient bool
+
+	// Name: COMPLEMENT_COVERAGE_DIR
+	// Description: If set, the method and templated path of every client-server request, every request to
+	// and from Complement's federation servers and every `DoFederationRequest` is recorded, and written to
+	// `$COMPLEMENT_COVERAGE_DIR/<package>.json` when the test package finishes. Use `go run ./cmd/endpoint-coverage`
+	// to compare these files with the endpoints in the spec.
+	CoverageDir string
+
+	// Name: COMPLEMENT_EXPECTATIONS_FILE
+	// Description: If set, the path to a YAML or JSON file listing tests which should be skipped, are expected to
+	// fail (`xfail`) or are `flaky` on each homeserver. This lets homeserver projects maintain their own list of
+	// failing tests without patching `runtime.SkipIf` calls or build tags into Complement. Test names are regular
+	// expressions matching the whole name as printed by `go test`, and also apply to subtests. Tests marked `xfail`
+	// still run, and fail as "unexpectedly passed" if they pass. Failures in `flaky` tests are logged and ignored.
+	// Only failures reported via Complement's assertions (`ct`, `must`, `match`, `client`) can be ignored; tests
+	// which call t.Fatalf or t.Errorf directly still fail and need to be marked as `skip`.
+	// Entries are keyed by the homeserver name set via build tags e.g `synapse`, or `*` to apply to every
+	// homeserver. See `internal/expectations` for the format.
+	ExpectationsFile string
+}
+
+const (
+	// The client ID the homeserver uses to authenticate to the stub OAuth 2.0 provider.
+	OAuthStubClientID = "complement-homeserver"
+	// The client secret the homeserver uses to authenticate to the stub OAuth 2.0 provider.
+	OAuthStubClientSecret = "complement-homeserver-secret"
+	// The client ID the homeserver uses to authenticate to the fake SSO identity provider.
+	SSOIdPClientID = "complement-homeserver"
+	// The client secret the homeserver uses to authenticate to the fake SSO identity provider.
+	SSOIdPClientSecret = "complement-sso-secret"
+)
+
+// OAuthStubIssuer returns the issuer URL of the stub OAuth 2.0 provider as seen by homeservers,
+// or the empty string if COMPLEMENT_OAUTH_STUB_PORT is not set.
+func (c *Complement) OAuthStubIssuer() string {
+	if c.OAuthStubPort == 0 {
+		return ""
+	}
+	return fmt.Sprintf("http://%s:%d/", c.HostnameRunningComplement, c.OAuthStubPort)
+}
+
+// SSOIdPIssuer returns the issuer URL of the fake SSO identity provider as seen by homeservers,
+// or the empty string if COMPLEMENT_SSO_IDP_PORT is not set.
+func (c *Complement) SSOIdPIssuer() string {
+	if c.SSOIdPPort == 0 {
+		return ""
+	}
+	return fmt.Sprintf("http://%s:%d/", c.HostnameRunningComplement, c.SSOIdPPort)
+}
+
+// SMTPSinkHostPort returns the host and port of the SMTP sink as seen by homeservers, or the empty
+// string and 0 if COMPLEMENT_SMTP_SINK_PORT is not set.
+func (c *Complement) SMTPSinkHostPort() (string, int) {
+	if c.SMTPSinkPort == 0 {
+		return "", 0
+	}
+	return c.HostnameRunningComplement, c.SMTPSinkPort
 }
 
 var hsRegex = regexp.MustCompile(`COMPLEMENT_BASE_IMAGE_(.+)=(.+)$`)
@@ -140,6 +251,18 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 	cfg.EnvVarsPropagatePrefix = os.Getenv("COMPLEMENT_SHARE_ENV_PREFIX")
 	cfg.PostTestScript = os.Getenv("COMPLEMENT_POST_TEST_SCRIPT")
 	cfg.SpawnHSTimeout = time.Duration(parseEnvWithDefault("COMPLEMENT_SPAWN_HS_TIMEOUT_SECS", 30)) * time.Second
+	cfg.OAuthStubPort = parseEnvWithDefault("COMPLEMENT_OAUTH_STUB_PORT", 0)
+	cfg.SSOIdPPort = parseEnvWithDefault("COMPLEMENT_SSO_IDP_PORT", 0)
+	cfg.SMTPSinkPort = parseEnvWithDefault("COMPLEMENT_SMTP_SINK_PORT", 0)
+	cfg.HARDir = os.Getenv("COMPLEMENT_HAR_DIR")
+	if cfg.HARDir == "" {
+		cfg.HARDir = filepath.Join(os.TempDir(), "complement-har")
+	}
+	cfg.HARAlways = os.Getenv("COMPLEMENT_HAR_ALWAYS") == "1"
+	cfg.SpecValidationDir = os.Getenv("COMPLEMENT_SPEC_VALIDATION_DIR")
+	cfg.SpecValidationLenient = os.Getenv("COMPLEMENT_SPEC_VALIDATION_LENIENT") == "1"
+	cfg.CoverageDir = os.Getenv("COMPLEMENT_COVERAGE_DIR")
+	cfg.ExpectationsFile = os.Getenv("COMPLEMENT_EXPECTATIONS_FILE")
 	if os.Getenv("COMPLEMENT_VERSION_CHECK_ITERATIONS") != "" {
 		fmt.Fprintln(os.Stderr, "Deprecated: COMPLEMENT_VERSION_CHECK_ITERATIONS will be removed in a later version. Use COMPLEMENT_SPAWN_HS_TIMEOUT_SECS instead which does the same thing and is clearer.")
 		// each iteration had a 50ms sleep between tries so the timeout is 50 * iteration ms
@@ -5,6 +5,12 @@
 // that aren't strictly via `go test`.
 package ct
 
+import (
+	"fmt"
+
+	"github.com/matrix-org/complement/internal/expectations"
+)
+
 // TestLike is an interface that testing.T satisfies. All client functions accept a TestLike interface,
 // with the intention of a `testing.T` being passed into them. However, the client may be used in non-test
 // scenarios e.g benchmarks, which can then use the same client by just implementing this interface.
@@ -22,16 +28,24 @@ type TestLike interface {
 const ansiRedForeground = "\x1b[31m"
 const ansiResetForeground = "\x1b[39m"
 
-// Errorf is a wrapper around t.Errorf which prints the failing error message in red.
+// Errorf is a wrapper around t.Errorf which prints the failing error message in red. If the test is
+// marked as skip, xfail or flaky in COMPLEMENT_EXPECTATIONS_FILE, the failure is handled according to that instead.
 func Errorf(t TestLike, format string, args ...any) {
 	t.Helper()
+	if expectations.Intercept(t, fmt.Sprintf(format, args...), false) {
+		return
+	}
 	format = ansiRedForeground + format + ansiResetForeground
 	t.Errorf(format, args...)
 }
 
-// Fatalf is a wrapper around t.Fatalf which prints the failing error message in red.
+// Fatalf is a wrapper around t.Fatalf which prints the failing error message in red. If the test is
+// marked as skip, xfail or flaky in COMPLEMENT_EXPECTATIONS_FILE, the failure is handled according to that instead.
 func Fatalf(t TestLike, format string, args ...any) {
 	t.Helper()
+	if expectations.Intercept(t, fmt.Sprintf(format, args...), true) {
+		return
+	}
 	format = ansiRedForeground + format + ansiResetForeground
 	t.Fatalf(format, args...)
 }
@@ -0,0 +1,50 @@
+#!/bin/bash
+#
+# Starts PostgreSQL and Palpo for Complement. Complement may run this more than once in the same
+# container e.g after Deployment.StopServer, so everything here must be idempotent.
+
+set -euo pipefail
+
+PGDATA=/var/lib/palpo/postgres
+PGBIN=$(echo /usr/lib/postgresql/*/bin)
+
+# Trust Complement's CA, and sign a certificate for this server with it.
+cp /complement/ca/ca.crt /usr/local/share/ca-certificates/complement.crt
+update-ca-certificates >/dev/null
+if [ ! -f "/conf/$SERVER_NAME.crt" ]; then
+    openssl genrsa -out "/conf/$SERVER_NAME.key" 2048 2>/dev/null
+    openssl req -new -sha256 -key "/conf/$SERVER_NAME.key" -subj "/C=US/ST=CA/O=Complement/CN=$SERVER_NAME" \
+        -addext "subjectAltName=DNS:$SERVER_NAME" -out "/conf/$SERVER_NAME.csr"
+    openssl x509 -req -in "/conf/$SERVER_NAME.csr" -CA /complement/ca/ca.crt -CAkey /complement/ca/ca.key \
+        -CAcreateserial -copy_extensions copy -out "/conf/$SERVER_NAME.crt" -days 1 -sha256
+fi
+
+# Start PostgreSQL, creating the database on first run.
+if [ ! -d "$PGDATA" ]; then
+    mkdir -p "$PGDATA"
+    chown postgres:postgres "$PGDATA"
+    su postgres -c "$PGBIN/initdb -D $PGDATA --auth=trust --username=palpo" >/dev/null
+    su postgres -c "$PGBIN/pg_ctl -D $PGDATA -o '-c listen_addresses=127.0.0.1' -w start" >/dev/null
+    su postgres -c "$PGBIN/createdb -h 127.0.0.1 -U palpo palpo"
+else
+    su postgres -c "$PGBIN/pg_ctl -D $PGDATA -o '-c listen_addresses=127.0.0.1' -w start" >/dev/null
+fi
+
+# Stop PostgreSQL cleanly when Complement stops the container. palpo_pid is empty if Palpo hasn't
+# started yet.
+palpo_pid=
+stop() {
+    if [ -n "$palpo_pid" ]; then
+        kill -TERM "$palpo_pid" 2>/dev/null || true
+        wait "$palpo_pid" || true
+    fi
+    su postgres -c "$PGBIN/pg_ctl -D $PGDATA -m fast -w stop" >/dev/null
+    exit 0
+}
+trap stop TERM INT
+
+export SERVER_NAME
+envsubst < /conf/palpo.toml.template > "$PALPO_CONFIG"
+palpo &
+palpo_pid=$!
+wait "$palpo_pid"
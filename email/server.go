@@ -0,0 +1,462 @@
+// package email is an EXPERIMENTAL SMTP server which records the email homeservers send, for testing
+// email validation flows such as registration, password resets and adding email addresses.
+// It is marked as EXPERIMENTAL as the API may break without warning.
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Subset of Deployment used by the SMTP server.
+type EmailDeployment interface {
+	GetConfig() *config.Complement
+}
+
+// Message is an email received by the SMTP server.
+type Message struct {
+	// The envelope sender and recipients, from MAIL FROM and RCPT TO.
+	From string
+	To   []string
+	// The decoded Subject header.
+	Subject string
+	Header  mail.Header
+	// The decoded text/plain and text/html parts of the message, if any.
+	Text string
+	HTML string
+	// The entire message as received.
+	Raw []byte
+}
+
+var linkRegexp = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// Links returns the URLs in the message, in the order they appear. The text part is preferred over
+// the HTML part.
+func (m Message) Links() []string {
+	body := m.Text
+	if body == "" {
+		body = m.HTML
+	}
+	var links []string
+	for _, link := range linkRegexp.FindAllString(body, -1) {
+		links = append(links, strings.ReplaceAll(strings.TrimRight(link, ".,;)"), "&amp;", "&"))
+	}
+	return links
+}
+
+// ValidationLink returns the first link in the message with a `token` query parameter, or the empty
+// string if there isn't one.
+func (m Message) ValidationLink() string {
+	for _, link := range m.Links() {
+		u, err := url.Parse(link)
+		if err == nil && u.Query().Get("token") != "" {
+			return link
+		}
+	}
+	return ""
+}
+
+// Token returns the `token` query parameter of the validation link, or the empty string if there isn't one.
+func (m Message) Token() string {
+	u, err := url.Parse(m.ValidationLink())
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("token")
+}
+
+func (m Message) sentTo(address string) bool {
+	for _, to := range m.To {
+		if strings.EqualFold(to, address) {
+			return true
+		}
+	}
+	return false
+}
+
+type messageWaiter struct {
+	check  func(m Message) bool
+	waiter *helpers.Waiter
+}
+
+// EXPERIMENTAL
+// Server is an SMTP server which accepts all email, without TLS or authentication, and records it.
+type Server struct {
+	t        ct.TestLike
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	// The host and port homeservers send email to.
+	Host string
+	Port int
+
+	mu       sync.Mutex
+	messages []Message
+	// the number of messages returned by MustWaitForMessage, per lowercase recipient
+	consumed map[string]int
+	waiters  []*messageWaiter
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+// EXPERIMENTAL
+// NewServer creates and starts an SMTP server listening on COMPLEMENT_SMTP_SINK_PORT, or a random port if it
+// is not set. Only when COMPLEMENT_SMTP_SINK_PORT is set will deployed homeservers be configured to send email
+// to this server. The server is closed when the test ends if `t` supports `Cleanup` (as *testing.T does),
+// otherwise call Close.
+func NewServer(t ct.TestLike, deployment EmailDeployment) *Server {
+	t.Helper()
+	cfg := deployment.GetConfig()
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.SMTPSinkPort))
+	if err != nil {
+		ct.Fatalf(t, "email.NewServer: could not listen: %s", err)
+	}
+	s := &Server{
+		t:        t,
+		listener: listener,
+		Host:     cfg.HostnameRunningComplement,
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		consumed: make(map[string]int),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	if tc, ok := t.(interface{ Cleanup(func()) }); ok {
+		tc.Cleanup(s.Close)
+	}
+	return s
+}
+
+// Close stops the server. It is called automatically when the test ends, if the test supports Cleanup.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// Messages returns the messages received so far, in the order they were received.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// WaiterForMessage creates a Waiter which waits until a message for which `check` returns true has been
+// received. Messages received before calling this function are checked too. Note that calling this function
+// doesn't actually block. Call .Wait(time.Duration) on the waiter to block.
+func (s *Server) WaiterForMessage(check func(m Message) bool) *helpers.Waiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := helpers.NewWaiter()
+	for _, m := range s.messages {
+		if check(m) {
+			w.Finish()
+			return w
+		}
+	}
+	s.waiters = append(s.waiters, &messageWaiter{check: check, waiter: w})
+	return w
+}
+
+// MustWaitForMessage waits for the next message sent to `address` and returns it. Each call returns a
+// different message, in the order they were received, so calling this after each action which sends email
+// returns the email for that action. Fails the test if no message arrives within the timeout.
+func (s *Server) MustWaitForMessage(t ct.TestLike, address string, timeout time.Duration) Message {
+	t.Helper()
+	key := strings.ToLower(address)
+	deadline := time.Now().Add(timeout)
+	for {
+		if msg, ok := s.nextMessage(key); ok {
+			return msg
+		}
+		if time.Now().After(deadline) {
+			ct.Fatalf(t, "email.Server.MustWaitForMessage: no email sent to %s within %v", address, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// nextMessage returns the first message to `address` which hasn't been returned yet, if any.
+func (s *Server) nextMessage(address string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := 0
+	for _, m := range s.messages {
+		if !m.sentTo(address) {
+			continue
+		}
+		if seen == s.consumed[address] {
+			s.consumed[address]++
+			return m, true
+		}
+		seen++
+	}
+	return Message{}, false
+}
+
+// MustGetValidationLink waits for the next message sent to `address` and returns its validation link.
+// Fails the test if no message arrives within 10s, or it has no validation link. This can be used with
+// client.CSAPI.MustValidateEmail.
+func (s *Server) MustGetValidationLink(t ct.TestLike, address string) string {
+	t.Helper()
+	msg := s.MustWaitForMessage(t, address, 10*time.Second)
+	link := msg.ValidationLink()
+	if link == "" {
+		ct.Fatalf(t, "email.Server.MustGetValidationLink: email to %s has no validation link: %s", address, msg.Text+msg.HTML)
+	}
+	return link
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return // closed
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) addMessage(msg Message) {
+	s.t.Logf("email: received %q from %s to %v", msg.Subject, msg.From, msg.To)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	waiters := s.waiters[:0]
+	for _, waiter := range s.waiters {
+		if waiter.check(msg) {
+			waiter.waiter.Finish()
+		} else {
+			waiters = append(waiters, waiter)
+		}
+	}
+	s.waiters = waiters
+}
+
+// handleConn speaks just enough SMTP (RFC 5321) to receive mail from homeservers.
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	reply := func(code int, msg string) bool {
+		return tp.PrintfLine("%d %s", code, msg) == nil
+	}
+	if !reply(220, "complement ESMTP") {
+		return
+	}
+	var from string
+	var to []string
+	for {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reply(250, "complement")
+		case "EHLO":
+			tp.PrintfLine("250-complement")
+			tp.PrintfLine("250-8BITMIME")
+			tp.PrintfLine("250-AUTH PLAIN LOGIN")
+			reply(250, "SMTPUTF8")
+		case "AUTH":
+			// accept any credentials
+			mech, initial, _ := strings.Cut(arg, " ")
+			switch strings.ToUpper(mech) {
+			case "PLAIN":
+				if initial == "" {
+					reply(334, "")
+					tp.ReadLine()
+				}
+			case "LOGIN":
+				reply(334, base64.StdEncoding.EncodeToString([]byte("Username:")))
+				tp.ReadLine()
+				reply(334, base64.StdEncoding.EncodeToString([]byte("Password:")))
+				tp.ReadLine()
+			}
+			reply(235, "authenticated")
+		case "MAIL":
+			from = parsePath(arg, "FROM:")
+			to = nil
+			reply(250, "OK")
+		case "RCPT":
+			to = append(to, parsePath(arg, "TO:"))
+			reply(250, "OK")
+		case "DATA":
+			if len(to) == 0 {
+				reply(503, "need RCPT")
+				continue
+			}
+			reply(354, "end data with <CR><LF>.<CR><LF>")
+			raw, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg, err := parseMessage(raw)
+			if err != nil {
+				s.t.Logf("email: failed to parse message: %s", err)
+			}
+			msg.From = from
+			msg.To = to
+			s.addMessage(msg)
+			from, to = "", nil
+			reply(250, "OK")
+		case "RSET":
+			from, to = "", nil
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "command not implemented")
+		}
+	}
+}
+
+// parsePath returns the address in e.g `FROM:<alice@example.com> SIZE=123`.
+func parsePath(arg, prefix string) string {
+	if len(arg) >= len(prefix) && strings.EqualFold(arg[:len(prefix)], prefix) {
+		arg = arg[len(prefix):]
+	}
+	arg = strings.TrimSpace(arg)
+	if i := strings.Index(arg, ">"); strings.HasPrefix(arg, "<") && i > 0 {
+		return arg[1:i]
+	}
+	path, _, _ := strings.Cut(arg, " ")
+	return path
+}
+
+// parseMessage parses the headers of the message and decodes its text parts. If the message cannot be
+// parsed, the returned Message still has Raw set.
+func parseMessage(raw []byte) (Message, error) {
+	msg := Message{Raw: raw}
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return msg, err
+	}
+	msg.Header = m.Header
+	msg.Subject = m.Header.Get("Subject")
+	if subject, err := new(mime.WordDecoder).DecodeHeader(msg.Subject); err == nil {
+		msg.Subject = subject
+	}
+	err = readPart(&msg, m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Body)
+	return msg, err
+}
+
+// readPart decodes a MIME part into msg.Text or msg.HTML, recursing into multipart parts.
+func readPart(msg *Message, contentType, transferEncoding string, body io.Reader) error {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			// use NextRawPart so we can decode quoted-printable ourselves, consistently with non-multipart messages
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = readPart(msg, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part); err != nil {
+				return err
+			}
+		}
+	}
+	switch strings.ToLower(transferEncoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: bufio.NewReader(body)})
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	switch mediaType {
+	case "text/plain":
+		if msg.Text == "" {
+			msg.Text = string(b)
+		}
+	case "text/html":
+		if msg.HTML == "" {
+			msg.HTML = string(b)
+		}
+	}
+	return nil
+}
+
+// newlineStripper removes line breaks from base64 encoded bodies.
+type newlineStripper struct {
+	r *bufio.Reader
+}
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		c, err := n.r.ReadByte()
+		if err != nil {
+			if i > 0 {
+				return i, nil
+			}
+			return 0, err
+		}
+		if c == '\r' || c == '\n' {
+			continue
+		}
+		p[i] = c
+		i++
+	}
+	return i, nil
+}
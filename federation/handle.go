@@ -2,6 +2,7 @@ package federation
 
 import (
 	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -13,6 +14,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 // EXPERIMENTAL
@@ -593,3 +595,141 @@ func HandleTransactionRequests(pduCallback func(gomatrixserverlib.PDU), eduCallb
 		})).Methods("PUT")
 	}
 }
+
+// EXPERIMENTAL
+// HandleExchangeThirdPartyInviteRequests is an option which makes the server process
+// `PUT /_matrix/federation/v1/exchange_third_party_invite/{roomID}` requests for rooms on this server.
+// This is sent by a homeserver when a user binds a third-party identifier which was invited to a room on
+// this server. The `signed` block must be for an `m.room.third_party_invite` event in the room, and be signed
+// by one of its public keys. The server then invites the user, and adds the signed invite to the room.
+//
+// inviteCallback is a callback function that if non-nil will be called and passed the invite event
+func HandleExchangeThirdPartyInviteRequests(deployment FederationDeployment, inviteCallback func(gomatrixserverlib.PDU)) func(*Server) {
+	return func(s *Server) {
+		// https://spec.matrix.org/v1.11/server-server-api/#put_matrixfederationv1exchange_third_party_inviteroomid
+		s.mux.Handle("/_matrix/federation/v1/exchange_third_party_invite/{roomID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			respond := func(res util.JSONResponse) {
+				w.WriteHeader(res.Code)
+				b, _ := json.Marshal(res.JSON)
+				w.Write(b)
+			}
+			fedReq, errResp := fclient.VerifyHTTPRequest(
+				req, time.Now(), s.serverName, nil, s.keyRing,
+			)
+			if fedReq == nil {
+				respond(errResp)
+				return
+			}
+			room, ok := s.rooms[mux.Vars(req)["roomID"]]
+			if !ok {
+				respond(util.JSONResponse{Code: 404, JSON: spec.NotFound("complement: unknown room")})
+				return
+			}
+			var partialEvent struct {
+				Type     string                 `json:"type"`
+				Sender   string                 `json:"sender"`
+				StateKey string                 `json:"state_key"`
+				Content  map[string]interface{} `json:"content"`
+			}
+			if err := json.Unmarshal(fedReq.Content(), &partialEvent); err != nil {
+				respond(util.MessageResponse(400, err.Error()))
+				return
+			}
+			if err := verifyThirdPartyInviteSigned(room, partialEvent.StateKey, fedReq.Content()); err != nil {
+				respond(util.JSONResponse{Code: 403, JSON: spec.Forbidden("complement: " + err.Error())})
+				return
+			}
+
+			proto, err := room.ProtoEventCreator(room, Event{
+				Type:     partialEvent.Type,
+				Sender:   partialEvent.Sender,
+				StateKey: &partialEvent.StateKey,
+				Content:  partialEvent.Content,
+			})
+			if err != nil {
+				respond(util.MessageResponse(400, err.Error()))
+				return
+			}
+			inviteEvent, err := room.EventCreator(room, s, proto)
+			if err != nil {
+				respond(util.MessageResponse(400, err.Error()))
+				return
+			}
+
+			// invite the user, as the spec says to do before responding
+			invitee, err := spec.NewUserID(partialEvent.StateKey, true)
+			if err != nil {
+				respond(util.MessageResponse(400, err.Error()))
+				return
+			}
+			inviteReq, err := fclient.NewInviteV2Request(inviteEvent, []gomatrixserverlib.InviteStrippedState{})
+			if err != nil {
+				respond(util.MessageResponse(500, err.Error()))
+				return
+			}
+			inviteRes, err := s.FederationClient(deployment).SendInviteV2(req.Context(), s.serverName, invitee.Domain(), inviteReq)
+			if err != nil {
+				respond(util.MessageResponse(500, "complement: failed to send invite: "+err.Error()))
+				return
+			}
+			verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
+			if err != nil {
+				respond(util.MessageResponse(500, err.Error()))
+				return
+			}
+			signedInvite, err := verImpl.NewEventFromTrustedJSON(inviteRes.Event, false)
+			if err != nil {
+				respond(util.MessageResponse(500, "complement: invalid invite response: "+err.Error()))
+				return
+			}
+			room.AddEvent(signedInvite)
+			if inviteCallback != nil {
+				inviteCallback(signedInvite)
+			}
+			respond(util.JSONResponse{Code: 200, JSON: struct{}{}})
+		})).Methods("PUT")
+	}
+}
+
+// verifyThirdPartyInviteSigned checks that `content.third_party_invite.signed` in the event JSON is for
+// `mxid`, and signed by a public key in the room's `m.room.third_party_invite` event for its token.
+func verifyThirdPartyInviteSigned(room *ServerRoom, mxid string, eventJSON []byte) error {
+	signed := gjson.GetBytes(eventJSON, "content.third_party_invite.signed")
+	if !signed.IsObject() {
+		return fmt.Errorf("missing content.third_party_invite.signed")
+	}
+	if signed.Get("mxid").Str != mxid {
+		return fmt.Errorf("signed mxid %q does not match state_key %q", signed.Get("mxid").Str, mxid)
+	}
+	token := signed.Get("token").Str
+	thirdPartyInvite := room.CurrentState("m.room.third_party_invite", token)
+	if thirdPartyInvite == nil {
+		return fmt.Errorf("no m.room.third_party_invite event with token %q", token)
+	}
+	content := gjson.ParseBytes(thirdPartyInvite.Content())
+	publicKeys := []string{}
+	if content.Get("public_key").Exists() {
+		publicKeys = append(publicKeys, content.Get("public_key").Str)
+	}
+	for _, key := range content.Get("public_keys.#.public_key").Array() {
+		publicKeys = append(publicKeys, key.Str)
+	}
+	for _, publicKey := range publicKeys {
+		keyBytes, err := base64.RawStdEncoding.DecodeString(publicKey)
+		if err != nil {
+			keyBytes, err = base64.RawURLEncoding.DecodeString(publicKey)
+		}
+		if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+			continue
+		}
+		for signingName, sigs := range signed.Get("signatures").Map() {
+			for keyID := range sigs.Map() {
+				err = gomatrixserverlib.VerifyJSON(signingName, gomatrixserverlib.KeyID(keyID), ed25519.PublicKey(keyBytes), []byte(signed.Raw))
+				if err == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("signed is not signed by any of the public keys in the m.room.third_party_invite event")
+}
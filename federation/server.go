@@ -32,14 +32,26 @@ import (
 
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/coverage"
+	"github.com/matrix-org/complement/internal/har"
 )
 
+// The comment on HAR entries for requests made by Complement federation servers
+const outboundHARComment = "Complement federation server (outbound)"
+
 // Subset of Deployment used in federation
 type FederationDeployment interface {
 	GetConfig() *config.Complement
 	RoundTripper() http.RoundTripper
 }
 
+// outboundTransport returns the transport for requests made by Complement federation servers, which
+// routes requests to the deployment and records them for HAR files and endpoint coverage.
+func outboundTransport(t ct.TestLike, deployment FederationDeployment) http.RoundTripper {
+	transport := har.ForTest(t, deployment.GetConfig()).RoundTripper(outboundHARComment, deployment.RoundTripper())
+	return coverage.RoundTripper(deployment.GetConfig(), transport)
+}
+
 // EXPERIMENTAL
 // Server represents a federation server
 type Server struct {
@@ -89,7 +101,7 @@ func NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Ser
 	fetcher := &basicKeyFetcher{
 		KeyFetcher: &gomatrixserverlib.DirectKeyFetcher{
 			Client: fclient.NewClient(
-				fclient.WithTransport(deployment.RoundTripper()),
+				fclient.WithTransport(outboundTransport(t, deployment)),
 			),
 			IsLocalServerName: func(s spec.ServerName) bool {
 				return s == spec.ServerName(deployment.GetConfig().HostnameRunningComplement)
@@ -123,7 +135,9 @@ func NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Ser
 	})
 
 	// generate certs and an http.Server
-	httpServer, certPath, keyPath, err := federationServer(deployment.GetConfig(), srv.mux)
+	handler := har.ForTest(t, deployment.GetConfig()).Handler("Complement federation server (inbound)", srv.mux)
+	handler = coverage.Handler(deployment.GetConfig(), handler)
+	httpServer, certPath, keyPath, err := federationServer(deployment.GetConfig(), handler)
 	if err != nil {
 		ct.Fatalf(t, "complement: unable to create federation server and certificates: %s", err.Error())
 	}
@@ -212,7 +226,7 @@ func (s *Server) FederationClient(deployment FederationDeployment) fclient.Feder
 	}
 	fedClient := fclient.NewFederationClient(
 		[]*fclient.SigningIdentity{&identity},
-		fclient.WithTransport(deployment.RoundTripper()),
+		fclient.WithTransport(outboundTransport(s.t, deployment)),
 	)
 	return fedClient
 }
@@ -263,7 +277,7 @@ func (s *Server) SendFederationRequest(
 		return err
 	}
 
-	httpClient := fclient.NewClient(fclient.WithTransport(deployment.RoundTripper()))
+	httpClient := fclient.NewClient(fclient.WithTransport(outboundTransport(t, deployment)))
 	start := time.Now()
 	err = httpClient.DoRequestAndParseResponse(ctx, httpReq, resBody)
 
@@ -292,7 +306,7 @@ func (s *Server) DoFederationRequest(
 		return nil, err
 	}
 
-	httpClient := fclient.NewClient(fclient.WithTransport(deployment.RoundTripper()))
+	httpClient := fclient.NewClient(fclient.WithTransport(outboundTransport(t, deployment)))
 	start := time.Now()
 
 	var resp *http.Response
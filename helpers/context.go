@@ -0,0 +1,37 @@
+package helpers
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// how long before the test deadline the context returned by TestContext expires, to leave time for
+// the failure to be reported.
+const testContextGracePeriod = 5 * time.Second
+
+// TestContext returns a context which is cancelled when the test ends, if `t` supports `Cleanup` (as
+// *testing.T does). If the test has a deadline (e.g from `go test -timeout`) the context expires
+// shortly before it, so in-flight requests fail the test with a clear error rather than the test
+// binary panicking. Pass this context to functions such as CSAPI.DoCtx and CSAPI.MustSyncUntilCtx so that
+// long-polls are not leaked when a test ends.
+func TestContext(t ct.TestLike) context.Context {
+	tc, ok := t.(interface{ Cleanup(func()) })
+	if !ok {
+		return context.Background()
+	}
+	var deadline time.Time
+	if td, ok := t.(interface{ Deadline() (time.Time, bool) }); ok {
+		deadline, _ = td.Deadline()
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline.Add(-testContextGracePeriod))
+	}
+	tc.Cleanup(cancel)
+	return ctx
+}
@@ -1,6 +1,7 @@
 package helpers
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -38,12 +39,31 @@ func (w *Waiter) Wait(t ct.TestLike, timeout time.Duration) {
 // If the timeout is reached, the test is failed with the given error message.
 func (w *Waiter) Waitf(t ct.TestLike, timeout time.Duration, errFormat string, args ...interface{}) {
 	t.Helper()
+	w.WaitfCtx(context.Background(), t, timeout, errFormat, args...)
+}
+
+// WaitCtx blocks until Finish() is called, the timeout is reached or the context is cancelled.
+// If the timeout is reached or the context is cancelled, the test is failed.
+func (w *Waiter) WaitCtx(ctx context.Context, t ct.TestLike, timeout time.Duration) {
+	t.Helper()
+	w.WaitfCtx(ctx, t, timeout, "Wait")
+}
+
+// WaitfCtx blocks until Finish() is called, the timeout is reached or the context is cancelled.
+// If the timeout is reached or the context is cancelled, the test is failed with the given error message.
+func (w *Waiter) WaitfCtx(ctx context.Context, t ct.TestLike, timeout time.Duration, errFormat string, args ...interface{}) {
+	t.Helper()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	select {
 	case <-w.ch:
 		return
-	case <-time.After(timeout):
+	case <-timer.C:
 		errmsg := fmt.Sprintf(errFormat, args...)
 		ct.Fatalf(t, "%s: timed out after %f seconds.", errmsg, timeout.Seconds())
+	case <-ctx.Done():
+		errmsg := fmt.Sprintf(errFormat, args...)
+		ct.Fatalf(t, "%s: cancelled: %s", errmsg, context.Cause(ctx))
 	}
 }
 
@@ -0,0 +1,51 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/cttest"
+)
+
+// wait calls WaitCtx in a new goroutine and returns the fatal error, if any.
+func wait(t *testing.T, ctx context.Context, w *Waiter, timeout time.Duration) string {
+	t.Helper()
+	ft := &cttest.FatalT{}
+	return ft.Run(t, func() {
+		w.WaitCtx(ctx, ft, timeout)
+	})
+}
+
+func TestWaiter(t *testing.T) {
+	t.Run("returns when finished", func(t *testing.T) {
+		w := NewWaiter()
+		time.AfterFunc(10*time.Millisecond, w.Finish)
+		if fatal := wait(t, context.Background(), w, time.Minute); fatal != "" {
+			t.Errorf("got failure %q, want none", fatal)
+		}
+		// finishing twice is fine, and later waits return immediately
+		w.Finish()
+		if fatal := wait(t, context.Background(), w, time.Minute); fatal != "" {
+			t.Errorf("got failure %q, want none", fatal)
+		}
+	})
+
+	t.Run("fails the test on timeout", func(t *testing.T) {
+		fatal := wait(t, context.Background(), NewWaiter(), 10*time.Millisecond)
+		if !strings.Contains(fatal, "Wait: timed out") {
+			t.Errorf("got failure %q, want a timeout", fatal)
+		}
+	})
+
+	t.Run("fails the test when the context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		time.AfterFunc(10*time.Millisecond, func() { cancel(fmt.Errorf("test ended")) })
+		fatal := wait(t, ctx, NewWaiter(), time.Minute)
+		if !strings.Contains(fatal, "Wait: cancelled: test ended") {
+			t.Errorf("got failure %q, want it to say the wait was cancelled and why", fatal)
+		}
+	})
+}
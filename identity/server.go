@@ -0,0 +1,478 @@
+// package identity is an EXPERIMENTAL stub identity server, for testing third-party invites and 3PID
+// lookups. It is marked as EXPERIMENTAL as the API may break without warning.
+package identity
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/federation"
+	"github.com/matrix-org/complement/internal/web"
+)
+
+// The ID of the long-term signing key of the identity server.
+const KeyID = "ed25519:0"
+
+// EXPERIMENTAL
+// Server is a stub identity server which implements the parts of `/_matrix/identity/v2` used by homeservers:
+// hash_details, lookup, store-invite, sign-ed25519 and the pubkey endpoints. It has a programmable directory
+// of 3PID to Matrix user ID bindings, see Bind.
+//
+// The identity server is served by a federation.Server, so it shares its server name and TLS certificate,
+// and is reachable from homeservers at `ServerName()`. This means the same server can also handle
+// `/exchange_third_party_invite` requests for rooms it creates:
+//
+//	srv := federation.NewServer(t, deployment,
+//		federation.HandleKeyRequests(),
+//		federation.HandleExchangeThirdPartyInviteRequests(deployment, nil),
+//	)
+//	cancel := srv.Listen()
+//	defer cancel()
+//	is := identity.NewServer(t, deployment, srv)
+type Server struct {
+	t          ct.TestLike
+	deployment federation.FederationDeployment
+	fedSrv     *federation.Server
+
+	// The long-term signing key of the identity server.
+	Priv   ed25519.PrivateKey
+	pepper string
+
+	mu       sync.Mutex
+	bindings map[threePID]string
+	invites  []*Invite
+	// unpadded base64 ephemeral public keys which are valid
+	ephemeralKeys map[string]bool
+}
+
+type threePID struct {
+	medium  string
+	address string
+}
+
+// Invite is a third-party invite stored on the identity server, either by a homeserver calling
+// `/store-invite` or by Server.StoreInvite.
+type Invite struct {
+	Medium  string
+	Address string
+	RoomID  string
+	Sender  string
+	// The token which is the state_key of the m.room.third_party_invite event
+	Token       string
+	DisplayName string
+	// The long-term public key of the identity server, as unpadded base64
+	PublicKey string
+	// The ephemeral key pair for this invite, as unpadded base64. The private key is normally only sent to
+	// the invitee, and can be used with `/sign-ed25519`.
+	EphemeralPublicKey  string
+	EphemeralPrivateKey string
+	// The URL which homeservers use to check PublicKey is still valid
+	KeyValidityURL string
+	// The URL which homeservers use to check EphemeralPublicKey is still valid
+	EphemeralKeyValidityURL string
+	// True if a homeserver has been told about this invite via `/3pid/onbind`
+	Bound bool
+}
+
+// EventContent returns the content of the `m.room.third_party_invite` event for this invite.
+func (inv *Invite) EventContent() map[string]interface{} {
+	return map[string]interface{}{
+		"display_name":     inv.DisplayName,
+		"key_validity_url": inv.KeyValidityURL,
+		"public_key":       inv.PublicKey,
+		"public_keys": []map[string]interface{}{
+			{
+				"public_key":       inv.PublicKey,
+				"key_validity_url": inv.KeyValidityURL,
+			},
+			{
+				"public_key":       inv.EphemeralPublicKey,
+				"key_validity_url": inv.EphemeralKeyValidityURL,
+			},
+		},
+	}
+}
+
+// EXPERIMENTAL
+// NewServer creates a new stub identity server and attaches its routes to `fedSrv`, which must already be
+// listening.
+func NewServer(t ct.TestLike, deployment federation.FederationDeployment, fedSrv *federation.Server) *Server {
+	t.Helper()
+	if !strings.Contains(string(fedSrv.ServerName()), ":") {
+		ct.Fatalf(t, "identity.NewServer: federation server must be listening, call Listen() first")
+	}
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		ct.Fatalf(t, "identity.NewServer: failed to generate signing key: %s", err)
+	}
+	s := &Server{
+		t:             t,
+		deployment:    deployment,
+		fedSrv:        fedSrv,
+		Priv:          priv,
+		pepper:        web.RandomString(16),
+		bindings:      make(map[threePID]string),
+		ephemeralKeys: make(map[string]bool),
+	}
+
+	r := fedSrv.Mux()
+	r.HandleFunc("/_matrix/identity/v2", func(w http.ResponseWriter, req *http.Request) {
+		respond(w, util.JSONResponse{Code: 200, JSON: struct{}{}})
+	}).Methods("GET")
+	r.HandleFunc("/_matrix/identity/v2/account/register", func(w http.ResponseWriter, req *http.Request) {
+		respond(w, util.JSONResponse{Code: 200, JSON: map[string]string{"token": web.RandomString(16)}})
+	}).Methods("POST")
+	r.HandleFunc("/_matrix/identity/v2/terms", func(w http.ResponseWriter, req *http.Request) {
+		respond(w, util.JSONResponse{Code: 200, JSON: map[string]interface{}{"policies": map[string]interface{}{}}})
+	}).Methods("GET")
+	r.HandleFunc("/_matrix/identity/v2/hash_details", s.authenticated(s.handleHashDetails)).Methods("GET")
+	r.HandleFunc("/_matrix/identity/v2/lookup", s.authenticated(s.handleLookup)).Methods("POST")
+	r.HandleFunc("/_matrix/identity/v2/store-invite", s.authenticated(s.handleStoreInvite)).Methods("POST")
+	r.HandleFunc("/_matrix/identity/v2/sign-ed25519", s.authenticated(s.handleSignEd25519)).Methods("POST")
+	r.HandleFunc("/_matrix/identity/v2/pubkey/isvalid", s.handlePubKeyIsValid).Methods("GET")
+	r.HandleFunc("/_matrix/identity/v2/pubkey/ephemeral/isvalid", s.handleEphemeralPubKeyIsValid).Methods("GET")
+	r.HandleFunc("/_matrix/identity/v2/pubkey/{keyID}", s.handlePubKey).Methods("GET")
+	return s
+}
+
+// ServerName returns the server name of the identity server, for use as `id_server`.
+func (s *Server) ServerName() string {
+	return string(s.fedSrv.ServerName())
+}
+
+// PublicKey returns the long-term public key of the identity server, as unpadded base64.
+func (s *Server) PublicKey() string {
+	return base64.RawStdEncoding.EncodeToString(s.Priv.Public().(ed25519.PublicKey))
+}
+
+// Bind adds a binding from the 3PID to `mxid` to the directory, so lookups will return it. Any pending
+// invites for the 3PID are sent to the homeserver of `mxid` via `/_matrix/federation/v1/3pid/onbind`,
+// failing the test if the homeserver does not accept them.
+func (s *Server) Bind(t ct.TestLike, medium, address, mxid string) {
+	t.Helper()
+	s.mu.Lock()
+	s.bindings[threePID{medium, address}] = mxid
+	var pending []*Invite
+	for _, inv := range s.invites {
+		if inv.Medium == medium && inv.Address == address && !inv.Bound {
+			inv.Bound = true
+			pending = append(pending, inv)
+		}
+	}
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	userID, err := spec.NewUserID(mxid, true)
+	if err != nil {
+		ct.Fatalf(t, "identity.Server.Bind: invalid mxid %s: %s", mxid, err)
+	}
+	invites := make([]map[string]interface{}, 0, len(pending))
+	for _, inv := range pending {
+		invites = append(invites, map[string]interface{}{
+			"medium":  inv.Medium,
+			"address": inv.Address,
+			"mxid":    mxid,
+			"room_id": inv.RoomID,
+			"sender":  inv.Sender,
+			"signed":  s.sign(t, s.Priv, mxid, inv.Sender, inv.Token),
+		})
+	}
+	req := fclient.NewFederationRequest("POST", s.fedSrv.ServerName(), userID.Domain(), "/_matrix/federation/v1/3pid/onbind")
+	if err = req.SetContent(map[string]interface{}{
+		"medium":  medium,
+		"address": address,
+		"mxid":    mxid,
+		"invites": invites,
+	}); err != nil {
+		ct.Fatalf(t, "identity.Server.Bind: failed to set content: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := s.fedSrv.DoFederationRequest(ctx, t, s.deployment, req)
+	if err != nil {
+		ct.Fatalf(t, "identity.Server.Bind: /3pid/onbind failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := io.ReadAll(res.Body)
+		ct.Fatalf(t, "identity.Server.Bind: /3pid/onbind returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+}
+
+// Unbind removes the binding for the 3PID from the directory.
+func (s *Server) Unbind(medium, address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bindings, threePID{medium, address})
+}
+
+// Invites returns the invites stored so far, in the order they were stored.
+func (s *Server) Invites() []Invite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invites := make([]Invite, 0, len(s.invites))
+	for _, inv := range s.invites {
+		invites = append(invites, *inv)
+	}
+	return invites
+}
+
+// StoreInvite stores an invite for the 3PID, as if `sender` had invited it to `roomID`. This is useful
+// for creating `m.room.third_party_invite` events in rooms on a federation.Server, see Invite.EventContent.
+func (s *Server) StoreInvite(t ct.TestLike, medium, address, roomID, sender string) Invite {
+	t.Helper()
+	return *s.storeInvite(t, medium, address, roomID, sender)
+}
+
+// SignInvite returns the `signed` block for `mxid` accepting the invite, as sent by the invitee's
+// homeserver in `/exchange_third_party_invite` and in the `third_party_invite` of the join event.
+func (s *Server) SignInvite(t ct.TestLike, inv Invite, mxid string) map[string]interface{} {
+	t.Helper()
+	return s.sign(t, s.Priv, mxid, inv.Sender, inv.Token)
+}
+
+func (s *Server) storeInvite(t ct.TestLike, medium, address, roomID, sender string) *Invite {
+	ephemeralPub, ephemeralPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		ct.Fatalf(t, "identity.Server: failed to generate ephemeral key: %s", err)
+	}
+	base := "https://" + s.ServerName() + "/_matrix/identity/v2/pubkey"
+	inv := &Invite{
+		Medium:                  medium,
+		Address:                 address,
+		RoomID:                  roomID,
+		Sender:                  sender,
+		Token:                   web.RandomString(16),
+		DisplayName:             redact(address),
+		PublicKey:               s.PublicKey(),
+		EphemeralPublicKey:      base64.RawStdEncoding.EncodeToString(ephemeralPub),
+		EphemeralPrivateKey:     base64.RawStdEncoding.EncodeToString(ephemeralPriv.Seed()),
+		KeyValidityURL:          base + "/isvalid",
+		EphemeralKeyValidityURL: base + "/ephemeral/isvalid",
+	}
+	s.mu.Lock()
+	s.invites = append(s.invites, inv)
+	s.ephemeralKeys[inv.EphemeralPublicKey] = true
+	s.mu.Unlock()
+	return inv
+}
+
+// sign returns a `signed` block for the mxid and token, signed by `priv`.
+func (s *Server) sign(t ct.TestLike, priv ed25519.PrivateKey, mxid, sender, token string) map[string]interface{} {
+	signed, err := json.Marshal(map[string]string{
+		"mxid":   mxid,
+		"sender": sender,
+		"token":  token,
+	})
+	if err != nil {
+		ct.Fatalf(t, "identity.Server: failed to marshal signed block: %s", err)
+	}
+	signed, err = gomatrixserverlib.SignJSON(s.ServerName(), KeyID, priv, signed)
+	if err != nil {
+		ct.Fatalf(t, "identity.Server: failed to sign: %s", err)
+	}
+	var res map[string]interface{}
+	if err = json.Unmarshal(signed, &res); err != nil {
+		ct.Fatalf(t, "identity.Server: failed to unmarshal signed block: %s", err)
+	}
+	return res
+}
+
+// authenticated wraps a handler which requires an access token. Any token is accepted.
+func (s *Server) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") && req.URL.Query().Get("access_token") == "" {
+			respond(w, util.JSONResponse{Code: 401, JSON: spec.MatrixError{ErrCode: "M_UNAUTHORIZED", Err: "complement: missing access token"}})
+			return
+		}
+		h(w, req)
+	}
+}
+
+func (s *Server) handleHashDetails(w http.ResponseWriter, req *http.Request) {
+	respond(w, util.JSONResponse{Code: 200, JSON: map[string]interface{}{
+		"algorithms":    []string{"none", "sha256"},
+		"lookup_pepper": s.pepper,
+	}})
+}
+
+func (s *Server) handleLookup(w http.ResponseWriter, req *http.Request) {
+	body, ok := readJSON(w, req)
+	if !ok {
+		return
+	}
+	algorithm := body.Get("algorithm").Str
+	if algorithm != "none" && algorithm != "sha256" {
+		respond(w, util.JSONResponse{Code: 400, JSON: spec.MatrixError{ErrCode: "M_INVALID_PARAM", Err: "complement: unknown algorithm"}})
+		return
+	}
+	if body.Get("pepper").Str != s.pepper {
+		respond(w, util.JSONResponse{Code: 400, JSON: map[string]string{
+			"errcode":       "M_INVALID_PEPPER",
+			"error":         "complement: unknown or invalid pepper",
+			"algorithm":     "sha256",
+			"lookup_pepper": s.pepper,
+		}})
+		return
+	}
+
+	s.mu.Lock()
+	hashed := make(map[string]string, len(s.bindings))
+	for pid, mxid := range s.bindings {
+		hashed[hashAddress(algorithm, pid.medium, pid.address, s.pepper)] = mxid
+	}
+	s.mu.Unlock()
+	mappings := map[string]string{}
+	for _, address := range body.Get("addresses").Array() {
+		if mxid, ok := hashed[address.Str]; ok {
+			mappings[address.Str] = mxid
+		}
+	}
+	respond(w, util.JSONResponse{Code: 200, JSON: map[string]interface{}{
+		"mappings": mappings,
+	}})
+}
+
+func (s *Server) handleStoreInvite(w http.ResponseWriter, req *http.Request) {
+	body, ok := readJSON(w, req)
+	if !ok {
+		return
+	}
+	medium, address := body.Get("medium").Str, body.Get("address").Str
+	if medium == "" || address == "" || body.Get("room_id").Str == "" || body.Get("sender").Str == "" {
+		respond(w, util.JSONResponse{Code: 400, JSON: spec.MissingParam("complement: missing medium, address, room_id or sender")})
+		return
+	}
+	s.mu.Lock()
+	_, bound := s.bindings[threePID{medium, address}]
+	s.mu.Unlock()
+	if bound {
+		respond(w, util.JSONResponse{Code: 400, JSON: spec.MatrixError{ErrCode: "M_THREEPID_IN_USE", Err: "complement: 3PID is already bound"}})
+		return
+	}
+	inv := s.storeInvite(s.t, medium, address, body.Get("room_id").Str, body.Get("sender").Str)
+	content := inv.EventContent()
+	respond(w, util.JSONResponse{Code: 200, JSON: map[string]interface{}{
+		"token":        inv.Token,
+		"display_name": inv.DisplayName,
+		"public_key":   inv.PublicKey,
+		"public_keys":  content["public_keys"],
+	}})
+}
+
+func (s *Server) handleSignEd25519(w http.ResponseWriter, req *http.Request) {
+	body, ok := readJSON(w, req)
+	if !ok {
+		return
+	}
+	keyBytes, err := base64.RawStdEncoding.DecodeString(body.Get("private_key").Str)
+	if err != nil {
+		keyBytes, err = base64.RawURLEncoding.DecodeString(body.Get("private_key").Str)
+	}
+	var priv ed25519.PrivateKey
+	switch {
+	case err != nil:
+	case len(keyBytes) == ed25519.SeedSize:
+		priv = ed25519.NewKeyFromSeed(keyBytes)
+	case len(keyBytes) == ed25519.PrivateKeySize:
+		priv = ed25519.PrivateKey(keyBytes)
+	}
+	if priv == nil {
+		respond(w, util.JSONResponse{Code: 400, JSON: spec.InvalidParam("complement: invalid private_key")})
+		return
+	}
+	mxid, token := body.Get("mxid").Str, body.Get("token").Str
+	if mxid == "" || token == "" {
+		respond(w, util.JSONResponse{Code: 400, JSON: spec.MissingParam("complement: missing mxid or token")})
+		return
+	}
+	var sender string
+	s.mu.Lock()
+	for _, inv := range s.invites {
+		if inv.Token == token {
+			sender = inv.Sender
+		}
+	}
+	s.mu.Unlock()
+	respond(w, util.JSONResponse{Code: 200, JSON: s.sign(s.t, priv, mxid, sender, token)})
+}
+
+func (s *Server) handlePubKey(w http.ResponseWriter, req *http.Request) {
+	if mux.Vars(req)["keyID"] != KeyID {
+		respond(w, util.JSONResponse{Code: 404, JSON: spec.NotFound("complement: unknown key")})
+		return
+	}
+	respond(w, util.JSONResponse{Code: 200, JSON: map[string]string{"public_key": s.PublicKey()}})
+}
+
+func (s *Server) handlePubKeyIsValid(w http.ResponseWriter, req *http.Request) {
+	respond(w, util.JSONResponse{Code: 200, JSON: map[string]bool{
+		"valid": req.URL.Query().Get("public_key") == s.PublicKey(),
+	}})
+}
+
+func (s *Server) handleEphemeralPubKeyIsValid(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	valid := s.ephemeralKeys[req.URL.Query().Get("public_key")]
+	s.mu.Unlock()
+	respond(w, util.JSONResponse{Code: 200, JSON: map[string]bool{"valid": valid}})
+}
+
+// hashAddress returns the address to look up for the 3PID with the given algorithm, as per
+// https://spec.matrix.org/v1.11/identity-service-api/#client-behaviour
+func hashAddress(algorithm, medium, address, pepper string) string {
+	if algorithm == "none" {
+		return address + " " + medium
+	}
+	hash := sha256.Sum256([]byte(address + " " + medium + " " + pepper))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// HashAddress returns the sha256 lookup hash of the 3PID for the given pepper, for tests which call
+// `/lookup` directly.
+func HashAddress(medium, address, pepper string) string {
+	return hashAddress("sha256", medium, address, pepper)
+}
+
+// redact returns a display name for the 3PID which does not reveal it entirely, like sydent does.
+func redact(address string) string {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || len(local) < 2 {
+		return "..."
+	}
+	return local[:len(local)/2] + "...@" + domain
+}
+
+func readJSON(w http.ResponseWriter, req *http.Request) (gjson.Result, bool) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil || !gjson.ValidBytes(body) {
+		respond(w, util.JSONResponse{Code: 400, JSON: spec.NotJSON("complement: request body is not JSON")})
+		return gjson.Result{}, false
+	}
+	return gjson.ParseBytes(body), true
+}
+
+func respond(w http.ResponseWriter, res util.JSONResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Code)
+	b, _ := json.Marshal(res.JSON)
+	w.Write(b)
+}
@@ -0,0 +1,367 @@
+// package idp is an EXPERIMENTAL fake OpenID Connect identity provider, for testing SSO login
+// (`m.login.sso`) on homeservers which act as an OpenID Connect relying party.
+// It is marked as EXPERIMENTAL as the API may break without warning.
+package idp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/web"
+)
+
+// Subset of Deployment used by the identity provider.
+type IdPDeployment interface {
+	GetConfig() *config.Complement
+}
+
+// User is the identity a test logs in as at the identity provider. Homeservers are expected to map
+// PreferredUsername to the localpart and Name to the displayname.
+type User struct {
+	// The stable subject identifier. Required.
+	Subject           string
+	PreferredUsername string
+	Name              string
+	Email             string
+}
+
+func (u User) claims() map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": u.Subject,
+	}
+	if u.PreferredUsername != "" {
+		claims["preferred_username"] = u.PreferredUsername
+	}
+	if u.Name != "" {
+		claims["name"] = u.Name
+	}
+	if u.Email != "" {
+		claims["email"] = u.Email
+		claims["email_verified"] = true
+	}
+	return claims
+}
+
+// EXPERIMENTAL
+// Server is a fake OpenID Connect identity provider. The authorization endpoint serves a login form
+// which creates a session for whatever identity is submitted to it; use Authenticator to submit it.
+type Server struct {
+	srv *web.Server
+	key *rsa.PrivateKey
+	kid string
+
+	// The issuer URL as seen by homeservers.
+	Issuer string
+
+	mu     sync.Mutex
+	codes  map[string]*session
+	tokens map[string]*session
+}
+
+type session struct {
+	User     User
+	ClientID string
+	Nonce    string
+	Used     bool
+}
+
+// EXPERIMENTAL
+// NewServer creates and starts a fake identity provider listening on COMPLEMENT_SSO_IDP_PORT, or a
+// random port if it is not set. Only when COMPLEMENT_SSO_IDP_PORT is set will deployed homeservers be
+// configured to use this provider. The server is closed when the test ends.
+func NewServer(t *testing.T, deployment IdPDeployment) *Server {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		ct.Fatalf(t, "idp.NewServer failed to generate RSA key: %s", err)
+	}
+	s := &Server{
+		key:    key,
+		kid:    "complement_" + web.RandomString(4),
+		codes:  make(map[string]*session),
+		tokens: make(map[string]*session),
+	}
+	cfg := deployment.GetConfig()
+	s.srv = web.NewServerOnPort(t, cfg, cfg.SSOIdPPort, func(r *mux.Router) {
+		r.HandleFunc("/.well-known/openid-configuration", s.handleDiscovery).Methods("GET")
+		r.HandleFunc("/jwks.json", s.handleJWKS).Methods("GET")
+		r.HandleFunc("/authorize", s.handleAuthorize).Methods("GET")
+		r.HandleFunc("/login", s.handleLogin).Methods("POST")
+		r.HandleFunc("/token", s.handleToken).Methods("POST")
+		r.HandleFunc("/userinfo", s.handleUserInfo).Methods("GET", "POST")
+	})
+	s.Issuer = s.srv.URL + "/"
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+// HTTPClient returns an HTTP client with a cookie jar which can talk to this provider from the
+// machine running Complement, for use with client.SSOLoginOpts. Requests to the issuer's host are
+// sent to the local port the server is listening on, as the issuer hostname is only resolvable from
+// inside containers. Redirects are not followed.
+func (s *Server) HTTPClient() *http.Client {
+	issuerURL, _ := url.Parse(s.Issuer)
+	localAddr := fmt.Sprintf("127.0.0.1:%d", s.srv.Port)
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Jar:     jar,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr == issuerURL.Host {
+					addr = localAddr
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Authenticator returns a client.SSOAuthenticator which submits the login form for the given user.
+func (s *Server) Authenticator(user User) client.SSOAuthenticator {
+	return func(t ct.TestLike, httpClient *http.Client, loginPage *http.Response) *http.Response {
+		t.Helper()
+		loginPage.Body.Close()
+		if !strings.HasPrefix(loginPage.Request.URL.String(), s.Issuer+"authorize") {
+			ct.Fatalf(t, "idp.Authenticator: expected the login page at %sauthorize but got %s", s.Issuer, loginPage.Request.URL.String())
+		}
+		form := url.Values{
+			"sub":                {user.Subject},
+			"preferred_username": {user.PreferredUsername},
+			"name":               {user.Name},
+			"email":              {user.Email},
+		}
+		res, err := httpClient.PostForm(s.Issuer+"login?"+loginPage.Request.URL.RawQuery, form)
+		if err != nil {
+			ct.Fatalf(t, "idp.Authenticator: failed to submit login form: %s", err)
+		}
+		return res
+	}
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, req *http.Request) {
+	web.WriteJSON(w, 200, map[string]interface{}{
+		"issuer":                                s.Issuer,
+		"authorization_endpoint":                s.Issuer + "authorize",
+		"token_endpoint":                        s.Issuer + "token",
+		"userinfo_endpoint":                     s.Issuer + "userinfo",
+		"jwks_uri":                              s.Issuer + "jwks.json",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"claims_supported":                      []string{"sub", "preferred_username", "name", "email", "email_verified"},
+	})
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, req *http.Request) {
+	pub := s.key.PublicKey
+	web.WriteJSON(w, 200, map[string]interface{}{
+		"keys": []interface{}{
+			map[string]interface{}{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": s.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			},
+		},
+	})
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Complement IdP</title></head>
+<body>
+<form method="post" action="/login?{{.Query}}">
+<label>Subject <input name="sub"></label>
+<label>Username <input name="preferred_username"></label>
+<label>Name <input name="name"></label>
+<label>Email <input name="email"></label>
+<input type="submit" value="Log in">
+</form>
+</body>
+</html>
+`))
+
+func (s *Server) handleAuthorize(w http.ResponseWriter, req *http.Request) {
+	if errmsg := validateAuthorizationRequest(req.URL.Query()); errmsg != "" {
+		http.Error(w, errmsg, 400)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = loginPage.Execute(w, struct{ Query template.URL }{template.URL(req.URL.RawQuery)})
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if errmsg := validateAuthorizationRequest(q); errmsg != "" {
+		http.Error(w, errmsg, 400)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	redirectURI, _ := url.Parse(q.Get("redirect_uri"))
+	params := url.Values{}
+	if q.Get("state") != "" {
+		params.Set("state", q.Get("state"))
+	}
+	user := User{
+		Subject:           req.PostForm.Get("sub"),
+		PreferredUsername: req.PostForm.Get("preferred_username"),
+		Name:              req.PostForm.Get("name"),
+		Email:             req.PostForm.Get("email"),
+	}
+	if user.Subject == "" {
+		params.Set("error", "access_denied")
+		params.Set("error_description", "no subject given")
+	} else {
+		code := web.RandomString(16)
+		s.mu.Lock()
+		s.codes[code] = &session{
+			User:     user,
+			ClientID: q.Get("client_id"),
+			Nonce:    q.Get("nonce"),
+		}
+		s.mu.Unlock()
+		params.Set("code", code)
+	}
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, req, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", err.Error())
+		return
+	}
+	clientID, clientSecret, ok := req.BasicAuth()
+	if !ok {
+		clientID = req.PostForm.Get("client_id")
+		clientSecret = req.PostForm.Get("client_secret")
+	}
+	if clientID != config.SSOIdPClientID || clientSecret != config.SSOIdPClientSecret {
+		writeOAuthError(w, 401, "invalid_client", "bad client credentials")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.PostForm.Get("grant_type") != "authorization_code" {
+		writeOAuthError(w, 400, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	sess := s.codes[req.PostForm.Get("code")]
+	if sess == nil || sess.Used {
+		writeOAuthError(w, 400, "invalid_grant", "unknown or used code")
+		return
+	}
+	sess.Used = true
+	accessToken := web.RandomString(16)
+	s.tokens[accessToken] = sess
+
+	now := time.Now()
+	idClaims := sess.User.claims()
+	idClaims["iss"] = s.Issuer
+	idClaims["aud"] = sess.ClientID
+	idClaims["iat"] = now.Unix()
+	idClaims["exp"] = now.Add(5 * time.Minute).Unix()
+	if sess.Nonce != "" {
+		idClaims["nonce"] = sess.Nonce
+	}
+	idToken, err := s.signJWT(idClaims)
+	if err != nil {
+		writeOAuthError(w, 500, "server_error", err.Error())
+		return
+	}
+	web.WriteJSON(w, 200, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) handleUserInfo(w http.ResponseWriter, req *http.Request) {
+	accessToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	sess := s.tokens[accessToken]
+	s.mu.Unlock()
+	if sess == nil {
+		writeOAuthError(w, 401, "invalid_token", "unknown access token")
+		return
+	}
+	web.WriteJSON(w, 200, sess.User.claims())
+}
+
+// signJWT returns an RS256 signed JWT with the given claims.
+func (s *Server) signJWT(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": s.kid,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// validateAuthorizationRequest returns an error message if the request is malformed.
+func validateAuthorizationRequest(q url.Values) string {
+	if q.Get("client_id") != config.SSOIdPClientID {
+		return "unknown client_id"
+	}
+	if q.Get("response_type") != "code" {
+		return "response_type must be code"
+	}
+	if _, err := url.ParseRequestURI(q.Get("redirect_uri")); err != nil {
+		return "invalid redirect_uri"
+	}
+	return ""
+}
+
+func writeOAuthError(w http.ResponseWriter, code int, errcode, description string) {
+	web.WriteJSON(w, code, map[string]interface{}{
+		"error":             errcode,
+		"error_description": description,
+	})
+}
@@ -0,0 +1,169 @@
+// Package coverage records which endpoints are hit during a test run, so they can be compared with the
+// endpoints in the spec by cmd/endpoint-coverage.
+package coverage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/matrix-org/complement/config"
+)
+
+// Placeholder replaces path segments which are identifiers rather than part of the endpoint
+// e.g room IDs, so requests to the same endpoint are recorded together.
+const Placeholder = "{}"
+
+var (
+	mu   sync.Mutex
+	hits = make(map[endpointKey]int)
+)
+
+type endpointKey struct {
+	method string
+	path   string
+}
+
+// File is the coverage written by a single test package.
+type File struct {
+	Package   string     `json:"package"`
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// Endpoint is a templated path and the number of times it was requested.
+type Endpoint struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Count  int    `json:"count"`
+}
+
+// RoundTripper returns an http.RoundTripper which records every request made through `wrap`, if
+// COMPLEMENT_COVERAGE_DIR is set. Otherwise returns `wrap`.
+func RoundTripper(cfg *config.Complement, wrap http.RoundTripper) http.RoundTripper {
+	if wrap == nil {
+		wrap = http.DefaultTransport
+	}
+	if cfg == nil || cfg.CoverageDir == "" {
+		return wrap
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		Record(req.Method, req.URL)
+		return wrap.RoundTrip(req)
+	})
+}
+
+// Handler returns an http.Handler which records every request served by `h`, if COMPLEMENT_COVERAGE_DIR
+// is set. Otherwise returns `h`.
+func Handler(cfg *config.Complement, h http.Handler) http.Handler {
+	if cfg == nil || cfg.CoverageDir == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		Record(req.Method, req.URL)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Record records a request to `u`.
+func Record(method string, u *url.URL) {
+	key := endpointKey{method: method, path: Template(u.EscapedPath())}
+	mu.Lock()
+	defer mu.Unlock()
+	hits[key]++
+}
+
+// Template replaces identifiers in an escaped path with Placeholder. Identifiers are segments starting with
+// a Matrix sigil e.g room IDs and user IDs, segments which are entirely digits e.g transaction IDs, and long
+// random-looking segments e.g media IDs. Other segments are left escaped.
+func Template(escapedPath string) string {
+	segments := strings.Split(escapedPath, "/")
+	for i, seg := range segments {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			unescaped = seg
+		}
+		// other segments are left escaped, so an escaped / does not add a segment
+		if isIdentifier(unescaped) {
+			segments[i] = Placeholder
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isIdentifier(seg string) bool {
+	if seg == "" {
+		return false
+	}
+	if strings.ContainsAny(seg[:1], "!$@#+") {
+		return true
+	}
+	var letters, digits int
+	for _, r := range seg {
+		switch {
+		case unicode.IsDigit(r):
+			digits++
+		case unicode.IsLetter(r):
+			letters++
+		}
+	}
+	if letters == 0 && digits > 0 {
+		return true
+	}
+	return len(seg) >= 16 && letters > 0 && digits > 0 && !strings.Contains(seg, ".")
+}
+
+// WriteFile writes every endpoint recorded so far to `$COMPLEMENT_COVERAGE_DIR/<package>.json`. Does
+// nothing if COMPLEMENT_COVERAGE_DIR is not set.
+func WriteFile(cfg *config.Complement) error {
+	if cfg == nil || cfg.CoverageDir == "" {
+		return nil
+	}
+	f := File{
+		Package:   cfg.PackageNamespace,
+		Endpoints: []Endpoint{},
+	}
+	mu.Lock()
+	for key, count := range hits {
+		f.Endpoints = append(f.Endpoints, Endpoint{Method: key.method, Path: key.path, Count: count})
+	}
+	mu.Unlock()
+	sort.Slice(f.Endpoints, func(i, j int) bool {
+		if f.Endpoints[i].Path != f.Endpoints[j].Path {
+			return f.Endpoints[i].Path < f.Endpoints[j].Path
+		}
+		return f.Endpoints[i].Method < f.Endpoints[j].Method
+	})
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.CoverageDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cfg.CoverageDir, cfg.PackageNamespace+".json"), b, 0644)
+}
+
+// ReadFile reads a file written by WriteFile.
+func ReadFile(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,60 @@
+package coverage
+
+import "testing"
+
+func TestTemplate(t *testing.T) {
+	testCases := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"room ID", "/_matrix/client/v3/rooms/%21abc%3Ahs1/state", "/_matrix/client/v3/rooms/{}/state"},
+		{"user ID", "/_matrix/client/v3/profile/@alice:hs1/displayname", "/_matrix/client/v3/profile/{}/displayname"},
+		{"room alias with an escaped slash", "/_matrix/client/v3/directory/room/%23foo%2Fbar%3Ahs1", "/_matrix/client/v3/directory/room/{}"},
+		{"event ID", "/_matrix/client/v3/rooms/%21abc%3Ahs1/event/%24ev", "/_matrix/client/v3/rooms/{}/event/{}"},
+		{"digit-only transaction ID", "/_matrix/client/v3/rooms/%21abc%3Ahs1/send/m.room.message/1234", "/_matrix/client/v3/rooms/{}/send/m.room.message/{}"},
+		{"long mixed media ID", "/_matrix/client/v1/media/download/hs1/abcdEFGH12345678", "/_matrix/client/v1/media/download/hs1/{}"},
+		{"short mixed segments are kept", "/_matrix/client/r0/rooms/%21abc%3Ahs1/v3abc", "/_matrix/client/r0/rooms/{}/v3abc"},
+		{"event type with digits and dots", "/_matrix/client/v3/user/@alice:hs1/account_data/org.matrix.msc3890.local_notification_settings", "/_matrix/client/v3/user/{}/account_data/org.matrix.msc3890.local_notification_settings"},
+		{"state key with an escaped slash stays one segment", "/_matrix/client/v3/rooms/%21abc%3Ahs1/state/m.room.topic/foo%2Fbar", "/_matrix/client/v3/rooms/{}/state/m.room.topic/foo%2Fbar"},
+		{"empty state key", "/_matrix/client/v3/rooms/%21abc%3Ahs1/state/m.room.name/", "/_matrix/client/v3/rooms/{}/state/m.room.name/"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Template(tc.path); got != tc.want {
+				t.Errorf("Template(%s): got %s, want %s", tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsIdentifier(t *testing.T) {
+	testCases := []struct {
+		seg  string
+		want bool
+	}{
+		{"", false},
+		{"!room:hs1", true},
+		{"$event", true},
+		{"@alice:hs1", true},
+		{"#alias:hs1", true},
+		{"+group:hs1", true},
+		{"0", true},
+		{"1234567890", true},
+		{"1.5", true},
+		{"v3", false},
+		{"r0", false},
+		{"sync", false},
+		{"m.room.message", false},
+		{"abcdEFGH1234567", false},
+		{"abcdEFGH12345678", true},
+		{"abcdefghijklmnopqrstuvwxyz", false},
+		{"org.matrix.msc2716.insertion", false},
+		{"foo/bar", false},
+	}
+	for _, tc := range testCases {
+		if got := isIdentifier(tc.seg); got != tc.want {
+			t.Errorf("isIdentifier(%q): got %v, want %v", tc.seg, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Package cttest provides a ct.TestLike for unit testing functions which fail the test.
+package cttest
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FatalT is a ct.TestLike which records the fatal error and stops the goroutine, like testing.T.
+// Functions under test must be run via Run.
+type FatalT struct {
+	mu    sync.Mutex
+	fatal string
+}
+
+func (t *FatalT) Helper()                                {}
+func (t *FatalT) Logf(msg string, args ...interface{})   {}
+func (t *FatalT) Skipf(msg string, args ...interface{})  { t.Fatalf(msg, args...) }
+func (t *FatalT) Error(args ...interface{})              { t.Fatalf("%s", fmt.Sprint(args...)) }
+func (t *FatalT) Errorf(msg string, args ...interface{}) { t.Fatalf(msg, args...) }
+func (t *FatalT) Fatalf(msg string, args ...interface{}) {
+	t.mu.Lock()
+	t.fatal = fmt.Sprintf(msg, args...)
+	t.mu.Unlock()
+	runtime.Goexit()
+}
+func (t *FatalT) Failed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.fatal != ""
+}
+func (t *FatalT) Name() string { return "FatalT" }
+
+// Run calls fn in a new goroutine and returns the fatal error, failing the test if fn does not
+// finish within 5s.
+func (ft *FatalT) Run(t *testing.T, fn func()) string {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not return within 5s")
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.fatal
+}
@@ -0,0 +1,94 @@
+package docker
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/complement/config"
+)
+
+// The URL line of a registration made by generateASRegistrationYaml for an application service without a URL.
+const emptyASURLLine = "url: ''\n"
+
+// appServiceHost listens on behalf of an application service which has no URL in its blueprint, so that
+// tests can serve its requests in-process via Deployment.ServeApplicationService. Until then, transactions
+// are acknowledged and dropped, and queries are rejected, so the homeserver does not back off.
+type appServiceHost struct {
+	url string
+	srv *http.Server
+
+	mu      sync.Mutex
+	handler http.Handler
+}
+
+// newAppServiceHostsForRegistrations starts an appServiceHost for each registration without a URL, and rewrites
+// the registration to point to it. Returns the hosts keyed on application service ID.
+func newAppServiceHostsForRegistrations(cfg *config.Complement, asIDToRegistrationMap map[string]string) (map[string]*appServiceHost, error) {
+	hosts := make(map[string]*appServiceHost)
+	for asID, registration := range asIDToRegistrationMap {
+		if !strings.Contains(registration, emptyASURLLine) {
+			continue
+		}
+		host, err := newAppServiceHost(cfg)
+		if err != nil {
+			closeAppServiceHosts(hosts)
+			return nil, fmt.Errorf("failed to listen for application service %s: %w", asID, err)
+		}
+		hosts[asID] = host
+		asIDToRegistrationMap[asID] = strings.Replace(registration, emptyASURLLine, fmt.Sprintf("url: '%s'\n", host.url), 1)
+	}
+	return hosts, nil
+}
+
+func newAppServiceHost(cfg *config.Complement) (*appServiceHost, error) {
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		return nil, err
+	}
+	host := &appServiceHost{
+		url: fmt.Sprintf("http://%s:%d", cfg.HostnameRunningComplement, ln.Addr().(*net.TCPAddr).Port),
+	}
+	host.srv = &http.Server{Handler: host}
+	go func() {
+		err := host.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("appServiceHost: Serve failed: %s", err)
+		}
+	}()
+	return host, nil
+}
+
+func (h *appServiceHost) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	handler := h.handler
+	h.mu.Unlock()
+	if handler != nil {
+		handler.ServeHTTP(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method == "PUT" && strings.Contains(req.URL.Path, "/transactions/") {
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+		return
+	}
+	w.WriteHeader(404)
+	w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"no application service is listening"}`))
+}
+
+// setHandler serves requests with `handler`, or the default handler if nil.
+func (h *appServiceHost) setHandler(handler http.Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handler = handler
+}
+
+func closeAppServiceHosts(hosts map[string]*appServiceHost) {
+	for _, host := range hosts {
+		host.srv.Close()
+	}
+}
@@ -389,6 +389,9 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 		}
 	}
 	d.log("%s : deployed base image to %s (%s)\n", contextStr, dep.BaseURL, dep.ContainerID)
+	// the container is committed with the application service registrations, which are rewritten
+	// again when the blueprint is deployed, so stop listening once the instructions have run
+	defer closeAppServiceHosts(dep.appServiceHosts)
 	err = runner.Run(hs, dep.BaseURL)
 	if err != nil {
 		d.log("%s : failed to run instructions: %s\n", contextStr, err)
@@ -434,11 +437,35 @@ func generateASRegistrationYaml(as b.ApplicationService) string {
 		fmt.Sprintf("push_ephemeral: %v\\n", as.SendEphemeral) +
 		fmt.Sprintf("org.matrix.msc3202: %v\\n", as.EnableEncryption) +
 		"namespaces:\\n" +
-		"  users:\\n" +
-		"    - exclusive: false\\n" +
-		"      regex: .*\\n" +
-		"  rooms: []\\n" +
-		"  aliases: []\\n"
+		generateASNamespacesYaml(as.Namespaces)
+}
+
+func generateASNamespacesYaml(namespaces *b.ApplicationServiceNamespaces) string {
+	if namespaces == nil {
+		namespaces = &b.ApplicationServiceNamespaces{
+			Users: []b.ApplicationServiceNamespace{{Regex: ".*", Exclusive: false}},
+		}
+	}
+	var yaml string
+	for _, kind := range []struct {
+		name       string
+		namespaces []b.ApplicationServiceNamespace
+	}{
+		{"users", namespaces.Users},
+		{"rooms", namespaces.Rooms},
+		{"aliases", namespaces.Aliases},
+	} {
+		if len(kind.namespaces) == 0 {
+			yaml += fmt.Sprintf("  %s: []\\n", kind.name)
+			continue
+		}
+		yaml += fmt.Sprintf("  %s:\\n", kind.name)
+		for _, ns := range kind.namespaces {
+			yaml += fmt.Sprintf("    - exclusive: %v\\n", ns.Exclusive) +
+				fmt.Sprintf("      regex: '%s'\\n", strings.ReplaceAll(ns.Regex, "'", "''"))
+		}
+	}
+	return yaml
 }
 
 // createNetworkIfNotExists creates a docker network and returns its name.
@@ -218,6 +218,7 @@ func (d *Deployer) PrintLogs(dep *Deployment) {
 
 // Destroy a deployment. This will kill all running containers.
 func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool, testName string, failed bool) {
+	complementRuntime.ForgetDeployment(dep)
 	for _, hsDep := range dep.HS {
 		if printServerLogs {
 			// If we want the logs we gracefully stop the containers to allow
@@ -252,6 +253,7 @@ func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool, testName strin
 		if err != nil {
 			log.Printf("Destroy: Failed to remove container %s : %s\n", hsDep.ContainerID, err)
 		}
+		closeAppServiceHosts(hsDep.appServiceHosts)
 	}
 }
 
@@ -365,6 +367,26 @@ func deployImage(
 	env := []string{
 		"SERVER_NAME=" + hsName,
 	}
+	if issuer := cfg.OAuthStubIssuer(); issuer != "" {
+		env = append(env,
+			"COMPLEMENT_OAUTH_ISSUER="+issuer,
+			"COMPLEMENT_OAUTH_CLIENT_ID="+config.OAuthStubClientID,
+			"COMPLEMENT_OAUTH_CLIENT_SECRET="+config.OAuthStubClientSecret,
+		)
+	}
+	if issuer := cfg.SSOIdPIssuer(); issuer != "" {
+		env = append(env,
+			"COMPLEMENT_SSO_IDP_ISSUER="+issuer,
+			"COMPLEMENT_SSO_IDP_CLIENT_ID="+config.SSOIdPClientID,
+			"COMPLEMENT_SSO_IDP_CLIENT_SECRET="+config.SSOIdPClientSecret,
+		)
+	}
+	if host, port := cfg.SMTPSinkHostPort(); host != "" {
+		env = append(env,
+			"COMPLEMENT_SMTP_HOST="+host,
+			fmt.Sprintf("COMPLEMENT_SMTP_PORT=%d", port),
+		)
+	}
 	if cfg.EnvVarsPropagatePrefix != "" {
 		for _, ev := range os.Environ() {
 			if strings.HasPrefix(ev, cfg.EnvVarsPropagatePrefix) {
@@ -419,6 +441,19 @@ func deployImage(
 	stubDeployment := &HomeserverDeployment{
 		ContainerID: containerID,
 	}
+	// Listen on behalf of application services without a URL
+	appServiceHosts, err := newAppServiceHostsForRegistrations(cfg, asIDToRegistrationMap)
+	if err != nil {
+		return stubDeployment, err
+	}
+	stubDeployment.appServiceHosts = appServiceHosts
+	// callers discard the deployment on error, so stop listening unless the homeserver is up
+	deployed := false
+	defer func() {
+		if !deployed {
+			closeAppServiceHosts(appServiceHosts)
+		}
+	}()
 
 	// Create the application service files
 	for asID, registration := range asIDToRegistrationMap {
@@ -486,6 +521,11 @@ func deployImage(
 		ApplicationServices: asIDToRegistrationFromLabels(inspect.Config.Labels),
 		DeviceIDs:           deviceIDsFromLabels(inspect.Config.Labels),
 		Network:             networkName,
+		appServiceHosts:     appServiceHosts,
+	}
+	for asID := range appServiceHosts {
+		// use the rewritten registration
+		d.ApplicationServices[asID] = asIDToRegistrationMap[asID]
 	}
 
 	stopTime := time.Now().Add(cfg.SpawnHSTimeout)
@@ -497,6 +537,7 @@ func deployImage(
 			log.Printf("%s: Server is responding after %d iterations", contextStr, iterCount)
 		}
 	}
+	deployed = true
 	return d, nil
 }
 
@@ -11,6 +11,9 @@ import (
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/internal/coverage"
+	"github.com/matrix-org/complement/internal/har"
+	"github.com/matrix-org/complement/internal/openapi"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
@@ -46,6 +49,9 @@ type HomeserverDeployment struct {
 	// The docker network this HS is connected to.
 	// Useful if you want to connect other containers to the same network.
 	Network string
+
+	// application service ID -> host listening on its behalf, for application services without a URL
+	appServiceHosts map[string]*appServiceHost
 }
 
 // Updates the client and federation base URLs of the homeserver deployment.
@@ -99,6 +105,42 @@ func (d *Deployment) RoundTripper() http.RoundTripper {
 	return &RoundTripper{Deployment: d}
 }
 
+// httpClient returns an HTTP client for talking to the given homeserver which logs requests and
+// records them to the HAR file for this test.
+func (d *Deployment) httpClient(t ct.TestLike, hsName string) *http.Client {
+	cli := client.NewLoggedClient(t, hsName, nil)
+	if d.Config.SpecValidationDir != "" {
+		spec, err := loadSpec(d.Config.SpecValidationDir)
+		if err != nil {
+			ct.Fatalf(t, "failed to load OpenAPI spec from COMPLEMENT_SPEC_VALIDATION_DIR: %s", err)
+		}
+		cli.Transport = spec.RoundTripper(t, d.Config.SpecValidationLenient, cli.Transport)
+	}
+	cli.Transport = har.ForTest(t, d.Config).RoundTripper("CSAPI "+hsName, cli.Transport)
+	cli.Transport = coverage.RoundTripper(d.Config, cli.Transport)
+	return cli
+}
+
+var (
+	specsMu sync.Mutex
+	specs   = make(map[string]*openapi.Spec)
+)
+
+// loadSpec loads the OpenAPI spec in `dir` once per test package, as parsing the whole spec is slow.
+func loadSpec(dir string) (*openapi.Spec, error) {
+	specsMu.Lock()
+	defer specsMu.Unlock()
+	if spec, ok := specs[dir]; ok {
+		return spec, nil
+	}
+	spec, err := openapi.Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	specs[dir] = spec
+	return spec, nil
+}
+
 func (d *Deployment) Register(t ct.TestLike, hsName string, opts helpers.RegistrationOpts) *client.CSAPI {
 	dep, ok := d.HS[hsName]
 	if !ok {
@@ -107,7 +149,7 @@ func (d *Deployment) Register(t ct.TestLike, hsName string, opts helpers.Registr
 	}
 	client := &client.CSAPI{
 		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
+		Client:           d.httpClient(t, hsName),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
 		Password:         opts.Password,
@@ -157,7 +199,7 @@ func (d *Deployment) Login(t ct.TestLike, hsName string, existing *client.CSAPI,
 	}
 	c := &client.CSAPI{
 		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
+		Client:           d.httpClient(t, hsName),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
 		Password:         existing.Password,
@@ -199,7 +241,7 @@ func (d *Deployment) UnauthenticatedClient(t ct.TestLike, hsName string) *client
 	}
 	client := &client.CSAPI{
 		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
+		Client:           d.httpClient(t, hsName),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
 	}
@@ -235,7 +277,7 @@ func (d *Deployment) AppServiceUser(t ct.TestLike, hsName, appServiceUserID stri
 		AccessToken:      token,
 		DeviceID:         deviceID,
 		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
+		Client:           d.httpClient(t, hsName),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
 	}
@@ -317,3 +359,22 @@ func (d *Deployment) ContainerID(t ct.TestLike, hsName string) string {
 	}
 	return hsDep.ContainerID
 }
+
+// ServeApplicationService serves requests from the HS to the application service `asID` with `h`, until the
+// returned function is called. The application service must not have a URL in the blueprint. Returns the
+// application service registration.
+func (d *Deployment) ServeApplicationService(t ct.TestLike, hsName, asID string, h http.Handler) (registration string, stop func()) {
+	t.Helper()
+	hsDep := d.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "ServeApplicationService: %s does not exist in this deployment", hsName)
+	}
+	host := hsDep.appServiceHosts[asID]
+	if host == nil {
+		ct.Fatalf(t, "ServeApplicationService: %s has no application service %s without a URL", hsName, asID)
+	}
+	host.setHandler(h)
+	return hsDep.ApplicationServices[asID], func() {
+		host.setHandler(nil)
+	}
+}
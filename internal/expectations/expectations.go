@@ -0,0 +1,294 @@
+// Package expectations lets homeserver projects mark tests as skipped, expected to fail, or flaky via a file,
+// rather than patching `runtime.SkipIf` calls into Complement. See COMPLEMENT_EXPECTATIONS_FILE.
+//
+// Failures are intercepted in ct.Errorf and ct.Fatalf, which every assertion in ct, must, match, client and
+// helpers goes through, so xfail and flaky work for subtests as well as top-level tests. Failures reported
+// directly via t.Errorf or t.Fatalf are NOT intercepted, so a test which uses them still fails when marked as
+// xfail or flaky. Tests like that need to be marked as skip instead.
+package expectations
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Action is what to do with a test listed in the expectations file.
+type Action string
+
+const (
+	// The test is skipped. Tests are skipped before they deploy anything, so top-level tests never
+	// run. Subtests which don't deploy homeservers run until their first failure and are then skipped,
+	// as Complement has no hook into the start of a subtest.
+	Skip Action = "skip"
+	// The test runs, but failures are logged instead of failing the test. If the test passes, it
+	// fails with "unexpectedly passed" so the entry can be removed. Subtests are checked when the
+	// test which deployed homeservers finishes.
+	XFail Action = "xfail"
+	// The test runs, but failures are logged instead of failing the test. Passing is fine.
+	Flaky Action = "flaky"
+)
+
+// File is the format of the expectations file, which can be YAML or JSON:
+//
+//	palpo:
+//	  - test: TestTxnIdempotency
+//	    action: skip
+//	    reason: transaction IDs are not scoped to the room
+//	  - test: TestSync/.*lazy_loading.*
+//	    action: xfail
+//	"*":
+//	  - test: TestFlakyThing
+//	    action: flaky
+//
+// Keys are homeserver names as used by `runtime.Homeserver`, and entries under "*" apply to every homeserver.
+type File map[string][]Entry
+
+// Entry is a single test or pattern in the expectations file.
+type Entry struct {
+	// The test name as printed by `go test` e.g "TestSync/Sync_with_filter", or a regular expression which
+	// must match the whole name. An entry for a test also applies to all of its subtests.
+	Test   string `yaml:"test" json:"test"`
+	Action Action `yaml:"action" json:"action"`
+	Reason string `yaml:"reason" json:"reason"`
+
+	re *regexp.Regexp
+	// one regular expression per "/"-separated part of Test, to find entries for the subtests of a test
+	parts []*regexp.Regexp
+}
+
+// matches returns true if the entry matches the test or one of its parents.
+func (e *Entry) matches(testName string) bool {
+	parts := strings.Split(testName, "/")
+	for i := len(parts); i > 0; i-- {
+		if e.re.MatchString(strings.Join(parts[:i], "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isForSubtestOf returns true if the entry can only match subtests of the test.
+func (e *Entry) isForSubtestOf(testName string) bool {
+	parts := strings.Split(testName, "/")
+	if len(e.parts) <= len(parts) {
+		return false
+	}
+	for i := range parts {
+		if !e.parts[i].MatchString(parts[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestLike is the subset of ct.TestLike used here. ct imports this package, so it can't be used directly.
+type TestLike interface {
+	Helper()
+	Logf(msg string, args ...interface{})
+	Skipf(msg string, args ...interface{})
+	Errorf(msg string, args ...interface{})
+	Failed() bool
+	Name() string
+}
+
+var (
+	mu      sync.Mutex
+	entries []*Entry
+	// test names which have had an expected failure
+	failedAsExpected = make(map[string]bool)
+	// test names which Begin will check for "unexpectedly passed", as tests can deploy more than once
+	begun = make(map[string]bool)
+)
+
+// Load loads the expectations for `homeserver` from the file at `path`. An empty path clears all
+// expectations.
+func Load(path, homeserver string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	entries = nil
+	failedAsExpected = make(map[string]bool)
+	begun = make(map[string]bool)
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f File
+	// JSON is a subset of YAML so this handles both
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for _, key := range []string{homeserver, "*"} {
+		if key == "" {
+			continue
+		}
+		for i := range f[key] {
+			e := &f[key][i]
+			switch e.Action {
+			case Skip, XFail, Flaky:
+			default:
+				return fmt.Errorf("%s: test %q has unknown action %q, want skip, xfail or flaky", path, e.Test, e.Action)
+			}
+			e.re, err = regexp.Compile("^(?:" + e.Test + ")$")
+			if err != nil {
+				return fmt.Errorf("%s: test %q is not a valid regular expression: %w", path, e.Test, err)
+			}
+			for _, part := range strings.Split(e.Test, "/") {
+				re, err := regexp.Compile("^(?:" + part + ")$")
+				if err != nil {
+					// e.g a "/" inside a group, so it can't be matched part by part
+					e.parts = nil
+					break
+				}
+				e.parts = append(e.parts, re)
+			}
+			entries = append(entries, e)
+		}
+	}
+	return nil
+}
+
+// lookup returns the first entry which matches the test or one of its parents.
+func lookup(testName string) *Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range entries {
+		if e.matches(testName) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Begin is called when a test deploys homeservers. It skips the test if it is listed as skip. When the test
+// finishes, it fails with "unexpectedly passed" if it is listed as xfail but did not fail, or if one of its
+// subtests is listed as xfail but no subtest matching that entry failed.
+func Begin(t TestLike) {
+	t.Helper()
+	if e := lookup(t.Name()); e != nil && e.Action == Skip {
+		t.Skipf("%s by COMPLEMENT_EXPECTATIONS_FILE", describe(e))
+		return
+	}
+	tc, ok := t.(interface{ Cleanup(func()) })
+	if !ok {
+		return
+	}
+	mu.Lock()
+	if len(entries) == 0 || begun[t.Name()] || hasBegunParent(t.Name()) {
+		// the parent checks this test and its subtests when it finishes
+		mu.Unlock()
+		return
+	}
+	begun[t.Name()] = true
+	mu.Unlock()
+	tc.Cleanup(func() {
+		checkUnexpectedPasses(t)
+	})
+}
+
+// checkUnexpectedPasses fails the test if it, or one of its subtests, is listed as xfail but did not fail.
+func checkUnexpectedPasses(t TestLike) {
+	t.Helper()
+	if ts, ok := t.(interface{ Skipped() bool }); ok && ts.Skipped() && !failedWithin(t.Name(), nil) {
+		// skipped for some other reason, so neither it nor its subtests ran
+		return
+	}
+	if e := lookup(t.Name()); e != nil && e.Action == XFail && !t.Failed() && !failedWithin(t.Name(), nil) {
+		t.Errorf("unexpectedly passed: %s is marked as xfail in COMPLEMENT_EXPECTATIONS_FILE, remove it from the file", t.Name())
+	}
+	if subtestsFiltered() {
+		// subtests listed in the file may not have run
+		return
+	}
+	mu.Lock()
+	var subtestEntries []*Entry
+	for _, e := range entries {
+		if e.Action == XFail && e.isForSubtestOf(t.Name()) {
+			subtestEntries = append(subtestEntries, e)
+		}
+	}
+	mu.Unlock()
+	for _, e := range subtestEntries {
+		if !failedWithin(t.Name(), e) {
+			t.Errorf("unexpectedly passed: no subtest of %s matching %q failed, but it is marked as xfail in COMPLEMENT_EXPECTATIONS_FILE, remove it from the file", t.Name(), e.Test)
+		}
+	}
+}
+
+// failedWithin returns true if the test or one of its subtests had an expected failure. If `e` is set, only
+// failures in tests which `e` matches are considered.
+func failedWithin(testName string, e *Entry) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	for name := range failedAsExpected {
+		if name != testName && !strings.HasPrefix(name, testName+"/") {
+			continue
+		}
+		if e == nil || e.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBegunParent returns true if Begin was called for a parent of the test. Must be called with mu held.
+func hasBegunParent(testName string) bool {
+	parts := strings.Split(testName, "/")
+	for i := len(parts) - 1; i > 0; i-- {
+		if begun[strings.Join(parts[:i], "/")] {
+			return true
+		}
+	}
+	return false
+}
+
+// subtestsFiltered returns true if `go test` was asked to only run some subtests via -run or -skip.
+var subtestsFiltered = func() bool {
+	for _, name := range []string{"test.run", "test.skip"} {
+		if f := flag.Lookup(name); f != nil && strings.Contains(f.Value.String(), "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Intercept is called when the test is about to fail with `msg`. Returns true if the failure was handled,
+// in which case the caller must not fail the test. If `fatal` is true and the failure was handled, the test
+// is stopped via t.Skipf, as it cannot continue and stopping it any other way would fail it.
+func Intercept(t TestLike, msg string, fatal bool) bool {
+	t.Helper()
+	e := lookup(t.Name())
+	if e == nil {
+		return false
+	}
+	switch e.Action {
+	case Skip:
+		t.Skipf("%s by COMPLEMENT_EXPECTATIONS_FILE, skipping after failure: %s", describe(e), msg)
+	case XFail, Flaky:
+		mu.Lock()
+		failedAsExpected[t.Name()] = true
+		mu.Unlock()
+		if fatal {
+			t.Skipf("%s by COMPLEMENT_EXPECTATIONS_FILE, stopping after failure: %s", describe(e), msg)
+		} else {
+			t.Logf("%s by COMPLEMENT_EXPECTATIONS_FILE, ignoring failure: %s", describe(e), msg)
+		}
+	}
+	return true
+}
+
+func describe(e *Entry) string {
+	s := "marked as " + string(e.Action)
+	if e.Reason != "" {
+		s += " (" + e.Reason + ")"
+	}
+	return s
+}
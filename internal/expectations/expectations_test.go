@@ -0,0 +1,279 @@
+package expectations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeT records what happens to a test instead of failing or skipping it.
+type fakeT struct {
+	name     string
+	errors   []string
+	logs     []string
+	skipped  string
+	cleanups []func()
+}
+
+func (t *fakeT) Helper() {}
+func (t *fakeT) Logf(msg string, args ...interface{}) {
+	t.logs = append(t.logs, fmt.Sprintf(msg, args...))
+}
+func (t *fakeT) Skipf(msg string, args ...interface{}) {
+	t.skipped = fmt.Sprintf(msg, args...)
+}
+func (t *fakeT) Errorf(msg string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(msg, args...))
+}
+func (t *fakeT) Failed() bool     { return len(t.errors) > 0 }
+func (t *fakeT) Skipped() bool    { return t.skipped != "" }
+func (t *fakeT) Name() string     { return t.name }
+func (t *fakeT) Cleanup(f func()) { t.cleanups = append(t.cleanups, f) }
+func (t *fakeT) finish() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+func mustLoad(t *testing.T, homeserver, contents string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "expectations.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("failed to write expectations file: %s", err)
+	}
+	if err := Load(path, homeserver); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	t.Cleanup(func() {
+		Load("", "")
+	})
+}
+
+func TestLoadErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{
+			name:     "unknown action",
+			contents: "synapse:\n  - test: TestA\n    action: ignore\n",
+			wantErr:  `unknown action "ignore"`,
+		},
+		{
+			name:     "invalid regular expression",
+			contents: "synapse:\n  - test: TestA(\n    action: skip\n",
+			wantErr:  "not a valid regular expression",
+		},
+		{
+			name:     "invalid YAML",
+			contents: "synapse: [",
+			wantErr:  "failed to parse",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "expectations.yaml")
+			if err := os.WriteFile(path, []byte(tc.contents), 0644); err != nil {
+				t.Fatalf("failed to write expectations file: %s", err)
+			}
+			err := Load(path, "synapse")
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Load: got error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	mustLoad(t, "synapse", `
+synapse:
+  - test: TestA/sub
+    action: flaky
+  - test: TestA
+    action: xfail
+  - test: TestB.*
+    action: skip
+dendrite:
+  - test: TestC
+    action: skip
+"*":
+  - test: TestC
+    action: xfail
+  - test: TestA/other
+    action: skip
+`)
+	testCases := []struct {
+		testName   string
+		wantAction Action
+	}{
+		// entries for the homeserver take precedence over "*", and earlier entries over later ones
+		{"TestA/sub", Flaky},
+		{"TestA/sub/nested", Flaky},
+		{"TestA/other", XFail},
+		{"TestA", XFail},
+		// the regular expression must match the whole name, or the name of a parent
+		{"TestBee", Skip},
+		{"TestBee/sub", Skip},
+		{"TestAB", ""},
+		{"TestC", XFail},
+		{"TestD", ""},
+	}
+	for _, tc := range testCases {
+		var got Action
+		if e := lookup(tc.testName); e != nil {
+			got = e.Action
+		}
+		if got != tc.wantAction {
+			t.Errorf("lookup(%q): got %q, want %q", tc.testName, got, tc.wantAction)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	mustLoad(t, "synapse", `
+synapse:
+  - test: TestSkipped
+    action: skip
+    reason: not implemented
+`)
+	ft := &fakeT{name: "TestSkipped"}
+	Begin(ft)
+	if !strings.Contains(ft.skipped, "not implemented") {
+		t.Errorf("Begin did not skip the test with the reason, got %q", ft.skipped)
+	}
+
+	sub := &fakeT{name: "TestSkipped/sub"}
+	if !Intercept(sub, "boom", false) {
+		t.Errorf("Intercept did not handle the failure of a skipped subtest")
+	}
+	if sub.skipped == "" || len(sub.errors) > 0 {
+		t.Errorf("Intercept did not skip the subtest: skipped=%q errors=%v", sub.skipped, sub.errors)
+	}
+
+	other := &fakeT{name: "TestOther"}
+	Begin(other)
+	if other.skipped != "" {
+		t.Errorf("Begin skipped a test which is not in the file")
+	}
+	if Intercept(other, "boom", false) {
+		t.Errorf("Intercept handled the failure of a test which is not in the file")
+	}
+}
+
+func TestXFail(t *testing.T) {
+	const file = "synapse:\n  - test: TestXFail\n    action: xfail\n"
+	t.Run("failing test passes", func(t *testing.T) {
+		mustLoad(t, "synapse", file)
+		ft := &fakeT{name: "TestXFail"}
+		Begin(ft)
+		if !Intercept(ft, "boom", false) {
+			t.Fatalf("Intercept did not handle the failure")
+		}
+		ft.finish()
+		if len(ft.errors) > 0 {
+			t.Errorf("test failed: %v", ft.errors)
+		}
+	})
+	t.Run("fatal failure stops the test without failing it", func(t *testing.T) {
+		mustLoad(t, "synapse", file)
+		ft := &fakeT{name: "TestXFail"}
+		Begin(ft)
+		Intercept(ft, "boom", true)
+		ft.finish()
+		if ft.skipped == "" || len(ft.errors) > 0 {
+			t.Errorf("test was not stopped via Skipf: skipped=%q errors=%v", ft.skipped, ft.errors)
+		}
+	})
+	t.Run("passing test fails", func(t *testing.T) {
+		mustLoad(t, "synapse", file)
+		ft := &fakeT{name: "TestXFail"}
+		Begin(ft)
+		ft.finish()
+		if len(ft.errors) != 1 || !strings.Contains(ft.errors[0], "unexpectedly passed") {
+			t.Errorf("test did not fail as unexpectedly passed: %v", ft.errors)
+		}
+	})
+}
+
+func TestXFailSubtests(t *testing.T) {
+	const file = `
+synapse:
+  - test: TestParent/xfail_.*
+    action: xfail
+`
+	// so this test can be run with e.g -run TestXFailSubtests/passing
+	defer func(f func() bool) { subtestsFiltered = f }(subtestsFiltered)
+	subtestsFiltered = func() bool { return false }
+	t.Run("failing subtest passes", func(t *testing.T) {
+		mustLoad(t, "synapse", file)
+		parent := &fakeT{name: "TestParent"}
+		Begin(parent)
+		sub := &fakeT{name: "TestParent/xfail_one"}
+		if !Intercept(sub, "boom", false) {
+			t.Fatalf("Intercept did not handle the failure")
+		}
+		passing := &fakeT{name: "TestParent/other"}
+		if Intercept(passing, "boom", false) {
+			t.Errorf("Intercept handled the failure of a subtest which is not in the file")
+		}
+		parent.finish()
+		if len(parent.errors) > 0 {
+			t.Errorf("test failed: %v", parent.errors)
+		}
+	})
+	t.Run("passing subtest fails the test which deployed", func(t *testing.T) {
+		mustLoad(t, "synapse", file)
+		parent := &fakeT{name: "TestParent"}
+		Begin(parent)
+		// a subtest which deploys again is checked by its parent
+		sub := &fakeT{name: "TestParent/xfail_one"}
+		Begin(sub)
+		if len(sub.cleanups) > 0 {
+			t.Errorf("Begin registered a check for a subtest whose parent is already checked")
+		}
+		parent.finish()
+		if len(parent.errors) != 1 || !strings.Contains(parent.errors[0], "unexpectedly passed") {
+			t.Errorf("test did not fail as unexpectedly passed: %v", parent.errors)
+		}
+	})
+	t.Run("skipped test does not check subtests", func(t *testing.T) {
+		mustLoad(t, "synapse", file)
+		parent := &fakeT{name: "TestParent"}
+		Begin(parent)
+		parent.Skipf("not supported")
+		parent.finish()
+		if len(parent.errors) > 0 {
+			t.Errorf("test failed: %v", parent.errors)
+		}
+	})
+}
+
+func TestFlaky(t *testing.T) {
+	mustLoad(t, "synapse", `
+"*":
+  - test: TestFlaky
+    action: flaky
+`)
+	failing := &fakeT{name: "TestFlaky/sub"}
+	Begin(failing)
+	if !Intercept(failing, "boom", false) {
+		t.Fatalf("Intercept did not handle the failure")
+	}
+	failing.finish()
+	if len(failing.errors) > 0 || failing.skipped != "" {
+		t.Errorf("failing flaky test failed: errors=%v skipped=%q", failing.errors, failing.skipped)
+	}
+	if len(failing.logs) != 1 || !strings.Contains(failing.logs[0], "boom") {
+		t.Errorf("failure was not logged: %v", failing.logs)
+	}
+
+	passing := &fakeT{name: "TestFlaky"}
+	Begin(passing)
+	passing.finish()
+	if len(passing.errors) > 0 {
+		t.Errorf("passing flaky test failed: %v", passing.errors)
+	}
+}
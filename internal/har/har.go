@@ -0,0 +1,368 @@
+// Package har records HTTP traffic made by and to Complement during a test, and writes it out as a
+// HAR 1.2 file (http://www.softwareishard.com/blog/har-12-spec/) which can be opened in browser devtools.
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+)
+
+// The maximum number of bytes of a request or response body to record. Larger bodies are truncated.
+const maxBodySize = 1024 * 1024
+
+var (
+	recordersMu sync.Mutex
+	recorders   = make(map[ct.TestLike]*Recorder)
+)
+
+// Recorder records HTTP requests and responses for a single test. All methods are safe to call on a
+// nil Recorder, in which case nothing is recorded.
+type Recorder struct {
+	testName string
+	path     string
+	always   bool
+
+	mu      sync.Mutex
+	entries []entry
+}
+
+// ForTest returns the Recorder for this test, creating it if needed. The HAR file is written when the
+// test ends if the test failed, or always if COMPLEMENT_HAR_ALWAYS is set. Returns nil if `t` does not
+// support `Cleanup` (as *testing.T does), as there is no way to know when the test ends.
+func ForTest(t ct.TestLike, cfg *config.Complement) *Recorder {
+	tc, ok := t.(interface{ Cleanup(func()) })
+	if !ok || cfg == nil {
+		return nil
+	}
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	if r, ok := recorders[t]; ok {
+		return r
+	}
+	fileName := strings.NewReplacer("/", "_", "\\", "_", " ", "_").Replace(t.Name()) + ".har"
+	r := &Recorder{
+		testName: t.Name(),
+		path:     filepath.Join(cfg.HARDir, cfg.PackageNamespace, fileName),
+		always:   cfg.HARAlways,
+	}
+	recorders[t] = r
+	tc.Cleanup(func() {
+		recordersMu.Lock()
+		delete(recorders, t)
+		recordersMu.Unlock()
+		if !r.always && !t.Failed() {
+			return
+		}
+		if err := r.WriteFile(); err != nil {
+			t.Logf("failed to write HAR file: %s", err)
+			return
+		}
+		t.Logf("HTTP traffic for this test has been written to %s", r.path)
+	})
+	return r
+}
+
+// RoundTripper returns an http.RoundTripper which records every request made through `wrap`, with the
+// given comment e.g "CSAPI hs1". If `wrap` is nil, http.DefaultTransport is used.
+func (r *Recorder) RoundTripper(comment string, wrap http.RoundTripper) http.RoundTripper {
+	if wrap == nil {
+		wrap = http.DefaultTransport
+	}
+	if r == nil {
+		return wrap
+	}
+	return &roundTripper{r: r, comment: comment, wrap: wrap}
+}
+
+// Handler returns an http.Handler which records every request served by `h`, with the given comment
+// e.g "Complement federation server (inbound)".
+func (r *Recorder) Handler(comment string, h http.Handler) http.Handler {
+	if r == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		reqBody := readAndReplaceBody(&req.Body)
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, req)
+		// inbound requests have no scheme or host on the URL, so reconstruct them
+		u := *req.URL
+		u.Scheme = "https"
+		if req.TLS == nil {
+			u.Scheme = "http"
+		}
+		u.Host = req.Host
+		r.add(start, time.Since(start), comment,
+			newRequest(req.Method, u.String(), req.Proto, req.Header, reqBody),
+			newResponse(rw.status, req.Proto, rw.Header(), rw.body.Bytes()),
+		)
+	})
+}
+
+// WriteFile writes every entry recorded so far to the HAR file for this test.
+func (r *Recorder) WriteFile() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	entries := make([]entry, len(r.entries))
+	copy(entries, r.entries)
+	r.mu.Unlock()
+
+	b, err := json.MarshalIndent(harFile{
+		Log: harLog{
+			Version: "1.2",
+			Creator: nameVersion{Name: "complement", Version: "1"},
+			Pages:   []struct{}{},
+			Entries: entries,
+			Comment: r.testName,
+		},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, b, 0644)
+}
+
+func (r *Recorder) add(start time.Time, duration time.Duration, comment string, req request, res response) {
+	ms := float64(duration) / float64(time.Millisecond)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            ms,
+		Request:         req,
+		Response:        res,
+		Cache:           struct{}{},
+		Timings:         timings{Send: 0, Wait: ms, Receive: 0},
+		Comment:         comment,
+	})
+}
+
+type roundTripper struct {
+	r       *Recorder
+	comment string
+	wrap    http.RoundTripper
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		if req.GetBody != nil {
+			// don't consume the body the request will send
+			if body, err := req.GetBody(); err == nil {
+				reqBody, _ = io.ReadAll(body)
+			}
+		} else {
+			reqBody = readAndReplaceBody(&req.Body)
+		}
+	}
+	start := time.Now()
+	res, err := rt.wrap.RoundTrip(req)
+	harReq := newRequest(req.Method, req.URL.String(), req.Proto, req.Header, reqBody)
+	if err != nil {
+		harRes := newResponse(0, "", nil, nil)
+		rt.r.add(start, time.Since(start), fmt.Sprintf("%s: error: %s", rt.comment, err), harReq, harRes)
+		return res, err
+	}
+	resBody := readAndReplaceBody(&res.Body)
+	rt.r.add(start, time.Since(start), rt.comment, harReq, newResponse(res.StatusCode, res.Proto, res.Header, resBody))
+	return res, nil
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	if rw.body.Len() < maxBodySize {
+		rw.body.Write(b)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// readAndReplaceBody reads the entire body and replaces it with an in-memory copy.
+func readAndReplaceBody(body *io.ReadCloser) []byte {
+	if *body == nil || *body == http.NoBody {
+		return nil
+	}
+	b, _ := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(b))
+	return b
+}
+
+func newRequest(method, rawURL, proto string, header http.Header, body []byte) request {
+	req := request{
+		Method:      method,
+		URL:         rawURL,
+		HTTPVersion: proto,
+		Cookies:     []struct{}{},
+		Headers:     newHeaders(header),
+		QueryString: []nameValue{},
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	if u, err := url.Parse(rawURL); err == nil {
+		for k, vals := range u.Query() {
+			for _, v := range vals {
+				req.QueryString = append(req.QueryString, nameValue{Name: k, Value: v})
+			}
+		}
+	}
+	if len(body) > 0 {
+		text, encoding := bodyText(body)
+		req.PostData = &postData{
+			MimeType: header.Get("Content-Type"),
+			Text:     text,
+			Comment:  encoding,
+		}
+	}
+	return req
+}
+
+func newResponse(status int, proto string, header http.Header, body []byte) response {
+	text, encoding := bodyText(body)
+	return response{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HTTPVersion: proto,
+		Cookies:     []struct{}{},
+		Headers:     newHeaders(header),
+		Content: content{
+			Size:     len(body),
+			MimeType: header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		},
+		RedirectURL: header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+}
+
+func newHeaders(header http.Header) []nameValue {
+	headers := []nameValue{}
+	for k, vals := range header {
+		for _, v := range vals {
+			headers = append(headers, nameValue{Name: k, Value: v})
+		}
+	}
+	return headers
+}
+
+// bodyText returns the body as a string, base64 encoding it if it is not valid UTF-8.
+func bodyText(body []byte) (text, encoding string) {
+	if len(body) > maxBodySize {
+		body = body[:maxBodySize]
+	}
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator nameVersion `json:"creator"`
+	Pages   []struct{}  `json:"pages"`
+	Entries []entry     `json:"entries"`
+	Comment string      `json:"comment,omitempty"`
+}
+
+type nameVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type nameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type entry struct {
+	StartedDateTime string   `json:"startedDateTime"`
+	Time            float64  `json:"time"`
+	Request         request  `json:"request"`
+	Response        response `json:"response"`
+	Cache           struct{} `json:"cache"`
+	Timings         timings  `json:"timings"`
+	Comment         string   `json:"comment,omitempty"`
+}
+
+type request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []struct{}  `json:"cookies"`
+	Headers     []nameValue `json:"headers"`
+	QueryString []nameValue `json:"queryString"`
+	PostData    *postData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type postData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// set to "base64" if the text is base64 encoded, as postData has no encoding field
+	Comment string `json:"comment,omitempty"`
+}
+
+type response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []struct{}  `json:"cookies"`
+	Headers     []nameValue `json:"headers"`
+	Content     content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
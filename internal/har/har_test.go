@@ -0,0 +1,171 @@
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+)
+
+// fakeT is a test whose failure and end can be controlled, so the HAR file written on Cleanup can be checked.
+type fakeT struct {
+	*testing.T
+	failed   bool
+	cleanups []func()
+}
+
+func (t *fakeT) Failed() bool        { return t.failed }
+func (t *fakeT) Cleanup(fn func())   { t.cleanups = append(t.cleanups, fn) }
+func (t *fakeT) Name() string        { return "TestHAR/sub test" }
+func (t *fakeT) Logf(string, ...any) {}
+
+// end runs the cleanup functions, as happens when a test ends.
+func (t *fakeT) end() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+func TestHAR(t *testing.T) {
+	// not valid UTF-8, so must be base64 encoded
+	binaryBody := []byte{0xff, 0xfe, 0x00, 0x01}
+	newConfig := func(always bool) *config.Complement {
+		return &config.Complement{HARDir: t.TempDir(), PackageNamespace: "ns", HARAlways: always}
+	}
+	harPath := func(cfg *config.Complement) string {
+		return filepath.Join(cfg.HARDir, "ns", "TestHAR_sub_test.har")
+	}
+
+	// record a request through both the client RoundTripper and the server Handler
+	record := func(t *testing.T, ft *fakeT, cfg *config.Complement) {
+		r := ForTest(ft, cfg)
+		if r == nil || ForTest(ft, cfg) != r {
+			t.Fatalf("ForTest: want the same recorder for the same test")
+		}
+		srv := httptest.NewServer(r.Handler("server", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(10 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.WriteHeader(201)
+			w.Write(binaryBody)
+		})))
+		defer srv.Close()
+		cli := &http.Client{Transport: r.RoundTripper("client", nil)}
+		res, err := cli.Post(srv.URL+"/path?a=b", "application/json", bytes.NewBufferString(`{"hello":"world"}`))
+		if err != nil {
+			t.Fatalf("Post: %s", err)
+		}
+		defer res.Body.Close()
+		// the body must still be readable after being recorded
+		var got bytes.Buffer
+		got.ReadFrom(res.Body)
+		if !bytes.Equal(got.Bytes(), binaryBody) {
+			t.Errorf("got response body %v, want %v", got.Bytes(), binaryBody)
+		}
+	}
+
+	t.Run("writes HAR 1.2 entries for requests and responses", func(t *testing.T) {
+		cfg := newConfig(true)
+		ft := &fakeT{T: t}
+		record(t, ft, cfg)
+		ft.end()
+
+		b, err := os.ReadFile(harPath(cfg))
+		if err != nil {
+			t.Fatalf("failed to read HAR file: %s", err)
+		}
+		if !gjson.ValidBytes(b) {
+			t.Fatalf("HAR file is not valid JSON: %s", string(b))
+		}
+		log := gjson.GetBytes(b, "log")
+		if log.Get("version").Str != "1.2" || log.Get("creator.name").Str != "complement" || log.Get("comment").Str != "TestHAR/sub test" {
+			t.Errorf("got log %s, want version 1.2 created by complement for the test", log.Get("@this|@ugly").Raw)
+		}
+		if !log.Get("pages").IsArray() {
+			t.Errorf("log.pages is not an array")
+		}
+		entries := log.Get("entries").Array()
+		if len(entries) != 2 {
+			t.Fatalf("got %d entries, want 2", len(entries))
+		}
+		// the server finishes handling the request before the client has the response
+		for i, wantComment := range []string{"server", "client"} {
+			e := entries[i]
+			if got := e.Get("comment").Str; got != wantComment {
+				t.Errorf("entry %d: got comment %q, want %q", i, got, wantComment)
+			}
+			if _, err := time.Parse(time.RFC3339Nano, e.Get("startedDateTime").Str); err != nil {
+				t.Errorf("entry %d: startedDateTime is not RFC3339: %s", i, err)
+			}
+			if e.Get("time").Float() < 10 || e.Get("timings.wait").Float() != e.Get("time").Float() {
+				t.Errorf("entry %d: got time %v and timings %s, want at least 10ms all spent waiting", i, e.Get("time").Raw, e.Get("timings").Raw)
+			}
+			for _, key := range []string{"timings.send", "timings.receive"} {
+				if !e.Get(key).Exists() {
+					t.Errorf("entry %d: missing %s", i, key)
+				}
+			}
+			req := e.Get("request")
+			// inbound requests have their URL reconstructed, so both entries have the absolute URL
+			if url := req.Get("url").Str; req.Get("method").Str != "POST" || !strings.HasPrefix(url, "http://127.0.0.1:") || !strings.HasSuffix(url, "/path?a=b") {
+				t.Errorf("entry %d: got request %s %s, want POST http://127.0.0.1:.../path?a=b", i, req.Get("method").Str, url)
+			}
+			if req.Get("queryString.#").Int() != 1 || req.Get("queryString.0.name").Str != "a" || req.Get("queryString.0.value").Str != "b" {
+				t.Errorf("entry %d: got query string %s, want a=b", i, req.Get("queryString").Raw)
+			}
+			if req.Get("postData.mimeType").Str != "application/json" || req.Get("postData.text").Str != `{"hello":"world"}` {
+				t.Errorf("entry %d: got post data %s, want the JSON body", i, req.Get("postData").Raw)
+			}
+			res := e.Get("response")
+			if res.Get("status").Int() != 201 || res.Get("statusText").Str != "Created" {
+				t.Errorf("entry %d: got status %d %q, want 201 Created", i, res.Get("status").Int(), res.Get("statusText").Str)
+			}
+			content := res.Get("content")
+			if content.Get("encoding").Str != "base64" || content.Get("text").Str != base64.StdEncoding.EncodeToString(binaryBody) ||
+				content.Get("size").Int() != int64(len(binaryBody)) || content.Get("mimeType").Str != "application/octet-stream" {
+				t.Errorf("entry %d: got content %s, want the base64 encoded body", i, content.Raw)
+			}
+		}
+	})
+
+	t.Run("only writes the file for failed tests by default", func(t *testing.T) {
+		cfg := newConfig(false)
+		ft := &fakeT{T: t}
+		record(t, ft, cfg)
+		ft.end()
+		if _, err := os.Stat(harPath(cfg)); !os.IsNotExist(err) {
+			t.Errorf("HAR file was written for a passing test: %v", err)
+		}
+
+		ft = &fakeT{T: t}
+		record(t, ft, cfg)
+		ft.failed = true
+		ft.end()
+		if _, err := os.Stat(harPath(cfg)); err != nil {
+			t.Errorf("HAR file was not written for a failing test: %s", err)
+		}
+	})
+
+	t.Run("records nothing without Cleanup", func(t *testing.T) {
+		if r := ForTest(struct{ ct.TestLike }{t}, newConfig(true)); r != nil {
+			t.Errorf("ForTest: got a recorder for a test without Cleanup")
+		}
+		// a nil recorder passes requests through unchanged
+		var r *Recorder
+		if r.RoundTripper("client", nil) != http.DefaultTransport {
+			t.Errorf("nil Recorder.RoundTripper did not return the wrapped RoundTripper")
+		}
+		if err := r.WriteFile(); err != nil {
+			t.Errorf("nil Recorder.WriteFile: %s", err)
+		}
+	})
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
 )
 
 // An instruction for the runner to run.
@@ -61,6 +62,8 @@ type Runner struct {
 	bestEffort bool
 	// set to true if the runner should stop
 	terminate atomic.Value
+	// how to retry requests which are rate limited
+	rateLimitPolicy client.RateLimitPolicy
 }
 
 func NewRunner(blueprintName string, bestEffort, debugLogging bool) *Runner {
@@ -74,6 +77,7 @@ func NewRunner(blueprintName string, bestEffort, debugLogging bool) *Runner {
 		roomConcurrency: 40,
 		terminate:       v,
 		bestEffort:      bestEffort,
+		rateLimitPolicy: client.DefaultRateLimitPolicy,
 	}
 }
 
@@ -200,6 +204,7 @@ func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []ins
 		}
 		return err
 	}
+	rateLimitRetries := 0
 	req, instr, i := r.next(instrs, hsURL, i)
 	for req != nil {
 		if r.terminate.Load().(bool) {
@@ -218,12 +223,23 @@ func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []ins
 				r.log("%s [%d/%d] %s => HTTP %s\n", contextStr, i, len(instrs), req.URL.String(), res.Status)
 			}
 			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
 			if err != nil {
 				err = isFatalErr(fmt.Errorf("%s : failed to read response body: %w", contextStr, err))
 				if err != nil {
 					return err
 				}
 			}
+			if rateLimitRetries < r.rateLimitPolicy.MaxRetries {
+				if backoff, limited := r.rateLimitPolicy.Backoff(res, body); limited {
+					rateLimitRetries++
+					r.log("%s [%d/%d] %s was rate limited, backing off for %v (retry %d/%d)\n", contextStr, i, len(instrs), req.URL.String(), backoff, rateLimitRetries, r.rateLimitPolicy.MaxRetries)
+					time.Sleep(backoff)
+					// remake the same request
+					req, instr, i = r.next(instrs, hsURL, i-1)
+					continue
+				}
+			}
 			if res.StatusCode < 200 || res.StatusCode >= 300 {
 				r.log("INSTRUCTION: %+v\n", instr)
 				err = isFatalErr(fmt.Errorf("%s : request %s returned HTTP %s : %s", contextStr, req.URL.String(), res.Status, string(body)))
@@ -244,6 +260,7 @@ func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []ins
 				}
 			}
 		}
+		rateLimitRetries = 0
 		req, instr, i = r.next(instrs, hsURL, i)
 	}
 	return nil
@@ -0,0 +1,446 @@
+// Package openapi validates client-server API responses against the OpenAPI definitions in the
+// matrix-spec repository (https://github.com/matrix-org/matrix-spec/tree/main/data/api/client-server).
+//
+// Only the subset of OpenAPI and JSON Schema used by the Matrix spec is supported.
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+var (
+	specsMu sync.Mutex
+	specs   = make(map[string]*Spec)
+)
+
+// Spec is a set of OpenAPI definitions, loaded from a directory of YAML files.
+type Spec struct {
+	operations []operation
+
+	// every file loaded so far, keyed on absolute path. Guarded by docsMu as files referenced via
+	// $ref are loaded lazily.
+	docsMu sync.Mutex
+	docs   map[string]interface{}
+}
+
+// An operation is a single method on a single path e.g GET /_matrix/client/v3/sync
+type operation struct {
+	id       string
+	method   string
+	template string
+	segments []string
+	node     map[string]interface{}
+	file     string
+}
+
+// Violation is a way in which a response does not conform to the spec.
+type Violation struct {
+	// A JSON pointer (RFC 6901) to the part of the response body which failed validation e.g
+	// "/rooms/join/!foo:hs1/timeline/limited". Empty if the whole body failed, or the violation
+	// is not about the body.
+	Pointer string
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.Pointer == "" {
+		return v.Message
+	}
+	return fmt.Sprintf("%s: %s", v.Pointer, v.Message)
+}
+
+// Load returns the spec defined in `dir`, which is either the `data/api/client-server` directory or
+// the root of a matrix-spec checkout. Specs are cached, so repeated calls with the same directory are cheap.
+func Load(dir string) (*Spec, error) {
+	if _, err := os.Stat(filepath.Join(dir, "data", "api", "client-server")); err == nil {
+		dir = filepath.Join(dir, "data", "api", "client-server")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	specsMu.Lock()
+	defer specsMu.Unlock()
+	if s, ok := specs[dir]; ok {
+		return s, nil
+	}
+	s := &Spec{
+		docs: make(map[string]interface{}),
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		doc, err := s.load(file)
+		if err != nil {
+			return nil, err
+		}
+		s.addOperations(file, doc)
+	}
+	if len(s.operations) == 0 {
+		return nil, fmt.Errorf("no OpenAPI operations found in %s", dir)
+	}
+	specs[dir] = s
+	return s, nil
+}
+
+// addOperations indexes every operation in the OpenAPI document `doc`.
+func (s *Spec) addOperations(file string, doc interface{}) {
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+	paths, ok := root["paths"].(map[string]interface{})
+	if !ok {
+		return // e.g a file of shared definitions
+	}
+	basePath := ""
+	if servers, ok := root["servers"].([]interface{}); ok && len(servers) > 0 {
+		basePath = lookupString(servers[0], "variables", "basePath", "default")
+	}
+	for path, methods := range paths {
+		methods, ok := methods.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		template := strings.TrimSuffix(basePath, "/") + path
+		for method, op := range methods {
+			op, ok := op.(map[string]interface{})
+			if !ok {
+				continue // e.g path-level `parameters`
+			}
+			id, _ := op["operationId"].(string)
+			s.operations = append(s.operations, operation{
+				id:       id,
+				method:   strings.ToUpper(method),
+				template: template,
+				segments: strings.Split(strings.Trim(template, "/"), "/"),
+				node:     op,
+				file:     file,
+			})
+		}
+	}
+}
+
+// Endpoint is an operation in the spec.
+type Endpoint struct {
+	Method string
+	// The path including the base path, with parameters in braces e.g /_matrix/client/v3/rooms/{roomId}/state
+	Path        string
+	OperationID string
+}
+
+// Endpoints returns every operation in the spec.
+func (s *Spec) Endpoints() []Endpoint {
+	endpoints := make([]Endpoint, 0, len(s.operations))
+	for _, op := range s.operations {
+		endpoints = append(endpoints, op.endpoint())
+	}
+	return endpoints
+}
+
+// Match returns the operation for a request to the unescaped `path`, which may itself be templated: a segment
+// in braces only matches a parameter in the spec.
+func (s *Spec) Match(method, path string) (Endpoint, bool) {
+	op := s.matchSegments(method, strings.Split(strings.Trim(path, "/"), "/"))
+	if op == nil {
+		return Endpoint{}, false
+	}
+	return op.endpoint(), true
+}
+
+func (op *operation) endpoint() Endpoint {
+	return Endpoint{Method: op.method, Path: op.template, OperationID: op.id}
+}
+
+// match returns the operation for this request, or nil if the request is not in the spec.
+func (s *Spec) match(method string, u *url.URL) *operation {
+	segments := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+	for i := range segments {
+		if unescaped, err := url.PathUnescape(segments[i]); err == nil {
+			segments[i] = unescaped
+		}
+	}
+	return s.matchSegments(method, segments)
+}
+
+// matchSegments returns the operation for these path segments. If several operations match, the one with the
+// most literal path segments wins, so /rooms/{roomId}/state wins over /rooms/{roomId}/{anything}.
+func (s *Spec) matchSegments(method string, segments []string) *operation {
+	var best *operation
+	bestLiterals := -1
+	for i := range s.operations {
+		op := &s.operations[i]
+		if op.method != method || len(op.segments) != len(segments) {
+			continue
+		}
+		literals := 0
+		matched := true
+		for j, seg := range op.segments {
+			if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+				continue
+			}
+			if seg != segments[j] {
+				matched = false
+				break
+			}
+			literals++
+		}
+		if matched && literals > bestLiterals {
+			best = op
+			bestLiterals = literals
+		}
+	}
+	return best
+}
+
+// ValidateResponse checks the status code, headers and body of a response against the spec. Returns the
+// name of the matching operation and any violations, or false if the request does not correspond to any
+// operation in the spec, in which case no validation is done.
+func (s *Spec) ValidateResponse(method string, u *url.URL, status int, header http.Header, body []byte) (string, []Violation, bool) {
+	op := s.match(method, u)
+	if op == nil {
+		return "", nil, false
+	}
+	name := op.id
+	if name == "" {
+		name = op.method + " " + op.template
+	}
+	responses, file := s.resolve(op.node["responses"], op.file)
+	responseNode, ok := responseFor(responses, status)
+	if !ok {
+		return name, []Violation{{Message: fmt.Sprintf("status code %d is not a documented response", status)}}, true
+	}
+	response, file := s.resolve(responseNode, file)
+	var violations []Violation
+
+	// check headers
+	headers, _ := lookup(response, "headers").(map[string]interface{})
+	for name, h := range headers {
+		h, hFile := s.resolve(h, file)
+		value := header.Get(name)
+		if value == "" {
+			if required, _ := lookup(h, "required").(bool); required {
+				violations = append(violations, Violation{Message: fmt.Sprintf("missing required header %s", name)})
+			}
+			continue
+		}
+		if schema := lookup(h, "schema"); schema != nil {
+			for _, v := range s.validate(schema, hFile, headerValue(value, schema), "") {
+				violations = append(violations, Violation{Message: fmt.Sprintf("header %s: %s", name, v)})
+			}
+		}
+	}
+
+	// check the body
+	schema := lookup(response, "content", "application/json", "schema")
+	if schema == nil {
+		return name, violations, true
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return name, append(violations, Violation{Message: fmt.Sprintf("Content-Type is %q, want application/json", header.Get("Content-Type"))}), true
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return name, append(violations, Violation{Message: fmt.Sprintf("body is not valid JSON: %s", err)}), true
+	}
+	return name, append(violations, s.validate(schema, file, value, "")...), true
+}
+
+// RoundTripper returns an http.RoundTripper which validates every response to a request made through
+// `wrap` which is in the spec. Violations fail the test, or are logged as warnings if `lenient` is true.
+func (s *Spec) RoundTripper(t ct.TestLike, lenient bool, wrap http.RoundTripper) http.RoundTripper {
+	if wrap == nil {
+		wrap = http.DefaultTransport
+	}
+	return &roundTripper{t: t, spec: s, lenient: lenient, wrap: wrap}
+}
+
+type roundTripper struct {
+	t       ct.TestLike
+	spec    *Spec
+	lenient bool
+	wrap    http.RoundTripper
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := rt.wrap.RoundTrip(req)
+	if err != nil || req.Method == http.MethodHead {
+		return res, err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		// let the caller see the truncated body and deal with it
+		return res, nil
+	}
+	name, violations, ok := rt.spec.ValidateResponse(req.Method, req.URL, res.StatusCode, res.Header, body)
+	if !ok {
+		return res, nil
+	}
+	for _, v := range violations {
+		if rt.lenient {
+			rt.t.Logf("WARNING: spec violation: %s %s (%s) returned %d: %s", req.Method, req.URL.Path, name, res.StatusCode, v)
+		} else {
+			ct.Errorf(rt.t, "spec violation: %s %s (%s) returned %d: %s", req.Method, req.URL.Path, name, res.StatusCode, v)
+		}
+	}
+	return res, nil
+}
+
+// responseFor returns the response definition for this status code, falling back to ranges e.g "4XX"
+// and then "default".
+func responseFor(responses interface{}, status int) (interface{}, bool) {
+	m, ok := responses.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	code := strconv.Itoa(status)
+	for _, key := range []string{code, code[:1] + "XX", code[:1] + "xx", "default"} {
+		if r, ok := m[key]; ok {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// headerValue converts a header to the type its schema expects, so it can be validated like JSON.
+func headerValue(value string, schema interface{}) interface{} {
+	switch lookupString(schema, "type") {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// load returns the parsed YAML or JSON file at `path`, loading it if needed.
+func (s *Spec) load(path string) (interface{}, error) {
+	s.docsMu.Lock()
+	defer s.docsMu.Unlock()
+	if doc, ok := s.docs[path]; ok {
+		return doc, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	// JSON is a subset of YAML so this handles both
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	doc = normalise(doc)
+	s.docs[path] = doc
+	return doc, nil
+}
+
+// resolve follows `node` if it is a $ref, returning the node it refers to and the file that node is in,
+// which relative $refs within it are resolved against. Unresolvable refs resolve to nil, which validates
+// anything, so gaps in the loader never fail tests.
+func (s *Spec) resolve(node interface{}, file string) (interface{}, string) {
+	for i := 0; i < 32; i++ { // guard against ref cycles
+		ref := lookupString(node, "$ref")
+		if ref == "" {
+			return node, file
+		}
+		refPath, pointer, _ := strings.Cut(ref, "#")
+		if refPath != "" {
+			file = filepath.Join(filepath.Dir(file), refPath)
+		}
+		doc, err := s.load(file)
+		if err != nil {
+			return nil, file
+		}
+		node = followPointer(doc, pointer)
+	}
+	return nil, file
+}
+
+// followPointer returns the node at the JSON pointer `pointer` in `doc`, or nil if there isn't one.
+func followPointer(doc interface{}, pointer string) interface{} {
+	if pointer == "" || pointer == "/" {
+		return doc
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		switch n := doc.(type) {
+		case map[string]interface{}:
+			doc = n[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil
+			}
+			doc = n[i]
+		default:
+			return nil
+		}
+	}
+	return doc
+}
+
+// normalise converts the map[interface{}]interface{} values YAML produces for non-string keys
+// e.g response codes into map[string]interface{}.
+func normalise(node interface{}) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			n[k] = normalise(v)
+		}
+		return n
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(n))
+		for k, v := range n {
+			m[fmt.Sprint(k)] = normalise(v)
+		}
+		return m
+	case []interface{}:
+		for i := range n {
+			n[i] = normalise(n[i])
+		}
+		return n
+	}
+	return node
+}
+
+func lookup(node interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = m[k]
+	}
+	return node
+}
+
+func lookupString(node interface{}, keys ...string) string {
+	s, _ := lookup(node, keys...).(string)
+	return s
+}
@@ -0,0 +1,230 @@
+package openapi
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func mustLoadFixture(t *testing.T) *Spec {
+	t.Helper()
+	s, err := Load("testdata/spec")
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	return s
+}
+
+func TestMatch(t *testing.T) {
+	s := mustLoadFixture(t)
+	testCases := []struct {
+		method      string
+		path        string
+		wantOpID    string
+		wantMatched bool
+	}{
+		// literal segments win over parameters
+		{"GET", "/_matrix/client/v3/rooms/!a:hs1/state", "getRoomState", true},
+		{"GET", "/_matrix/client/v3/rooms/!a:hs1/members", "getRoomAnything", true},
+		{"GET", "/_matrix/client/v3/rooms/!a:hs1/state/m.room.name", "getRoomStateEvent", true},
+		// templated paths only match parameters
+		{"GET", "/_matrix/client/v3/rooms/{roomId}/state", "getRoomState", true},
+		{"GET", "/_matrix/client/v3/rooms/{roomId}/{anything}", "getRoomAnything", true},
+		{"GET", "/_matrix/client/v3/rooms/{roomId}/state/{eventType}", "getRoomStateEvent", true},
+		// no match
+		{"POST", "/_matrix/client/v3/rooms/!a:hs1/state", "", false},
+		{"GET", "/_matrix/client/v3/rooms/!a:hs1", "", false},
+		{"GET", "/_matrix/client/v1/rooms/!a:hs1/state", "", false},
+	}
+	for _, tc := range testCases {
+		endpoint, ok := s.Match(tc.method, tc.path)
+		if ok != tc.wantMatched || endpoint.OperationID != tc.wantOpID {
+			t.Errorf("Match(%s %s): got (%q, %v), want (%q, %v)", tc.method, tc.path, endpoint.OperationID, ok, tc.wantOpID, tc.wantMatched)
+		}
+	}
+
+	// escaped segments are matched once unescaped, so an escaped "/" doesn't add a segment
+	u, _ := url.Parse("/_matrix/client/v3/rooms/%21a%3Ahs1/state/m.room%2Fname")
+	if op := s.match("GET", u); op == nil || op.id != "getRoomStateEvent" {
+		t.Errorf("match(%s): got %+v, want getRoomStateEvent", u, op)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	s := mustLoadFixture(t)
+	got := make(map[string]Endpoint)
+	for _, e := range s.Endpoints() {
+		got[e.OperationID] = e
+	}
+	want := Endpoint{Method: "GET", Path: "/_matrix/client/v3/things/{thingId}", OperationID: "getThing"}
+	if len(got) != 4 || got["getThing"] != want {
+		t.Errorf("Endpoints: got %v, want 4 endpoints including %v", got, want)
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	s := mustLoadFixture(t)
+	const validThing = `{"id":"!abc:hs1","name":"thing"}`
+	jsonHeaders := func(extra ...string) http.Header {
+		h := http.Header{"Content-Type": {"application/json"}, "X-Count": {"3"}}
+		for i := 0; i+1 < len(extra); i += 2 {
+			h.Set(extra[i], extra[i+1])
+		}
+		return h
+	}
+	testCases := []struct {
+		name           string
+		status         int
+		header         http.Header
+		body           string
+		wantViolations []Violation
+	}{
+		{
+			name:   "valid",
+			status: 200,
+			header: jsonHeaders("X-Enabled", "true"),
+			body:   `{"id":"!abc:hs1","name":"thing","nickname":null,"value":"abc","tags":["a"],"a/b~c":true}`,
+		},
+		{
+			name:   "undocumented status code",
+			status: 500,
+			header: jsonHeaders(),
+			body:   `{}`,
+			wantViolations: []Violation{
+				{Message: "status code 500 is not a documented response"},
+			},
+		},
+		{
+			name:   "status code range via $ref in the same file",
+			status: 404,
+			header: jsonHeaders(),
+			body:   `{"error":"not found"}`,
+			wantViolations: []Violation{
+				{Message: `missing required key "errcode"`},
+			},
+		},
+		{
+			name:   "missing required key",
+			status: 200,
+			header: jsonHeaders(),
+			body:   `{"id":"!abc:hs1"}`,
+			wantViolations: []Violation{
+				{Message: `missing required key "name"`},
+			},
+		},
+		{
+			name:   "additionalProperties false",
+			status: 200,
+			header: jsonHeaders(),
+			body:   `{"id":"!abc:hs1","name":"thing","extra":1}`,
+			wantViolations: []Violation{
+				{Pointer: "/extra", Message: "unexpected key"},
+			},
+		},
+		{
+			name:   "relative $ref across files",
+			status: 200,
+			header: jsonHeaders(),
+			body:   `{"id":"not a room ID","name":"thing"}`,
+			wantViolations: []Violation{
+				{Pointer: "/id", Message: `"not a room ID" does not match pattern ^![a-z]+:[a-z0-9]+$`},
+			},
+		},
+		{
+			name:   "nullable",
+			status: 200,
+			header: jsonHeaders(),
+			body:   `{"id":"!abc:hs1","name":"thing","nickname":5}`,
+			wantViolations: []Violation{
+				{Pointer: "/nickname", Message: "got integer 5, want type string"},
+			},
+		},
+		{
+			name:   "anyOf",
+			status: 200,
+			header: jsonHeaders(),
+			body:   `{"id":"!abc:hs1","name":"thing","value":"ABC"}`,
+			wantViolations: []Violation{
+				{Pointer: "/value", Message: "matches none of the 2 schemas in anyOf, first failure: /value: got string \"ABC\", want type integer"},
+			},
+		},
+		{
+			name:   "array items and minLength",
+			status: 200,
+			header: jsonHeaders(),
+			body:   `{"id":"!abc:hs1","name":"","tags":["a",1]}`,
+			wantViolations: []Violation{
+				{Pointer: "/name", Message: "string is 0 characters, want at least 1"},
+				{Pointer: "/tags/1", Message: "got integer 1, want type string"},
+			},
+		},
+		{
+			name:   "pointer escaping",
+			status: 200,
+			header: jsonHeaders(),
+			body:   `{"id":"!abc:hs1","name":"thing","a/b~c":"yes"}`,
+			wantViolations: []Violation{
+				{Pointer: "/a~1b~0c", Message: `got string "yes", want type boolean`},
+			},
+		},
+		{
+			name:   "headers are coerced to their schema type",
+			status: 200,
+			header: jsonHeaders("X-Count", "three", "X-Enabled", "maybe"),
+			body:   validThing,
+			wantViolations: []Violation{
+				{Message: `header X-Count: got string "three", want type integer`},
+				{Message: `header X-Enabled: got string "maybe", want type boolean`},
+			},
+		},
+		{
+			name:   "missing required header",
+			status: 200,
+			header: http.Header{"Content-Type": {"application/json"}},
+			body:   validThing,
+			wantViolations: []Violation{
+				{Message: "missing required header X-Count"},
+			},
+		},
+		{
+			name:   "wrong content type",
+			status: 200,
+			header: jsonHeaders("Content-Type", "text/plain"),
+			body:   validThing,
+			wantViolations: []Violation{
+				{Message: `Content-Type is "text/plain", want application/json`},
+			},
+		},
+	}
+	u, _ := url.Parse("/_matrix/client/v3/things/1")
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			name, violations, ok := s.ValidateResponse("GET", u, tc.status, tc.header, []byte(tc.body))
+			if !ok || name != "getThing" {
+				t.Fatalf("ValidateResponse: got (%q, %v), want the request to match getThing", name, ok)
+			}
+			sortViolations(violations)
+			if !reflect.DeepEqual(violations, tc.wantViolations) {
+				t.Errorf("ValidateResponse:\ngot  %q\nwant %q", violations, tc.wantViolations)
+			}
+		})
+	}
+
+	t.Run("requests not in the spec are not validated", func(t *testing.T) {
+		u, _ := url.Parse("/_matrix/client/v3/unknown")
+		if _, _, ok := s.ValidateResponse("GET", u, 200, jsonHeaders(), []byte(`{}`)); ok {
+			t.Errorf("ValidateResponse validated a request which is not in the spec")
+		}
+	})
+}
+
+// sortViolations sorts violations about headers, which are checked in map order, so they can be compared.
+func sortViolations(violations []Violation) {
+	sort.SliceStable(violations, func(i, j int) bool {
+		a, b := violations[i], violations[j]
+		return strings.HasPrefix(a.Message, "header ") && strings.HasPrefix(b.Message, "header ") && a.Message < b.Message
+	})
+}
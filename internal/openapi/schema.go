@@ -0,0 +1,292 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	patternsMu sync.Mutex
+	patterns   = make(map[string]*regexp.Regexp)
+)
+
+// validate checks `value`, which was decoded from JSON with UseNumber, against the JSON Schema `schema`
+// defined in `file`. `pointer` is the JSON pointer to `value` in the response body.
+//
+// This supports the keywords the Matrix spec uses: annotations such as `format` and `example` are ignored.
+// `oneOf` is treated like `anyOf`, as the spec does not always make its alternatives mutually exclusive.
+func (s *Spec) validate(schema interface{}, file string, value interface{}, pointer string) []Violation {
+	if b, ok := schema.(bool); ok {
+		if !b {
+			return []Violation{{Pointer: pointer, Message: "no value is allowed here"}}
+		}
+		return nil
+	}
+	node, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var violations []Violation
+	if _, ok := node["$ref"]; ok {
+		refNode, refFile := s.resolve(node, file)
+		violations = append(violations, s.validate(refNode, refFile, value, pointer)...)
+	}
+
+	if !matchesType(node, value) {
+		// the remaining keywords assume the right type, so stop here
+		return append(violations, Violation{
+			Pointer: pointer,
+			Message: fmt.Sprintf("got %s %s, want type %v", jsonType(value), truncate(value), node["type"]),
+		})
+	}
+	if enum, ok := node["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("%s is not one of %v", truncate(value), enum)})
+		}
+	}
+	if c, ok := node["const"]; ok && !jsonEqual(c, value) {
+		violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("%s is not %v", truncate(value), c)})
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		violations = append(violations, s.validateObject(node, file, v, pointer)...)
+	case []interface{}:
+		if min, ok := number(node["minItems"]); ok && float64(len(v)) < min {
+			violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("array has %d items, want at least %v", len(v), min)})
+		}
+		if max, ok := number(node["maxItems"]); ok && float64(len(v)) > max {
+			violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("array has %d items, want at most %v", len(v), max)})
+		}
+		if items, ok := node["items"]; ok {
+			for i, item := range v {
+				violations = append(violations, s.validate(items, file, item, pointer+"/"+strconv.Itoa(i))...)
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := number(node["minLength"]); ok && length < min {
+			violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("string is %v characters, want at least %v", length, min)})
+		}
+		if max, ok := number(node["maxLength"]); ok && length > max {
+			violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("string is %v characters, want at most %v", length, max)})
+		}
+		if pattern, ok := node["pattern"].(string); ok {
+			if re := compilePattern(pattern); re != nil && !re.MatchString(v) {
+				violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("%q does not match pattern %s", v, pattern)})
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if min, ok := number(node["minimum"]); ok && n < min {
+			violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("%v is less than the minimum %v", v, min)})
+		}
+		if max, ok := number(node["maximum"]); ok && n > max {
+			violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("%v is greater than the maximum %v", v, max)})
+		}
+	}
+
+	if allOf, ok := node["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			violations = append(violations, s.validate(sub, file, value, pointer)...)
+		}
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		alternatives, ok := node[keyword].([]interface{})
+		if !ok || len(alternatives) == 0 {
+			continue
+		}
+		var first []Violation
+		matched := false
+		for i, sub := range alternatives {
+			subViolations := s.validate(sub, file, value, pointer)
+			if len(subViolations) == 0 {
+				matched = true
+				break
+			}
+			if i == 0 {
+				first = subViolations
+			}
+		}
+		if !matched {
+			violations = append(violations, Violation{
+				Pointer: pointer,
+				Message: fmt.Sprintf("matches none of the %d schemas in %s, first failure: %s", len(alternatives), keyword, first[0]),
+			})
+		}
+	}
+	return violations
+}
+
+func (s *Spec) validateObject(node map[string]interface{}, file string, obj map[string]interface{}, pointer string) []Violation {
+	var violations []Violation
+	if required, ok := node["required"].([]interface{}); ok {
+		for _, r := range required {
+			key, _ := r.(string)
+			if _, ok := obj[key]; !ok {
+				violations = append(violations, Violation{Pointer: pointer, Message: fmt.Sprintf("missing required key %q", key)})
+			}
+		}
+	}
+	properties, _ := node["properties"].(map[string]interface{})
+	patternProperties, _ := node["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := node["additionalProperties"]
+
+	// sort keys so violations are reported in a stable order
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		keyPointer := pointer + "/" + escapePointer(key)
+		known := false
+		if sub, ok := properties[key]; ok {
+			known = true
+			violations = append(violations, s.validate(sub, file, obj[key], keyPointer)...)
+		}
+		for pattern, sub := range patternProperties {
+			if re := compilePattern(pattern); re != nil && re.MatchString(key) {
+				known = true
+				violations = append(violations, s.validate(sub, file, obj[key], keyPointer)...)
+			}
+		}
+		if !known && hasAdditional {
+			if b, ok := additional.(bool); ok && !b {
+				violations = append(violations, Violation{Pointer: keyPointer, Message: "unexpected key"})
+			} else {
+				violations = append(violations, s.validate(additional, file, obj[key], keyPointer)...)
+			}
+		}
+	}
+	return violations
+}
+
+// matchesType returns true if `value` has one of the types allowed by `node`, or if it doesn't restrict
+// the type. OpenAPI 3.0's `nullable` is honoured as well as 3.1's type arrays.
+func matchesType(node map[string]interface{}, value interface{}) bool {
+	var types []string
+	switch t := node["type"].(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, tt := range t {
+			if s, ok := tt.(string); ok {
+				types = append(types, s)
+			}
+		}
+	default:
+		return true
+	}
+	if nullable, _ := node["nullable"].(bool); nullable {
+		types = append(types, "null")
+	}
+	got := jsonType(value)
+	for _, want := range types {
+		if want == got || (want == "number" && got == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON Schema type of a value decoded with UseNumber.
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) && !strings.ContainsAny(v.String(), ".") {
+			return "integer" // too big for an int64, but still an integer
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// jsonEqual compares a value from the spec with a value from a response. Numbers are compared by value,
+// as YAML and JSON decode them into different types.
+func jsonEqual(specValue, value interface{}) bool {
+	a, aIsNum := number(specValue)
+	b, bIsNum := number(value)
+	if aIsNum || bIsNum {
+		return aIsNum && bIsNum && a == b
+	}
+	return reflect.DeepEqual(specValue, value)
+}
+
+// number returns the value of any numeric type produced by the YAML or JSON decoders.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// compilePattern compiles an ECMA-262 regular expression from the spec. Returns nil if Go cannot
+// compile it, in which case the pattern is not checked.
+func compilePattern(pattern string) *regexp.Regexp {
+	patternsMu.Lock()
+	defer patternsMu.Unlock()
+	if re, ok := patterns[pattern]; ok {
+		return re
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		re = nil
+	}
+	patterns[pattern] = re
+	return re
+}
+
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// truncate returns the value as JSON, shortened so violations don't dump entire response bodies.
+func truncate(value interface{}) string {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	if len(b) > 100 {
+		return string(b[:100]) + "..."
+	}
+	return string(b)
+}
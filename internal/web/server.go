@@ -20,13 +20,20 @@ type Server struct {
 
 func NewServer(t *testing.T, comp *config.Complement, configFunc func(router *mux.Router)) *Server {
 	t.Helper()
+	return NewServerOnPort(t, comp, 0, configFunc)
+}
+
+// NewServerOnPort is the same as NewServer but listens on the given port. If the port is 0, a random
+// port is used. This is useful when homeservers need to know the URL before the server is created.
+func NewServerOnPort(t *testing.T, comp *config.Complement, port int, configFunc func(router *mux.Router)) *Server {
+	t.Helper()
 
-	listener, err := net.Listen("tcp", ":0")
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		t.Fatalf("Could not create listener for web server: %s", err)
 	}
 
-	port := listener.Addr().(*net.TCPAddr).Port
+	port = listener.Addr().(*net.TCPAddr).Port
 
 	r := mux.NewRouter()
 
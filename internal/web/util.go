@@ -0,0 +1,23 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// WriteJSON writes `body` as an uncacheable JSON response with the given status code.
+func WriteJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// RandomString returns `numBytes` random bytes as a hex string, for use as tokens, codes and secrets.
+func RandomString(numBytes int) string {
+	b := make([]byte, numBytes)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
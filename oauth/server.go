@@ -0,0 +1,609 @@
+// package oauth is an EXPERIMENTAL stub OAuth 2.0 / OpenID Connect provider, for testing homeservers
+// which delegate authentication to an external provider (MSC3861).
+// It is marked as EXPERIMENTAL as the API may break without warning.
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/web"
+)
+
+// The grant type for the device authorization grant, RFC 8628.
+const GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Subset of Deployment used by the stub provider.
+type OAuthDeployment interface {
+	GetConfig() *config.Complement
+}
+
+// EXPERIMENTAL
+// Server is a stub OAuth 2.0 authorization server. It supports discovery, dynamic client registration,
+// the authorization code grant with PKCE, refresh tokens, the device authorization grant, token
+// introspection and token revocation.
+//
+// All authorization requests are approved immediately, for the Matrix user given in the `login_hint`
+// (e.g `mxid:@alice:hs1`). Device authorization requests must be approved by the test by calling
+// ApproveDeviceAuthorization.
+type Server struct {
+	t   ct.TestLike
+	cfg *config.Complement
+
+	// The issuer URL as seen by homeservers. Only valid after calling Listen().
+	Issuer string
+	// How long issued access tokens are valid for. Default: 5 minutes.
+	AccessTokenLifetime time.Duration
+
+	port      int
+	listening bool
+	mux       *mux.Router
+	srv       *http.Server
+
+	mu            sync.Mutex
+	clients       map[string]*registeredClient
+	codes         map[string]*authorizationCode
+	accessTokens  map[string]*Token
+	refreshTokens map[string]*Token
+	deviceGrants  map[string]*deviceGrant // keyed on device_code
+}
+
+// Token is an access token issued by the stub provider.
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	ClientID     string
+	// The Matrix user ID this token was issued for.
+	UserID    string
+	Scope     string
+	ExpiresAt time.Time
+	Revoked   bool
+}
+
+type registeredClient struct {
+	ClientID     string
+	RedirectURIs []string
+	GrantTypes   []string
+}
+
+type authorizationCode struct {
+	ClientID      string
+	RedirectURI   string
+	UserID        string
+	Scope         string
+	CodeChallenge string
+	Used          bool
+}
+
+type deviceGrant struct {
+	ClientID  string
+	Scope     string
+	UserCode  string
+	UserID    string
+	Approved  bool
+	Denied    bool
+	Redeemed  bool
+	ExpiresAt time.Time
+}
+
+// EXPERIMENTAL
+// NewServer creates a new stub OAuth 2.0 provider. Call Listen() to start serving requests.
+func NewServer(t ct.TestLike, deployment OAuthDeployment, opts ...func(*Server)) *Server {
+	srv := &Server{
+		t:                   t,
+		cfg:                 deployment.GetConfig(),
+		AccessTokenLifetime: 5 * time.Minute,
+		mux:                 mux.NewRouter(),
+		clients:             make(map[string]*registeredClient),
+		codes:               make(map[string]*authorizationCode),
+		accessTokens:        make(map[string]*Token),
+		refreshTokens:       make(map[string]*Token),
+		deviceGrants:        make(map[string]*deviceGrant),
+	}
+	// the homeserver is a pre-registered confidential client
+	srv.clients[config.OAuthStubClientID] = &registeredClient{
+		ClientID: config.OAuthStubClientID,
+	}
+	srv.mux.HandleFunc("/.well-known/openid-configuration", srv.handleDiscovery).Methods("GET")
+	srv.mux.HandleFunc("/.well-known/oauth-authorization-server", srv.handleDiscovery).Methods("GET")
+	srv.mux.HandleFunc("/oauth2/keys.json", srv.handleJWKS).Methods("GET")
+	srv.mux.HandleFunc("/oauth2/registration", srv.handleRegistration).Methods("POST")
+	srv.mux.HandleFunc("/authorize", srv.handleAuthorize).Methods("GET")
+	srv.mux.HandleFunc("/oauth2/token", srv.handleToken).Methods("POST")
+	srv.mux.HandleFunc("/oauth2/introspect", srv.handleIntrospect).Methods("POST")
+	srv.mux.HandleFunc("/oauth2/revoke", srv.handleRevoke).Methods("POST")
+	srv.mux.HandleFunc("/oauth2/device", srv.handleDeviceAuthorization).Methods("POST")
+	srv.mux.HandleFunc("/link", srv.handleVerification).Methods("GET")
+	srv.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ct.Errorf(t, "OAuth stub received unexpected request: %s %s", req.Method, req.URL.String())
+		w.WriteHeader(404)
+	})
+	srv.srv = &http.Server{Handler: srv.mux}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// Listen for requests. The port is COMPLEMENT_OAUTH_STUB_PORT if set, else a random port. Only when
+// COMPLEMENT_OAUTH_STUB_PORT is set will deployed homeservers be configured to use this provider.
+//
+// Returns a function which must be called to stop the server.
+func (s *Server) Listen() (cancel func()) {
+	if s.listening {
+		return func() {}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", s.cfg.OAuthStubPort)) //nolint
+	if err != nil {
+		ct.Fatalf(s.t, "oauth.Server.Listen: net.Listen failed: %s", err)
+	}
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.Issuer = fmt.Sprintf("http://%s:%d/", s.cfg.HostnameRunningComplement, s.port)
+	s.listening = true
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.t.Logf("oauth.Server.Listen: Serve failed: %s", err)
+		}
+	}()
+
+	return func() {
+		err := s.srv.Close()
+		if err != nil {
+			ct.Fatalf(s.t, "oauth.Server.Listen: failed to shutdown server: %s", err)
+		}
+		wg.Wait()
+	}
+}
+
+// Mux returns this server's router so tests can add extra handlers, e.g to simulate provider errors.
+func (s *Server) Mux() *mux.Router {
+	return s.mux
+}
+
+// HTTPClient returns an HTTP client which can talk to this provider from the machine running
+// Complement. Requests to the issuer's host are sent to the local port the server is listening on,
+// as the issuer hostname is only resolvable from inside containers. Redirects are not followed, so
+// the authorization response can be inspected.
+func (s *Server) HTTPClient() *http.Client {
+	if !s.listening {
+		ct.Fatalf(s.t, "HTTPClient() called before Listen() - the port is only known after calling Listen()")
+	}
+	issuerHost := fmt.Sprintf("%s:%d", s.cfg.HostnameRunningComplement, s.port)
+	localAddr := fmt.Sprintf("127.0.0.1:%d", s.port)
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr == issuerHost {
+					addr = localAddr
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// ApproveDeviceAuthorization approves the pending device authorization request with the given
+// user code on behalf of `userID`. The client's next poll of the token endpoint will succeed.
+func (s *Server) ApproveDeviceAuthorization(t ct.TestLike, userCode, userID string) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grant := s.deviceGrantByUserCode(userCode)
+	if grant == nil {
+		ct.Fatalf(t, "ApproveDeviceAuthorization: no pending device authorization with user code %s", userCode)
+	}
+	grant.Approved = true
+	grant.UserID = userID
+}
+
+// DenyDeviceAuthorization denies the pending device authorization request with the given user code.
+// The client's next poll of the token endpoint will fail with `access_denied`.
+func (s *Server) DenyDeviceAuthorization(t ct.TestLike, userCode string) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grant := s.deviceGrantByUserCode(userCode)
+	if grant == nil {
+		ct.Fatalf(t, "DenyDeviceAuthorization: no pending device authorization with user code %s", userCode)
+	}
+	grant.Denied = true
+}
+
+// RevokeToken revokes an access token and its refresh token, as if the user had signed out at the
+// provider. Homeservers will be told the token is inactive on their next introspection request.
+func (s *Server) RevokeToken(t ct.TestLike, accessToken string) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok := s.accessTokens[accessToken]
+	if tok == nil {
+		ct.Fatalf(t, "RevokeToken: unknown access token %s", accessToken)
+	}
+	tok.Revoked = true
+}
+
+// Tokens returns a copy of every token issued for the given Matrix user ID.
+func (s *Server) Tokens(userID string) []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tokens []Token
+	for _, tok := range s.accessTokens {
+		if tok.UserID == userID {
+			tokens = append(tokens, *tok)
+		}
+	}
+	return tokens
+}
+
+func (s *Server) deviceGrantByUserCode(userCode string) *deviceGrant {
+	for _, grant := range s.deviceGrants {
+		if grant.UserCode == userCode && !grant.Redeemed {
+			return grant
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, req *http.Request) {
+	issuer := s.Issuer
+	web.WriteJSON(w, 200, map[string]interface{}{
+		"issuer":                                        issuer,
+		"authorization_endpoint":                        issuer + "authorize",
+		"token_endpoint":                                issuer + "oauth2/token",
+		"registration_endpoint":                         issuer + "oauth2/registration",
+		"introspection_endpoint":                        issuer + "oauth2/introspect",
+		"revocation_endpoint":                           issuer + "oauth2/revoke",
+		"device_authorization_endpoint":                 issuer + "oauth2/device",
+		"jwks_uri":                                      issuer + "oauth2/keys.json",
+		"response_types_supported":                      []string{"code"},
+		"response_modes_supported":                      []string{"query", "fragment"},
+		"grant_types_supported":                         []string{"authorization_code", "refresh_token", GrantTypeDeviceCode},
+		"code_challenge_methods_supported":              []string{"S256"},
+		"token_endpoint_auth_methods_supported":         []string{"none", "client_secret_basic", "client_secret_post"},
+		"introspection_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"revocation_endpoint_auth_methods_supported":    []string{"none", "client_secret_basic", "client_secret_post"},
+		"scopes_supported":                              []string{"openid", "urn:matrix:client:api:*", "urn:matrix:org.matrix.msc2967.client:api:*"},
+		"subject_types_supported":                       []string{"public"},
+		"id_token_signing_alg_values_supported":         []string{"RS256"},
+		"prompt_values_supported":                       []string{"create"},
+	})
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, req *http.Request) {
+	// ID tokens are never issued, so there are no keys to publish.
+	web.WriteJSON(w, 200, map[string]interface{}{
+		"keys": []interface{}{},
+	})
+}
+
+func (s *Server) handleRegistration(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		RedirectURIs []string `json:"redirect_uris"`
+		GrantTypes   []string `json:"grant_types"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeOAuthError(w, 400, "invalid_client_metadata", "body is not valid JSON: "+err.Error())
+		return
+	}
+	if len(body.GrantTypes) == 0 {
+		body.GrantTypes = []string{"authorization_code"}
+	}
+	client := &registeredClient{
+		ClientID:     "client_" + web.RandomString(8),
+		RedirectURIs: body.RedirectURIs,
+		GrantTypes:   body.GrantTypes,
+	}
+	s.mu.Lock()
+	s.clients[client.ClientID] = client
+	s.mu.Unlock()
+	web.WriteJSON(w, 201, map[string]interface{}{
+		"client_id":                  client.ClientID,
+		"client_id_issued_at":        time.Now().Unix(),
+		"redirect_uris":              client.RedirectURIs,
+		"grant_types":                client.GrantTypes,
+		"response_types":             []string{"code"},
+		"token_endpoint_auth_method": "none",
+	})
+}
+
+func (s *Server) handleAuthorize(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client := s.clients[q.Get("client_id")]
+	if client == nil {
+		writeOAuthError(w, 400, "invalid_client", "unknown client_id")
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		// do not redirect to unregistered URIs
+		writeOAuthError(w, 400, "invalid_request", "redirect_uri is not registered for this client")
+		return
+	}
+	redirectWith := func(params url.Values) {
+		params.Set("state", q.Get("state"))
+		target, _ := url.Parse(redirectURI)
+		if q.Get("response_mode") == "fragment" {
+			target.Fragment = params.Encode()
+		} else {
+			target.RawQuery = params.Encode()
+		}
+		http.Redirect(w, req, target.String(), http.StatusFound)
+	}
+	if q.Get("response_type") != "code" {
+		redirectWith(url.Values{"error": {"unsupported_response_type"}})
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		redirectWith(url.Values{"error": {"invalid_request"}, "error_description": {"PKCE with S256 is required"}})
+		return
+	}
+	userID := strings.TrimPrefix(q.Get("login_hint"), "mxid:")
+	if !strings.HasPrefix(userID, "@") {
+		redirectWith(url.Values{"error": {"login_required"}, "error_description": {"login_hint must be mxid:@user:server"}})
+		return
+	}
+	code := web.RandomString(16)
+	s.codes[code] = &authorizationCode{
+		ClientID:      client.ClientID,
+		RedirectURI:   redirectURI,
+		UserID:        userID,
+		Scope:         q.Get("scope"),
+		CodeChallenge: q.Get("code_challenge"),
+	}
+	redirectWith(url.Values{"code": {code}})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clientID := req.PostForm.Get("client_id")
+	if user, _, ok := req.BasicAuth(); ok {
+		clientID = user
+	}
+	if s.clients[clientID] == nil {
+		writeOAuthError(w, 401, "invalid_client", "unknown client_id")
+		return
+	}
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := s.codes[req.PostForm.Get("code")]
+		if code == nil || code.Used || code.ClientID != clientID {
+			writeOAuthError(w, 400, "invalid_grant", "unknown or used authorization code")
+			return
+		}
+		code.Used = true
+		if code.RedirectURI != req.PostForm.Get("redirect_uri") {
+			writeOAuthError(w, 400, "invalid_grant", "redirect_uri does not match")
+			return
+		}
+		if pkceChallenge(req.PostForm.Get("code_verifier")) != code.CodeChallenge {
+			writeOAuthError(w, 400, "invalid_grant", "code_verifier does not match code_challenge")
+			return
+		}
+		s.writeToken(w, s.issueToken(clientID, code.UserID, code.Scope))
+	case "refresh_token":
+		old := s.refreshTokens[req.PostForm.Get("refresh_token")]
+		if old == nil || old.Revoked || old.ClientID != clientID {
+			writeOAuthError(w, 400, "invalid_grant", "unknown or revoked refresh token")
+			return
+		}
+		// refresh tokens are rotated
+		old.Revoked = true
+		delete(s.refreshTokens, old.RefreshToken)
+		s.writeToken(w, s.issueToken(clientID, old.UserID, old.Scope))
+	case GrantTypeDeviceCode:
+		grant := s.deviceGrants[req.PostForm.Get("device_code")]
+		if grant == nil || grant.Redeemed || grant.ClientID != clientID {
+			writeOAuthError(w, 400, "invalid_grant", "unknown device code")
+			return
+		}
+		if time.Now().After(grant.ExpiresAt) {
+			writeOAuthError(w, 400, "expired_token", "device code has expired")
+			return
+		}
+		if grant.Denied {
+			writeOAuthError(w, 400, "access_denied", "the user denied the request")
+			return
+		}
+		if !grant.Approved {
+			writeOAuthError(w, 400, "authorization_pending", "the user has not approved the request yet")
+			return
+		}
+		grant.Redeemed = true
+		s.writeToken(w, s.issueToken(clientID, grant.UserID, grant.Scope))
+	default:
+		writeOAuthError(w, 400, "unsupported_grant_type", "unsupported grant_type")
+	}
+}
+
+func (s *Server) handleDeviceAuthorization(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clientID := req.PostForm.Get("client_id")
+	if s.clients[clientID] == nil {
+		writeOAuthError(w, 401, "invalid_client", "unknown client_id")
+		return
+	}
+	deviceCode := web.RandomString(16)
+	userCode := strings.ToUpper(web.RandomString(4))
+	s.deviceGrants[deviceCode] = &deviceGrant{
+		ClientID:  clientID,
+		Scope:     req.PostForm.Get("scope"),
+		UserCode:  userCode,
+		ExpiresAt: time.Now().Add(5 * time.Minute),
+	}
+	verificationURI := s.Issuer + "link"
+	web.WriteJSON(w, 200, map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?code=" + userCode,
+		"expires_in":                300,
+		"interval":                  1,
+	})
+}
+
+// handleVerification serves the verification URI from device authorization responses. Users can't
+// approve requests here, as tests approve them by calling ApproveDeviceAuthorization.
+func (s *Server) handleVerification(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(200)
+	fmt.Fprintln(w, "Complement OAuth stub: device authorization requests are approved by the test via ApproveDeviceAuthorization.")
+	if userCode := req.URL.Query().Get("code"); userCode != "" {
+		fmt.Fprintf(w, "User code: %s\n", userCode)
+	}
+}
+
+func (s *Server) handleIntrospect(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", err.Error())
+		return
+	}
+	if !isHomeserverClient(req) {
+		writeOAuthError(w, 401, "invalid_client", "introspection requires the homeserver's client credentials")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := req.PostForm.Get("token")
+	tok := s.accessTokens[token]
+	if tok == nil {
+		tok = s.refreshTokens[token]
+	}
+	if tok == nil || tok.Revoked || time.Now().After(tok.ExpiresAt) {
+		web.WriteJSON(w, 200, map[string]interface{}{
+			"active": false,
+		})
+		return
+	}
+	localpart := strings.SplitN(strings.TrimPrefix(tok.UserID, "@"), ":", 2)[0]
+	tokenType := "access_token"
+	if token == tok.RefreshToken {
+		tokenType = "refresh_token"
+	}
+	web.WriteJSON(w, 200, map[string]interface{}{
+		"active":     true,
+		"scope":      tok.Scope,
+		"client_id":  tok.ClientID,
+		"username":   localpart,
+		"sub":        localpart,
+		"token_type": tokenType,
+		"exp":        tok.ExpiresAt.Unix(),
+		"iat":        tok.ExpiresAt.Add(-s.AccessTokenLifetime).Unix(),
+		"iss":        s.Issuer,
+		"device_id":  deviceIDFromScope(tok.Scope),
+	})
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := req.PostForm.Get("token")
+	if tok := s.accessTokens[token]; tok != nil {
+		tok.Revoked = true
+	} else if tok := s.refreshTokens[token]; tok != nil {
+		tok.Revoked = true
+	}
+	// RFC 7009: unknown tokens are not an error
+	w.WriteHeader(200)
+}
+
+// issueToken creates a new access and refresh token. Must be called with the mutex held.
+func (s *Server) issueToken(clientID, userID, scope string) *Token {
+	tok := &Token{
+		AccessToken:  "mat_" + web.RandomString(16),
+		RefreshToken: "mar_" + web.RandomString(16),
+		ClientID:     clientID,
+		UserID:       userID,
+		Scope:        scope,
+		ExpiresAt:    time.Now().Add(s.AccessTokenLifetime),
+	}
+	s.accessTokens[tok.AccessToken] = tok
+	s.refreshTokens[tok.RefreshToken] = tok
+	return tok
+}
+
+func (s *Server) writeToken(w http.ResponseWriter, tok *Token) {
+	web.WriteJSON(w, 200, map[string]interface{}{
+		"access_token":  tok.AccessToken,
+		"refresh_token": tok.RefreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(s.AccessTokenLifetime.Seconds()),
+		"scope":         tok.Scope,
+	})
+}
+
+// isHomeserverClient returns true if the request is authenticated with the homeserver's client
+// credentials, using either client_secret_basic or client_secret_post.
+func isHomeserverClient(req *http.Request) bool {
+	clientID, clientSecret, ok := req.BasicAuth()
+	if !ok {
+		clientID = req.PostForm.Get("client_id")
+		clientSecret = req.PostForm.Get("client_secret")
+	}
+	return clientID == config.OAuthStubClientID && clientSecret == config.OAuthStubClientSecret
+}
+
+// deviceIDFromScope extracts the Matrix device ID from the stable or unstable (MSC2967) device scope.
+func deviceIDFromScope(scope string) string {
+	for _, s := range strings.Fields(scope) {
+		for _, prefix := range []string{"urn:matrix:client:device:", "urn:matrix:org.matrix.msc2967.client:device:"} {
+			if strings.HasPrefix(s, prefix) {
+				return strings.TrimPrefix(s, prefix)
+			}
+		}
+	}
+	return ""
+}
+
+func pkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func writeOAuthError(w http.ResponseWriter, code int, errcode, description string) {
+	web.WriteJSON(w, code, map[string]interface{}{
+		"error":             errcode,
+		"error_description": description,
+	})
+}
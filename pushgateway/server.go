@@ -0,0 +1,293 @@
+// package pushgateway is an EXPERIMENTAL stub push gateway, for testing which push notifications homeservers
+// send. It is marked as EXPERIMENTAL as the API may break without warning.
+package pushgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/internal/coverage"
+	"github.com/matrix-org/complement/internal/har"
+)
+
+// The app ID of pushers made by Server.Pusher.
+const AppID = "org.matrix.complement"
+
+// Subset of Deployment used by the push gateway.
+type PushGatewayDeployment interface {
+	GetConfig() *config.Complement
+}
+
+// EXPERIMENTAL
+// Server is a stub push gateway which implements `POST /_matrix/push/v1/notify`. It records every notification
+// it receives. Use Pusher to make a pusher which sends notifications to it:
+//
+//	gateway := pushgateway.NewServer(t, deployment)
+//	cancel := gateway.Listen()
+//	defer cancel()
+//	alice.MustSetPusher(t, gateway.Pusher("alice-pushkey"))
+type Server struct {
+	t   ct.TestLike
+	cfg *config.Complement
+	mux *mux.Router
+	srv *http.Server
+
+	// The URL of the notify endpoint as seen by homeservers. Only valid after calling Listen().
+	URL       string
+	listening bool
+
+	mu               sync.Mutex
+	notifications    []Notification
+	rejectedPushKeys map[string]bool
+	waiters          []*notificationWaiter
+}
+
+// Notification is a notification sent to the push gateway.
+type Notification struct {
+	EventID           string
+	RoomID            string
+	Type              string
+	Sender            string
+	SenderDisplayName string
+	RoomName          string
+	RoomAlias         string
+	UserIsTarget      bool
+	// "high" or "low". Defaults to "high" if the homeserver did not send it.
+	Priority string
+	// The content of the event, if the pusher's format includes it.
+	Content gjson.Result
+	Counts  Counts
+	Devices []Device
+	// The entire notification object.
+	Body gjson.Result
+}
+
+// Counts are the unread counts sent with a notification, which clients use for badge counts.
+type Counts struct {
+	Unread      int64
+	MissedCalls int64
+}
+
+// Device is a device the notification should be delivered to.
+type Device struct {
+	AppID     string
+	PushKey   string
+	PushKeyTS int64
+	// The `data` of the pusher, without the URL.
+	Data gjson.Result
+	// The actions from the push rule which matched, e.g the sound to play.
+	Tweaks gjson.Result
+}
+
+type notificationWaiter struct {
+	check  func(n Notification) bool
+	waiter *helpers.Waiter
+}
+
+// EXPERIMENTAL
+// NewServer creates a new stub push gateway. Call Listen() to start serving requests.
+func NewServer(t ct.TestLike, deployment PushGatewayDeployment, opts ...func(*Server)) *Server {
+	srv := &Server{
+		t:                t,
+		cfg:              deployment.GetConfig(),
+		mux:              mux.NewRouter(),
+		rejectedPushKeys: make(map[string]bool),
+	}
+	srv.mux.HandleFunc("/_matrix/push/v1/notify", srv.handleNotify).Methods("POST")
+	srv.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ct.Errorf(t, "push gateway received unexpected request: %s %s", req.Method, req.URL.String())
+		w.WriteHeader(404)
+	})
+	handler := har.ForTest(t, srv.cfg).Handler("Complement push gateway", srv.mux)
+	srv.srv = &http.Server{Handler: coverage.Handler(srv.cfg, handler)}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// WithRejectedPushKeys makes the push gateway reject notifications to these pushkeys, which tells the
+// homeserver to remove the pushers.
+func WithRejectedPushKeys(pushKeys ...string) func(*Server) {
+	return func(srv *Server) {
+		srv.RejectPushKeys(pushKeys...)
+	}
+}
+
+// Listen for requests on a random port. Returns a function which must be called to stop the server.
+func (s *Server) Listen() (cancel func()) {
+	if s.listening {
+		return func() {}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		ct.Fatalf(s.t, "pushgateway.Server.Listen: net.Listen failed: %s", err)
+	}
+	s.URL = fmt.Sprintf("http://%s:%d/_matrix/push/v1/notify", s.cfg.HostnameRunningComplement, ln.Addr().(*net.TCPAddr).Port)
+	s.listening = true
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.t.Logf("pushgateway.Server.Listen: Serve failed: %s", err)
+		}
+	}()
+
+	return func() {
+		err := s.srv.Close()
+		if err != nil {
+			ct.Fatalf(s.t, "pushgateway.Server.Listen: failed to shutdown server: %s", err)
+		}
+		wg.Wait()
+	}
+}
+
+// Pusher returns an HTTP pusher which sends notifications for `pushKey` to this push gateway, for use with
+// CSAPI.MustSetPusher. Must be called after Listen().
+func (s *Server) Pusher(pushKey string) client.Pusher {
+	if !s.listening {
+		ct.Fatalf(s.t, "pushgateway.Server.Pusher: must call Listen() first")
+	}
+	return client.Pusher{
+		Kind:              "http",
+		AppID:             AppID,
+		PushKey:           pushKey,
+		AppDisplayName:    "Complement",
+		DeviceDisplayName: "Complement push gateway",
+		Lang:              "en",
+		Data: map[string]interface{}{
+			"url": s.URL,
+		},
+	}
+}
+
+// RejectPushKeys makes the push gateway reject all future notifications to these pushkeys, which tells the
+// homeserver to remove the pushers.
+func (s *Server) RejectPushKeys(pushKeys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pushKey := range pushKeys {
+		s.rejectedPushKeys[pushKey] = true
+	}
+}
+
+// Notifications returns the notifications received so far, in the order they were received.
+func (s *Server) Notifications() []Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Notification(nil), s.notifications...)
+}
+
+// WaiterForNotification creates a Waiter which waits until a notification for which `check` returns true
+// has been received. Notifications received before calling this function are checked too. Note that calling
+// this function doesn't actually block. Call .Wait(time.Duration) on the waiter to block.
+func (s *Server) WaiterForNotification(check func(n Notification) bool) *helpers.Waiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := helpers.NewWaiter()
+	for _, n := range s.notifications {
+		if check(n) {
+			w.Finish()
+			return w
+		}
+	}
+	s.waiters = append(s.waiters, &notificationWaiter{check: check, waiter: w})
+	return w
+}
+
+// WaiterForEvent creates a Waiter which waits until a notification for the given event ID has been received.
+func (s *Server) WaiterForEvent(eventID string) *helpers.Waiter {
+	return s.WaiterForNotification(func(n Notification) bool {
+		return n.EventID == eventID
+	})
+}
+
+func (s *Server) handleNotify(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	if !gjson.ValidBytes(body) {
+		ct.Errorf(s.t, "push gateway received invalid JSON: %s", string(body))
+		w.WriteHeader(400)
+		return
+	}
+	n := parseNotification(gjson.GetBytes(body, "notification"))
+	s.t.Logf("push gateway received notification for event %s in room %s for %d devices", n.EventID, n.RoomID, len(n.Devices))
+
+	s.mu.Lock()
+	rejected := []string{}
+	for _, d := range n.Devices {
+		if s.rejectedPushKeys[d.PushKey] {
+			rejected = append(rejected, d.PushKey)
+		}
+	}
+	s.notifications = append(s.notifications, n)
+	waiters := s.waiters[:0]
+	for _, waiter := range s.waiters {
+		if waiter.check(n) {
+			waiter.waiter.Finish()
+		} else {
+			waiters = append(waiters, waiter)
+		}
+	}
+	s.waiters = waiters
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	res, _ := json.Marshal(map[string]interface{}{
+		"rejected": rejected,
+	})
+	w.Write(res)
+}
+
+func parseNotification(body gjson.Result) Notification {
+	n := Notification{
+		EventID:           body.Get("event_id").Str,
+		RoomID:            body.Get("room_id").Str,
+		Type:              body.Get("type").Str,
+		Sender:            body.Get("sender").Str,
+		SenderDisplayName: body.Get("sender_display_name").Str,
+		RoomName:          body.Get("room_name").Str,
+		RoomAlias:         body.Get("room_alias").Str,
+		UserIsTarget:      body.Get("user_is_target").Bool(),
+		Priority:          body.Get("prio").Str,
+		Content:           body.Get("content"),
+		Counts: Counts{
+			Unread:      body.Get("counts.unread").Int(),
+			MissedCalls: body.Get("counts.missed_calls").Int(),
+		},
+		Body: body,
+	}
+	if n.Priority == "" {
+		n.Priority = "high"
+	}
+	for _, d := range body.Get("devices").Array() {
+		n.Devices = append(n.Devices, Device{
+			AppID:     d.Get("app_id").Str,
+			PushKey:   d.Get("pushkey").Str,
+			PushKeyTS: d.Get("pushkey_ts").Int(),
+			Data:      d.Get("data"),
+			Tweaks:    d.Get("tweaks"),
+		})
+	}
+	return n
+}
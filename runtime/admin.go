@@ -0,0 +1,134 @@
+package runtime
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// AdminAPI performs admin operations on a homeserver. Admin APIs are not part of the spec, so each homeserver
+// implementation has its own adapter, chosen via the `*_blacklist` build tag in the same way as Homeserver.
+//
+// Every operation skips the test (via t.Skipf) if the homeserver does not support it, and fails the test if
+// the homeserver supports it but the operation fails.
+type AdminAPI interface {
+	// PurgeHistory deletes the events in the room which were sent before `ts`, including local events.
+	PurgeHistory(t ct.TestLike, roomID string, ts time.Time)
+	// ShutdownRoom makes all local users leave the room.
+	ShutdownRoom(t ct.TestLike, roomID string)
+	// DeactivateUser deactivates the local user.
+	DeactivateUser(t ct.TestLike, userID string)
+	// DeleteMedia deletes the media with the given `mxc://` URI.
+	DeleteMedia(t ct.TestLike, mxcURI string)
+	// SendServerNotice sends a server notice with the given content to the local user. Returns the event ID.
+	SendServerNotice(t ct.TestLike, userID string, content map[string]interface{}) (eventID string)
+}
+
+// newAdminAPI makes the AdminAPI for the homeserver being tested. It is overwritten by hs_$name.go. If Complement
+// is run without a `*_blacklist` tag, the Synapse admin API is assumed, as it is the most widely implemented.
+var newAdminAPI = func(admin *client.CSAPI) AdminAPI {
+	return &synapseAdminAPI{admin: admin}
+}
+
+// NewAdminAPI returns the AdminAPI for the homeserver being tested, which performs operations as `admin`. The
+// user must be a server admin e.g registered with helpers.RegistrationOpts{IsAdmin: true}:
+//
+//	admin := runtime.NewAdminAPI(deployment.Register(t, "hs1", helpers.RegistrationOpts{IsAdmin: true}))
+//	admin.PurgeHistory(t, roomID, time.Now())
+func NewAdminAPI(admin *client.CSAPI) AdminAPI {
+	return newAdminAPI(admin)
+}
+
+// unsupportedAdminAPI skips the test for every operation. Adapters embed it so operations they don't
+// implement are skipped.
+type unsupportedAdminAPI struct{}
+
+func (unsupportedAdminAPI) PurgeHistory(t ct.TestLike, roomID string, ts time.Time) {
+	t.Helper()
+	skipUnsupportedAdmin(t, "purging history")
+}
+
+func (unsupportedAdminAPI) ShutdownRoom(t ct.TestLike, roomID string) {
+	t.Helper()
+	skipUnsupportedAdmin(t, "shutting down rooms")
+}
+
+func (unsupportedAdminAPI) DeactivateUser(t ct.TestLike, userID string) {
+	t.Helper()
+	skipUnsupportedAdmin(t, "deactivating users")
+}
+
+func (unsupportedAdminAPI) DeleteMedia(t ct.TestLike, mxcURI string) {
+	t.Helper()
+	skipUnsupportedAdmin(t, "deleting media")
+}
+
+func (unsupportedAdminAPI) SendServerNotice(t ct.TestLike, userID string, content map[string]interface{}) string {
+	t.Helper()
+	skipUnsupportedAdmin(t, "sending server notices")
+	return ""
+}
+
+func skipUnsupportedAdmin(t ct.TestLike, operation string) {
+	t.Helper()
+	hs := Homeserver
+	if hs == "" {
+		hs = "this homeserver"
+	}
+	t.Skipf("skipped as the admin API for %s does not support %s", hs, operation)
+}
+
+// mustDoAdmin makes an admin request, skipping the test if the homeserver does not recognise the endpoint,
+// and failing it if the response is not 2xx. Returns the response body.
+func mustDoAdmin(t ct.TestLike, admin *client.CSAPI, operation, method string, paths []string, opts ...client.RequestOpt) gjson.Result {
+	t.Helper()
+	res := admin.Do(t, method, paths, opts...)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		ct.Fatalf(t, "AdminAPI: failed to read response to %s %s: %s", method, strings.Join(paths, "/"), err)
+	}
+	if isUnrecognisedEndpoint(res, body) {
+		skipUnsupportedAdmin(t, operation)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		ct.Fatalf(t, "AdminAPI: %s failed: %s %s returned HTTP %d: %s", operation, method, strings.Join(paths, "/"), res.StatusCode, string(body))
+	}
+	return gjson.ParseBytes(body)
+}
+
+// isUnrecognisedEndpoint returns true if the response means the endpoint does not exist, as opposed to e.g the
+// room or media in the request not existing.
+func isUnrecognisedEndpoint(res *http.Response, body []byte) bool {
+	if res.StatusCode != 404 && res.StatusCode != 405 {
+		return false
+	}
+	errcode := gjson.GetBytes(body, "errcode")
+	return !errcode.Exists() || errcode.Str == "M_UNRECOGNIZED"
+}
+
+// waitForAdminTask polls `paths` until `status` is "complete", for admin operations which happen in the background.
+// Fails the test if the status is "failed" or the task does not complete within 30s.
+func waitForAdminTask(t ct.TestLike, admin *client.CSAPI, operation string, paths []string) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		status := mustDoAdmin(t, admin, operation, "GET", paths).Get("status").Str
+		switch status {
+		case "complete":
+			return
+		case "failed":
+			ct.Fatalf(t, "AdminAPI: %s failed", operation)
+		}
+		if time.Now().After(deadline) {
+			ct.Fatalf(t, "AdminAPI: %s did not complete within 30s, status is %q", operation, status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,7 @@
+package runtime
+
+// conduitAdminAPI is used for Conduit and Conduwuit, which only offer admin commands sent as messages to the
+// admin room, so no operations are supported yet.
+type conduitAdminAPI struct {
+	unsupportedAdminAPI
+}
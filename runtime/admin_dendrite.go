@@ -0,0 +1,24 @@
+package runtime
+
+import (
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// dendriteAdminAPI uses Dendrite's admin endpoints: https://element-hq.github.io/dendrite/administration/adminapi
+// Dendrite can only purge whole rooms, and cannot deactivate users or delete media via its admin API.
+type dendriteAdminAPI struct {
+	unsupportedAdminAPI
+	admin *client.CSAPI
+}
+
+func (a *dendriteAdminAPI) ShutdownRoom(t ct.TestLike, roomID string) {
+	t.Helper()
+	mustDoAdmin(t, a.admin, "shutting down rooms", "POST", []string{"_dendrite", "admin", "evacuateRoom", roomID})
+}
+
+func (a *dendriteAdminAPI) SendServerNotice(t ct.TestLike, userID string, content map[string]interface{}) string {
+	t.Helper()
+	// Dendrite implements the Synapse endpoint for this
+	return (&synapseAdminAPI{admin: a.admin}).SendServerNotice(t, userID, content)
+}
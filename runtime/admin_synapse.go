@@ -0,0 +1,56 @@
+package runtime
+
+import (
+	"time"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// synapseAdminAPI uses the Synapse admin API: https://element-hq.github.io/synapse/latest/usage/administration/admin_api/
+// Other homeservers which implement parts of it can use this too, as endpoints which 404 skip the test.
+type synapseAdminAPI struct {
+	admin *client.CSAPI
+}
+
+func (a *synapseAdminAPI) PurgeHistory(t ct.TestLike, roomID string, ts time.Time) {
+	t.Helper()
+	const operation = "purging history"
+	res := mustDoAdmin(t, a.admin, operation, "POST", []string{"_synapse", "admin", "v1", "purge_history", roomID}, client.WithJSONBody(t, map[string]interface{}{
+		"purge_up_to_ts":      ts.UnixMilli(),
+		"delete_local_events": true,
+	}))
+	waitForAdminTask(t, a.admin, operation, []string{"_synapse", "admin", "v1", "purge_history_status", res.Get("purge_id").Str})
+}
+
+func (a *synapseAdminAPI) ShutdownRoom(t ct.TestLike, roomID string) {
+	t.Helper()
+	const operation = "shutting down rooms"
+	res := mustDoAdmin(t, a.admin, operation, "DELETE", []string{"_synapse", "admin", "v2", "rooms", roomID}, client.WithJSONBody(t, map[string]interface{}{
+		"block": true,
+		"purge": false,
+	}))
+	waitForAdminTask(t, a.admin, operation, []string{"_synapse", "admin", "v2", "rooms", "delete_status", res.Get("delete_id").Str})
+}
+
+func (a *synapseAdminAPI) DeactivateUser(t ct.TestLike, userID string) {
+	t.Helper()
+	mustDoAdmin(t, a.admin, "deactivating users", "POST", []string{"_synapse", "admin", "v1", "deactivate", userID}, client.WithJSONBody(t, map[string]interface{}{
+		"erase": false,
+	}))
+}
+
+func (a *synapseAdminAPI) DeleteMedia(t ct.TestLike, mxcURI string) {
+	t.Helper()
+	serverName, mediaID := client.SplitMxc(mxcURI)
+	mustDoAdmin(t, a.admin, "deleting media", "DELETE", []string{"_synapse", "admin", "v1", "media", serverName, mediaID})
+}
+
+func (a *synapseAdminAPI) SendServerNotice(t ct.TestLike, userID string, content map[string]interface{}) string {
+	t.Helper()
+	res := mustDoAdmin(t, a.admin, "sending server notices", "POST", []string{"_synapse", "admin", "v1", "send_server_notice"}, client.WithJSONBody(t, map[string]interface{}{
+		"user_id": userID,
+		"content": content,
+	}))
+	return res.Get("event_id").Str
+}
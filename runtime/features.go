@@ -0,0 +1,274 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// FeatureDeployment is the subset of complement.Deployment needed to detect which features a
+// homeserver supports.
+type FeatureDeployment interface {
+	GetFullyQualifiedHomeserverName(t ct.TestLike, hsName string) spec.ServerName
+	UnauthenticatedClient(t ct.TestLike, serverName string) *client.CSAPI
+	Register(t ct.TestLike, hsName string, opts helpers.RegistrationOpts) *client.CSAPI
+	RoundTripper() http.RoundTripper
+}
+
+// Feature is something a homeserver may or may not support, such as an unstable feature or a capability.
+// Use SkipUnlessFeature to skip tests for features the homeserver does not support.
+type Feature struct {
+	// a human readable description of the feature, used as the skip reason
+	name  string
+	check func(t ct.TestLike, s *serverFeatures) bool
+}
+
+func (f Feature) String() string {
+	return f.name
+}
+
+// UnstableFeature is supported if `/versions` lists it as true in `unstable_features` e.g "org.matrix.msc3391".
+func UnstableFeature(name string) Feature {
+	return Feature{
+		name: fmt.Sprintf("unstable feature %s", name),
+		check: func(t ct.TestLike, s *serverFeatures) bool {
+			return s.getVersions(t).Get("unstable_features." + client.GjsonEscape(name)).Bool()
+		},
+	}
+}
+
+// SpecVersion is supported if `/versions` lists it in `versions` e.g "v1.11".
+func SpecVersion(version string) Feature {
+	return Feature{
+		name: fmt.Sprintf("spec version %s", version),
+		check: func(t ct.TestLike, s *serverFeatures) bool {
+			for _, v := range s.getVersions(t).Get("versions").Array() {
+				if v.Str == version {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// Capability is supported if `/capabilities` returns it and it is not disabled via `enabled: false`
+// e.g "m.change_password". As /capabilities requires authentication, checking this registers a throwaway
+// user on the homeserver the first time.
+func Capability(name string) Feature {
+	return Feature{
+		name: fmt.Sprintf("capability %s", name),
+		check: func(t ct.TestLike, s *serverFeatures) bool {
+			capability := s.getCapabilities(t).Get("capabilities." + client.GjsonEscape(name))
+			if !capability.Exists() {
+				return false
+			}
+			enabled := capability.Get("enabled")
+			return !enabled.Exists() || enabled.Bool()
+		},
+	}
+}
+
+// ServerImplementation is supported if the federation `/version` endpoint returns this server name
+// e.g "Synapse". The comparison is case-insensitive.
+func ServerImplementation(name string) Feature {
+	return Feature{
+		name: fmt.Sprintf("server implementation %s", name),
+		check: func(t ct.TestLike, s *serverFeatures) bool {
+			return strings.EqualFold(s.getFederationVersion(t).Get("server.name").Str, name)
+		},
+	}
+}
+
+// AnyOf is supported if any of the given features are supported. This is useful for MSCs which have been
+// merged into a spec version but may still be advertised as an unstable feature.
+func AnyOf(features ...Feature) Feature {
+	names := make([]string, len(features))
+	for i := range features {
+		names[i] = features[i].name
+	}
+	return Feature{
+		name: "any of " + strings.Join(names, ", "),
+		check: func(t ct.TestLike, s *serverFeatures) bool {
+			for _, f := range features {
+				if f.check(t, s) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// HasFeature returns true if the homeserver `hsName` supports the feature. Responses from the homeserver
+// are cached for the lifetime of the deployment, so this is cheap to call repeatedly.
+func HasFeature(t ct.TestLike, deployment FeatureDeployment, hsName string, feature Feature) bool {
+	t.Helper()
+	return featuresFor(deployment, hsName).has(t, feature)
+}
+
+// SkipUnlessFeature skips the test (via t.Skipf) unless hs1 supports all of the given features:
+//
+//	runtime.SkipUnlessFeature(t, deployment, runtime.UnstableFeature("org.matrix.msc3391"))
+//
+// Unlike SkipIf, this works for any homeserver without needing a `*_blacklist` build tag.
+func SkipUnlessFeature(t ct.TestLike, deployment FeatureDeployment, features ...Feature) {
+	t.Helper()
+	SkipUnlessFeatureOn(t, deployment, "hs1", features...)
+}
+
+// SkipUnlessFeatureOn skips the test (via t.Skipf) unless the homeserver `hsName` supports all of the
+// given features.
+func SkipUnlessFeatureOn(t ct.TestLike, deployment FeatureDeployment, hsName string, features ...Feature) {
+	t.Helper()
+	s := featuresFor(deployment, hsName)
+	for _, f := range features {
+		if !s.has(t, f) {
+			t.Skipf("skipped as %s does not support %s", hsName, f)
+			return
+		}
+	}
+}
+
+// SkipIfFeature skips the test (via t.Skipf) if hs1 supports any of the given features e.g
+// runtime.ServerImplementation("Dendrite").
+func SkipIfFeature(t ct.TestLike, deployment FeatureDeployment, features ...Feature) {
+	t.Helper()
+	s := featuresFor(deployment, "hs1")
+	for _, f := range features {
+		if s.has(t, f) {
+			t.Skipf("skipped as hs1 supports %s", f)
+			return
+		}
+	}
+}
+
+var (
+	featuresMu    sync.Mutex
+	featuresCache = make(map[featuresKey]*serverFeatures)
+)
+
+type featuresKey struct {
+	deployment FeatureDeployment
+	hsName     string
+}
+
+// serverFeatures lazily fetches and caches the responses used to detect features on a single homeserver.
+type serverFeatures struct {
+	deployment FeatureDeployment
+	hsName     string
+
+	mu                sync.Mutex
+	versions          *gjson.Result
+	capabilities      *gjson.Result
+	federationVersion *gjson.Result
+}
+
+// featuresFor returns the cached features for this homeserver, creating them if needed. They are kept until
+// ForgetDeployment is called.
+func featuresFor(deployment FeatureDeployment, hsName string) *serverFeatures {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	key := featuresKey{deployment: deployment, hsName: hsName}
+	s, ok := featuresCache[key]
+	if !ok {
+		s = &serverFeatures{deployment: deployment, hsName: hsName}
+		featuresCache[key] = s
+	}
+	return s
+}
+
+// ForgetDeployment drops the features cached for every homeserver in the deployment. Deployers must call
+// this when the deployment is destroyed, so destroyed deployments are not kept alive for the rest of the run.
+func ForgetDeployment(deployment FeatureDeployment) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	for key := range featuresCache {
+		if key.deployment == deployment {
+			delete(featuresCache, key)
+		}
+	}
+}
+
+func (s *serverFeatures) has(t ct.TestLike, f Feature) bool {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return f.check(t, s)
+}
+
+func (s *serverFeatures) getVersions(t ct.TestLike) gjson.Result {
+	t.Helper()
+	if s.versions == nil {
+		cli := s.deployment.UnauthenticatedClient(t, s.hsName)
+		res := cli.MustDo(t, "GET", []string{"_matrix", "client", "versions"})
+		versions := gjson.ParseBytes(client.ParseJSON(t, res))
+		s.versions = &versions
+	}
+	return *s.versions
+}
+
+// getCapabilities fetches /capabilities once, registering a throwaway user to do so.
+func (s *serverFeatures) getCapabilities(t ct.TestLike) gjson.Result {
+	t.Helper()
+	if s.capabilities == nil {
+		// /capabilities requires authentication, so make a user just for this
+		cli := s.deployment.Register(t, s.hsName, helpers.RegistrationOpts{LocalpartSuffix: "features"})
+		res := cli.Do(t, "GET", []string{"_matrix", "client", "v3", "capabilities"})
+		var capabilities gjson.Result
+		if res.StatusCode == 200 {
+			capabilities = gjson.ParseBytes(client.ParseJSON(t, res))
+		} else {
+			t.Logf("runtime: %s returned HTTP %d for /capabilities, assuming no capabilities", s.hsName, res.StatusCode)
+			res.Body.Close()
+		}
+		s.capabilities = &capabilities
+	}
+	return *s.capabilities
+}
+
+func (s *serverFeatures) getFederationVersion(t ct.TestLike) gjson.Result {
+	t.Helper()
+	if s.federationVersion == nil {
+		var version gjson.Result
+		body, err := s.fetchFederationVersion(t)
+		if err != nil {
+			t.Logf("runtime: failed to fetch federation /version from %s, assuming an unknown server: %s", s.hsName, err)
+		} else {
+			version = gjson.ParseBytes(body)
+		}
+		s.federationVersion = &version
+	}
+	return *s.federationVersion
+}
+
+func (s *serverFeatures) fetchFederationVersion(t ct.TestLike) ([]byte, error) {
+	cli := &http.Client{
+		Transport: s.deployment.RoundTripper(),
+		Timeout:   10 * time.Second,
+	}
+	serverName := s.deployment.GetFullyQualifiedHomeserverName(t, s.hsName)
+	res, err := cli.Get("https://" + string(serverName) + "/_matrix/federation/v1/version")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP %d: %s", res.StatusCode, string(body))
+	}
+	return body, nil
+}
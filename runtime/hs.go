@@ -12,6 +12,7 @@ const (
 	Synapse   = "synapse"
 	Conduit   = "conduit"
 	Conduwuit = "conduwuit"
+	Palpo     = "palpo"
 )
 
 var Homeserver string
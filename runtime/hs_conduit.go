@@ -2,6 +2,11 @@
 
 package runtime
 
+import "github.com/matrix-org/complement/client"
+
 func init() {
 	Homeserver = Conduit
+	newAdminAPI = func(admin *client.CSAPI) AdminAPI {
+		return &conduitAdminAPI{}
+	}
 }
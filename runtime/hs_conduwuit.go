@@ -5,6 +5,11 @@
 
 package runtime
 
+import "github.com/matrix-org/complement/client"
+
 func init() {
 	Homeserver = Conduwuit
+	newAdminAPI = func(admin *client.CSAPI) AdminAPI {
+		return &conduitAdminAPI{}
+	}
 }
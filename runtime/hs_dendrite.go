@@ -8,10 +8,15 @@ import (
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+
+	complementclient "github.com/matrix-org/complement/client"
 )
 
 func init() {
 	Homeserver = Dendrite
+	newAdminAPI = func(admin *complementclient.CSAPI) AdminAPI {
+		return &dendriteAdminAPI{admin: admin}
+	}
 	// For Dendrite, we want to always stop the container gracefully, as this is needed to
 	// extract e.g. coverage reports.
 	ContainerKillFunc = func(client *client.Client, containerID string) error {
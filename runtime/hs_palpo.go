@@ -0,0 +1,31 @@
+//go:build palpo_blacklist
+// +build palpo_blacklist
+
+package runtime
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	complementclient "github.com/matrix-org/complement/client"
+)
+
+func init() {
+	Homeserver = Palpo
+	// Palpo implements parts of the Synapse admin API, and the rest are skipped as they 404
+	newAdminAPI = func(admin *complementclient.CSAPI) AdminAPI {
+		return &synapseAdminAPI{admin: admin}
+	}
+	// Palpo runs PostgreSQL in the same container, so stop it gracefully: SIGTERM lets Palpo finish
+	// in-flight requests and lets PostgreSQL shut down cleanly, which keeps the data directory usable
+	// if the container is started again e.g via Deployment.StartServer.
+	ContainerKillFunc = func(client *client.Client, containerID string) error {
+		timeoutSecs := 5
+		return client.ContainerStop(context.Background(), containerID, container.StopOptions{
+			Signal:  "SIGTERM",
+			Timeout: &timeoutSecs,
+		})
+	}
+}
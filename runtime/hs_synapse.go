@@ -2,6 +2,11 @@
 
 package runtime
 
+import "github.com/matrix-org/complement/client"
+
 func init() {
 	Homeserver = Synapse
+	newAdminAPI = func(admin *client.CSAPI) AdminAPI {
+		return &synapseAdminAPI{admin: admin}
+	}
 }
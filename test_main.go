@@ -8,6 +8,7 @@ import (
 	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/expectations"
 )
 
 var (
@@ -93,6 +94,7 @@ func OldDeploy(t ct.TestLike, blueprint b.Blueprint) Deployment {
 	if testPackage == nil {
 		ct.Fatalf(t, "Deploy: testPackage not set, did you forget to call complement.TestMain?")
 	}
+	expectations.Begin(t)
 	return testPackage.OldDeploy(t, blueprint)
 }
 
@@ -107,6 +109,7 @@ func Deploy(t ct.TestLike, numServers int) Deployment {
 	if testPackage == nil {
 		ct.Fatalf(t, "Deploy: testPackage not set, did you forget to call complement.TestMain?")
 	}
+	expectations.Begin(t)
 	if customDeployer != nil {
 		return customDeployer(t, numServers, testPackage.Config)
 	}
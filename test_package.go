@@ -14,7 +14,10 @@ import (
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/internal/coverage"
 	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/expectations"
+	"github.com/matrix-org/complement/runtime"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/sirupsen/logrus"
 )
@@ -99,6 +102,9 @@ type TestPackage struct {
 func NewTestPackage(pkgNamespace string) (*TestPackage, error) {
 	cfg := config.NewConfigFromEnvVars(pkgNamespace, "")
 	log.Printf("config: %+v", cfg)
+	if err := expectations.Load(cfg.ExpectationsFile, runtime.Homeserver); err != nil {
+		return nil, fmt.Errorf("failed to load COMPLEMENT_EXPECTATIONS_FILE: %w", err)
+	}
 	builder, err := docker.NewBuilder(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make docker builder: %w", err)
@@ -125,6 +131,9 @@ func (tp *TestPackage) Cleanup() {
 	}
 	tp.existingDeploymentMu.Unlock()
 	tp.complementBuilder.Cleanup()
+	if err := coverage.WriteFile(tp.Config); err != nil {
+		log.Printf("failed to write endpoint coverage: %s", err)
+	}
 }
 
 // Deploy will deploy the given blueprint or terminate the test.
@@ -3,15 +3,19 @@ package csapi_tests
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/match"
 	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/runtime"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
@@ -123,3 +127,80 @@ func syncUntilInvite(t *testing.T, alice *client.CSAPI) string {
 	})
 	return roomID
 }
+
+// Test the admin operations in runtime.AdminAPI. Operations the homeserver does not support are skipped.
+func TestAdminAPI(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	admin := runtime.NewAdminAPI(deployment.Register(t, "hs1", helpers.RegistrationOpts{
+		IsAdmin: true,
+	}))
+
+	t.Run("Deactivated users cannot use their access token", func(t *testing.T) {
+		bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		admin.DeactivateUser(t, bob.UserID)
+		res := bob.Do(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: http.StatusUnauthorized,
+		})
+	})
+
+	t.Run("Local users leave rooms which are shut down", func(t *testing.T) {
+		alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		admin.ShutdownRoom(t, roomID)
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncLeftFrom(alice.UserID, roomID))
+	})
+
+	t.Run("Purged events are not returned by /messages", func(t *testing.T) {
+		alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		purgedEventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type:    "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "purge me"},
+		})
+		time.Sleep(10 * time.Millisecond) // ensure the events have different timestamps
+		keptEventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type:    "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "keep me"},
+		})
+		// use the server's timestamps rather than our clock, so the purge is just before the kept event
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", keptEventID})
+		keptTS := must.ParseJSON(t, res.Body).Get("origin_server_ts").Int()
+		admin.PurgeHistory(t, roomID, time.UnixMilli(keptTS-1))
+
+		res = alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "messages"}, client.WithQueries(url.Values{
+			"dir":   []string{"b"},
+			"limit": []string{"100"},
+		}))
+		body := must.ParseJSON(t, res.Body)
+		var eventIDs []string
+		for _, ev := range body.Get("chunk").Array() {
+			eventIDs = append(eventIDs, ev.Get("event_id").Str)
+		}
+		must.ContainSubset(t, eventIDs, []string{keptEventID})
+		must.NotContainSubset(t, eventIDs, []string{purgedEventID})
+	})
+
+	t.Run("Deleted media cannot be downloaded", func(t *testing.T) {
+		alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		mxcURI := alice.UploadContent(t, []byte("delete me"), "delete_me.txt", "text/plain")
+		admin.DeleteMedia(t, mxcURI)
+		origin, mediaID := client.SplitMxc(mxcURI)
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v1", "media", "download", origin, mediaID})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: http.StatusNotFound,
+		})
+	})
+
+	t.Run("Users receive server notices", func(t *testing.T) {
+		alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		eventID := admin.SendServerNotice(t, alice.UserID, map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "hello from server notices!",
+		})
+		roomID := syncUntilInvite(t, alice)
+		alice.MustJoinRoom(t, roomID, []spec.ServerName{})
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+	})
+}
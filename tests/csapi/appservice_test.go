@@ -0,0 +1,253 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/appservice"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestAppServiceTransactions(t *testing.T) {
+	deployment := complement.OldDeploy(t, b.BlueprintHSWithApplicationService)
+	defer deployment.Destroy(t)
+
+	// reject the first attempt of any transaction with this message, to check the homeserver retries it
+	const retryBody = "please retry"
+	as := appservice.NewServer(t, deployment, "hs1", "my_as_id", appservice.HandleTransactions(
+		func(txn appservice.Transaction) util.JSONResponse {
+			for _, ev := range txn.Events {
+				if txn.Attempt == 1 && ev.Get("content.body").Str == retryBody {
+					return util.JSONResponse{
+						Code: 503,
+						JSON: map[string]string{"errcode": "M_UNKNOWN", "error": "try again later"},
+					}
+				}
+			}
+			return util.JSONResponse{Code: 200, JSON: struct{}{}}
+		},
+	))
+	cancel := as.Listen()
+	defer cancel()
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+
+	t.Run("Application service receives events in its namespace", func(t *testing.T) {
+		eventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "hello application service",
+			},
+		})
+		as.WaiterForEvent(eventID).Waitf(t, 10*time.Second, "application service did not receive event %s", eventID)
+		for _, txn := range as.Transactions() {
+			for _, ev := range txn.Events {
+				if ev.Get("event_id").Str != eventID {
+					continue
+				}
+				must.Equal(t, ev.Get("sender").Str, alice.UserID, "sender")
+				must.Equal(t, ev.Get("room_id").Str, roomID, "room_id")
+				must.Equal(t, ev.Get("content.body").Str, "hello application service", "content.body")
+			}
+		}
+	})
+
+	t.Run("Application service transactions are retried", func(t *testing.T) {
+		eventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    retryBody,
+			},
+		})
+		as.WaiterForEvent(eventID).Waitf(t, 30*time.Second, "application service did not receive retried event %s", eventID)
+		for _, txn := range as.Transactions() {
+			for _, ev := range txn.Events {
+				if ev.Get("event_id").Str == eventID && txn.Attempt < 2 {
+					ct.Errorf(t, "transaction %s was accepted on attempt %d, want a retry", txn.ID, txn.Attempt)
+				}
+			}
+		}
+	})
+}
+
+func TestAppServiceNamespaces(t *testing.T) {
+	deployment := complement.OldDeploy(t, b.BlueprintHSWithExclusiveApplicationService)
+	defer deployment.Destroy(t)
+
+	bot := deployment.AppServiceUser(t, "hs1", "@bridge-bot:hs1")
+	var mu sync.Mutex
+	bridgedUsers := make(map[string]*client.CSAPI)
+	bridgedRooms := make(map[string]string) // alias -> room ID
+	// the handlers run on the application service's goroutine, which must not fail the test, so failures
+	// are recorded for the test to check
+	var handlerErrs []string
+	handlerFailed := func(format string, args ...interface{}) util.JSONResponse {
+		msg := fmt.Sprintf(format, args...)
+		mu.Lock()
+		handlerErrs = append(handlerErrs, msg)
+		mu.Unlock()
+		return util.JSONResponse{
+			Code: 500,
+			JSON: map[string]string{"errcode": "M_UNKNOWN", "error": msg},
+		}
+	}
+	mustNotHaveHandlerErrors := func(t *testing.T) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if len(handlerErrs) > 0 {
+			ct.Fatalf(t, "application service query handlers failed: %v", handlerErrs)
+		}
+	}
+
+	as := appservice.NewServer(t, deployment, "hs1", "bridge",
+		// create users and rooms on demand, as bridges do
+		appservice.HandleUserQueries(func(userID string) util.JSONResponse {
+			localpart := strings.TrimSuffix(strings.TrimPrefix(userID, "@"), ":hs1")
+			res := bot.Do(t, "POST", []string{"_matrix", "client", "v3", "register"}, client.WithJSONBody(t, map[string]interface{}{
+				"type":     "m.login.application_service",
+				"username": localpart,
+			}))
+			defer res.Body.Close()
+			resBody, err := io.ReadAll(res.Body)
+			if err != nil || res.StatusCode != 200 {
+				return handlerFailed("failed to register %s: HTTP %d %s %v", userID, res.StatusCode, string(resBody), err)
+			}
+			body := gjson.ParseBytes(resBody)
+			mu.Lock()
+			bridgedUsers[userID] = &client.CSAPI{
+				UserID:      body.Get("user_id").Str,
+				AccessToken: body.Get("access_token").Str,
+				BaseURL:     bot.BaseURL,
+				Client:      bot.Client,
+			}
+			mu.Unlock()
+			return util.JSONResponse{Code: 200, JSON: struct{}{}}
+		}),
+		appservice.HandleRoomAliasQueries(func(alias string) util.JSONResponse {
+			localpart := strings.TrimSuffix(strings.TrimPrefix(alias, "#"), ":hs1")
+			res := bot.CreateRoom(t, map[string]interface{}{
+				"preset":          "public_chat",
+				"room_alias_name": localpart,
+			})
+			defer res.Body.Close()
+			resBody, err := io.ReadAll(res.Body)
+			if err != nil || res.StatusCode != 200 {
+				return handlerFailed("failed to create a room for %s: HTTP %d %s %v", alias, res.StatusCode, string(resBody), err)
+			}
+			mu.Lock()
+			bridgedRooms[alias] = gjson.GetBytes(resBody, "room_id").Str
+			mu.Unlock()
+			return util.JSONResponse{Code: 200, JSON: struct{}{}}
+		}),
+	)
+	cancel := as.Listen()
+	defer cancel()
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	t.Run("Homeserver queries the application service for unknown users in its namespace", func(t *testing.T) {
+		const userID = "@bridged_user_query:hs1"
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+		alice.MustInviteRoom(t, roomID, userID)
+		must.ContainSubset(t, as.UserQueries(), []string{userID})
+		mustNotHaveHandlerErrors(t)
+		mu.Lock()
+		bridged := bridgedUsers[userID]
+		mu.Unlock()
+		if bridged == nil {
+			ct.Fatalf(t, "application service did not create %s", userID)
+		}
+		bridged.MustJoinRoom(t, roomID, nil)
+	})
+
+	t.Run("Homeserver queries the application service for unknown room aliases in its namespace", func(t *testing.T) {
+		const alias = "#bridged_alias_query:hs1"
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "directory", "room", alias})
+		mustNotHaveHandlerErrors(t)
+		must.MatchResponse(t, res, match.HTTPResponse{StatusCode: 200})
+		roomID := gjson.GetBytes(client.ParseJSON(t, res), "room_id").Str
+		must.ContainSubset(t, as.RoomAliasQueries(), []string{alias})
+		mu.Lock()
+		wantRoomID := bridgedRooms[alias]
+		mu.Unlock()
+		must.Equal(t, roomID, wantRoomID, "room ID for the alias created by the application service")
+	})
+
+	t.Run("Application service only receives events involving its namespace", func(t *testing.T) {
+		unbridgedRoomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		unbridgedEventID := alice.SendEventSynced(t, unbridgedRoomID, b.Event{
+			Type:    "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "not for the bridge"},
+		})
+
+		const userID = "@bridged_namespace:hs1"
+		bridgedRoomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		alice.MustInviteRoom(t, bridgedRoomID, userID)
+		mustNotHaveHandlerErrors(t)
+		mu.Lock()
+		bridged := bridgedUsers[userID]
+		mu.Unlock()
+		if bridged == nil {
+			ct.Fatalf(t, "application service did not create %s", userID)
+		}
+		bridged.MustJoinRoom(t, bridgedRoomID, nil)
+		bridgedEventID := alice.SendEventSynced(t, bridgedRoomID, b.Event{
+			Type:    "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "for the bridge"},
+		})
+		// events are sent to the application service in order, so the first event has been dropped by now
+		as.WaiterForEvent(bridgedEventID).Waitf(t, 10*time.Second, "application service did not receive event %s", bridgedEventID)
+		for _, txn := range as.Transactions() {
+			for _, ev := range txn.Events {
+				if ev.Get("event_id").Str == unbridgedEventID {
+					ct.Errorf(t, "application service received event %s in a room without users in its namespace", unbridgedEventID)
+				}
+			}
+		}
+	})
+
+	t.Run("Exclusive namespaces cannot be used by other users", func(t *testing.T) {
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		res := unauthed.Do(t, "POST", []string{"_matrix", "client", "v3", "register"}, client.WithJSONBody(t, map[string]interface{}{
+			"username": "bridged_squatter",
+			"password": "complement_password",
+			"auth": map[string]interface{}{
+				"type": "m.login.dummy",
+			},
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 400,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_EXCLUSIVE"),
+			},
+		})
+
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		res = alice.Do(t, "PUT", []string{"_matrix", "client", "v3", "directory", "room", "#bridged_squatter:hs1"}, client.WithJSONBody(t, map[string]interface{}{
+			"room_id": roomID,
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 400,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_EXCLUSIVE"),
+			},
+		})
+	})
+}
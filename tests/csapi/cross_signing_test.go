@@ -0,0 +1,80 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestCrossSigning(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	aliceKeys := alice.MustBootstrapCrossSigning(t)
+	bobKeys := bob.MustBootstrapCrossSigning(t)
+
+	t.Run("Uploaded cross-signing keys are returned by /keys/query", func(t *testing.T) {
+		res := alice.MustQueryKeys(t, map[string][]string{alice.UserID: {}})
+		userID := client.GjsonEscape(alice.UserID)
+		must.Equal(t, res.Get("master_keys."+userID+".keys."+client.GjsonEscape(aliceKeys.Master.KeyID())).Str, aliceKeys.Master.PublicKeyBase64(), "master key")
+		must.Equal(t, res.Get("self_signing_keys."+userID+".keys."+client.GjsonEscape(aliceKeys.SelfSigning.KeyID())).Str, aliceKeys.SelfSigning.PublicKeyBase64(), "self-signing key")
+		must.Equal(t, res.Get("user_signing_keys."+userID+".keys."+client.GjsonEscape(aliceKeys.UserSigning.KeyID())).Str, aliceKeys.UserSigning.PublicKeyBase64(), "user-signing key")
+		// the self-signing key must be signed by the master key
+		must.Equal(t, res.Get("self_signing_keys."+userID+".signatures."+userID+"."+client.GjsonEscape(aliceKeys.Master.KeyID())).Exists(), true, "self-signing key signed by master key")
+	})
+
+	t.Run("Own device is signed by the self-signing key", func(t *testing.T) {
+		res := alice.MustQueryKeys(t, map[string][]string{alice.UserID: {alice.DeviceID}})
+		sig := res.Get("device_keys." + client.GjsonEscape(alice.UserID) + "." + client.GjsonEscape(alice.DeviceID) +
+			".signatures." + client.GjsonEscape(alice.UserID) + "." + client.GjsonEscape(aliceKeys.SelfSigning.KeyID()))
+		must.Equal(t, sig.Exists(), true, "device signed by self-signing key")
+	})
+
+	t.Run("User-signing key is only visible to its owner", func(t *testing.T) {
+		res := bob.MustQueryKeys(t, map[string][]string{alice.UserID: {}})
+		must.Equal(t, res.Get("master_keys."+client.GjsonEscape(alice.UserID)).Exists(), true, "master key visible")
+		must.Equal(t, res.Get("user_signing_keys."+client.GjsonEscape(alice.UserID)).Exists(), false, "user-signing key visible to another user")
+	})
+
+	t.Run("Signing another user's master key is only visible to the signer", func(t *testing.T) {
+		bobMasterKey := alice.MustGetMasterKey(t, bob.UserID)
+		alice.MustUploadSignatures(t, map[string]map[string]interface{}{
+			bob.UserID: {
+				bobKeys.Master.PublicKeyBase64(): aliceKeys.SignUser(t, bobMasterKey),
+			},
+		})
+		sigPath := "signatures." + client.GjsonEscape(alice.UserID) + "." + client.GjsonEscape(aliceKeys.UserSigning.KeyID())
+		aliceView := alice.MustQueryKeys(t, map[string][]string{bob.UserID: {}})
+		must.Equal(t, aliceView.Get("master_keys."+client.GjsonEscape(bob.UserID)+"."+sigPath).Exists(), true, "signature visible to alice")
+
+		charlie := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		charlieView := charlie.MustQueryKeys(t, map[string][]string{bob.UserID: {}})
+		must.Equal(t, charlieView.Get("master_keys."+client.GjsonEscape(bob.UserID)+"."+sigPath).Exists(), false, "signature visible to charlie")
+	})
+
+	t.Run("Invalid signatures are rejected by /keys/signatures/upload", func(t *testing.T) {
+		bobMasterKey := alice.MustGetMasterKey(t, bob.UserID)
+		// sign with a key which isn't alice's user-signing key
+		wrongKey := client.NewCrossSigningKey(t, "user_signing")
+		signed := wrongKey.Sign(t, alice.UserID, bobMasterKey)
+		// but claim it was signed by the user-signing key
+		signatures := signed["signatures"].(map[string]map[string]interface{})
+		signatures[alice.UserID][aliceKeys.UserSigning.KeyID()] = signatures[alice.UserID][wrongKey.KeyID()]
+		delete(signatures[alice.UserID], wrongKey.KeyID())
+
+		res := alice.UploadSignatures(t, map[string]map[string]interface{}{
+			bob.UserID: {
+				bobKeys.Master.PublicKeyBase64(): signed,
+			},
+		})
+		body := gjson.ParseBytes(client.ParseJSON(t, res))
+		must.Equal(t, body.Get("failures."+client.GjsonEscape(bob.UserID)+"."+client.GjsonEscape(bobKeys.Master.PublicKeyBase64())).Exists(), true, "expected a failure for the invalid signature")
+	})
+}
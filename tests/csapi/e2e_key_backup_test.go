@@ -1,9 +1,14 @@
 package csapi_tests
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"testing"
 
+	"github.com/tidwall/gjson"
+
 	"github.com/matrix-org/complement"
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/helpers"
@@ -155,3 +160,109 @@ func TestE2EKeyBackupReplaceRoomKeyRules(t *testing.T) {
 		}
 	})
 }
+
+// This test checks that a key backup with real curve25519 auth data signed by a device round-trips
+// through the server, and that the server only accepts sessions for the current backup version.
+func TestE2EKeyBackupAuthData(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	deviceKeys, deviceSigningKey := alice.MustGenerateDeviceKeys(t)
+	alice.MustUploadKeys(t, deviceKeys, nil)
+
+	backup := client.NewKeyBackup(t)
+	backup.AuthData = deviceSigningKey.Sign(t, backup.AuthData)
+	alice.MustCreateKeyBackup(t, backup)
+
+	t.Run("auth_data signatures are returned unmodified", func(t *testing.T) {
+		version := alice.MustGetKeyBackupVersion(t, backup.Version)
+		must.Equal(t, version.Get("algorithm").Str, client.KeyBackupAlgorithm, "algorithm")
+		must.Equal(t, version.Get("auth_data.public_key").Str, base64.RawStdEncoding.EncodeToString(backup.PublicKey), "public key")
+		// the signature must verify against the device key the server returns
+		queryRes := alice.MustQueryKeys(t, map[string][]string{alice.UserID: {alice.DeviceID}})
+		devicePubKey := queryRes.Get("device_keys." + client.GjsonEscape(alice.UserID) + "." + client.GjsonEscape(alice.DeviceID) +
+			".keys." + client.GjsonEscape(deviceSigningKey.KeyID())).Str
+		pubKey, err := base64.RawStdEncoding.DecodeString(devicePubKey)
+		must.NotError(t, "failed to decode device key", err)
+		err = client.VerifySignature(version.Get("auth_data"), alice.UserID, deviceSigningKey.KeyID(), ed25519.PublicKey(pubKey))
+		must.NotError(t, "auth_data signature does not verify", err)
+	})
+
+	t.Run("Changing the algorithm of a backup version is rejected", func(t *testing.T) {
+		res := alice.Do(t, "PUT", []string{"_matrix", "client", "v3", "room_keys", "version", backup.Version}, client.WithJSONBody(t, map[string]interface{}{
+			"algorithm": "m.megolm_backup.v1",
+			"auth_data": backup.AuthData,
+			"version":   backup.Version,
+		}))
+		must.MatchFailure(t, res)
+	})
+
+	t.Run("Sessions for an old backup version are rejected", func(t *testing.T) {
+		oldBackup := backup
+		newBackup := client.NewKeyBackup(t)
+		newBackup.AuthData = deviceSigningKey.Sign(t, newBackup.AuthData)
+		alice.MustCreateKeyBackup(t, newBackup)
+
+		res := alice.UploadBackupSession(t, oldBackup.Version, "!foo:hs1", "old_version_session", client.KeyBackupSession{
+			SessionData: oldBackup.EncryptSession(t, map[string]interface{}{"session_key": "old"}),
+		})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_WRONG_ROOM_KEYS_VERSION"),
+				match.JSONKeyEqual("current_version", newBackup.Version),
+			},
+		})
+	})
+}
+
+// This test uploads a sequence of real encrypted sessions for the same session ID and checks that the
+// server keeps the session chosen by the "better session wins" rules after every upload.
+func TestE2EKeyBackupBetterSessionWins(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	roomID := "!foo:hs1"
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	backup := client.NewKeyBackup(t)
+	alice.MustCreateKeyBackup(t, backup)
+
+	uploads := []client.KeyBackupSession{
+		{FirstMessageIndex: 10, ForwardedCount: 5, IsVerified: false},
+		{FirstMessageIndex: 11, ForwardedCount: 0, IsVerified: false}, // worse index
+		{FirstMessageIndex: 10, ForwardedCount: 4, IsVerified: false}, // better forwarded count
+		{FirstMessageIndex: 20, ForwardedCount: 9, IsVerified: true},  // verified beats everything
+		{FirstMessageIndex: 0, ForwardedCount: 0, IsVerified: false},  // unverified never beats verified
+		{FirstMessageIndex: 15, ForwardedCount: 9, IsVerified: true},  // better index
+		{FirstMessageIndex: 15, ForwardedCount: 9, IsVerified: true},  // identical is not better
+	}
+	var best *client.KeyBackupSession
+	for i := range uploads {
+		upload := uploads[i]
+		upload.SessionData = backup.EncryptSession(t, map[string]interface{}{
+			"algorithm":   "m.megolm.v1.aes-sha2",
+			"session_key": fmt.Sprintf("session key %d", i),
+		})
+		if best == nil || client.KeyBackupSessionIsBetter(upload, *best) {
+			best = &upload
+		}
+		alice.MustUploadBackupSession(t, backup.Version, roomID, "session", upload)
+
+		got := alice.MustGetBackupSession(t, backup.Version, roomID, "session")
+		must.Equal(t, got.IsVerified, best.IsVerified, fmt.Sprintf("upload %d: is_verified", i))
+		must.Equal(t, got.FirstMessageIndex, best.FirstMessageIndex, fmt.Sprintf("upload %d: first_message_index", i))
+		must.Equal(t, got.ForwardedCount, best.ForwardedCount, fmt.Sprintf("upload %d: forwarded_count", i))
+		gotSession, err := backup.DecryptSession(gjson.Parse(mustMarshal(t, got.SessionData)))
+		must.NotError(t, fmt.Sprintf("upload %d: failed to decrypt session_data", i), err)
+		wantSession, err := backup.DecryptSession(gjson.Parse(mustMarshal(t, best.SessionData)))
+		must.NotError(t, "failed to decrypt expected session_data", err)
+		must.Equal(t, gotSession.Get("session_key").Str, wantSession.Get("session_key").Str, fmt.Sprintf("upload %d: kept session", i))
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	must.NotError(t, "failed to marshal JSON", err)
+	return string(b)
+}
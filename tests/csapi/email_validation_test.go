@@ -0,0 +1,68 @@
+package csapi_tests
+
+import (
+	"os"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/email"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test flows where the homeserver validates an email address by sending a link to it:
+// https://spec.matrix.org/v1.11/client-server-api/#adding-account-administrative-contact-information
+func TestEmailValidation(t *testing.T) {
+	// check before deploying, as the homeserver is only configured to send email when this is set
+	if os.Getenv("COMPLEMENT_SMTP_SINK_PORT") == "" {
+		t.Skipf("COMPLEMENT_SMTP_SINK_PORT is not set")
+	}
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	sink := email.NewServer(t, deployment)
+
+	t.Run("Can add a validated email address to an account", func(t *testing.T) {
+		alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		const address = "alice@example.com"
+		v := alice.MustValidateEmail(t, []string{"_matrix", "client", "v3", "account", "3pid", "email", "requestToken"}, address, sink.MustGetValidationLink)
+		alice.MustAddThreePID(t, v)
+
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "3pid"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONCheckOff("threepids", []interface{}{"email/" + address}, match.CheckOffMapper(func(r gjson.Result) interface{} {
+					return r.Get("medium").Str + "/" + r.Get("address").Str
+				})),
+			},
+		})
+	})
+
+	t.Run("Can reset a password via email", func(t *testing.T) {
+		bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		const address = "bob@example.com"
+		bob.MustAddThreePID(t, bob.MustValidateEmail(t, []string{"_matrix", "client", "v3", "account", "3pid", "email", "requestToken"}, address, sink.MustGetValidationLink))
+
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		v := unauthed.MustValidateEmail(t, []string{"_matrix", "client", "v3", "account", "password", "email", "requestToken"}, address, sink.MustGetValidationLink)
+		unauthed.MustDoWithUIA(t, "POST", []string{"_matrix", "client", "v3", "account", "password"}, []client.RequestOpt{
+			client.WithJSONBody(t, map[string]interface{}{
+				"new_password":   "new_complement_password",
+				"logout_devices": false,
+			}),
+		}, v.UIAStage())
+
+		res := unauthed.Do(t, "POST", []string{"_matrix", "client", "v3", "login"}, client.WithJSONBody(t, map[string]interface{}{
+			"type": "m.login.password",
+			"identifier": map[string]interface{}{
+				"type": "m.id.user",
+				"user": bob.UserID,
+			},
+			"password": "new_complement_password",
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{StatusCode: 200})
+	})
+}
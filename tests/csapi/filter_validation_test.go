@@ -0,0 +1,178 @@
+package csapi_tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Tests that servers reject invalid filters, and return valid filters unchanged.
+// See https://spec.matrix.org/v1.10/client-server-api/#filtering
+func TestFilterValidation(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	t.Run("Filters round-trip", func(t *testing.T) {
+		filter := client.NewFilter().
+			WithEventFields("type", "content.body").
+			WithEventFormat("client").
+			WithPresence(client.NewEventFilter().WithLimit(5).WithNotSenders(bob.UserID)).
+			WithAccountData(client.NewEventFilter().WithTypes("m.push_rules")).
+			WithNotRooms("!notthisone:hs1").
+			WithIncludeLeave(true).
+			WithTimeline(client.NewRoomEventFilter().
+				WithLimit(10).
+				WithTypes("m.room.*").
+				WithNotTypes("m.room.redaction").
+				WithSenders(alice.UserID).
+				WithContainsURL(false).
+				WithUnreadThreadNotifications(true),
+			).
+			WithState(client.NewRoomEventFilter().
+				WithLazyLoadMembers(true).
+				WithIncludeRedundantMembers(true),
+			).
+			WithEphemeral(client.NewRoomEventFilter().WithNotTypes("m.typing")).
+			WithRoomAccountData(client.NewRoomEventFilter().WithLimit(0))
+		filterID := alice.MustCreateFilter(t, filter)
+		got := alice.MustGetFilter(t, filterID)
+		must.Equal(t, got.JSON(t), filter.JSON(t), "downloaded filter")
+	})
+
+	t.Run("Empty filters round-trip", func(t *testing.T) {
+		filterID := alice.MustCreateFilter(t, client.NewFilter())
+		must.Equal(t, alice.MustGetFilter(t, filterID).JSON(t), "{}", "downloaded filter")
+	})
+
+	t.Run("Filters with the wrong types are rejected with M_BAD_JSON", func(t *testing.T) {
+		testCases := map[string]map[string]interface{}{
+			"limit is a string": {
+				"room": map[string]interface{}{
+					"timeline": map[string]interface{}{"limit": "ten"},
+				},
+			},
+			"room is a string": {
+				"room": "all of them",
+			},
+			"types is not an array": {
+				"presence": map[string]interface{}{"types": "m.presence"},
+			},
+			"event_format is unknown": {
+				"event_format": "xml",
+			},
+			"lazy_load_members is not a boolean": {
+				"room": map[string]interface{}{
+					"state": map[string]interface{}{"lazy_load_members": "yes"},
+				},
+			},
+		}
+		for name, filter := range testCases {
+			t.Run(name, func(t *testing.T) {
+				res := alice.CreateFilter(t, filter)
+				must.MatchResponse(t, res, match.HTTPResponse{
+					StatusCode: 400,
+					JSON: []match.JSON{
+						match.JSONKeyEqual("errcode", "M_BAD_JSON"),
+					},
+				})
+			})
+		}
+	})
+
+	t.Run("Filters for other users are rejected", func(t *testing.T) {
+		res := alice.Do(t, "POST", []string{"_matrix", "client", "v3", "user", bob.UserID, "filter"}, client.WithJSONBody(t, client.NewFilter()))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+		})
+	})
+
+	t.Run("Unknown filters return M_NOT_FOUND", func(t *testing.T) {
+		res := alice.GetFilter(t, "12345678")
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 404,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_NOT_FOUND"),
+			},
+		})
+	})
+
+	t.Run("/sync rejects invalid inline filters with M_BAD_JSON", func(t *testing.T) {
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "sync"}, client.WithQueries(url.Values{
+			"timeout": []string{"0"},
+			"filter":  []string{`{"room":{"timeline":{"limit":"ten"}}}`},
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 400,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_BAD_JSON"),
+			},
+		})
+	})
+
+	t.Run("/sync rejects unknown filter IDs with M_INVALID_PARAM", func(t *testing.T) {
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "sync"}, client.WithQueries(url.Values{
+			"timeout": []string{"0"},
+			"filter":  []string{"12345678"},
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 400,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_INVALID_PARAM"),
+			},
+		})
+	})
+
+	t.Run("Uploaded filters are applied to /sync", func(t *testing.T) {
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		bob.MustJoinRoom(t, roomID, nil)
+		bobEventID := bob.SendEventSynced(t, roomID, b.Event{
+			Type:    "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "from bob"},
+		})
+		aliceEventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type:    "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "from alice"},
+		})
+		filterID := alice.MustCreateFilter(t, client.NewFilter().WithTimeline(
+			client.NewRoomEventFilter().WithNotSenders(bob.UserID),
+		))
+		res := alice.MustSyncTyped(t, client.SyncReq{Filter: filterID})
+		var eventIDs []string
+		for _, ev := range res.Rooms.Join[roomID].Timeline.Events {
+			must.NotEqual(t, ev.Sender, bob.UserID, "event from excluded sender")
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+		must.ContainSubset(t, eventIDs, []string{aliceEventID})
+		must.NotContainSubset(t, eventIDs, []string{bobEventID})
+	})
+
+	t.Run("Room event filters are applied to /messages", func(t *testing.T) {
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		alice.SendEventSynced(t, roomID, b.Event{
+			Type:    "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "no url"},
+		})
+		imageEventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type:    "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.image", "body": "image", "url": "mxc://hs1/abcdef"},
+		})
+		it := alice.MessagesIterator(t, roomID, client.MessagesOpts{
+			Filter: client.NewRoomEventFilter().WithContainsURL(true).JSON(t),
+		})
+		events := it.All(t)
+		must.Equal(t, len(events), 1, "number of events with a url")
+		must.Equal(t, events[0].Get("event_id").Str, imageEventID, "event with a url")
+		must.Equal(t, events[0].Get("content.url").Type, gjson.String, "content.url")
+	})
+}
@@ -0,0 +1,169 @@
+package csapi_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/idp"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Tests logging in with `m.login.token`, using tokens generated by an existing session (MSC3882).
+func TestLoginWithLoginToken(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	res := alice.GenerateLoginToken(t)
+	if res.StatusCode == 400 || res.StatusCode == 404 {
+		t.Skipf("Homeserver does not support generating login tokens: %s", res.Status)
+	}
+	res.Body.Close()
+
+	t.Run("Login token logs in as the same user with a new device", func(t *testing.T) {
+		loginToken, _ := alice.MustGenerateLoginToken(t)
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		userID, _, deviceID := unauthed.MustLoginWithToken(t, loginToken)
+		must.Equal(t, userID, alice.UserID, "user ID")
+		must.NotEqual(t, deviceID, alice.DeviceID, "device ID")
+	})
+
+	t.Run("Login token cannot be used twice", func(t *testing.T) {
+		loginToken, _ := alice.MustGenerateLoginToken(t)
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		unauthed.MustLoginWithToken(t, loginToken)
+		res := unauthed.LoginWithToken(t, loginToken)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_FORBIDDEN"),
+			},
+		})
+	})
+
+	t.Run("Unknown login token is rejected", func(t *testing.T) {
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		res := unauthed.LoginWithToken(t, "not_a_real_login_token")
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_FORBIDDEN"),
+			},
+		})
+	})
+
+	// Requires the image to make login tokens expire within 10s, see "Image requirements" in the README.
+	t.Run("Expired login token is rejected", func(t *testing.T) {
+		loginToken, expiresIn := alice.MustGenerateLoginToken(t)
+		if expiresIn == 0 || expiresIn > 10*time.Second {
+			t.Skipf("Login tokens are valid for %v, which is too long to wait for: configure the image to expire them within 10s", expiresIn)
+		}
+		time.Sleep(expiresIn + time.Second)
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		res := unauthed.LoginWithToken(t, loginToken)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_FORBIDDEN"),
+			},
+		})
+	})
+}
+
+// Tests logging in via `m.login.sso` with an OpenID Connect identity provider. The homeserver must map
+// `preferred_username` to the localpart and `name` to the displayname.
+func TestLoginViaSSO(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	if deployment.GetConfig().SSOIdPPort == 0 {
+		t.Skipf("COMPLEMENT_SSO_IDP_PORT is not set")
+	}
+
+	provider := idp.NewServer(t, deployment)
+	hsName := string(deployment.GetFullyQualifiedHomeserverName(t, "hs1"))
+
+	t.Run("GET /login offers m.login.sso", func(t *testing.T) {
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		res := unauthed.MustDo(t, "GET", []string{"_matrix", "client", "v3", "login"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONCheckOff("flows", []interface{}{"m.login.sso", "m.login.token"},
+					match.CheckOffMapper(func(r gjson.Result) interface{} {
+						return r.Get("type").Str
+					}),
+					match.CheckOffAllowUnwanted(),
+				),
+			},
+		})
+	})
+
+	t.Run("SSO login maps attributes from the identity provider", func(t *testing.T) {
+		user := idp.User{
+			Subject:           "sso-subject-attrs",
+			PreferredUsername: "sso_alice",
+			Name:              "SSO Alice",
+			Email:             "sso_alice@example.com",
+		}
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		userID, accessToken, _ := unauthed.MustLoginViaSSO(t, client.SSOLoginOpts{
+			HTTPClient:   provider.HTTPClient(),
+			IdPBaseURL:   provider.Issuer,
+			Authenticate: provider.Authenticator(user),
+		})
+		must.Equal(t, userID, "@sso_alice:"+hsName, "user ID")
+		unauthed.UserID = userID
+		unauthed.AccessToken = accessToken
+		res := unauthed.MustDo(t, "GET", []string{"_matrix", "client", "v3", "profile", userID, "displayname"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("displayname", "SSO Alice"),
+			},
+		})
+	})
+
+	t.Run("SSO login with the same subject logs in as the same user", func(t *testing.T) {
+		user := idp.User{
+			Subject:           "sso-subject-relogin",
+			PreferredUsername: "sso_bob",
+			Name:              "SSO Bob",
+		}
+		opts := client.SSOLoginOpts{
+			HTTPClient:   provider.HTTPClient(),
+			IdPBaseURL:   provider.Issuer,
+			Authenticate: provider.Authenticator(user),
+		}
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		userID1, _, deviceID1 := unauthed.MustLoginViaSSO(t, opts)
+		// a fresh cookie jar, as a new browser would have
+		opts.HTTPClient = provider.HTTPClient()
+		userID2, _, deviceID2 := unauthed.MustLoginViaSSO(t, opts)
+		must.Equal(t, userID2, userID1, "user ID")
+		must.NotEqual(t, deviceID2, deviceID1, "device ID")
+	})
+
+	t.Run("SSO login token cannot be used twice", func(t *testing.T) {
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		loginToken := unauthed.MustGetLoginTokenViaSSO(t, client.SSOLoginOpts{
+			HTTPClient: provider.HTTPClient(),
+			IdPBaseURL: provider.Issuer,
+			Authenticate: provider.Authenticator(idp.User{
+				Subject:           "sso-subject-reuse",
+				PreferredUsername: "sso_charlie",
+			}),
+		})
+		unauthed.MustLoginWithToken(t, loginToken)
+		res := unauthed.LoginWithToken(t, loginToken)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_FORBIDDEN"),
+			},
+		})
+	})
+}
@@ -2,16 +2,20 @@ package csapi_tests
 
 import (
 	"fmt"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/match"
 	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/pushgateway"
 )
 
 // sytest: Getting push rules doesn't corrupt the cache SYN-390
@@ -33,6 +37,91 @@ func TestPushRuleCacheHealth(t *testing.T) {
 	must.MatchGJSON(t, alice.GetAllPushRules(t), match.JSONKeyEqual("global.sender.0.actions.0", "dont_notify"))
 }
 
+func TestPushGateway(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	gateway := pushgateway.NewServer(t, deployment)
+	cancel := gateway.Listen()
+	defer cancel()
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := bob.MustCreateRoom(t, map[string]interface{}{
+		"preset": "private_chat",
+		"invite": []string{alice.UserID},
+	})
+	alice.MustJoinRoom(t, roomID, nil)
+
+	t.Run("Messages in one-to-one rooms are pushed", func(t *testing.T) {
+		alice.MustSetPusher(t, gateway.Pusher("alice-full"))
+		eventID := bob.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "hello alice",
+			},
+		})
+		gateway.WaiterForEvent(eventID).Waitf(t, 10*time.Second, "push gateway did not receive a notification for %s", eventID)
+		for _, n := range gateway.Notifications() {
+			if n.EventID != eventID {
+				continue
+			}
+			must.Equal(t, n.RoomID, roomID, "room_id")
+			must.Equal(t, n.Sender, bob.UserID, "sender")
+			must.Equal(t, n.Type, "m.room.message", "type")
+			must.Equal(t, n.Content.Get("body").Str, "hello alice", "content.body")
+			must.Equal(t, n.Priority, "high", "prio")
+			if n.Counts.Unread < 1 {
+				ct.Errorf(t, "unread count: got %d, want at least 1", n.Counts.Unread)
+			}
+			must.Equal(t, len(n.Devices), 1, "number of devices")
+			must.Equal(t, n.Devices[0].PushKey, "alice-full", "pushkey")
+			must.Equal(t, n.Devices[0].AppID, pushgateway.AppID, "app_id")
+		}
+	})
+
+	t.Run("Pushers with event_id_only format do not include the event", func(t *testing.T) {
+		pusher := gateway.Pusher("alice-event-id-only")
+		pusher.Data["format"] = "event_id_only"
+		pusher.Append = true
+		alice.MustSetPusher(t, pusher)
+		eventID := bob.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "secret",
+			},
+		})
+		gateway.WaiterForNotification(func(n pushgateway.Notification) bool {
+			return n.EventID == eventID && len(n.Devices) == 1 && n.Devices[0].PushKey == "alice-event-id-only"
+		}).Waitf(t, 10*time.Second, "push gateway did not receive an event_id_only notification for %s", eventID)
+		for _, n := range gateway.Notifications() {
+			if n.EventID != eventID || len(n.Devices) != 1 || n.Devices[0].PushKey != "alice-event-id-only" {
+				continue
+			}
+			must.Equal(t, n.RoomID, roomID, "room_id")
+			must.Equal(t, n.Content.Exists(), false, "content exists")
+			must.Equal(t, n.Sender, "", "sender")
+		}
+	})
+
+	t.Run("Pushers are removed when the push gateway rejects the pushkey", func(t *testing.T) {
+		gateway.RejectPushKeys("alice-full", "alice-event-id-only")
+		eventID := bob.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "are you still there?",
+			},
+		})
+		gateway.WaiterForEvent(eventID).Waitf(t, 10*time.Second, "push gateway did not receive a notification for %s", eventID)
+		alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "pushers"}, client.WithRetryUntil(10*time.Second, func(res *http.Response) bool {
+			return len(gjson.ParseBytes(client.ParseJSON(t, res)).Get("pushers").Array()) == 0
+		}))
+	})
+}
+
 func TestPushSync(t *testing.T) {
 	deployment := complement.Deploy(t, 1)
 	defer deployment.Destroy(t)
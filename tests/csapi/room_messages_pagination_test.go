@@ -0,0 +1,131 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+)
+
+// Tests that paginating /messages across many small pages returns every event exactly once.
+func TestRoomMessagesPagination(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+
+	var sentEventIDs []string
+	for i := 0; i < 20; i++ {
+		sentEventIDs = append(sentEventIDs, alice.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    fmt.Sprintf("Message %d", i),
+			},
+		}))
+	}
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, sentEventIDs[len(sentEventIDs)-1]))
+
+	isMessage := func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.room.message"
+	}
+	messageIDs := func(events []gjson.Result) (eventIDs []string) {
+		for _, ev := range events {
+			if isMessage(ev) {
+				eventIDs = append(eventIDs, ev.Get("event_id").Str)
+			}
+		}
+		return eventIDs
+	}
+	reversed := func(in []string) []string {
+		out := make([]string, len(in))
+		for i := range in {
+			out[len(in)-1-i] = in[i]
+		}
+		return out
+	}
+
+	t.Run("Backwards pagination returns every event once", func(t *testing.T) {
+		it := alice.MessagesIterator(t, roomID, client.MessagesOpts{Limit: 3})
+		events := it.All(t)
+		must.Equal(t, it.Exhausted(), true, "timeline exhausted")
+		must.Equal(t, len(it.DuplicateEventIDs()), 0, fmt.Sprintf("duplicate events %v: %s", it.DuplicateEventIDs(), it))
+		must.HaveInOrder(t, messageIDs(events), reversed(sentEventIDs))
+		must.Equal(t, events[len(events)-1].Get("type").Str, "m.room.create", "last event")
+	})
+
+	t.Run("Forwards pagination returns every event once", func(t *testing.T) {
+		it := alice.MessagesIterator(t, roomID, client.MessagesOpts{Dir: "f", Limit: 4})
+		events := it.All(t)
+		must.Equal(t, len(it.DuplicateEventIDs()), 0, fmt.Sprintf("duplicate events %v: %s", it.DuplicateEventIDs(), it))
+		must.HaveInOrder(t, messageIDs(events), sentEventIDs)
+	})
+
+	t.Run("Pagination stops once the predicate matches", func(t *testing.T) {
+		it := alice.MessagesIterator(t, roomID, client.MessagesOpts{Limit: 5})
+		ev := it.MustUntil(t, func(ev gjson.Result) bool {
+			return ev.Get("event_id").Str == sentEventIDs[12]
+		})
+		must.Equal(t, ev.Get("content.body").Str, "Message 12", "matched event")
+		must.Equal(t, len(it.Pages()), 2, "pages fetched")
+		must.Equal(t, it.Exhausted(), false, "timeline exhausted")
+	})
+
+	t.Run("Filters are applied to every page", func(t *testing.T) {
+		it := alice.MessagesIterator(t, roomID, client.MessagesOpts{
+			Limit:  4,
+			Filter: `{"types":["m.room.message"]}`,
+		})
+		events := it.All(t)
+		for _, ev := range events {
+			must.Equal(t, ev.Get("type").Str, "m.room.message", "event type")
+		}
+		must.Equal(t, len(it.MissingEventIDs(sentEventIDs)), 0, fmt.Sprintf("missing events %v", it.MissingEventIDs(sentEventIDs)))
+		must.Equal(t, len(events), len(sentEventIDs), "number of events")
+	})
+
+	t.Run("Gaps in a limited sync can be filled from prev_batch", func(t *testing.T) {
+		filter := `{"room":{"timeline":{"limit":2}}}`
+		_, since := alice.MustSync(t, client.SyncReq{Filter: filter})
+
+		var gapEventIDs []string
+		for i := 0; i < 10; i++ {
+			gapEventIDs = append(gapEventIDs, alice.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+				Type: "m.room.message",
+				Content: map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    fmt.Sprintf("Gap message %d", i),
+				},
+			}))
+		}
+		var timeline gjson.Result
+		alice.MustSyncUntil(t, client.SyncReq{Since: since, Filter: filter}, func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+			timeline = topLevelSyncJSON.Get("rooms.join." + client.GjsonEscape(roomID) + ".timeline")
+			for _, ev := range timeline.Get("events").Array() {
+				if ev.Get("event_id").Str == gapEventIDs[len(gapEventIDs)-1] {
+					return nil
+				}
+			}
+			return fmt.Errorf("timeline does not include %s", gapEventIDs[len(gapEventIDs)-1])
+		})
+		must.Equal(t, timeline.Get("limited").Bool(), true, "timeline limited")
+		inTimeline := len(timeline.Get("events").Array())
+
+		// paginate from the start of the limited timeline back to the previous sync
+		it := alice.MessagesIterator(t, roomID, client.MessagesOpts{
+			From:  timeline.Get("prev_batch").Str,
+			To:    since,
+			Limit: 3,
+		})
+		events := it.All(t)
+		must.Equal(t, len(it.DuplicateEventIDs()), 0, fmt.Sprintf("duplicate events %v: %s", it.DuplicateEventIDs(), it))
+		must.HaveInOrder(t, messageIDs(events), reversed(gapEventIDs[:len(gapEventIDs)-inTimeline]))
+	})
+}
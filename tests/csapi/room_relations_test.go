@@ -303,3 +303,77 @@ func TestRelationsPaginationSync(t *testing.T) {
 		},
 	})
 }
+
+// Tests that relations are bundled into the unsigned section of their parent event, and that the
+// typed relation helpers send relations the server understands.
+// See https://spec.matrix.org/v1.10/client-server-api/#aggregations-of-child-events
+func TestBundledAggregations(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.MustJoinRoom(t, roomID, nil)
+
+	rootID := alice.SendEventSynced(t, roomID, b.Event{
+		Type:    "m.room.message",
+		Content: map[string]interface{}{"msgtype": "m.text", "body": "root"},
+	})
+	reactionID := bob.MustSendReaction(t, roomID, rootID, "👍")
+	threadReplyID := bob.MustSendThreadReply(t, roomID, rootID, map[string]interface{}{"msgtype": "m.text", "body": "in thread"})
+	editID := alice.MustSendEdit(t, roomID, rootID, map[string]interface{}{"msgtype": "m.text", "body": "edited root"})
+	replyID := bob.MustSendReply(t, roomID, rootID, map[string]interface{}{"msgtype": "m.text", "body": "reply"})
+
+	t.Run("/relations returns every relation", func(t *testing.T) {
+		it := alice.RelationsIterator(t, roomID, rootID, client.RelationsOpts{Limit: 1})
+		events := it.All(t)
+		must.Equal(t, len(events), 3, "number of relations")
+		must.ContainSubset(t, it.EventIDs(), []string{reactionID, threadReplyID, editID})
+		must.NotContainSubset(t, it.EventIDs(), []string{replyID})
+	})
+
+	t.Run("/relations filters by rel_type and event_type", func(t *testing.T) {
+		it := alice.RelationsIterator(t, roomID, rootID, client.RelationsOpts{RelType: "m.annotation", EventType: "m.reaction"})
+		it.All(t)
+		must.HaveInOrder(t, it.EventIDs(), []string{reactionID})
+
+		it = alice.RelationsIterator(t, roomID, rootID, client.RelationsOpts{RelType: "m.thread"})
+		it.All(t)
+		must.HaveInOrder(t, it.EventIDs(), []string{threadReplyID})
+	})
+
+	t.Run("/relations with recurse returns relations of relations", func(t *testing.T) {
+		threadEditID := bob.MustSendEdit(t, roomID, threadReplyID, map[string]interface{}{"msgtype": "m.text", "body": "edited in thread"})
+		it := alice.RelationsIterator(t, roomID, rootID, client.RelationsOpts{Recurse: true})
+		it.All(t)
+		must.ContainSubset(t, it.EventIDs(), []string{reactionID, threadReplyID, editID, threadEditID})
+
+		it = alice.RelationsIterator(t, roomID, rootID, client.RelationsOpts{})
+		it.All(t)
+		must.NotContainSubset(t, it.EventIDs(), []string{threadEditID})
+	})
+
+	t.Run("Aggregations are bundled on /event, /context and /messages", func(t *testing.T) {
+		alice.MustHaveBundledAggregations(t, roomID, rootID,
+			client.BundledThread(threadReplyID, 1),
+			client.BundledThreadParticipated(false),
+			client.BundledEdit(editID),
+		)
+		bob.MustHaveBundledAggregations(t, roomID, rootID,
+			client.BundledThreadParticipated(true),
+		)
+		alice.MustHaveBundledAggregations(t, roomID, replyID,
+			client.NoBundledAggregation("m.thread"),
+			client.NoBundledAggregation("m.replace"),
+		)
+	})
+
+	t.Run("Aggregations are bundled on /sync", func(t *testing.T) {
+		// the root is no longer the most recent event, so make sure it is still in the timeline
+		filter := client.NewFilter().WithTimeline(client.NewRoomEventFilter().WithLimit(50))
+		alice.MustSyncUntil(t, client.SyncReq{Filter: filter.JSON(t)},
+			client.SyncTimelineHasBundledAggregations(roomID, rootID, client.BundledEdit(editID)),
+		)
+	})
+}
@@ -0,0 +1,136 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Tests that a client which only sees gappy (limited) incremental syncs still ends up with the
+// same room state as /rooms/{roomID}/state, which is what clients rely on to render rooms.
+func TestSyncAccumulatedStateMatchesRoomState(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	charlie := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "initial name",
+	})
+	bob.MustJoinRoom(t, roomID, nil)
+
+	// Use a small timeline limit so that incremental syncs are limited.
+	filter := `{"room":{"timeline":{"limit":3}}}`
+	acc := client.NewSyncAccumulator(alice.UserID)
+	alice.MustSyncAccumulateUntil(t, acc, client.SyncReq{Filter: filter}, func(acc *client.SyncAccumulator) error {
+		joined := acc.Room(roomID).JoinedMembers()
+		if len(joined) != 2 {
+			return fmt.Errorf("expected 2 joined members, got %v", joined)
+		}
+		return nil
+	})
+	alice.MustMatchAccumulatedState(t, acc, roomID)
+
+	t.Run("Room state is correct after a gappy sync", func(t *testing.T) {
+		// Change state, then bury the changes under enough messages to make the next sync limited.
+		for i := 0; i < 3; i++ {
+			bob.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+				Type:     "m.room.name",
+				StateKey: b.Ptr(""),
+				Content: map[string]interface{}{
+					"name": fmt.Sprintf("name %d", i),
+				},
+			})
+		}
+		bob.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+			Type:     "m.room.topic",
+			StateKey: b.Ptr(""),
+			Content: map[string]interface{}{
+				"topic": "gappy topic",
+			},
+		})
+		charlie.MustJoinRoom(t, roomID, nil)
+		bob.MustLeaveRoom(t, roomID)
+		var lastEventID string
+		for i := 0; i < 10; i++ {
+			lastEventID = charlie.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+				Type: "m.room.message",
+				Content: map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    fmt.Sprintf("message %d", i),
+				},
+			})
+		}
+
+		alice.MustSyncAccumulateUntil(t, acc, client.SyncReq{Filter: filter}, func(acc *client.SyncAccumulator) error {
+			room := acc.Room(roomID)
+			if len(room.Timeline) == 0 || room.Timeline[len(room.Timeline)-1].Get("event_id").Str != lastEventID {
+				return fmt.Errorf("last timeline event is not %s", lastEventID)
+			}
+			return nil
+		})
+		room := acc.Room(roomID)
+		if room.NumGaps == 0 {
+			t.Errorf("expected a limited timeline but none was seen")
+		}
+		if room.Name() != "name 2" {
+			t.Errorf("room name: got %q, want %q", room.Name(), "name 2")
+		}
+		if topic := room.CurrentState("m.room.topic", "").Get("content.topic").Str; topic != "gappy topic" {
+			t.Errorf("room topic: got %q, want %q", topic, "gappy topic")
+		}
+		wantMembers := []string{alice.UserID, charlie.UserID}
+		sort.Strings(wantMembers)
+		if got := room.JoinedMembers(); !reflect.DeepEqual(got, wantMembers) {
+			t.Errorf("joined members: got %v, want %v", got, wantMembers)
+		}
+		alice.MustMatchAccumulatedState(t, acc, roomID)
+	})
+
+	t.Run("Account data overrides are accumulated", func(t *testing.T) {
+		alice.MustSetGlobalAccountData(t, "com.example.accumulated", map[string]interface{}{"v": 1})
+		alice.MustSetGlobalAccountData(t, "com.example.accumulated", map[string]interface{}{"v": 2})
+		alice.MustSetRoomAccountData(t, roomID, "com.example.accumulated", map[string]interface{}{"v": 3})
+		alice.MustSyncAccumulateUntil(t, acc, client.SyncReq{Filter: filter}, func(acc *client.SyncAccumulator) error {
+			if v := acc.AccountData["com.example.accumulated"].Get("content.v").Int(); v != 2 {
+				return fmt.Errorf("global account data: got v=%d, want 2", v)
+			}
+			if v := acc.Room(roomID).AccountData["com.example.accumulated"].Get("content.v").Int(); v != 3 {
+				return fmt.Errorf("room account data: got v=%d, want 3", v)
+			}
+			return nil
+		})
+	})
+
+	t.Run("Unread counts are accumulated", func(t *testing.T) {
+		charlie.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "hello " + alice.UserID,
+				"m.mentions": map[string]interface{}{
+					"user_ids": []string{alice.UserID},
+				},
+			},
+		})
+		alice.MustSyncAccumulateUntil(t, acc, client.SyncReq{Filter: filter}, func(acc *client.SyncAccumulator) error {
+			room := acc.Room(roomID)
+			if room.HighlightCount < 1 {
+				return fmt.Errorf("highlight count: got %d, want >= 1", room.HighlightCount)
+			}
+			if room.NotificationCount < room.HighlightCount {
+				return fmt.Errorf("notification count %d is less than highlight count %d", room.NotificationCount, room.HighlightCount)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,66 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+)
+
+// Tests that /sync responses can be parsed into client.SyncResponse, and that the typed checkers work.
+func TestSyncTyped(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+
+	t.Run("Joined rooms are parsed", func(t *testing.T) {
+		eventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Hello world",
+			},
+		})
+		res := alice.MustSyncTyped(t, client.SyncReq{})
+		must.NotEqual(t, res.NextBatch, "", "next_batch")
+		room, ok := res.Rooms.Join[roomID]
+		must.Equal(t, ok, true, "room in rooms.join")
+		var found bool
+		for _, ev := range room.Timeline.Events {
+			if ev.EventID == eventID {
+				found = true
+				must.Equal(t, ev.Sender, alice.UserID, "sender")
+				must.Equal(t, ev.IsState(), false, "message is a state event")
+				must.Equal(t, ev.Content.Get("body").Str, "Hello world", "body")
+			}
+		}
+		must.Equal(t, found, true, "message in timeline")
+		must.Equal(t, room.Raw.Get("timeline.events.#").Int(), int64(len(room.Timeline.Events)), "raw timeline length")
+	})
+
+	t.Run("Typed checkers can be used with MustSyncUntil", func(t *testing.T) {
+		since := bob.MustSyncUntil(t, client.SyncReq{TimeoutMillis: "0"})
+		alice.MustInviteRoom(t, roomID, bob.UserID)
+		since = bob.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncInvitedToTyped(bob.UserID, roomID))
+		bob.MustJoinRoom(t, roomID, nil)
+		bob.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncJoinedToTyped(bob.UserID, roomID))
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedToTyped(bob.UserID, roomID, func(ev client.SyncEvent) bool {
+			return ev.Sender == bob.UserID
+		}))
+	})
+
+	t.Run("Device list changes are parsed", func(t *testing.T) {
+		since := alice.MustSyncUntil(t, client.SyncReq{TimeoutMillis: "0"})
+		bobDeviceKeys, bobOTKs := bob.MustGenerateOneTimeKeys(t, 1)
+		bob.MustUploadKeys(t, bobDeviceKeys, bobOTKs)
+		alice.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncDeviceListsChanged(bob.UserID))
+		res := bob.MustSyncTyped(t, client.SyncReq{})
+		must.Equal(t, res.DeviceOneTimeKeysCount["signed_curve25519"], 1, "one-time key count")
+	})
+}
@@ -0,0 +1,81 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestUserInteractiveAuth(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	password := "complement_uia_password"
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{Password: password})
+
+	newDevice := func(t *testing.T) string {
+		t.Helper()
+		return deployment.Login(t, "hs1", alice, helpers.LoginOpts{Password: password}).DeviceID
+	}
+
+	t.Run("Device deletion can be completed with a password", func(t *testing.T) {
+		deviceID := newDevice(t)
+		_, uia := alice.MustDoWithUIA(t, "DELETE", []string{"_matrix", "client", "v3", "devices", deviceID}, nil)
+		must.Equal(t, len(uia.Flow) > 0, true, "expected a UIA flow to be used")
+		must.Equal(t, uia.Session != "", true, "expected a UIA session")
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "devices", deviceID})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 404,
+		})
+	})
+
+	t.Run("Wrong password is rejected with M_FORBIDDEN and the session is kept", func(t *testing.T) {
+		deviceID := newDevice(t)
+		paths := []string{"_matrix", "client", "v3", "devices", deviceID}
+		res, uia := alice.DoWithUIA(t, "DELETE", paths, nil, client.UIAPassword("not-the-password"))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 401,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_FORBIDDEN"),
+				match.JSONKeyPresent("flows"),
+				match.JSONKeyEqual("session", uia.Session),
+			},
+		})
+		if uia.LastChallenge == nil {
+			ct.Fatalf(t, "DoWithUIA returned 401 without a UIA challenge")
+		}
+		// the same session can then be completed with the right password
+		res = alice.DoUIAStage(t, "DELETE", paths, nil, uia.Session, client.UIAPassword(password), uia.LastChallenge.Params)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 200,
+		})
+	})
+
+	// Homeservers forget sessions when they expire, so this is also how expired sessions are rejected.
+	t.Run("Unknown sessions are rejected", func(t *testing.T) {
+		deviceID := newDevice(t)
+		paths := []string{"_matrix", "client", "v3", "devices", deviceID}
+		challenge := alice.MustGetUIAChallenge(t, "DELETE", paths, nil)
+		res := alice.DoUIAStage(t, "DELETE", paths, nil, challenge.Session+"-unknown", client.UIAPassword(password), challenge.Params)
+		must.MatchFailure(t, res)
+		// the device must still exist
+		alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "devices", deviceID})
+	})
+
+	t.Run("Completed sessions cannot be reused for a different request", func(t *testing.T) {
+		deviceID1 := newDevice(t)
+		deviceID2 := newDevice(t)
+		_, uia := alice.MustDoWithUIA(t, "DELETE", []string{"_matrix", "client", "v3", "devices", deviceID1}, nil)
+		if uia.LastChallenge == nil {
+			ct.Fatalf(t, "expected the server to require user-interactive auth to delete a device")
+		}
+		res := alice.DoUIAStage(t, "DELETE", []string{"_matrix", "client", "v3", "devices", deviceID2}, nil, uia.Session, client.UIADummy(), uia.LastChallenge.Params)
+		must.MatchFailure(t, res)
+		alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "devices", deviceID2})
+	})
+}
@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+)
+
+// Tests that cross-signing keys and signatures made on one server are visible to users on another.
+func TestFederationCrossSigning(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs2", helpers.RegistrationOpts{})
+
+	// for device lists to be shared between alice and bob they must share a room
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.MustJoinRoom(t, roomID, []spec.ServerName{
+		deployment.GetFullyQualifiedHomeserverName(t, "hs1"),
+	})
+	bob.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	aliceKeys := alice.MustBootstrapCrossSigning(t)
+	bobKeys := bob.MustBootstrapCrossSigning(t)
+
+	t.Run("Cross-signing keys are visible over federation", func(t *testing.T) {
+		userID := client.GjsonEscape(alice.UserID)
+		masterKeyPath := "master_keys." + userID + ".keys." + client.GjsonEscape(aliceKeys.Master.KeyID())
+		// hs2 may have cached alice's keys from before she bootstrapped cross-signing, so wait for the update
+		res := bob.MustQueryKeys(t, map[string][]string{alice.UserID: {}}, keysQueryHas(t, masterKeyPath))
+		must.Equal(t, res.Get(masterKeyPath).Str, aliceKeys.Master.PublicKeyBase64(), "master key")
+		must.Equal(t, res.Get("self_signing_keys."+userID+".keys."+client.GjsonEscape(aliceKeys.SelfSigning.KeyID())).Str, aliceKeys.SelfSigning.PublicKeyBase64(), "self-signing key")
+		must.Equal(t, res.Get("user_signing_keys."+userID).Exists(), false, "user-signing key visible over federation")
+	})
+
+	t.Run("Device signatures are visible over federation", func(t *testing.T) {
+		sigPath := "device_keys." + client.GjsonEscape(alice.UserID) + "." + client.GjsonEscape(alice.DeviceID) +
+			".signatures." + client.GjsonEscape(alice.UserID) + "." + client.GjsonEscape(aliceKeys.SelfSigning.KeyID())
+		res := bob.MustQueryKeys(t, map[string][]string{alice.UserID: {alice.DeviceID}}, keysQueryHas(t, sigPath))
+		must.Equal(t, res.Get(sigPath).Exists(), true, "device signed by self-signing key")
+	})
+
+	t.Run("Signing a remote user's master key is visible to the signer", func(t *testing.T) {
+		// hs1 may have cached bob's keys from before he bootstrapped cross-signing
+		bobMasterKey := alice.MustGetMasterKey(t, bob.UserID, keysQueryHas(t,
+			"master_keys."+client.GjsonEscape(bob.UserID)+".keys."+client.GjsonEscape(bobKeys.Master.KeyID()),
+		))
+		alice.MustUploadSignatures(t, map[string]map[string]interface{}{
+			bob.UserID: {
+				bobKeys.Master.PublicKeyBase64(): aliceKeys.SignUser(t, bobMasterKey),
+			},
+		})
+		sigPath := "master_keys." + client.GjsonEscape(bob.UserID) + ".signatures." + client.GjsonEscape(alice.UserID) + "." + client.GjsonEscape(aliceKeys.UserSigning.KeyID())
+		res := alice.MustQueryKeys(t, map[string][]string{bob.UserID: {}}, keysQueryHas(t, sigPath))
+		must.Equal(t, res.Get(sigPath).Exists(), true, "signature on remote master key")
+	})
+}
+
+// keysQueryHas retries /keys/query until `path` exists in the response, as key updates take time to
+// propagate over federation.
+func keysQueryHas(t *testing.T, path string) client.RequestOpt {
+	return client.WithRetryUntil(10*time.Second, func(res *http.Response) bool {
+		if res.StatusCode != 200 {
+			return false
+		}
+		return gjson.ParseBytes(client.ParseJSON(t, res)).Get(path).Exists()
+	})
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/match"
 	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/runtime"
 
 	"github.com/tidwall/gjson"
 )
@@ -24,6 +25,7 @@ var testAccountDataContent = map[string]interface{}{"test_data": 1}
 func TestRemovingAccountData(t *testing.T) {
 	deployment := complement.Deploy(t, 1)
 	defer deployment.Destroy(t)
+	runtime.SkipUnlessFeature(t, deployment, runtime.UnstableFeature("org.matrix.msc3391"))
 
 	// Create a user to manipulate the account data of
 	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
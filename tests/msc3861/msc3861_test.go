@@ -0,0 +1,133 @@
+// This file contains tests for delegating authentication to an OAuth 2.0 provider
+// as defined by MSC3861, which you can read here:
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3861
+//
+// These tests only run when COMPLEMENT_OAUTH_STUB_PORT is set and the homeserver image
+// configures itself to use COMPLEMENT_OAUTH_ISSUER.
+
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/oauth"
+)
+
+func TestOAuthLogin(t *testing.T) {
+	// check before deploying, as the homeserver is only configured to use the provider when this is set
+	if os.Getenv("COMPLEMENT_OAUTH_STUB_PORT") == "" {
+		t.Skipf("COMPLEMENT_OAUTH_STUB_PORT is not set")
+	}
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	provider := oauth.NewServer(t, deployment)
+	cancel := provider.Listen()
+	defer cancel()
+
+	hsName := string(deployment.GetFullyQualifiedHomeserverName(t, "hs1"))
+
+	t.Run("Homeserver advertises the provider as its issuer", func(t *testing.T) {
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		must.Equal(t, unauthed.MustGetOAuthIssuer(t), provider.Issuer, "issuer")
+	})
+
+	t.Run("Password login is not offered", func(t *testing.T) {
+		unauthed := deployment.UnauthenticatedClient(t, "hs1")
+		res := unauthed.MustDo(t, "GET", []string{"_matrix", "client", "v3", "login"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONArrayEach("flows", func(flow gjson.Result) error {
+					if flow.Get("type").Str == "m.login.password" {
+						return fmt.Errorf("password login is offered: %s", flow.Raw)
+					}
+					return nil
+				}),
+			},
+		})
+	})
+
+	t.Run("Can log in with the authorization code grant", func(t *testing.T) {
+		alice := deployment.UnauthenticatedClient(t, "hs1")
+		tokens := alice.MustLoginWithOAuth(t, client.OAuthLoginOpts{
+			HTTPClient: provider.HTTPClient(),
+			UserID:     "@alice_code:" + hsName,
+			DeviceID:   "CODEDEVICE",
+		})
+		must.Equal(t, alice.UserID, "@alice_code:"+hsName, "user ID")
+		must.Equal(t, alice.DeviceID, "CODEDEVICE", "device ID")
+		must.Equal(t, tokens.RefreshToken != "", true, "expected a refresh token")
+		alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "devices", "CODEDEVICE"})
+	})
+
+	t.Run("Refreshed tokens replace the old access token", func(t *testing.T) {
+		alice := deployment.UnauthenticatedClient(t, "hs1")
+		tokens := alice.MustLoginWithOAuth(t, client.OAuthLoginOpts{
+			HTTPClient: provider.HTTPClient(),
+			UserID:     "@alice_refresh:" + hsName,
+		})
+		oldAccessToken := tokens.AccessToken
+		alice.MustRefreshOAuthToken(t, provider.HTTPClient(), tokens)
+		alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+
+		alice.AccessToken = oldAccessToken
+		// homeservers may cache introspection responses for a short while
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"},
+			client.WithRetryUntil(10*time.Second, func(res *http.Response) bool {
+				return res.StatusCode == 401
+			}),
+		)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 401,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_UNKNOWN_TOKEN"),
+			},
+		})
+	})
+
+	t.Run("Tokens revoked at the provider are rejected", func(t *testing.T) {
+		alice := deployment.UnauthenticatedClient(t, "hs1")
+		tokens := alice.MustLoginWithOAuth(t, client.OAuthLoginOpts{
+			HTTPClient: provider.HTTPClient(),
+			UserID:     "@alice_revoke:" + hsName,
+		})
+		alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+		provider.RevokeToken(t, tokens.AccessToken)
+		// homeservers may cache introspection responses for a short while
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"},
+			client.WithRetryUntil(10*time.Second, func(res *http.Response) bool {
+				return res.StatusCode == 401
+			}),
+		)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 401,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_UNKNOWN_TOKEN"),
+			},
+		})
+	})
+
+	t.Run("Can log in with the device authorization grant", func(t *testing.T) {
+		userID := "@alice_device:" + hsName
+		alice := deployment.UnauthenticatedClient(t, "hs1")
+		alice.MustLoginWithOAuthDeviceGrant(t, client.OAuthLoginOpts{
+			HTTPClient: provider.HTTPClient(),
+			UserID:     userID,
+			DeviceID:   "GRANTDEVICE",
+		}, 10*time.Second, func(userCode, verificationURI string) {
+			provider.ApproveDeviceAuthorization(t, userCode, userID)
+		})
+		must.Equal(t, alice.UserID, userID, "user ID")
+		must.Equal(t, alice.DeviceID, "GRANTDEVICE", "device ID")
+	})
+}
@@ -0,0 +1,310 @@
+// This file contains tests for simplified sliding sync as
+// defined by MSC4186, which you can read here:
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4186
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// allRoomsList returns sliding sync lists with a single list called "all" covering the first 20 rooms.
+func allRoomsList(requiredState [][2]string, timelineLimit int) map[string]client.SlidingSyncList {
+	return map[string]client.SlidingSyncList{
+		"all": {
+			Ranges: [][2]int64{{0, 19}},
+			SlidingSyncRoomSubscription: client.SlidingSyncRoomSubscription{
+				RequiredState: requiredState,
+				TimelineLimit: timelineLimit,
+			},
+		},
+	}
+}
+
+func TestSlidingSyncLists(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID1 := alice.MustCreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+	roomID2 := alice.MustCreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+	roomID3 := alice.MustCreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+
+	t.Run("List count includes all joined rooms", func(t *testing.T) {
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList(nil, 1),
+		},
+			client.SlidingSyncListCount("all", 3),
+			client.SlidingSyncHasRoom(roomID1),
+			client.SlidingSyncHasRoom(roomID2),
+			client.SlidingSyncHasRoom(roomID3),
+		)
+	})
+
+	t.Run("List is sorted by recent activity", func(t *testing.T) {
+		alice.SendEventSynced(t, roomID1, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "bump",
+			},
+		})
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList(nil, 1),
+		}, client.SlidingSyncRoomsOrderedByRecency([]string{roomID1, roomID3, roomID2}))
+	})
+
+	t.Run("List ranges limit the rooms returned", func(t *testing.T) {
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: map[string]client.SlidingSyncList{
+				"all": {
+					Ranges: [][2]int64{{0, 0}},
+					SlidingSyncRoomSubscription: client.SlidingSyncRoomSubscription{
+						TimelineLimit: 1,
+					},
+				},
+			},
+		},
+			client.SlidingSyncListCount("all", 3),
+			client.SlidingSyncRooms([]string{roomID1}),
+		)
+	})
+}
+
+func TestSlidingSyncRoomData(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	t.Run("Room name is calculated from m.room.name", func(t *testing.T) {
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+			"name":   "Sliding Sync Room",
+		})
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList([][2]string{{"m.room.name", ""}}, 1),
+		}, client.SlidingSyncRoomName(roomID, "Sliding Sync Room"))
+	})
+
+	t.Run("Room avatar is taken from m.room.avatar", func(t *testing.T) {
+		avatarURL := "mxc://example.org/sliding_sync_avatar"
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+			"initial_state": []map[string]interface{}{
+				{
+					"type":      "m.room.avatar",
+					"state_key": "",
+					"content": map[string]interface{}{
+						"url": avatarURL,
+					},
+				},
+			},
+		})
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList([][2]string{{"m.room.avatar", ""}}, 1),
+		}, client.SlidingSyncRoomAvatar(roomID, avatarURL))
+	})
+
+	t.Run("Heroes are returned for unnamed rooms", func(t *testing.T) {
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		bob.MustJoinRoom(t, roomID, nil)
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList(nil, 1),
+		}, client.SlidingSyncRoomHeroes(roomID, []string{bob.UserID}))
+	})
+
+	t.Run("Notification and highlight counts are returned", func(t *testing.T) {
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		bob.MustJoinRoom(t, roomID, nil)
+		bob.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "hello",
+			},
+		})
+		bob.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "hello " + alice.UserID,
+				"m.mentions": map[string]interface{}{
+					"user_ids": []string{alice.UserID},
+				},
+			},
+		})
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList(nil, 1),
+		}, client.SlidingSyncRoomNotificationCount(roomID, 2, 1))
+	})
+
+	t.Run("Room subscriptions return rooms outside of lists", func(t *testing.T) {
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		eventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "subscribed",
+			},
+		})
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			RoomSubscriptions: map[string]client.SlidingSyncRoomSubscription{
+				roomID: {
+					RequiredState: [][2]string{{"m.room.create", ""}},
+					TimelineLimit: 5,
+				},
+			},
+		},
+			client.SlidingSyncRoomTimelineHas(roomID, func(ev gjson.Result) bool {
+				return ev.Get("event_id").Str == eventID
+			}),
+			client.SlidingSyncRoomRequiredStateHas(roomID, func(ev gjson.Result) bool {
+				return ev.Get("type").Str == "m.room.create"
+			}),
+		)
+	})
+
+	t.Run("Incremental responses only contain new timeline events", func(t *testing.T) {
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		req := client.SlidingSyncReq{
+			RoomSubscriptions: map[string]client.SlidingSyncRoomSubscription{
+				roomID: {TimelineLimit: 10},
+			},
+		}
+		req.Pos = alice.MustSlidingSyncUntil(t, req, client.SlidingSyncRoomTimelineHas(roomID, func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "m.room.create"
+		}))
+		eventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "new",
+			},
+		})
+		alice.MustSlidingSyncUntil(t, req, func(clientUserID string, res gjson.Result) error {
+			if err := client.SlidingSyncRoomTimelineHas(roomID, func(ev gjson.Result) bool {
+				return ev.Get("event_id").Str == eventID
+			})(clientUserID, res); err != nil {
+				return err
+			}
+			if err := client.SlidingSyncRoomTimelineHas(roomID, func(ev gjson.Result) bool {
+				return ev.Get("type").Str == "m.room.create"
+			})(clientUserID, res); err == nil {
+				t.Errorf("incremental response contained m.room.create event again: %s", res.Get("rooms").Raw)
+			}
+			return nil
+		})
+	})
+}
+
+func TestSlidingSyncExtensions(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.MustJoinRoom(t, roomID, nil)
+
+	t.Run("to_device extension returns to-device messages", func(t *testing.T) {
+		bob.MustSendToDeviceMessages(t, "com.example.test", map[string]map[string]map[string]interface{}{
+			alice.UserID: {
+				alice.DeviceID: {
+					"hello": "sliding sync",
+				},
+			},
+		})
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Extensions: &client.SlidingSyncExtensions{
+				ToDevice: &client.SlidingSyncToDeviceExtension{Enabled: true},
+			},
+		}, client.SlidingSyncToDeviceHas(bob.UserID, func(msg gjson.Result) bool {
+			return msg.Get("type").Str == "com.example.test" && msg.Get("content.hello").Str == "sliding sync"
+		}))
+	})
+
+	t.Run("e2ee extension returns one-time key counts", func(t *testing.T) {
+		deviceKeys, oneTimeKeys := alice.MustGenerateOneTimeKeys(t, 3)
+		alice.MustUploadKeys(t, deviceKeys, oneTimeKeys)
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Extensions: &client.SlidingSyncExtensions{
+				E2EE: &client.SlidingSyncExtension{Enabled: true},
+			},
+		}, client.SlidingSyncOneTimeKeyCount("signed_curve25519", 3))
+	})
+
+	t.Run("e2ee extension returns device list changes", func(t *testing.T) {
+		pos := alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList(nil, 1),
+			Extensions: &client.SlidingSyncExtensions{
+				E2EE: &client.SlidingSyncExtension{Enabled: true},
+			},
+		})
+		deviceKeys, oneTimeKeys := bob.MustGenerateOneTimeKeys(t, 1)
+		bob.MustUploadKeys(t, deviceKeys, oneTimeKeys)
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Pos:   pos,
+			Lists: allRoomsList(nil, 1),
+			Extensions: &client.SlidingSyncExtensions{
+				E2EE: &client.SlidingSyncExtension{Enabled: true},
+			},
+		}, client.SlidingSyncDeviceListChanged(bob.UserID))
+	})
+
+	t.Run("account_data extension returns global and room account data", func(t *testing.T) {
+		alice.MustSetGlobalAccountData(t, "com.example.global", map[string]interface{}{"foo": "bar"})
+		alice.MustSetRoomAccountData(t, roomID, "com.example.room", map[string]interface{}{"baz": "quuz"})
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList(nil, 1),
+			Extensions: &client.SlidingSyncExtensions{
+				AccountData: &client.SlidingSyncExtension{Enabled: true},
+			},
+		},
+			client.SlidingSyncGlobalAccountDataHas(func(ev gjson.Result) bool {
+				return ev.Get("type").Str == "com.example.global" && ev.Get("content.foo").Str == "bar"
+			}),
+			client.SlidingSyncRoomAccountDataHas(roomID, func(ev gjson.Result) bool {
+				return ev.Get("type").Str == "com.example.room" && ev.Get("content.baz").Str == "quuz"
+			}),
+		)
+	})
+
+	t.Run("receipts extension returns read receipts", func(t *testing.T) {
+		eventID := bob.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "read me",
+			},
+		})
+		bob.MustDo(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "receipt", "m.read", eventID}, client.WithJSONBody(t, struct{}{}))
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList(nil, 1),
+			Extensions: &client.SlidingSyncExtensions{
+				Receipts: &client.SlidingSyncExtension{Enabled: true},
+			},
+		}, client.SlidingSyncReceiptsHas(roomID, func(edu gjson.Result) bool {
+			return edu.Get("type").Str == "m.receipt" &&
+				edu.Get("content."+client.GjsonEscape(eventID)+".m\\.read."+client.GjsonEscape(bob.UserID)).Exists()
+		}))
+	})
+
+	t.Run("typing extension returns typing users", func(t *testing.T) {
+		bob.MustSendTyping(t, roomID, true, 10000)
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Lists: allRoomsList(nil, 1),
+			Extensions: &client.SlidingSyncExtensions{
+				Typing: &client.SlidingSyncExtension{Enabled: true},
+			},
+		}, client.SlidingSyncUsersTyping(roomID, []string{bob.UserID}))
+	})
+}
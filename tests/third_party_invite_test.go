@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/federation"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/identity"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that users can be invited by email address via an identity server, and receive the invite
+// once they bind that address:
+// https://spec.matrix.org/v1.11/client-server-api/#third-party-invites
+func TestThirdPartyInvite(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+		federation.HandleExchangeThirdPartyInviteRequests(deployment, nil),
+	)
+	srv.UnexpectedRequestsAreErrors = false // we expect to be pushed events
+	cancel := srv.Listen()
+	defer cancel()
+	is := identity.NewServer(t, deployment, srv)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	t.Run("Invite by email is delivered once the address is bound", func(t *testing.T) {
+		const address = "bob-local@example.com"
+		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+		alice.MustDo(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "invite"}, client.WithJSONBody(t, map[string]interface{}{
+			"id_server":       is.ServerName(),
+			"id_access_token": "complement",
+			"medium":          "email",
+			"address":         address,
+		}))
+
+		invites := is.Invites()
+		must.Equal(t, len(invites), 1, "number of stored invites")
+		must.Equal(t, invites[0].RoomID, roomID, "invite room_id")
+		must.Equal(t, invites[0].Sender, alice.UserID, "invite sender")
+		token := invites[0].Token
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state", "m.room.third_party_invite", token})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("public_key", is.PublicKey()),
+			},
+		})
+
+		_, since := bob.MustSync(t, client.SyncReq{})
+		is.Bind(t, "email", address, bob.UserID)
+		bob.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncInvitedTo(bob.UserID, roomID))
+		bob.MustJoinRoom(t, roomID, nil)
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+		res = alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state", "m.room.member", bob.UserID})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("membership", "join"),
+			},
+		})
+	})
+
+	t.Run("Invite by email to a remote room is exchanged over federation", func(t *testing.T) {
+		const address = "bob-remote@example.com"
+		roomVer := alice.GetDefaultRoomVersion(t)
+		charlie := srv.UserID("charlie")
+		room := srv.MustMakeRoom(t, roomVer, federation.InitialRoomEvents(roomVer, charlie))
+		inv := is.StoreInvite(t, "email", address, room.RoomID, charlie)
+		room.AddEvent(srv.MustCreateEvent(t, room, federation.Event{
+			Type:     "m.room.third_party_invite",
+			StateKey: &inv.Token,
+			Sender:   charlie,
+			Content:  inv.EventContent(),
+		}))
+
+		_, since := bob.MustSync(t, client.SyncReq{})
+		is.Bind(t, "email", address, bob.UserID)
+		bob.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncInvitedTo(bob.UserID, room.RoomID))
+
+		inviteEvent := room.CurrentState("m.room.member", bob.UserID)
+		if inviteEvent == nil {
+			ct.Fatalf(t, "invite for %s was not added to the room", bob.UserID)
+		}
+		must.Equal(t, gjson.GetBytes(inviteEvent.Content(), "membership").Str, "invite", "membership")
+		must.Equal(t, gjson.GetBytes(inviteEvent.Content(), "third_party_invite.signed.token").Str, inv.Token, "third_party_invite token")
+	})
+}